@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// Animated preview formats, picked by ANIMATED_PREVIEW_FORMAT.
+const (
+	previewWebP = "webp"
+	previewGIF  = "gif"
+)
+
+const (
+	// animatedPreviewSeconds is how long the looping clip runs
+	animatedPreviewSeconds = 3
+	animatedPreviewWidth   = 320
+	animatedPreviewFPS     = 10
+)
+
+// animatedPreviewArgs are the ffmpeg output arguments for a preview in the
+// given format. GIFs get a palette made from the clip itself, since the
+// default one bands badly on video.
+func animatedPreviewArgs(format string) []string {
+	scale := fmt.Sprintf("fps=%d,scale=%d:-2:flags=lanczos", animatedPreviewFPS, animatedPreviewWidth)
+	if format == previewGIF {
+		return []string{
+			"-vf", scale + ",split[a][b];[a]palettegen[p];[b][p]paletteuse",
+			"-loop", "0",
+			"-f", "gif",
+		}
+	}
+	return []string{
+		"-vf", scale,
+		"-c:v", "libwebp",
+		"-quality", "60",
+		"-loop", "0",
+		"-f", "webp",
+	}
+}
+
+// generateAnimatedPreview cuts a short looping clip from the upload at
+// srcPath, starting where the automatic thumbnail is taken, and stores it
+// with the thumbnails. Videos shorter than the clip are used whole.
+func (cfg *apiConfig) generateAnimatedPreview(ctx context.Context, srcPath, format string, probe videoProbe) (string, error) {
+	start := 0.0
+	if probe.durationSeconds > animatedPreviewSeconds {
+		start = min(probe.durationSeconds*autoThumbnailPosition, probe.durationSeconds-animatedPreviewSeconds)
+	}
+
+	previewFile, err := os.CreateTemp(cfg.tempDir, tempFilePrefix+"preview-*."+format)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(previewFile.Name())
+	previewFile.Close()
+
+	weight, err := cfg.ffmpegThreads.acquire(ctx, 1, cfg.tunables(ctx).maxFFmpegThreads)
+	if err != nil {
+		return "", err
+	}
+	args := []string{
+		"-y",
+		"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+		"-t", strconv.Itoa(animatedPreviewSeconds),
+		"-i", srcPath,
+		"-an",
+	}
+	args = append(args, animatedPreviewArgs(format)...)
+	cmd := cfg.ffmpegCommand(ctx, append(args, previewFile.Name())...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	cfg.ffmpegThreads.release(weight)
+	if err != nil {
+		return "", fmt.Errorf("ffmpeg: %w: %s", err, lastLine(stderr.String()))
+	}
+
+	preview, err := os.ReadFile(previewFile.Name())
+	if err != nil {
+		return "", err
+	}
+	key, err := cfg.putImageAsset(ctx, preview, "."+format)
+	if err != nil {
+		return "", err
+	}
+	return cfg.assets.URL(key), nil
+}
+
+// removeAnimatedPreview deletes a preview replaced by a new upload's.
+// Failures are logged, since the new one is already saved.
+func (cfg *apiConfig) removeAnimatedPreview(ctx context.Context, previewURL *string) {
+	if previewURL == nil {
+		return
+	}
+	err := cfg.removeThumbnail(ctx, *previewURL)
+	if err != nil {
+		log.Printf("Couldn't remove animated preview %s: %v", *previewURL, err)
+	}
+}
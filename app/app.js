@@ -26,11 +26,10 @@ async function createVideoDraft() {
   const description = document.getElementById('video-description').value;
 
   try {
-    const res = await fetch('/api/videos', {
+    const res = await apiFetch('/api/videos', {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
       },
       body: JSON.stringify({ title, description }),
     });
@@ -68,6 +67,7 @@ async function login() {
 
     if (data.token) {
       localStorage.setItem('token', data.token);
+      localStorage.setItem('refreshToken', data.refresh_token);
       document.getElementById('auth-section').style.display = 'none';
       document.getElementById('video-section').style.display = 'block';
       await getVideos();
@@ -102,8 +102,66 @@ async function signup() {
   }
 }
 
+// apiFetch is fetch for authenticated API calls. Access tokens only last a
+// few minutes, so a request rejected as unauthorized is retried once after
+// exchanging the refresh token for new tokens.
+async function apiFetch(url, options = {}) {
+  const send = () =>
+    fetch(url, {
+      ...options,
+      headers: {
+        ...options.headers,
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+  const res = await send();
+  if (res.status !== 401 || !(await refreshSession())) {
+    return res;
+  }
+  return send();
+}
+
+// refreshSession replaces both tokens, sharing one request between callers
+// that need it at the same time: a refresh token only works once.
+let refreshing = null;
+function refreshSession() {
+  if (!refreshing) {
+    refreshing = (async () => {
+      const refreshToken = localStorage.getItem('refreshToken');
+      if (!refreshToken) return false;
+      const res = await fetch('/api/refresh', {
+        method: 'POST',
+        headers: {
+          Authorization: `Bearer ${refreshToken}`,
+        },
+      });
+      if (!res.ok) {
+        logout();
+        return false;
+      }
+      const data = await res.json();
+      localStorage.setItem('token', data.token);
+      localStorage.setItem('refreshToken', data.refresh_token);
+      return true;
+    })().finally(() => {
+      refreshing = null;
+    });
+  }
+  return refreshing;
+}
+
 function logout() {
+  const refreshToken = localStorage.getItem('refreshToken');
+  if (refreshToken) {
+    fetch('/api/revoke', {
+      method: 'POST',
+      headers: {
+        Authorization: `Bearer ${refreshToken}`,
+      },
+    });
+  }
   localStorage.removeItem('token');
+  localStorage.removeItem('refreshToken');
   document.getElementById('auth-section').style.display = 'block';
   document.getElementById('video-section').style.display = 'none';
 }
@@ -130,11 +188,8 @@ async function uploadThumbnail(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/thumbnail_upload/${videoID}`, {
+    const res = await apiFetch(`/api/thumbnail_upload/${videoID}`, {
       method: 'POST',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
       body: formData,
     });
     if (!res.ok) {
@@ -163,11 +218,8 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
+    const res = await apiFetch(`/api/video_upload/${videoID}`, {
       method: 'POST',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
       body: formData,
     });
     if (!res.ok) {
@@ -175,6 +227,12 @@ async function uploadVideoFile(videoID) {
       throw new Error(`Failed to upload video file. Error: ${data.error}`);
     }
 
+    // The file is processed in the background; wait for its job to finish
+    const job = await waitForJob(await res.json());
+    if (job.status === 'failed') {
+      throw new Error(`Failed to process video file. Error: ${job.error ? job.error.message : 'unknown error'}`);
+    }
+
     console.log('Video uploaded!');
     await getVideo(videoID);
   } catch (error) {
@@ -186,13 +244,23 @@ async function uploadVideoFile(videoID) {
 
 const videoStateHandler = createVideoStateHandler();
 
+async function waitForJob(job) {
+  while (job.status === 'queued' || job.status === 'running') {
+    await new Promise((resolve) => setTimeout(resolve, 1000));
+    const res = await apiFetch(`/api/jobs/${job.id}`);
+    const data = await res.json();
+    if (!res.ok) {
+      throw new Error(`Failed to check processing job. Error: ${data.error}`);
+    }
+    job = data;
+  }
+  return job;
+}
+
 async function getVideos() {
   try {
-    const res = await fetch('/api/videos', {
+    const res = await apiFetch('/api/videos', {
       method: 'GET',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
     });
     if (!res.ok) {
       const data = await res.json();
@@ -231,11 +299,8 @@ function createVideoStateHandler() {
 
 async function getVideo(videoID) {
   try {
-    const res = await fetch(`/api/videos/${videoID}`, {
+    const res = await apiFetch(`/api/videos/${videoID}`, {
       method: 'GET',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
     });
     if (!res.ok) {
       throw new Error('Failed to get video.');
@@ -257,12 +322,19 @@ function viewVideo(video) {
   document.getElementById('video-description-display').textContent = video.description;
 
   const thumbnailImg = document.getElementById('thumbnail-image');
+  const thumbnailWebP = document.getElementById('thumbnail-webp');
   if (!video.thumbnail_url) {
     thumbnailImg.style.display = 'none';
   } else {
     thumbnailImg.style.display = 'block';
     thumbnailImg.src = video.thumbnail_url;
   }
+  // Browsers that can show WebP pick the smaller copy over the original
+  if (video.thumbnail_webp_url) {
+    thumbnailWebP.srcset = video.thumbnail_webp_url;
+  } else {
+    thumbnailWebP.removeAttribute('srcset');
+  }
 
   const videoPlayer = document.getElementById('video-player');
   if (videoPlayer) {
@@ -270,12 +342,102 @@ function viewVideo(video) {
       videoPlayer.style.display = 'none';
     } else {
       videoPlayer.style.display = 'block';
-      videoPlayer.src = video.video_url;
-      videoPlayer.load();
+      playVideo(videoPlayer, video.video_url);
     }
   }
 }
 
+let streamPlayer = null;
+
+// Safari plays HLS playlists natively; other browsers need hls.js, and
+// every browser needs dash.js for DASH manifests. The libraries are only
+// fetched the first time a video needs them. A signed manifest's query
+// string has to be repeated on the requests it leads to, which only the
+// libraries can do, so Safari uses hls.js for those too when it can.
+async function playVideo(videoPlayer, url) {
+  if (streamPlayer) {
+    streamPlayer.destroy();
+    streamPlayer = null;
+  }
+  const parsed = new URL(url, location.href);
+  const isHLS = parsed.pathname.endsWith('.m3u8');
+  const isDASH = parsed.pathname.endsWith('.mpd');
+  const signature = parsed.searchParams.has('Signature') ? parsed.search : '';
+  const nativeHLS = isHLS && videoPlayer.canPlayType('application/vnd.apple.mpegurl');
+  if (!isHLS && !isDASH) {
+    videoPlayer.src = url;
+    videoPlayer.load();
+    return;
+  }
+
+  try {
+    if (isHLS) {
+      if (nativeHLS && !signature) {
+        videoPlayer.src = url;
+        videoPlayer.load();
+        return;
+      }
+      await loadScript('https://cdn.jsdelivr.net/npm/hls.js@1', () => window.Hls);
+      if (nativeHLS && !Hls.isSupported()) {
+        videoPlayer.src = url;
+        videoPlayer.load();
+        return;
+      }
+      const hls = new Hls({
+        xhrSetup: (xhr, requestURL) => {
+          const signed = withSignature(requestURL, signature);
+          if (signed !== requestURL) {
+            xhr.open('GET', signed, true);
+          }
+        },
+      });
+      hls.loadSource(url);
+      hls.attachMedia(videoPlayer);
+      streamPlayer = hls;
+    } else {
+      await loadScript('https://cdn.dashjs.org/latest/dash.all.min.js', () => window.dashjs);
+      const dash = dashjs.MediaPlayer().create();
+      if (signature) {
+        dash.addRequestInterceptor((request) => {
+          request.url = withSignature(request.url, signature);
+          return Promise.resolve(request);
+        });
+      }
+      dash.initialize(videoPlayer, url, false);
+      streamPlayer = { destroy: () => dash.reset() };
+    }
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+// withSignature adds a signed manifest's query string to a request for one
+// of the files it points at, unless the request is already signed.
+function withSignature(requestURL, signature) {
+  if (!signature) {
+    return requestURL;
+  }
+  const parsed = new URL(requestURL, location.href);
+  if (parsed.searchParams.has('Signature')) {
+    return requestURL;
+  }
+  parsed.search = signature;
+  return parsed.toString();
+}
+
+function loadScript(src, loaded) {
+  if (loaded()) {
+    return Promise.resolve();
+  }
+  return new Promise((resolve, reject) => {
+    const script = document.createElement('script');
+    script.src = src;
+    script.onload = resolve;
+    script.onerror = () => reject(new Error(`Could not load the player from ${src}`));
+    document.head.appendChild(script);
+  });
+}
+
 async function deleteVideo() {
   if (!currentVideo) {
     alert('No video selected for deletion.');
@@ -283,11 +445,8 @@ async function deleteVideo() {
   }
 
   try {
-    const res = await fetch(`/api/videos/${currentVideo.id}`, {
+    const res = await apiFetch(`/api/videos/${currentVideo.id}`, {
       method: 'DELETE',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
     });
     if (!res.ok) {
       throw new Error('Failed to delete video.');
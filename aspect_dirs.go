@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// reducedRatio is the ratio of width to height in lowest terms, such as
+// "4:3" or "1:1".
+func reducedRatio(width, height int) string {
+	a, b := width, height
+	for b != 0 {
+		a, b = b, a%b
+	}
+	if a <= 0 {
+		return "other"
+	}
+	return fmt.Sprintf("%d:%d", width/a, height/a)
+}
+
+// aspectDir is the bucket directory a video classified as aspect is stored
+// under. With OTHER_ASPECT_SUBDIRS on, "other" videos get a directory per
+// reduced ratio, as in "other/4x3", so square, 4:3 and ultrawide content
+// can be told apart and given their own lifecycle rules.
+func aspectDir(aspect, ratio string, subdirs bool) string {
+	if aspect != "other" || !subdirs || !strings.Contains(ratio, ":") {
+		return aspect
+	}
+	return path.Join("other", strings.Replace(ratio, ":", "x", 1))
+}
+
+// storedOtherDir returns the ratio directory under "other" the video's
+// processed file is stored in, such as "other/4x3", or "" when it isn't
+// in one.
+func storedOtherDir(video database.Video) string {
+	if video.VideoURL == nil {
+		return ""
+	}
+	segments := strings.Split(path.Dir(*video.VideoURL), "/")
+	for i, segment := range segments {
+		// The video ID directory follows the ratio one in versioned keys,
+		// so the ratio is told apart by its "x"
+		if segment == "other" && i+1 < len(segments) && strings.Contains(segments[i+1], "x") {
+			return path.Join("other", segments[i+1])
+		}
+	}
+	return ""
+}
@@ -1,12 +0,0 @@
-package main
-
-import (
-	"os"
-)
-
-func (cfg apiConfig) ensureAssetsDir() error {
-	if _, err := os.Stat(cfg.assetsRoot); os.IsNotExist(err) {
-		return os.Mkdir(cfg.assetsRoot, 0755)
-	}
-	return nil
-}
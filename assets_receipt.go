@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// videoAssets enumerates every artifact generated for a video, so clients
+// have one place to find them instead of piecing together separate fields.
+// Artifacts a video doesn't have, such as renditions when they are turned
+// off, are left out.
+type videoAssets struct {
+	Video               *videoAsset                   `json:"video,omitempty"`
+	Renditions          database.Renditions           `json:"renditions,omitempty"`
+	Thumbnail           *videoAsset                   `json:"thumbnail,omitempty"`
+	ThumbnailCandidates []database.ThumbnailCandidate `json:"thumbnail_candidates,omitempty"`
+	// ThumbnailWebP is the thumbnail re-encoded for browsers that take WebP
+	ThumbnailWebP *videoAsset `json:"thumbnail_webp,omitempty"`
+	// AnimatedPreview is the short looping clip shown on hover
+	AnimatedPreview *videoAsset `json:"animated_preview,omitempty"`
+	// Audio is the extracted audio track
+	Audio *videoAsset `json:"audio,omitempty"`
+	// Storyboard is the seek bar preview: a WebVTT file at its URL whose
+	// cues point into the sprite sheet at its SpriteURL
+	Storyboard *database.Storyboard `json:"storyboard,omitempty"`
+}
+
+type videoAsset struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type,omitempty"`
+	SizeBytes   int64  `json:"size_bytes,omitempty"`
+	// Bucket and Key locate the object in S3 or GCS for clients that sign
+	// their own URLs; Bucket is empty with local storage. They are only set
+	// for users with the storage_details flag.
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key,omitempty"`
+}
+
+// buildVideoAssets derives the asset list from the stored record rather than
+// keeping a second copy of the URLs that could drift from it. URLs are
+// signed as signVideo signs them, so they work wherever the record's own
+// URLs need a signature.
+func (cfg *apiConfig) buildVideoAssets(ctx context.Context, video database.Video) (videoAssets, error) {
+	signed, err := cfg.signVideo(ctx, video)
+	if err != nil {
+		return videoAssets{}, err
+	}
+
+	var assets videoAssets
+	if signed.VideoURL != nil {
+		assets.Video = &videoAsset{
+			URL:         *signed.VideoURL,
+			ContentType: storedContentType(video),
+			SizeBytes:   video.SizeBytes,
+		}
+	}
+	assets.Renditions = signed.Renditions
+	if signed.ThumbnailURL != nil {
+		assets.Thumbnail = &videoAsset{
+			URL: *signed.ThumbnailURL,
+		}
+	}
+
+	candidates, err := cfg.db.GetThumbnailCandidates(video.ID)
+	if err != nil {
+		return videoAssets{}, err
+	}
+	for i := range candidates {
+		candidates[i].URL, err = cfg.signURL(ctx, candidates[i].URL, "")
+		if err != nil {
+			return videoAssets{}, err
+		}
+	}
+	assets.ThumbnailCandidates = candidates
+	if signed.ThumbnailWebPURL != nil {
+		assets.ThumbnailWebP = &videoAsset{
+			URL:         *signed.ThumbnailWebPURL,
+			ContentType: "image/webp",
+		}
+	}
+	if signed.AnimatedPreviewURL != nil {
+		// Previews are WebP or GIF depending on the encoder available
+		assets.AnimatedPreview = &videoAsset{
+			URL:         *signed.AnimatedPreviewURL,
+			ContentType: mime.TypeByExtension(filepath.Ext(*video.AnimatedPreviewURL)),
+		}
+	}
+	if signed.AudioURL != nil {
+		assets.Audio = &videoAsset{
+			URL:         *signed.AudioURL,
+			ContentType: "audio/mp4",
+		}
+	}
+	assets.Storyboard = signed.Storyboard
+	return assets, nil
+}
+
+// addStorageLocation fills in where the processed video is stored in the
+// bucket. It is left out by default so regular users don't see storage
+// internals. The key comes from the record's unsigned URL.
+func (cfg *apiConfig) addStorageLocation(assets *videoAssets, video database.Video) error {
+	if assets.Video == nil || video.VideoURL == nil {
+		return nil
+	}
+	key, err := cfg.bucketKeyFromURL(*video.VideoURL)
+	if err != nil {
+		return err
+	}
+	assets.Video.Bucket = cfg.storageBucket
+	assets.Video.Key = key
+	return nil
+}
+
+// videoWithAssets is the upload receipt: the video record plus its assets.
+type videoWithAssets struct {
+	database.Video
+	Assets videoAssets `json:"assets"`
+	// StageTimings is only set for users with the stage_timings flag
+	StageTimings []stageTiming `json:"stage_timings,omitempty"`
+}
+
+func (cfg *apiConfig) handlerVideoAssetsGet(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	assets, err := cfg.buildVideoAssets(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list video assets", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, assets)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/cloudfront/sign"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const testCDNHost = "cdn.example.test"
+
+// useTestCDNSigner serves cfg's storage through a CloudFront distribution
+// that only takes signed requests, as with S3 behind CloudFront.
+func useTestCDNSigner(t *testing.T, cfg *apiConfig) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.storage, err = storage.NewLocal(t.TempDir(), "https://"+testCDNHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.s3CfDistribution = testCDNHost
+	cfg.cdnURLSigner = &cdnURLSigner{signer: sign.NewURLSigner("KTESTKEYPAIR", key)}
+}
+
+// storedURL is the URL cfg's storage gives the object at key.
+func storedURL(cfg *apiConfig, key string) *string {
+	u := cfg.storage.URL(key)
+	return &u
+}
+
+// checkSigned fails unless rawURL carries a CloudFront signature.
+func checkSigned(t *testing.T, what, rawURL string) {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("%s URL %q: %v", what, rawURL, err)
+	}
+	q := u.Query()
+	if q.Get("Signature") == "" || q.Get("Key-Pair-Id") != "KTESTKEYPAIR" {
+		t.Errorf("%s URL isn't signed: %s", what, rawURL)
+	}
+}
+
+func checkUnsigned(t *testing.T, what, rawURL string) {
+	t.Helper()
+	if strings.Contains(rawURL, "Signature=") {
+		t.Errorf("%s URL is signed: %s", what, rawURL)
+	}
+}
+
+// newProcessedVideo stores a video as the pipeline leaves it, with its
+// files in the distribution.
+func newProcessedVideo(t *testing.T, cfg *apiConfig, userID uuid.UUID, visibility string) database.Video {
+	t.Helper()
+	video := newTestVideo(t, cfg, userID)
+	video.VideoURL = storedURL(cfg, "landscape/"+video.ID.String()+".mp4")
+	video.ThumbnailURL = storedURL(cfg, "thumbnails/"+video.ID.String()+".jpg")
+	video.SizeBytes = 1024
+	err := cfg.db.UpdateVideo(video)
+	if err != nil {
+		t.Fatalf("UpdateVideo: %v", err)
+	}
+	if visibility != "" && visibility != video.Visibility {
+		err = cfg.db.SetVideoVisibility(video.ID, visibility)
+		if err != nil {
+			t.Fatalf("SetVideoVisibility: %v", err)
+		}
+	}
+	_, err = cfg.db.ReplaceThumbnailCandidates(video.ID, []database.ThumbnailCandidate{
+		{VideoID: video.ID, Position: 0, URL: *storedURL(cfg, "thumbnails/"+video.ID.String()+"-0.jpg"), Score: 0.5},
+		{VideoID: video.ID, Position: 1, URL: *storedURL(cfg, "thumbnails/"+video.ID.String()+"-1.jpg"), Score: 0.9},
+	})
+	if err != nil {
+		t.Fatalf("ReplaceThumbnailCandidates: %v", err)
+	}
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	return video
+}
+
+func getAssets(t *testing.T, cfg *apiConfig, video database.Video, token string) videoAssets {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"/assets", nil)
+	r.SetPathValue("videoID", video.ID.String())
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	cfg.handlerVideoAssetsGet(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var assets videoAssets
+	err := json.Unmarshal(w.Body.Bytes(), &assets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assets
+}
+
+func TestVideoAssets(t *testing.T) {
+	t.Run("unsigned distribution", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		user, token := newTestUser(t, cfg)
+		video := newProcessedVideo(t, cfg, user.ID, "")
+
+		assets := getAssets(t, cfg, video, token)
+		if assets.Video == nil || assets.Video.URL != *video.VideoURL || assets.Video.ContentType != "video/mp4" || assets.Video.SizeBytes != 1024 {
+			t.Errorf("video asset = %+v", assets.Video)
+		}
+		if assets.Thumbnail == nil || assets.Thumbnail.URL != *video.ThumbnailURL {
+			t.Errorf("thumbnail asset = %+v", assets.Thumbnail)
+		}
+		if len(assets.ThumbnailCandidates) != 2 {
+			t.Fatalf("got %d thumbnail candidates, want 2", len(assets.ThumbnailCandidates))
+		}
+		for _, c := range assets.ThumbnailCandidates {
+			checkUnsigned(t, "candidate", c.URL)
+		}
+	})
+
+	for _, visibility := range []string{database.VisibilityPublic, database.VisibilityUnlisted, database.VisibilityPrivate} {
+		t.Run("signed distribution, "+visibility, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			useTestCDNSigner(t, cfg)
+			user, token := newTestUser(t, cfg)
+			video := newProcessedVideo(t, cfg, user.ID, visibility)
+
+			assets := getAssets(t, cfg, video, token)
+			if assets.Video == nil || assets.Thumbnail == nil {
+				t.Fatalf("assets = %+v, want the video and thumbnail", assets)
+			}
+			checkSigned(t, "video", assets.Video.URL)
+			if !strings.HasPrefix(assets.Video.URL, *video.VideoURL+"?") {
+				t.Errorf("video URL %s doesn't sign %s", assets.Video.URL, *video.VideoURL)
+			}
+			if assets.Video.ContentType != "video/mp4" {
+				t.Errorf("content type = %q, want it from the unsigned URL", assets.Video.ContentType)
+			}
+			checkSigned(t, "thumbnail", assets.Thumbnail.URL)
+			for _, c := range assets.ThumbnailCandidates {
+				checkSigned(t, "candidate", c.URL)
+			}
+		})
+	}
+
+	t.Run("storage details use the unsigned key", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		useTestCDNSigner(t, cfg)
+		cfg.storageBucket = "tubely-test"
+		user, _ := newTestUser(t, cfg)
+		video := newProcessedVideo(t, cfg, user.ID, "")
+
+		assets, err := cfg.buildVideoAssets(context.Background(), video)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSigned(t, "video", assets.Video.URL)
+		err = cfg.addStorageLocation(&assets, video)
+		if err != nil {
+			t.Fatalf("addStorageLocation: %v", err)
+		}
+		if assets.Video.Bucket != "tubely-test" || assets.Video.Key != "landscape/"+video.ID.String()+".mp4" {
+			t.Errorf("location = %s/%s", assets.Video.Bucket, assets.Video.Key)
+		}
+	})
+}
+
+func TestVideoAssetsRenditions(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		signing bool
+	}{{"unsigned", false}, {"signed", true}} {
+		t.Run(tt.name, func(t *testing.T) {
+			signing := tt.signing
+			cfg := newTestConfig(t)
+			if signing {
+				useTestCDNSigner(t, cfg)
+			}
+			user, token := newTestUser(t, cfg)
+			video := newProcessedVideo(t, cfg, user.ID, "")
+			video.Renditions = database.Renditions{
+				{Name: "720p", Width: 1280, Height: 720, URL: *storedURL(cfg, "landscape/"+video.ID.String()+"/720p.mp4"), SizeBytes: 512, BitrateKbps: 2800},
+				{Name: "480p", Width: 854, Height: 480, URL: *storedURL(cfg, "landscape/"+video.ID.String()+"/480p.mp4"), SizeBytes: 256, BitrateKbps: 1400},
+			}
+			err := cfg.db.UpdateVideo(video)
+			if err != nil {
+				t.Fatalf("UpdateVideo: %v", err)
+			}
+
+			assets := getAssets(t, cfg, video, token)
+			if len(assets.Renditions) != len(video.Renditions) {
+				t.Fatalf("got %d renditions, want %d", len(assets.Renditions), len(video.Renditions))
+			}
+			for i, got := range assets.Renditions {
+				want := video.Renditions[i]
+				if got.Name != want.Name || got.Width != want.Width || got.Height != want.Height ||
+					got.SizeBytes != want.SizeBytes || got.BitrateKbps != want.BitrateKbps {
+					t.Errorf("rendition %d = %+v, want %+v", i, got, want)
+				}
+				if signing {
+					checkSigned(t, got.Name, got.URL)
+				} else if got.URL != want.URL {
+					t.Errorf("rendition %s URL = %s, want %s", got.Name, got.URL, want.URL)
+				}
+			}
+
+			// Signing works on a copy; the record keeps its own URLs
+			stored, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkUnsigned(t, "stored rendition", stored.Renditions[0].URL)
+		})
+	}
+}
+
+func TestVideoAssetsStoryboard(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		signing bool
+	}{{"unsigned", false}, {"signed", true}} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			if tt.signing {
+				useTestCDNSigner(t, cfg)
+			}
+			user, token := newTestUser(t, cfg)
+			video := newProcessedVideo(t, cfg, user.ID, "")
+			if assets := getAssets(t, cfg, video, token); assets.Storyboard != nil {
+				t.Errorf("video without a storyboard got %+v", assets.Storyboard)
+			}
+
+			prefix := "storyboards/" + video.ID.String() + "/"
+			video.Storyboard = &database.Storyboard{
+				URL:             *storedURL(cfg, prefix+"storyboard.vtt"),
+				SpriteURL:       *storedURL(cfg, prefix+"sprite.jpg"),
+				IntervalSeconds: 2,
+				TileWidth:       160,
+				TileHeight:      90,
+				Columns:         10,
+				Rows:            10,
+			}
+			err := cfg.db.UpdateVideo(video)
+			if err != nil {
+				t.Fatalf("UpdateVideo: %v", err)
+			}
+
+			got := getAssets(t, cfg, video, token).Storyboard
+			if got == nil {
+				t.Fatal("receipt has no storyboard")
+			}
+			want := *video.Storyboard
+			if got.IntervalSeconds != want.IntervalSeconds || got.TileWidth != want.TileWidth || got.TileHeight != want.TileHeight ||
+				got.Columns != want.Columns || got.Rows != want.Rows {
+				t.Errorf("storyboard = %+v, want %+v", got, want)
+			}
+			if tt.signing {
+				checkSigned(t, "storyboard VTT", got.URL)
+				checkSigned(t, "storyboard sprite", got.SpriteURL)
+			} else if got.URL != want.URL || got.SpriteURL != want.SpriteURL {
+				t.Errorf("storyboard URLs = %s, %s, want %s, %s", got.URL, got.SpriteURL, want.URL, want.SpriteURL)
+			}
+		})
+	}
+}
+
+func TestVideoAssetsDerivedFiles(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		signing bool
+	}{{"unsigned", false}, {"signed", true}} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			if tt.signing {
+				useTestCDNSigner(t, cfg)
+			}
+			user, token := newTestUser(t, cfg)
+			video := newProcessedVideo(t, cfg, user.ID, "")
+			assets := getAssets(t, cfg, video, token)
+			if assets.ThumbnailWebP != nil || assets.AnimatedPreview != nil || assets.Audio != nil {
+				t.Errorf("video without derived files got %+v, %+v, %+v", assets.ThumbnailWebP, assets.AnimatedPreview, assets.Audio)
+			}
+
+			id := video.ID.String()
+			video.ThumbnailWebPURL = storedURL(cfg, "thumbnails/"+id+".webp")
+			video.AnimatedPreviewURL = storedURL(cfg, "previews/"+id+".gif")
+			err := cfg.db.UpdateVideo(video)
+			if err != nil {
+				t.Fatalf("UpdateVideo: %v", err)
+			}
+			video.AudioURL = storedURL(cfg, "audio/"+id+".m4a")
+			err = cfg.db.SetAudioURL(video.ID, video.AudioURL)
+			if err != nil {
+				t.Fatalf("SetAudioURL: %v", err)
+			}
+
+			assets = getAssets(t, cfg, video, token)
+			for _, tc := range []struct {
+				what        string
+				got         *videoAsset
+				url         string
+				contentType string
+			}{
+				{"WebP thumbnail", assets.ThumbnailWebP, *video.ThumbnailWebPURL, "image/webp"},
+				{"animated preview", assets.AnimatedPreview, *video.AnimatedPreviewURL, "image/gif"},
+				{"audio", assets.Audio, *video.AudioURL, "audio/mp4"},
+			} {
+				if tc.got == nil {
+					t.Errorf("receipt has no %s", tc.what)
+					continue
+				}
+				if tc.got.ContentType != tc.contentType {
+					t.Errorf("%s content type = %q, want %q", tc.what, tc.got.ContentType, tc.contentType)
+				}
+				if tt.signing {
+					checkSigned(t, tc.what, tc.got.URL)
+				} else if tc.got.URL != tc.url {
+					t.Errorf("%s URL = %s, want %s", tc.what, tc.got.URL, tc.url)
+				}
+			}
+		})
+	}
+}
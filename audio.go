@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// uploadMediaTypes lists the upload content types each media kind accepts.
+var uploadMediaTypes = map[string][]string{
+	database.MediaKindVideo: {"video/mp4"},
+	database.MediaKindAudio: {"audio/mpeg", "audio/mp4"},
+}
+
+var errEncodingProfileNotSupported = errors.New("encoding profiles only apply to video")
+
+func validMediaKind(kind string) bool {
+	_, ok := uploadMediaTypes[kind]
+	return ok
+}
+
+// acceptsMediaType reports whether a record of the given kind takes uploads
+// of mediaType.
+func acceptsMediaType(kind, mediaType string) bool {
+	return slices.Contains(uploadMediaTypes[kind], mediaType)
+}
+
+// storedContentType is the content type of a record's processed file, told
+// apart by the extension the pipeline gave it. The query string of a signed
+// URL is ignored.
+func storedContentType(video database.Video) string {
+	if video.VideoURL == nil {
+		return ""
+	}
+	rawURL, _, _ := strings.Cut(*video.VideoURL, "?")
+	switch path.Ext(rawURL) {
+	case ".mp3":
+		return "audio/mpeg"
+	case ".m4a":
+		return "audio/mp4"
+	case ".m3u8":
+		return hlsPlaylistContentType
+	case ".mpd":
+		return dashManifestContentType
+	}
+	return "video/mp4"
+}
+
+// sniffMP3 reports whether data starts like an MP3 file: an ID3v2 tag or
+// an MPEG audio frame sync.
+func sniffMP3(data []byte) (bool, string) {
+	if bytes.HasPrefix(data, []byte("ID3")) {
+		return true, "audio/mpeg"
+	}
+	if len(data) >= 2 && data[0] == 0xFF && data[1]&0xE0 == 0xE0 {
+		return true, "audio/mpeg"
+	}
+	return false, http.DetectContentType(data)
+}
+
+// audioInfo is what the pipeline needs to know about an audio upload.
+type audioInfo struct {
+	mp3             bool
+	codec           string
+	durationSeconds float64
+	bitrateKbps     int64
+}
+
+func (a audioInfo) contentType() string {
+	if a.mp3 {
+		return "audio/mpeg"
+	}
+	return "audio/mp4"
+}
+
+func (a audioInfo) ext() string {
+	if a.mp3 {
+		return ".mp3"
+	}
+	return ".m4a"
+}
+
+// probeAudio checks that the file holds an audio stream and reads its
+// container format, duration and bitrate.
+func probeAudio(ctx context.Context, filePath string) (audioInfo, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_streams", "-show_format", filePath)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return audioInfo{}, encryptionFailure(err, stderr.Bytes())
+	}
+
+	var probe struct {
+		Streams []ffprobeStream `json:"streams"`
+		Format  struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+			BitRate    string `json:"bit_rate"`
+		} `json:"format"`
+	}
+	err = json.Unmarshal(out.Bytes(), &probe)
+	if err != nil {
+		return audioInfo{}, err
+	}
+
+	i := slices.IndexFunc(probe.Streams, func(s ffprobeStream) bool {
+		return s.CodecType == "audio"
+	})
+	if i < 0 {
+		return audioInfo{}, errors.New("no audio stream found in ffprobe output")
+	}
+	err = checkStreamsEncrypted(probe.Streams)
+	if err != nil {
+		return audioInfo{}, err
+	}
+
+	info := audioInfo{
+		mp3:   probe.Format.FormatName == "mp3",
+		codec: probe.Streams[i].CodecName,
+	}
+	if !info.mp3 && !strings.Contains(probe.Format.FormatName, "mp4") {
+		return audioInfo{}, fmt.Errorf("unsupported audio container %q", probe.Format.FormatName)
+	}
+	info.durationSeconds, err = strconv.ParseFloat(probe.Format.Duration, 64)
+	if err != nil {
+		return audioInfo{}, fmt.Errorf("couldn't parse duration %q: %w", probe.Format.Duration, err)
+	}
+	// Not every muxer reports a bitrate; leave it unset rather than fail
+	bitRate, err := strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	if err == nil {
+		info.bitrateKbps = bitRate / 1000
+	}
+	return info, nil
+}
+
+// audioEncodeArgs are the ffmpeg input and codec arguments for audio. The
+// audio is copied as it is; any cover art or other streams are dropped.
+func audioEncodeArgs(filePath string) []string {
+	return []string{"-i", filePath, "-map", "0:a", "-c", "copy"}
+}
+
+// processAudioForFastStart is the audio counterpart of
+// processVideoForFastStart. M4A files get their metadata moved to the front;
+// MP3 has no index to move, so it is only remuxed to drop anything ffmpeg
+// can't parse.
+func (cfg *apiConfig) processAudioForFastStart(filePath string, info audioInfo) (string, error) {
+	outputFilePath := strings.TrimSuffix(filePath, filepath.Ext(filePath)) + "-faststart" + info.ext()
+
+	args := audioEncodeArgs(filePath)
+	if info.mp3 {
+		args = append(args, "-f", "mp3", outputFilePath)
+	} else {
+		args = append(args, "-movflags", "faststart", "-f", "mp4", outputFilePath)
+	}
+
+	cmd := cfg.ffmpegCommand(context.Background(), args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", encryptionFailure(err, stderr.Bytes())
+	}
+	return outputFilePath, nil
+}
+
+var errNoAudioTrack = errors.New("video has no audio track")
+
+// extractAudioTrack writes the first audio stream of src, a path or URL
+// ffmpeg can read, to outPath as a faststart M4A. AAC is copied as it is;
+// anything else is encoded to AAC.
+func (cfg *apiConfig) extractAudioTrack(ctx context.Context, src, outPath string) error {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "a:0", "-show_entries", "stream=codec_name", "-print_format", "json", src)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return encryptionFailure(err, stderr.Bytes())
+	}
+	var probe struct {
+		Streams []struct {
+			CodecName string `json:"codec_name"`
+		} `json:"streams"`
+	}
+	err = json.Unmarshal(out.Bytes(), &probe)
+	if err != nil {
+		return err
+	}
+	if len(probe.Streams) == 0 {
+		return errNoAudioTrack
+	}
+
+	args := []string{"-i", src, "-map", "0:a:0", "-vn"}
+	if probe.Streams[0].CodecName == "aac" {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, "-c:a", "aac", "-b:a", "128k")
+	}
+	args = append(args, "-movflags", "faststart", "-f", "mp4", "-y", outPath)
+
+	cmd = cfg.ffmpegCommand(ctx, args...)
+	stderr.Reset()
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return encryptionFailure(err, stderr.Bytes())
+	}
+	return nil
+}
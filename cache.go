@@ -1,10 +1,106 @@
 package main
 
-import "net/http"
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"sync"
+	"time"
 
-func noCacheMiddleware(next http.Handler) http.Handler {
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/contenthash"
+)
+
+// assetETags caches content-hash ETags for files in the assets directory,
+// keyed by path and invalidated when the file's size or mtime changes, so
+// revalidations don't re-hash the file each time.
+type assetETags struct {
+	hash contenthash.Algorithm
+
+	mu      sync.Mutex
+	entries map[string]assetETag
+}
+
+type assetETag struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+func newAssetETags(hash contenthash.Algorithm) *assetETags {
+	return &assetETags{
+		hash:    hash,
+		entries: make(map[string]assetETag),
+	}
+}
+
+// get returns a strong ETag for the named file in assets, or "" if it isn't a
+// regular file.
+func (a *assetETags) get(assets http.FileSystem, name string) (string, error) {
+	f, err := assets.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", nil
+	}
+
+	a.mu.Lock()
+	cached, ok := a.entries[name]
+	a.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.etag, nil
+	}
+
+	digest, err := a.hash.Sum(f)
+	if err != nil {
+		return "", err
+	}
+	etag := `"` + digest + `"`
+
+	a.mu.Lock()
+	a.entries[name] = assetETag{modTime: info.ModTime(), size: info.Size(), etag: etag}
+	a.mu.Unlock()
+	return etag, nil
+}
+
+// assetCacheMiddleware adds a content-hash ETag and cache headers to asset
+// responses. http.FileServer then answers If-None-Match revalidations with
+// a bodyless 304. assets must be the file system next serves from, with the URL
+// prefix already stripped.
+func (cfg *apiConfig) assetCacheMiddleware(assets http.FileSystem, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Cache-Control", "no-store")
+		tun := cfg.tunables(r.Context())
+
+		etag, err := cfg.assetETags.get(assets, r.URL.Path)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Couldn't compute ETag for asset %s: %v", r.URL.Path, err)
+			}
+			// Let the file server produce the 404 or error response
+			next.ServeHTTP(w, r)
+			return
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+
+		// Browsers and the CDN get separate lifetimes; with neither set,
+		// caches must revalidate on every use
+		if tun.assetsMaxAge == 0 && tun.assetsSMaxAge == 0 {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, s-maxage=%d", tun.assetsMaxAge, tun.assetsSMaxAge))
+		}
+		w.Header().Set("Vary", "Accept-Encoding")
+
 		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newAssetsServer serves dir under /assets the way main does.
+func newAssetsServer(cfg *apiConfig, dir string) http.Handler {
+	assetsFS := http.Dir(dir)
+	return http.StripPrefix("/assets", cfg.assetCacheMiddleware(assetsFS, http.FileServer(assetsFS)))
+}
+
+func strongETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// TestAssetRevalidation replays the conditional requests CloudFront sends
+// when a cached thumbnail goes stale.
+func TestAssetRevalidation(t *testing.T) {
+	cfg := newTestConfig(t)
+	dir := t.TempDir()
+	thumbnail := []byte("\xff\xd8\xff\xe0 not much of a JPEG")
+	err := os.WriteFile(filepath.Join(dir, "thumb.jpg"), thumbnail, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newAssetsServer(cfg, dir)
+	etag := strongETag(thumbnail)
+	lastModified := time.Now().UTC().Format(http.TimeFormat)
+	longAgo := time.Now().Add(-24 * time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name     string
+		method   string
+		header   map[string]string
+		status   int
+		withBody bool
+	}{
+		{name: "first fetch", status: http.StatusOK, withBody: true},
+		{name: "If-None-Match", header: map[string]string{"If-None-Match": etag}, status: http.StatusNotModified},
+		{name: "weak If-None-Match", header: map[string]string{"If-None-Match": "W/" + etag}, status: http.StatusNotModified},
+		{name: "one of several ETags", header: map[string]string{"If-None-Match": `"stale", ` + etag}, status: http.StatusNotModified},
+		{name: "any ETag", header: map[string]string{"If-None-Match": "*"}, status: http.StatusNotModified},
+		{name: "stale ETag", header: map[string]string{"If-None-Match": `"stale"`}, status: http.StatusOK, withBody: true},
+		{
+			// CloudFront forwards both validators; If-None-Match wins
+			name:   "matching ETag with an old If-Modified-Since",
+			header: map[string]string{"If-None-Match": etag, "If-Modified-Since": longAgo},
+			status: http.StatusNotModified,
+		},
+		{
+			name:     "stale ETag with a current If-Modified-Since",
+			header:   map[string]string{"If-None-Match": `"stale"`, "If-Modified-Since": lastModified},
+			status:   http.StatusOK,
+			withBody: true,
+		},
+		{name: "HEAD revalidation", method: http.MethodHead, header: map[string]string{"If-None-Match": etag}, status: http.StatusNotModified},
+		{
+			name:     "compressed fetch",
+			header:   map[string]string{"Accept-Encoding": "gzip, br"},
+			status:   http.StatusOK,
+			withBody: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "/assets/thumb.jpg", nil)
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			// A 304 must carry the headers a 200 would, so caches can
+			// refresh what they stored
+			if got := w.Header().Get("ETag"); got != etag {
+				t.Errorf("ETag = %s, want %s", got, etag)
+			}
+			if got := w.Header().Get("Cache-Control"); got != "no-cache" {
+				t.Errorf("Cache-Control = %q, want no-cache", got)
+			}
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			if tt.withBody && w.Body.String() != string(thumbnail) {
+				t.Errorf("body = %q, want the thumbnail", w.Body)
+			}
+			if !tt.withBody && w.Body.Len() != 0 {
+				t.Errorf("%d response has a %d byte body", w.Code, w.Body.Len())
+			}
+		})
+	}
+}
+
+func TestAssetRevalidationAfterChange(t *testing.T) {
+	cfg := newTestConfig(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "thumb.jpg")
+	before := []byte("first thumbnail")
+	err := os.WriteFile(path, before, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newAssetsServer(cfg, dir)
+
+	// Cache the first file's ETag
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/assets/thumb.jpg", nil))
+	if got := w.Header().Get("ETag"); got != strongETag(before) {
+		t.Fatalf("ETag = %s, want %s", got, strongETag(before))
+	}
+
+	after := []byte("second thumbnail, a little longer")
+	err = os.WriteFile(path, after, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the ETag cache sees a new mtime even on coarse clocks
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(path, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/assets/thumb.jpg", nil)
+	r.Header.Set("If-None-Match", strongETag(before))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || w.Body.String() != string(after) {
+		t.Fatalf("revalidating the old ETag got %d %q, want 200 with the new file", w.Code, w.Body)
+	}
+	if got := w.Header().Get("ETag"); got != strongETag(after) {
+		t.Errorf("ETag = %s, want %s", got, strongETag(after))
+	}
+}
+
+func TestAssetCacheLifetimes(t *testing.T) {
+	cfg := newTestConfig(t)
+	tun := *cfg.currentTunables.Load()
+	tun.assetsMaxAge = 60
+	tun.assetsSMaxAge = 86400
+	cfg.currentTunables.Store(&tun)
+
+	dir := t.TempDir()
+	thumbnail := []byte("thumbnail")
+	err := os.WriteFile(filepath.Join(dir, "thumb.jpg"), thumbnail, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newAssetsServer(cfg, dir)
+
+	for _, inm := range []string{"", strongETag(thumbnail)} {
+		r := httptest.NewRequest(http.MethodGet, "/assets/thumb.jpg", nil)
+		if inm != "" {
+			r.Header.Set("If-None-Match", inm)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		want := "public, max-age=60, s-maxage=86400"
+		if got := w.Header().Get("Cache-Control"); got != want {
+			t.Errorf("%d response Cache-Control = %q, want %q", w.Code, got, want)
+		}
+	}
+}
+
+func TestAssetMissing(t *testing.T) {
+	cfg := newTestConfig(t)
+	handler := newAssetsServer(cfg, t.TempDir())
+
+	r := httptest.NewRequest(http.MethodGet, "/assets/missing.jpg", nil)
+	r.Header.Set("If-None-Match", "*")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", w.Code)
+	}
+	if w.Header().Get("ETag") != "" {
+		t.Errorf("missing asset got ETag %s", w.Header().Get("ETag"))
+	}
+}
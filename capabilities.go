@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// capabilityDetectTimeout bounds each ffmpeg run made to detect what it can
+// do.
+const capabilityDetectTimeout = 10 * time.Second
+
+// codecEncoders lists, for each codec the server reports on, the ffmpeg
+// encoders that produce it, software ones first.
+var codecEncoders = map[string][]string{
+	"h264": {"libx264", "h264_nvenc", "h264_qsv", "h264_vaapi", "h264_videotoolbox", "h264_amf"},
+	"hevc": {"libx265", "hevc_nvenc", "hevc_qsv", "hevc_vaapi", "hevc_videotoolbox", "hevc_amf"},
+	"av1":  {"libsvtav1", "libaom-av1", "librav1e", "av1_nvenc", "av1_qsv", "av1_vaapi", "av1_amf"},
+	"vp9":  {"libvpx-vp9", "vp9_qsv", "vp9_vaapi"},
+	"aac":  {"aac", "libfdk_aac"},
+	"webp": {"libwebp"},
+}
+
+type codecSupport struct {
+	Available bool     `json:"available"`
+	Encoders  []string `json:"encoders"`
+}
+
+// capabilities is what this server's ffmpeg build can do, and which
+// pipeline features can therefore run. It is detected once at startup.
+type capabilities struct {
+	FFmpeg        bool                    `json:"ffmpeg"`
+	FFprobe       bool                    `json:"ffprobe"`
+	FFmpegVersion string                  `json:"ffmpeg_version,omitempty"`
+	Codecs        map[string]codecSupport `json:"codecs"`
+	HWAccels      []string                `json:"hwaccels"`
+	// Features maps pipeline features to whether they are enabled. A
+	// feature that is configured on but lacks what it needs shows as false.
+	Features   map[string]bool `json:"features"`
+	DetectedAt time.Time       `json:"detected_at"`
+}
+
+// detectCapabilities asks ffmpeg for its version, encoders and hardware
+// acceleration methods. Missing tools are reported, not returned as errors,
+// so the server still starts and says what it can't do.
+func (cfg *apiConfig) detectCapabilities(ctx context.Context) *capabilities {
+	caps := &capabilities{
+		Codecs:     map[string]codecSupport{},
+		HWAccels:   []string{},
+		DetectedAt: time.Now().UTC(),
+	}
+	_, err := exec.LookPath("ffprobe")
+	caps.FFprobe = err == nil
+
+	versionOut, err := runCapabilityProbe(ctx, "-version")
+	caps.FFmpeg = err == nil
+	encoders := map[string]bool{}
+	if caps.FFmpeg {
+		caps.FFmpegVersion = parseFFmpegVersion(versionOut)
+
+		encodersOut, err := runCapabilityProbe(ctx, "-encoders")
+		if err != nil {
+			log.Printf("Couldn't list ffmpeg encoders: %v", err)
+		}
+		encoders = parseFFmpegEncoders(encodersOut)
+
+		hwaccelsOut, err := runCapabilityProbe(ctx, "-hwaccels")
+		if err != nil {
+			log.Printf("Couldn't list ffmpeg hardware acceleration methods: %v", err)
+		}
+		caps.HWAccels = parseFFmpegHWAccels(hwaccelsOut)
+	}
+
+	for codec, names := range codecEncoders {
+		support := codecSupport{Encoders: []string{}}
+		for _, name := range names {
+			if encoders[name] {
+				support.Encoders = append(support.Encoders, name)
+			}
+		}
+		support.Available = len(support.Encoders) > 0
+		caps.Codecs[codec] = support
+	}
+
+	media := caps.FFmpeg && caps.FFprobe
+	caps.Features = map[string]bool{
+		"video_processing":   media,
+		"encoding_profiles":  media && encoders["libx264"],
+		"portrait_padding":   media && cfg.padPortraitToLandscape && encoders["libx264"],
+		"frame_thumbnails":   caps.FFmpeg,
+		"webp_thumbnails":    caps.FFmpeg && cfg.generateWebPThumbnails && caps.Codecs["webp"].Available,
+		"audio_extraction":   caps.FFmpeg && caps.Codecs["aac"].Available,
+		"hls_output":         media && encoders["libx264"],
+		"dash_output":        media && encoders["libx264"],
+		"storyboards":        media,
+		"animated_previews":  media && (cfg.tunables(ctx).animatedPreviewFormat == previewGIF || caps.Codecs["webp"].Available),
+		"remote_transcoding": cfg.remoteTranscoder != nil,
+	}
+	return caps
+}
+
+// runCapabilityProbe runs ffmpeg with a query flag and returns its output.
+// The global options aren't added; they are meant for processing runs.
+func runCapabilityProbe(ctx context.Context, flag string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, capabilityDetectTimeout)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", flag)
+	cmd.Stdout = &out
+	err := cmd.Run()
+	return out.String(), err
+}
+
+// parseFFmpegVersion picks the version out of the first line of
+// "ffmpeg -version", e.g. "ffmpeg version 6.1.1-3ubuntu5 Copyright ...".
+func parseFFmpegVersion(out string) string {
+	line, _, _ := strings.Cut(out, "\n")
+	fields := strings.Fields(line)
+	if len(fields) >= 3 && fields[0] == "ffmpeg" && fields[1] == "version" {
+		return fields[2]
+	}
+	return strings.TrimSpace(line)
+}
+
+// parseFFmpegEncoders reads the names from "ffmpeg -encoders", whose list
+// follows a legend ending in a " ------" line, one encoder per line as
+// " V....D libx264  libx264 H.264 / AVC ...".
+func parseFFmpegEncoders(out string) map[string]bool {
+	encoders := map[string]bool{}
+	inList := false
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if !inList {
+			inList = len(fields) == 1 && strings.HasPrefix(fields[0], "---")
+			continue
+		}
+		if len(fields) >= 2 {
+			encoders[fields[1]] = true
+		}
+	}
+	return encoders
+}
+
+// parseFFmpegHWAccels reads the methods listed after the heading of
+// "ffmpeg -hwaccels".
+func parseFFmpegHWAccels(out string) []string {
+	methods := []string{}
+	_, list, ok := strings.Cut(out, "Hardware acceleration methods:")
+	if !ok {
+		return methods
+	}
+	for _, method := range strings.Fields(list) {
+		methods = append(methods, method)
+	}
+	return methods
+}
+
+// logCapabilities summarizes the detected capabilities in the server log.
+func logCapabilities(caps *capabilities) {
+	if !caps.FFmpeg || !caps.FFprobe {
+		log.Printf("Capabilities: ffmpeg found: %t, ffprobe found: %t; video processing is unavailable", caps.FFmpeg, caps.FFprobe)
+	} else {
+		log.Printf("Capabilities: ffmpeg %s", caps.FFmpegVersion)
+	}
+
+	var codecs, features []string
+	for codec, support := range caps.Codecs {
+		if support.Available {
+			codecs = append(codecs, fmt.Sprintf("%s (%s)", codec, strings.Join(support.Encoders, ", ")))
+		}
+	}
+	for feature, enabled := range caps.Features {
+		if enabled {
+			features = append(features, feature)
+		}
+	}
+	slices.Sort(codecs)
+	slices.Sort(features)
+	log.Printf("Capabilities: encoders: %s; hwaccels: %s; features: %s",
+		orNone(codecs), orNone(caps.HWAccels), orNone(features))
+}
+
+func orNone(list []string) string {
+	if len(list) == 0 {
+		return "none"
+	}
+	return strings.Join(list, ", ")
+}
+
+// handlerCapabilities reports what the server can do, so clients only offer
+// what will work, such as AV1 only when there is an AV1 encoder.
+func (cfg *apiConfig) handlerCapabilities(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, cfg.capabilities)
+}
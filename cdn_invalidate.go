@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	"github.com/google/uuid"
+)
+
+// cdnInvalidationTimeout bounds the CreateInvalidation call. CloudFront
+// finishes the invalidation itself in the background.
+const cdnInvalidationTimeout = 10 * time.Second
+
+// cdnInvalidator issues CloudFront invalidations. It is nil unless
+// CLOUDFRONT_DISTRIBUTION_ID is set with the S3 backend.
+type cdnInvalidator struct {
+	client         *cloudfront.Client
+	distributionID string
+}
+
+func newCDNInvalidator(awsCfg aws.Config, distributionID string) *cdnInvalidator {
+	return &cdnInvalidator{
+		client:         cloudfront.NewFromConfig(awsCfg),
+		distributionID: distributionID,
+	}
+}
+
+// invalidateCDN asks CloudFront to drop its cached copies of the URLs,
+// for files rewritten in place under the same key, so viewers don't keep
+// getting the old content until it expires. URLs not served through the
+// distribution are skipped. Failures are only logged, since the new file
+// is already stored.
+func (cfg *apiConfig) invalidateCDN(ctx context.Context, urls ...string) {
+	if cfg.cdnInvalidator == nil || !cfg.tunables(ctx).cdnInvalidation {
+		return
+	}
+
+	var paths []string
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Host != cfg.s3CfDistribution {
+			continue
+		}
+		paths = append(paths, parsed.EscapedPath())
+	}
+	if len(paths) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cdnInvalidationTimeout)
+	defer cancel()
+	_, err := cfg.cdnInvalidator.client.CreateInvalidation(ctx, &cloudfront.CreateInvalidationInput{
+		DistributionId: aws.String(cfg.cdnInvalidator.distributionID),
+		InvalidationBatch: &types.InvalidationBatch{
+			CallerReference: aws.String(uuid.NewString()),
+			Paths: &types.Paths{
+				Quantity: aws.Int32(int32(len(paths))),
+				Items:    paths,
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Warning: couldn't invalidate %v in CloudFront: %v", paths, err)
+		return
+	}
+	log.Printf("Invalidated %v in CloudFront", paths)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/cloudfront/sign"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// cdnURLSigner signs URLs served through the CloudFront distribution, for
+// distributions that only serve signed requests. It is nil unless
+// CLOUDFRONT_KEY_PAIR_ID and CLOUDFRONT_PRIVATE_KEY_PATH are set.
+type cdnURLSigner struct {
+	signer *sign.URLSigner
+}
+
+// newCDNURLSigner loads the key pair CloudFront checks signatures against.
+func newCDNURLSigner(keyPairID, privateKeyPath string) (*cdnURLSigner, error) {
+	if keyPairID == "" || privateKeyPath == "" {
+		return nil, fmt.Errorf("CLOUDFRONT_KEY_PAIR_ID and CLOUDFRONT_PRIVATE_KEY_PATH must be set together")
+	}
+	key, err := sign.LoadPEMPrivKeyFile(privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load CloudFront private key: %w", err)
+	}
+	return &cdnURLSigner{signer: sign.NewURLSigner(keyPairID, key)}, nil
+}
+
+// signVideo returns a copy of the video whose URLs are signed to expire
+// after SIGNED_URL_TTL_MINUTES, so links taken from a response can't be
+// shared indefinitely: CloudFront signed URLs for a distribution that needs
+// them, or with PRESIGN_VIDEO_URLS, presigned bucket URLs. URLs served from
+// anywhere else are left as they are. Records keep the unsigned URLs, and
+// every fetch signs them afresh.
+//
+// A segment tree's manifest and a storyboard's files refer to others next
+// to them, which a canned signature for one URL wouldn't let through. They
+// are signed with a custom policy covering their whole prefix, and clients
+// repeat the manifest's query string on the requests it leads to. Presigned
+// URLs have no such policy, so they are only for single files.
+func (cfg *apiConfig) signVideo(ctx context.Context, video database.Video) (database.Video, error) {
+	if cfg.cdnURLSigner == nil && !cfg.presignVideoURLs {
+		return video, nil
+	}
+
+	var err error
+	signField := func(u *string, prefix string) *string {
+		if u == nil || err != nil {
+			return u
+		}
+		var signed string
+		signed, err = cfg.signURL(ctx, *u, prefix)
+		return &signed
+	}
+
+	videoPrefix := ""
+	if video.VideoURL != nil && isSegmentedURL(*video.VideoURL) {
+		videoPrefix = (*video.VideoURL)[:strings.LastIndex(*video.VideoURL, "/")+1]
+	}
+	video.VideoURL = signField(video.VideoURL, videoPrefix)
+	video.ThumbnailURL = signField(video.ThumbnailURL, "")
+	video.ThumbnailWebPURL = signField(video.ThumbnailWebPURL, "")
+	video.AnimatedPreviewURL = signField(video.AnimatedPreviewURL, "")
+	video.AudioURL = signField(video.AudioURL, "")
+
+	if len(video.Renditions) > 0 {
+		renditions := make(database.Renditions, len(video.Renditions))
+		copy(renditions, video.Renditions)
+		for i := range renditions {
+			renditions[i].URL = *signField(&renditions[i].URL, "")
+		}
+		video.Renditions = renditions
+	}
+	if video.Storyboard != nil {
+		storyboard := *video.Storyboard
+		prefix := strings.TrimSuffix(storyboard.URL, ".vtt")
+		storyboard.URL = *signField(&storyboard.URL, prefix)
+		storyboard.SpriteURL = *signField(&storyboard.SpriteURL, prefix)
+		video.Storyboard = &storyboard
+	}
+	return video, err
+}
+
+// signVideos signs each of videos in place, as signVideo does.
+func (cfg *apiConfig) signVideos(ctx context.Context, videos []database.Video) error {
+	for i := range videos {
+		var err error
+		videos[i], err = cfg.signVideo(ctx, videos[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signURL signs one stored URL the way signVideo signs a video's. With a
+// prefix, a CloudFront signature covers every URL starting with it.
+func (cfg *apiConfig) signURL(ctx context.Context, rawURL, prefix string) (string, error) {
+	if cfg.cdnURLSigner == nil && !cfg.presignVideoURLs {
+		return rawURL, nil
+	}
+	ttl := cfg.tunables(ctx).signedURLTTL
+	if cfg.presignVideoURLs {
+		return cfg.presignStoredURL(ctx, rawURL, ttl)
+	}
+	return cfg.signCDNURL(rawURL, prefix, time.Now().Add(ttl))
+}
+
+// signCDNURL signs rawURL if it is served through the distribution. With a
+// prefix, the signature covers every URL starting with it.
+func (cfg *apiConfig) signCDNURL(rawURL, prefix string, expires time.Time) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host != cfg.s3CfDistribution {
+		return rawURL, nil
+	}
+	if prefix == "" {
+		return cfg.cdnURLSigner.signer.Sign(rawURL, expires)
+	}
+	return cfg.cdnURLSigner.signer.SignWithPolicy(rawURL, sign.NewCannedPolicy(prefix+"*", expires))
+}
+
+// presignStoredURL presigns a GET of the bucket object behind rawURL, if it
+// is one.
+func (cfg *apiConfig) presignStoredURL(ctx context.Context, rawURL string, ttl time.Duration) (string, error) {
+	key, ok := cfg.storage.KeyFromURL(rawURL)
+	if !ok {
+		return rawURL, nil
+	}
+	return cfg.storage.Presign(ctx, key, ttl)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/httpclient"
+)
+
+// cdnWarmRangeBytes is how much of a video to request when warming. With
+// faststart the moov atom and first frames live at the front of the file,
+// which is exactly what a player asks the edge for first.
+const cdnWarmRangeBytes = 1 << 20 // 1 MB
+
+var cdnWarmClient = httpclient.New(httpclient.Policy{
+	Timeout:      30 * time.Second,
+	MaxRedirects: 3,
+	MaxBodyBytes: cdnWarmRangeBytes,
+	Retry: httpclient.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+	},
+})
+
+// warmCDNCache requests each URL from the CDN in the background so the first
+// viewer doesn't pay for the origin fetch. Failures are only logged.
+func (cfg *apiConfig) warmCDNCache(ctx context.Context, urls ...*string) {
+	if !cfg.tunables(ctx).warmCDN {
+		return
+	}
+
+	for _, u := range urls {
+		if u == nil {
+			continue
+		}
+		parsed, err := url.Parse(*u)
+		if err != nil || parsed.Host != cfg.s3CfDistribution {
+			// Only assets served through the distribution benefit
+			continue
+		}
+		target := *u
+		// A distribution that needs signed URLs turns away unsigned warming
+		if cfg.cdnURLSigner != nil {
+			target, err = cfg.signCDNURL(target, "", time.Now().Add(time.Minute))
+			if err != nil {
+				log.Printf("Warning: couldn't sign %s to warm the CDN cache: %v", *u, err)
+				continue
+			}
+		}
+		go func(target string) {
+			err := warmURL(target)
+			if err != nil {
+				log.Printf("Warning: couldn't warm CDN cache for %s: %v", target, err)
+			}
+		}(target)
+	}
+}
+
+func warmURL(target string) error {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", cdnWarmRangeBytes-1))
+
+	resp, err := cdnWarmClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so the edge sees a completed request
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
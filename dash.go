@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	dashManifest = "manifest.mpd"
+	// dashSegmentSeconds is a multiple of renditionKeyframeSeconds, like
+	// hlsSegmentSeconds
+	dashSegmentSeconds = 6
+
+	dashManifestContentType = "application/dash+xml"
+)
+
+// segmentDASH writes the variants as representations of one manifest in
+// workDir, with fragmented MP4 segments. ffmpeg has to write them all in
+// one run to put them in the same adaptation set, which is what lets
+// players switch between them.
+func (cfg *apiConfig) segmentDASH(ctx context.Context, job transcodeJob, probe videoProbe, variants []segmentVariant, workDir string) error {
+	weight := 1
+	if variants[0].encodes(job) {
+		weight = job.threads
+	}
+	weight, err := cfg.ffmpegThreads.acquire(ctx, weight, cfg.tunables(ctx).maxFFmpegThreads)
+	if err != nil {
+		return err
+	}
+	defer cfg.ffmpegThreads.release(weight)
+
+	args := []string{"-y"}
+	if variants[0].rung != nil {
+		args = append(args, dashLadderArgs(job, probe, variants)...)
+	} else {
+		args = append(args, job.videoEncodeArgs()...)
+	}
+	adaptationSets := "id=0,streams=v"
+	if probe.hasAudio {
+		adaptationSets += " id=1,streams=a"
+	}
+	args = append(args,
+		"-f", "dash",
+		"-seg_duration", strconv.Itoa(dashSegmentSeconds),
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-adaptation_sets", adaptationSets,
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		filepath.Join(workDir, dashManifest),
+	)
+	cmd := cfg.ffmpegCommand(ctx, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return encryptionFailure(err, stderr.Bytes())
+	}
+	return nil
+}
+
+// dashLadderArgs are the ffmpeg input and codec arguments that encode the
+// source once per ladder variant, as numbered video streams of the same
+// output, plus one audio stream at the top rung's bitrate.
+func dashLadderArgs(job transcodeJob, probe videoProbe, variants []segmentVariant) []string {
+	args := []string{"-i", job.srcPath}
+	for range variants {
+		args = append(args, "-map", "0:v:0")
+	}
+	if probe.hasAudio {
+		args = append(args, "-map", "0:a:0")
+	}
+	for i, variant := range variants {
+		n := strconv.Itoa(i)
+		kbps := variant.rung.videoBitrateKbps
+		args = append(args,
+			"-filter:v:"+n, fmt.Sprintf("scale=%d:%d", variant.width, variant.height),
+			"-b:v:"+n, fmt.Sprintf("%dk", kbps),
+			"-maxrate:v:"+n, fmt.Sprintf("%dk", kbps),
+			"-bufsize:v:"+n, fmt.Sprintf("%dk", 2*kbps),
+		)
+	}
+	args = append(args,
+		"-c:v", "libx264",
+		"-preset", "medium",
+		"-force_key_frames", renditionKeyframeExpr,
+		"-pix_fmt", "yuv420p",
+	)
+	if probe.hasAudio {
+		args = append(args, "-c:a", "aac", "-b:a", fmt.Sprintf("%dk", variants[0].rung.audioBitrateKbps))
+	}
+	if job.threads > 0 {
+		args = append(args, "-threads", strconv.Itoa(job.threads))
+	}
+	return args
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// dedupScope decides which existing videos an upload may share its stored
+// file with when their content hashes match.
+type dedupScope string
+
+const (
+	// dedupUser only matches the uploader's own videos, so nobody can
+	// learn from upload timing or storage usage what others have uploaded
+	dedupUser dedupScope = "user"
+	// dedupGlobal matches any user's videos, for the most storage savings
+	dedupGlobal dedupScope = "global"
+	dedupOff    dedupScope = "off"
+)
+
+// parseDedupScope validates a DEDUP_SCOPE value. Empty selects dedupUser.
+func parseDedupScope(v string) (dedupScope, error) {
+	switch dedupScope(v) {
+	case "":
+		return dedupUser, nil
+	case dedupUser, dedupGlobal, dedupOff:
+		return dedupScope(v), nil
+	}
+	return "", fmt.Errorf("unsupported DEDUP_SCOPE %q (want user, global or off)", v)
+}
+
+// findDuplicate returns a ready video within the configured scope whose
+// stored file was made from the same content with the same encoding
+// profile, or a zero Video when there is none. The other processing
+// options don't change the stored file.
+func (cfg *apiConfig) findDuplicate(video database.Video, srcHash string) (database.Video, error) {
+	if cfg.dedupScope == dedupOff || srcHash == "" {
+		return database.Video{}, nil
+	}
+	var userID *uuid.UUID
+	if cfg.dedupScope == dedupUser {
+		userID = &video.UserID
+	}
+	return cfg.db.GetVideoByChecksum(srcHash, video.MediaKind, video.ProcessingOptions.EncodingProfile, userID, video.ID)
+}
+
+// findStoredObject looks for a processed file with the content hash that
+// the job may point at instead of storing its own, within the configured
+// scope. Only files a video still refers to count; one that was orphaned
+// may be about to be cleaned up.
+func (cfg *apiConfig) findStoredObject(job transcodeJob, contentHash string) (*database.StoredObject, error) {
+	if cfg.dedupScope == dedupOff {
+		return nil, nil
+	}
+	var userID *uuid.UUID
+	if cfg.dedupScope == dedupUser {
+		userID = &job.userID
+	}
+	objects, err := cfg.db.FindStoredObjects(contentHash, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objects {
+		refs, err := cfg.db.CountVideoURLReferences(cfg.storage.URL(obj.Key), uuid.Nil)
+		if err != nil {
+			return nil, err
+		}
+		if refs > 0 {
+			return &obj, nil
+		}
+	}
+	return nil, nil
+}
+
+// recordStoredObject remembers the processed file the job stored, so
+// later identical output can point at it. Failing only costs that saving,
+// so it is logged.
+func (cfg *apiConfig) recordStoredObject(job transcodeJob, contentHash string, size int64) {
+	err := cfg.db.RecordStoredObject(database.StoredObject{
+		ContentHash: contentHash,
+		Key:         job.key,
+		UserID:      job.userID,
+		SizeBytes:   size,
+	})
+	if err != nil {
+		log.Printf("Couldn't record the processed file of video %s: %v", job.videoID, err)
+	}
+}
+
+// releaseVideoFile removes a processed file a video no longer points at,
+// or the whole segment tree of an HLS or DASH manifest, unless another
+// video still refers to it. Failures are logged, since the record has already moved
+// on.
+func (cfg *apiConfig) releaseVideoFile(ctx context.Context, videoID uuid.UUID, videoURL string) {
+	refs, err := cfg.db.CountVideoURLReferences(videoURL, videoID)
+	if err != nil {
+		log.Printf("Couldn't count references to %s: %v", videoURL, err)
+		return
+	}
+	if refs > 0 {
+		return
+	}
+	key, err := cfg.bucketKeyFromURL(videoURL)
+	if err != nil {
+		log.Printf("Couldn't remove video file: %v", err)
+		return
+	}
+	if isSegmentedURL(videoURL) {
+		err = cfg.removeSegmentTree(ctx, key)
+	} else {
+		err = cfg.storage.Delete(ctx, key)
+	}
+	if err != nil {
+		log.Printf("Couldn't remove video file %s: %v", key, err)
+		return
+	}
+	err = cfg.db.DeleteStoredObject(key)
+	if err != nil {
+		log.Printf("Couldn't forget video file %s: %v", key, err)
+	}
+}
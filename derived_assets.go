@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Derived asset kinds and states reported in the status payload.
+const (
+	derivedThumbnail           = "thumbnail"
+	derivedThumbnailCandidates = "thumbnail_candidates"
+
+	derivedReady = "ready"
+	derivedStale = "stale"
+)
+
+// derivedAssetStatus says whether an asset generated from a video's content
+// still matches the upload it was made from.
+type derivedAssetStatus struct {
+	Kind   string `json:"kind"`
+	Status string `json:"status"`
+}
+
+// collectStaleDerivedAssets deletes the thumbnail candidates left over from
+// an upload the video's content has since replaced. The video's thumbnail
+// file is kept even if it was one of them, since it is still shown; it is
+// reported as stale instead. Failures are logged, not returned, since the
+// new upload is already stored.
+func (cfg *apiConfig) collectStaleDerivedAssets(ctx context.Context, video database.Video) {
+	removed, err := cfg.db.DeleteStaleThumbnailCandidates(video.ID, video.SourceHash)
+	if err != nil {
+		log.Printf("Couldn't collect stale thumbnail candidates for video %s: %v", video.ID, err)
+		return
+	}
+	for _, url := range removed {
+		if video.ThumbnailURL != nil && url == *video.ThumbnailURL {
+			continue
+		}
+		if err := cfg.removeThumbnail(ctx, url); err != nil {
+			log.Printf("Couldn't remove stale thumbnail candidate %s: %v", url, err)
+		}
+	}
+}
+
+// derivedAssetStatuses reports, for each kind of asset generated from the
+// video's content, whether it matches the current upload. Thumbnails the
+// owner uploaded aren't derived and aren't listed.
+func (cfg *apiConfig) derivedAssetStatuses(video database.Video) ([]derivedAssetStatus, error) {
+	statuses := []derivedAssetStatus{}
+	status := func(sourceHash string) string {
+		if sourceHash == video.SourceHash {
+			return derivedReady
+		}
+		return derivedStale
+	}
+
+	if video.ThumbnailURL != nil && video.ThumbnailSourceHash != "" {
+		statuses = append(statuses, derivedAssetStatus{
+			Kind:   derivedThumbnail,
+			Status: status(video.ThumbnailSourceHash),
+		})
+	}
+
+	candidates, err := cfg.db.GetThumbnailCandidates(video.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) > 0 {
+		candidatesStatus := derivedReady
+		for _, c := range candidates {
+			if status(c.SourceHash) == derivedStale {
+				candidatesStatus = derivedStale
+			}
+		}
+		statuses = append(statuses, derivedAssetStatus{
+			Kind:   derivedThumbnailCandidates,
+			Status: candidatesStatus,
+		})
+	}
+	return statuses, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/devs3"
+)
+
+// devS3BasePath is where the fake S3 is mounted in DEV_MODE.
+const devS3BasePath = "/devs3"
+
+// Defaults that let DEV_MODE start without any S3 settings.
+const (
+	devS3DefaultBucket = "tubely-dev"
+	devS3DefaultRegion = "us-east-1"
+	devS3DefaultRoot   = "devs3"
+)
+
+// The demo account seeded in DEV_MODE.
+const (
+	devDemoEmail    = "demo@tubely.dev"
+	devDemoPassword = "tubely-demo"
+)
+
+// devSampleVideos are seeded for the demo user. Files come from
+// samplesdownload.sh; a sample whose file is missing is seeded without one.
+var devSampleVideos = []struct {
+	title       string
+	description string
+	video       string
+	thumbnail   string
+}{
+	{
+		title:       "Boots (landscape)",
+		description: "Sample landscape video seeded by DEV_MODE.",
+		video:       "samples/boots-video-horizontal.mp4",
+		thumbnail:   "samples/boots-image-horizontal.png",
+	},
+	{
+		title:       "Boots (portrait)",
+		description: "Sample portrait video seeded by DEV_MODE.",
+		video:       "samples/boots-video-vertical.mp4",
+		thumbnail:   "samples/boots-image-vertical.png",
+	},
+}
+
+func logDevModeBanner(root string) {
+	line := strings.Repeat("*", 72)
+	log.Println(line)
+	log.Println("DEV_MODE is on: S3 is replaced by a local fake storing objects in " + root)
+	log.Printf("and a demo user (%s / %s) is seeded.", devDemoEmail, devDemoPassword)
+	log.Println("This mode is for local development only. NEVER run it in production.")
+	log.Println(line)
+}
+
+// newDevS3 starts the fake S3 and returns a client for it along with the
+// base URL its objects are served from. origin is where the server that
+// mounts it at devS3BasePath is reached, such as "http://localhost:8091".
+func newDevS3(root, origin, bucket, region string) (*s3.Client, *devs3.Server, string, error) {
+	srv, err := devs3.New(root, devS3BasePath, region)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	endpoint := origin + devS3BasePath
+	client := s3.New(s3.Options{
+		Region:       region,
+		BaseEndpoint: aws.String(endpoint),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider(devs3.AccessKeyID, devs3.SecretAccessKey, ""),
+		// The fake doesn't decode aws-chunked bodies with trailing checksums
+		RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+	})
+	return client, srv, endpoint + "/" + bucket, nil
+}
+
+// seedDevData creates the demo user and sample videos unless the demo user
+// already exists, so restarting doesn't duplicate them. Sample files are
+// run through the normal pipeline, which needs ffmpeg; failures are logged
+// and leave the video without a file.
+func (cfg *apiConfig) seedDevData(ctx context.Context) error {
+	existing, err := cfg.db.GetUserByEmail(devDemoEmail)
+	if err != nil {
+		return err
+	}
+	if existing.Email != "" {
+		return nil
+	}
+
+	hashedPassword, err := auth.HashPassword(devDemoPassword)
+	if err != nil {
+		return err
+	}
+	user, err := cfg.db.CreateUser(database.CreateUserParams{
+		Email:    devDemoEmail,
+		Password: hashedPassword,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, sample := range devSampleVideos {
+		video, err := cfg.db.CreateVideo(database.CreateVideoParams{
+			Title:       sample.title,
+			Description: sample.description,
+			UserID:      user.ID,
+		}, database.ProcessingOptions{})
+		if err != nil {
+			return err
+		}
+
+		err = cfg.seedSampleThumbnail(ctx, &video, sample.thumbnail)
+		if err != nil {
+			log.Printf("Couldn't seed thumbnail for %q: %v", sample.title, err)
+		}
+		err = cfg.seedSampleVideo(ctx, &video, sample.video)
+		if err != nil {
+			log.Printf("Couldn't seed video file for %q: %v", sample.title, err)
+		}
+	}
+	log.Printf("Seeded demo user %s with %d sample videos", devDemoEmail, len(devSampleVideos))
+	return nil
+}
+
+func (cfg *apiConfig) seedSampleThumbnail(ctx context.Context, video *database.Video, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	thumbnailURL, err := cfg.saveThumbnail(ctx, f, filepath.Ext(path))
+	if err != nil {
+		return err
+	}
+	cfg.useThumbnail(ctx, video, thumbnailURL)
+	return cfg.db.UpdateVideo(*video)
+}
+
+func (cfg *apiConfig) seedSampleVideo(ctx context.Context, video *database.Video, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	plog := newProcessingLog(ctx, video.ID)
+	defer cfg.saveProcessingLog(ctx, plog)
+	return cfg.ingestVideo(ctx, video, f, plog)
+}
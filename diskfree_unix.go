@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// diskFreeBytes returns the space available to unprivileged users on the
+// filesystem containing path.
+func diskFreeBytes(path string) (int64, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
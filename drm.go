@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errEncryptedMedia means the upload is DRM-protected or otherwise
+// encrypted, so it can't be decoded no matter how often it is retried.
+var errEncryptedMedia = errors.New("video is encrypted")
+
+// encryptedCodecTags are sample entry types used for protected tracks. CENC
+// (Widevine, PlayReady) marks tracks as encv/enca; iTunes FairPlay uses
+// drmi/drms. ffmpeg usually reports the original format from the frma box
+// instead, so these only catch files where it couldn't.
+var encryptedCodecTags = map[string]bool{
+	"encv": true,
+	"enca": true,
+	"drmi": true,
+	"drms": true,
+}
+
+// encryptionStderrMarkers are lowercase fragments of the messages ffmpeg and
+// ffprobe log when they hit encrypted samples they have no key for.
+var encryptionStderrMarkers = []string{
+	"decryption key",
+	"failed to decrypt",
+	"encrypted stream",
+	"encryption info",
+	"unsupported encryption",
+	"drm protected",
+}
+
+// ffprobeStream holds the ffprobe stream fields used to classify uploads.
+type ffprobeStream struct {
+	CodecType      string `json:"codec_type"`
+	CodecName      string `json:"codec_name"`
+	AvgFrameRate   string `json:"avg_frame_rate"`
+	CodecTagString string `json:"codec_tag_string"`
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	SideDataList   []struct {
+		SideDataType string `json:"side_data_type"`
+	} `json:"side_data_list"`
+	Disposition struct {
+		// AttachedPic marks cover art stored as a one-frame video stream
+		AttachedPic int `json:"attached_pic"`
+	} `json:"disposition"`
+}
+
+// streamEncryption returns a description of why the stream looks encrypted,
+// or "" when it doesn't.
+func streamEncryption(stream ffprobeStream) string {
+	if encryptedCodecTags[stream.CodecTagString] {
+		return fmt.Sprintf("%s stream has protected sample entry %s", stream.CodecType, stream.CodecTagString)
+	}
+	for _, sd := range stream.SideDataList {
+		if strings.Contains(strings.ToLower(sd.SideDataType), "encryption") {
+			return fmt.Sprintf("%s stream has %s", stream.CodecType, sd.SideDataType)
+		}
+	}
+	return ""
+}
+
+// checkStreamsEncrypted returns errEncryptedMedia if any stream is protected.
+func checkStreamsEncrypted(streams []ffprobeStream) error {
+	for _, stream := range streams {
+		if reason := streamEncryption(stream); reason != "" {
+			return fmt.Errorf("%w: %s", errEncryptedMedia, reason)
+		}
+	}
+	return nil
+}
+
+// encryptionFailure wraps err with errEncryptedMedia when a failed ffmpeg
+// or ffprobe run logged a decryption problem, and returns it as is
+// otherwise.
+func encryptionFailure(err error, stderr []byte) error {
+	lower := bytes.ToLower(stderr)
+	for _, marker := range encryptionStderrMarkers {
+		if bytes.Contains(lower, []byte(marker)) {
+			return fmt.Errorf("%w: %w: %s", errEncryptedMedia, err, bytes.TrimSpace(stderr))
+		}
+	}
+	return err
+}
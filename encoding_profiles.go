@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// encodingProfile is a named set of x264 settings owners can pick from
+// instead of passing ffmpeg flags themselves.
+type encodingProfile struct {
+	// crf is the constant rate factor; lower is higher quality.
+	crf int
+	// preset trades encoding time for compression.
+	preset string
+	// maxBitrateKbps caps the video bitrate, in kbit/s. Zero means uncapped.
+	maxBitrateKbps int
+	// audioBitrateKbps is the AAC bitrate.
+	audioBitrateKbps int
+}
+
+var encodingProfiles = map[string]encodingProfile{
+	"web-optimized": {crf: 23, preset: "medium", maxBitrateKbps: 5000, audioBitrateKbps: 128},
+	"high-quality":  {crf: 18, preset: "slow", maxBitrateKbps: 0, audioBitrateKbps: 192},
+	"small-file":    {crf: 28, preset: "veryfast", maxBitrateKbps: 1500, audioBitrateKbps: 96},
+}
+
+var errUnknownEncodingProfile = errors.New("unknown encoding profile")
+
+func validateEncodingProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := encodingProfiles[name]; !ok {
+		return fmt.Errorf("%w %q, expected one of %s", errUnknownEncodingProfile, name, strings.Join(encodingProfileNames(), ", "))
+	}
+	return nil
+}
+
+func encodingProfileNames() []string {
+	names := make([]string, 0, len(encodingProfiles))
+	for name := range encodingProfiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+var errThumbnailsNotSupported = errors.New("audio records have no frames to generate thumbnails from")
+
+var errRenditionsNotSupported = errors.New("audio records have no picture to make renditions of")
+
+var errStoryboardNotSupported = errors.New("audio records have no frames to make a storyboard from")
+
+var errAnimatedPreviewNotSupported = errors.New("audio records have no frames to make an animated preview from")
+
+// validateProcessingOptions checks options for a record of the given media
+// kind before they are stored.
+func validateProcessingOptions(mediaKind string, opts database.ProcessingOptions) error {
+	if mediaKind == database.MediaKindAudio {
+		if opts.EncodingProfile != "" {
+			return errEncodingProfileNotSupported
+		}
+		if database.Enabled(opts.GenerateThumbnails, false) {
+			return errThumbnailsNotSupported
+		}
+		if database.Enabled(opts.GenerateRenditions, false) {
+			return errRenditionsNotSupported
+		}
+		if database.Enabled(opts.GenerateStoryboard, false) {
+			return errStoryboardNotSupported
+		}
+		if database.Enabled(opts.GenerateAnimatedPreview, false) {
+			return errAnimatedPreviewNotSupported
+		}
+		if opts.OutputFormat != "" && opts.OutputFormat != outputMP4 {
+			return errOutputFormatNotSupported
+		}
+	}
+	err := validateOutputFormat(opts.OutputFormat)
+	if err != nil {
+		return err
+	}
+	return validateEncodingProfile(opts.EncodingProfile)
+}
+
+// ffmpegArgs returns the codec arguments for the profile.
+func (p encodingProfile) ffmpegArgs() []string {
+	args := []string{
+		"-c:v", "libx264",
+		"-preset", p.preset,
+		"-crf", strconv.Itoa(p.crf),
+		"-pix_fmt", "yuv420p",
+	}
+	if p.maxBitrateKbps > 0 {
+		args = append(args,
+			"-maxrate", fmt.Sprintf("%dk", p.maxBitrateKbps),
+			"-bufsize", fmt.Sprintf("%dk", 2*p.maxBitrateKbps),
+		)
+	}
+	return append(args, "-c:a", "aac", "-b:a", fmt.Sprintf("%dk", p.audioBitrateKbps))
+}
+
+// selectEncodingProfile validates a profile requested with an upload and
+// stores it on the video, so a later reprocess uses the same settings. An
+// empty name leaves the video's current choice in place. Audio records don't
+// take profiles.
+func (cfg *apiConfig) selectEncodingProfile(video *database.Video, name string) error {
+	if name == "" || name == video.ProcessingOptions.EncodingProfile {
+		return nil
+	}
+	if video.MediaKind == database.MediaKindAudio {
+		return errEncodingProfileNotSupported
+	}
+	err := validateEncodingProfile(name)
+	if err != nil {
+		return err
+	}
+	video.ProcessingOptions.EncodingProfile = name
+	return cfg.db.UpdateVideoMetadata(*video)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envInt64 reads an optional integer environment variable, returning
+// fallback when it is unset. Invalid values are reported as errors so
+// misconfiguration is caught at startup or reload rather than at the first
+// upload.
+func envInt64(key string, fallback int64) (int64, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer: %w", key, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%s must not be negative", key)
+	}
+	return n, nil
+}
+
+// envBool reads an optional boolean environment variable such as "true" or
+// "0", returning fallback when it is unset.
+func envBool(key string, fallback bool) (bool, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("%s must be a boolean: %w", key, err)
+	}
+	return b, nil
+}
+
+// envList reads an optional comma-separated environment variable, dropping
+// blanks around and between entries.
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envFloat reads an optional positive float environment variable, returning
+// fallback when it is unset.
+func envFloat(key string, fallback float64) (float64, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number: %w", key, err)
+	}
+	if f <= 0 {
+		return 0, fmt.Errorf("%s must be positive", key)
+	}
+	return f, nil
+}
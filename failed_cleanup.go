@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// failedCleanupInterval is how often failed uploads are checked for
+// leftovers past FAILED_UPLOAD_RETENTION_HOURS.
+const failedCleanupInterval = time.Hour
+
+// failedCleanupBatch caps how many videos one pass cleans, so a backlog is
+// worked off over several passes.
+const failedCleanupBatch = 100
+
+// tempFilePrefix leads the name of every temp file the server creates.
+const tempFilePrefix = "tubely-"
+
+// videoKeyDirs are the bucket directories holding per-video objects. Keys
+// in them start with the video ID, possibly behind a shard prefix.
+var videoKeyDirs = []string{"landscape", "portrait", "other", "audio", "originals", "transcode-inputs"}
+
+// cleanFailedUploads periodically removes what failed uploads left behind
+// until ctx is cancelled.
+func (cfg *apiConfig) cleanFailedUploads(ctx context.Context) {
+	ticker := time.NewTicker(failedCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		cfg.cleanFailedUploadsOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cleanFailedUploadsOnce cleans videos that have been failed or poisoned
+// for longer than the retention, and temp files, uncompleted direct uploads
+// and finished processing jobs older than it. A retention of 0 turns cleanup
+// off.
+func (cfg *apiConfig) cleanFailedUploadsOnce(ctx context.Context) {
+	tun := cfg.tunables(ctx)
+	if tun.failedUploadRetentionHours <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(tun.failedUploadRetentionHours) * time.Hour)
+
+	cfg.removeStaleTempFiles(cutoff)
+	cfg.removeStaleDirectUploads(ctx, cutoff)
+	_, err := cfg.db.DeleteFinishedProcessingJobs(cutoff)
+	if err != nil {
+		log.Printf("Couldn't delete finished processing jobs: %v", err)
+	}
+
+	videos, err := cfg.db.GetFailedVideosToClean(cutoff, failedCleanupBatch)
+	if err != nil {
+		log.Printf("Couldn't list failed videos to clean up: %v", err)
+		return
+	}
+	for _, video := range videos {
+		if ctx.Err() != nil {
+			return
+		}
+		err := cfg.cleanFailedVideo(ctx, video, tun.failedUploadDeleteRecord)
+		if err != nil {
+			log.Printf("Couldn't clean up failed video %s: %v", video.ID, err)
+		}
+	}
+	if len(videos) > 0 {
+		log.Printf("Cleaned up %d failed uploads", len(videos))
+	}
+}
+
+// cleanFailedVideo removes the objects a failed upload stored before it
+// failed, such as an original, a processed file under a different aspect,
+// renditions or a storyboard, along with thumbnail candidates generated
+// from it. What the record still points at, from an earlier successful
+// upload, is kept unless deleteRecord is set, in which case the record goes
+// too. Files other videos share through dedup are always kept.
+func (cfg *apiConfig) cleanFailedVideo(ctx context.Context, video database.Video, deleteRecord bool) error {
+	keep := map[string]bool{}
+	// An HLS or DASH manifest keeps the segment tree under it
+	var keepDirs []string
+	if !deleteRecord {
+		urls := video.Renditions.URLs()
+		if video.Storyboard != nil {
+			urls = append(urls, video.Storyboard.URLs()...)
+		}
+		for _, u := range []*string{video.VideoURL, video.AudioURL} {
+			if u != nil {
+				urls = append(urls, *u)
+			}
+		}
+		for _, u := range urls {
+			if key, ok := cfg.storage.KeyFromURL(u); ok {
+				keep[key] = true
+				if isSegmentedURL(u) {
+					keepDirs = append(keepDirs, segmentTreeDirKey(key))
+				}
+			}
+		}
+		if video.OriginalKey != nil {
+			keep[*video.OriginalKey] = true
+		}
+	}
+
+	keys, err := cfg.videoObjectKeys(ctx, video)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if keep[key] || slices.ContainsFunc(keepDirs, func(dir string) bool { return strings.HasPrefix(key, dir) }) {
+			continue
+		}
+		// Other videos refer to a segment tree by its manifest
+		refKey := key
+		if manifestKey, ok := segmentTreeManifestKey(key); ok {
+			refKey = manifestKey
+		}
+		refs, err := cfg.db.CountVideoURLReferences(cfg.storage.URL(refKey), video.ID)
+		if err != nil {
+			return err
+		}
+		if refs > 0 {
+			continue
+		}
+		err = cfg.storage.Delete(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !deleteRecord {
+		cfg.collectStaleDerivedAssets(ctx, video)
+		return cfg.db.SetArtifactsCleaned(video.ID)
+	}
+
+	candidates, err := cfg.db.GetThumbnailCandidates(video.ID)
+	if err != nil {
+		return err
+	}
+	for _, candidate := range candidates {
+		if err := cfg.removeThumbnail(ctx, candidate.URL); err != nil {
+			log.Printf("Couldn't remove thumbnail candidate %s: %v", candidate.URL, err)
+		}
+	}
+	if video.ThumbnailURL != nil {
+		if err := cfg.removeThumbnail(ctx, *video.ThumbnailURL); err != nil {
+			log.Printf("Couldn't remove thumbnail %s: %v", *video.ThumbnailURL, err)
+		}
+	}
+	return cfg.db.DeleteVideo(video.ID)
+}
+
+// videoObjectKeys lists every bucket object stored for the video, looking
+// both with and without its shard prefix since S3_KEY_SHARDING may have
+// changed since they were written.
+func (cfg *apiConfig) videoObjectKeys(ctx context.Context, video database.Video) ([]string, error) {
+	id := video.ID.String()
+	keys := []string{}
+	dirs := videoKeyDirs
+	// Ratio directories under "other" can't all be listed, so only the one
+	// the video is stored in is looked through
+	if dir := storedOtherDir(video); dir != "" {
+		dirs = append(slices.Clip(videoKeyDirs), dir)
+	}
+	for _, dir := range dirs {
+		for _, prefix := range []string{path.Join(dir, id), path.Join(shardPrefix(video.ID), dir, id)} {
+			objects, err := cfg.storage.List(ctx, prefix)
+			if err != nil {
+				return nil, err
+			}
+			for _, obj := range objects {
+				// A longer ID that happens to share the prefix isn't ours
+				rest := strings.TrimPrefix(obj.Key, prefix)
+				if rest == "" || strings.ContainsAny(rest[:1], ".-/") {
+					keys = append(keys, obj.Key)
+				}
+			}
+		}
+	}
+	return keys, nil
+}
+
+// lastWritten returns when the file at p, or anything under it if it is a
+// directory, was last written.
+func lastWritten(p string) (time.Time, error) {
+	var latest time.Time
+	err := filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest, err
+}
+
+// removeStaleTempFiles deletes the server's temp files last written before
+// cutoff. They are normally removed as soon as a request is done with
+// them, so old ones were left by a crash or a kill.
+func (cfg *apiConfig) removeStaleTempFiles(cutoff time.Time) {
+	entries, err := os.ReadDir(cfg.tempDir)
+	if err != nil {
+		log.Printf("Couldn't list temp files: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			continue
+		}
+		// Work directories, such as the ones HLS and DASH are packaged in,
+		// go with everything in them once nothing in them has been written
+		// since cutoff
+		p := filepath.Join(cfg.tempDir, entry.Name())
+		written, err := lastWritten(p)
+		if err != nil || !written.Before(cutoff) {
+			continue
+		}
+		err = os.RemoveAll(p)
+		if err != nil {
+			log.Printf("Couldn't remove stale temp file %s: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/featureflags"
+	"github.com/google/uuid"
+)
+
+// brokenFlagStore can't load any flags.
+type brokenFlagStore struct{}
+
+func (brokenFlagStore) GetFeatureFlags() ([]database.FeatureFlag, error) {
+	return nil, errors.New("database is locked")
+}
+
+func TestFlagsFallBackToDefaults(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.flags = featureflags.NewCache(brokenFlagStore{}, featureFlagCacheTTL, defaultFeatureFlags)
+	for _, flag := range defaultFeatureFlags {
+		if got := cfg.flags.Enabled(flag.Name, uuid.New()); got != flag.Enabled {
+			t.Errorf("%s = %v while the table can't be read, want its default %v", flag.Name, got, flag.Enabled)
+		}
+	}
+}
+
+// TestQuotaIgnoresFlags checks that the storage quota holds for every user,
+// whatever the flags say and even when they can't be loaded.
+func TestQuotaIgnoresFlags(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.flags = featureflags.NewCache(brokenFlagStore{}, featureFlagCacheTTL, defaultFeatureFlags)
+	tun := *cfg.currentTunables.Load()
+	tun.userQuotaBytes = 512
+	cfg.currentTunables.Store(&tun)
+	srv := newTestServer(t, cfg)
+
+	for range 20 {
+		user, token := newTestUser(t, cfg)
+		video := newTestVideo(t, cfg, user.ID)
+		form, contentType := multipartVideo(t, "video/mp4", fakeMP4())
+		resp, body := doRequest(t, srv, http.MethodPost, "/api/video_upload/"+video.ID.String(), token, contentType, form)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("over-quota upload status = %d, want %d: %s", resp.StatusCode, http.StatusForbidden, body)
+		}
+	}
+}
+
+// TestRenditionsRollout checks that rendition generation follows its
+// flag's rollout where GENERATE_RENDITIONS turns it on.
+func TestRenditionsRollout(t *testing.T) {
+	tests := []struct {
+		name    string
+		rollout int
+		want    bool
+	}{
+		{name: "everyone", rollout: 100, want: true},
+		{name: "no one", rollout: 0, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			useFakeTranscoder(cfg)
+			tun := *cfg.currentTunables.Load()
+			tun.generateRenditions = true
+			cfg.currentTunables.Store(&tun)
+			_, err := cfg.db.UpsertFeatureFlag(flagRenditions, true, tt.rollout)
+			if err != nil {
+				t.Fatalf("UpsertFeatureFlag: %v", err)
+			}
+			cfg.flags.Invalidate()
+			srv := newTestServer(t, cfg)
+			user, token := newTestUser(t, cfg)
+			video := newTestVideo(t, cfg, user.ID)
+
+			resp, body := sessionUpload(t, srv, token, video.ID, fakeMP4())
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("upload status = %d: %s", resp.StatusCode, body)
+			}
+			entries, err := cfg.db.GetProcessingLog(video.ID)
+			if err != nil {
+				t.Fatalf("GetProcessingLog: %v", err)
+			}
+			ran := false
+			for _, entry := range entries {
+				if entry.Step == stageRenditions {
+					ran = true
+				}
+			}
+			if ran != tt.want {
+				t.Errorf("renditions step ran = %v, want %v", ran, tt.want)
+			}
+		})
+	}
+}
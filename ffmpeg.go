@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// loadFFmpegGlobalArgs reads FFMPEG_GLOBAL_ARGS, a JSON array of options
+// put before every other ffmpeg argument, e.g. ["-hwaccel", "cuda"] to
+// decode on an NVIDIA GPU. Each entry is passed to ffmpeg as one argument,
+// without any shell splitting.
+func loadFFmpegGlobalArgs() ([]string, error) {
+	val := os.Getenv("FFMPEG_GLOBAL_ARGS")
+	if val == "" {
+		return nil, nil
+	}
+	var args []string
+	err := json.Unmarshal([]byte(val), &args)
+	if err != nil {
+		return nil, fmt.Errorf("FFMPEG_GLOBAL_ARGS must be a JSON array of strings: %w", err)
+	}
+	for i, arg := range args {
+		if arg == "" {
+			return nil, fmt.Errorf("FFMPEG_GLOBAL_ARGS entry %d is empty", i)
+		}
+	}
+	return args, nil
+}
+
+// ffmpegCommand builds an ffmpeg invocation with the configured global
+// options ahead of args.
+func (cfg *apiConfig) ffmpegCommand(ctx context.Context, args ...string) *exec.Cmd {
+	full := make([]string, 0, len(cfg.ffmpegGlobalArgs)+len(args))
+	full = append(full, cfg.ffmpegGlobalArgs...)
+	full = append(full, args...)
+	return exec.CommandContext(ctx, "ffmpeg", full...)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// streamFFmpegToStorage runs ffmpeg with its output on stdout and stores the
+// stream as it is produced, so the result never touches the disk. args are
+// everything but the output, which must be a format that doesn't seek. It
+// returns the number of bytes stored. ffmpeg failures are reported at the
+// faststart stage and upload failures at the store stage.
+func (cfg *apiConfig) streamFFmpegToStorage(ctx context.Context, args []string, key, contentType string) (int64, *processingError) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	var stderr bytes.Buffer
+	cmd := cfg.ffmpegCommand(ctx, append(args, "pipe:1")...)
+	cmd.Stdout = pw
+	cmd.Stderr = &stderr
+	err := cmd.Start()
+	if err != nil {
+		return 0, newProcessingError(stageFaststart, err)
+	}
+
+	// Hand ffmpeg's exit status to the uploader as the end of the stream,
+	// so a failed encode aborts the upload instead of storing a truncated
+	// file. The status is sent before the pipe is closed, so it is always
+	// there by the time the upload sees the failure.
+	ffmpegDone := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			err = encryptionFailure(err, stderr.Bytes())
+		}
+		ffmpegDone <- err
+		pw.CloseWithError(err)
+	}()
+
+	body := &countingReader{r: pr}
+	err = cfg.storage.Put(ctx, key, body, contentType)
+	if err != nil {
+		select {
+		case ffmpegErr := <-ffmpegDone:
+			if ffmpegErr != nil {
+				return 0, newProcessingError(stageFaststart, ffmpegErr)
+			}
+		default:
+			// ffmpeg is still running; stop it, since nothing reads its
+			// output any more
+			cancel()
+			pr.CloseWithError(err)
+			<-ffmpegDone
+		}
+		return 0, newProcessingError(stageStore, err)
+	}
+
+	err = <-ffmpegDone
+	if err != nil {
+		return 0, newProcessingError(stageFaststart, err)
+	}
+	return body.n, nil
+}
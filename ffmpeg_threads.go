@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// videoProbe is what probing a video found out about it.
+type videoProbe struct {
+	// aspect is "16:9", "9:16" or the reduced ratio of anything else
+	aspect string
+	width  int
+	height int
+	// durationSeconds is 0 when ffprobe couldn't tell
+	durationSeconds float64
+	hasAudio        bool
+	// codec is the ffprobe name of the video stream's codec, like "h264"
+	codec string
+	// bitrateKbps is the whole file's, 0 when ffprobe couldn't tell
+	bitrateKbps int64
+	// frameRate is the video stream's average, 0 when ffprobe couldn't
+	// tell
+	frameRate float64
+}
+
+// workUnits measures how much encoding the video takes, in seconds of
+// 1080p video: a 10 second 4K clip counts as 40, a minute of 720p as about
+// 27. Videos of unknown duration count as one second.
+func (p videoProbe) workUnits() float64 {
+	seconds := max(p.durationSeconds, 1)
+	return seconds * float64(p.width*p.height) / (1920 * 1080)
+}
+
+// threadTier gives videos of up to maxUnits work units threads ffmpeg
+// threads.
+type threadTier struct {
+	maxUnits float64
+	threads  int
+}
+
+// parseThreadTiers reads FFMPEG_THREAD_TIERS entries of the form
+// "units:threads", e.g. "60:1,600:2,3600:4". Tiers must be in increasing
+// order of units; videos bigger than the last get its thread count.
+func parseThreadTiers(entries []string) ([]threadTier, error) {
+	tiers := make([]threadTier, 0, len(entries))
+	for _, entry := range entries {
+		unitsStr, threadsStr, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("FFMPEG_THREAD_TIERS entry %q isn't units:threads", entry)
+		}
+		units, err := strconv.ParseFloat(unitsStr, 64)
+		if err != nil || units <= 0 {
+			return nil, fmt.Errorf("FFMPEG_THREAD_TIERS entry %q needs positive units", entry)
+		}
+		threads, err := strconv.Atoi(threadsStr)
+		if err != nil || threads <= 0 {
+			return nil, fmt.Errorf("FFMPEG_THREAD_TIERS entry %q needs a positive thread count", entry)
+		}
+		if len(tiers) > 0 && units <= tiers[len(tiers)-1].maxUnits {
+			return nil, fmt.Errorf("FFMPEG_THREAD_TIERS entries must be in increasing order of units")
+		}
+		tiers = append(tiers, threadTier{maxUnits: units, threads: threads})
+	}
+	return tiers, nil
+}
+
+// threadsFor picks the ffmpeg thread count for a video from the tiers. 0
+// leaves it to ffmpeg, which is what happens without tiers.
+func threadsFor(tiers []threadTier, probe videoProbe) int {
+	if len(tiers) == 0 {
+		return 0
+	}
+	units := probe.workUnits()
+	for _, tier := range tiers {
+		if units <= tier.maxUnits {
+			return tier.threads
+		}
+	}
+	return tiers[len(tiers)-1].threads
+}
+
+// threadBudget shares MAX_FFMPEG_THREADS between the transcodes running at
+// once. Each one takes as many threads as it was given, so a queue of small
+// clips runs side by side while a big file waits for room to run wide.
+type threadBudget struct {
+	mu    sync.Mutex
+	inUse int
+	// released is closed and replaced whenever threads are given back
+	released chan struct{}
+}
+
+func newThreadBudget() *threadBudget {
+	return &threadBudget{released: make(chan struct{})}
+}
+
+// acquire waits until threads fit in a budget of capacity, and returns how
+// many it took. A job wider than the whole budget is cut down to it, and a
+// capacity of 0 means no limit. Like probeLimiter, the capacity is passed
+// on every call so a reload takes effect for the next transcode. Every
+// successful acquire must be released with what it returned.
+func (b *threadBudget) acquire(ctx context.Context, threads, capacity int) (int, error) {
+	threads = max(threads, 1)
+	if capacity > 0 {
+		threads = min(threads, capacity)
+	}
+	for {
+		b.mu.Lock()
+		if capacity <= 0 || b.inUse+threads <= capacity {
+			b.inUse += threads
+			b.mu.Unlock()
+			return threads, nil
+		}
+		released := b.released
+		b.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (b *threadBudget) release(threads int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inUse -= threads
+	close(b.released)
+	b.released = make(chan struct{})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const featureFlagCacheTTL = 15 * time.Second
+
+const (
+	// flagRenditions rolls out rendition generation. Where
+	// GENERATE_RENDITIONS turns it on, only users in the flag's rollout get
+	// renditions; a video's own processing options still win. It is on
+	// for everyone by default, so GENERATE_RENDITIONS alone decides until
+	// an operator lowers the rollout.
+	flagRenditions = "renditions"
+	// flagMRSSFeed publishes a user's ready public videos as a Media RSS
+	// feed. Unlisted and private videos are left out, so it is on for new
+	// installs; an existing install keeps the value it already stored.
+	flagMRSSFeed = "mrss_feed"
+	// flagStorageDetails adds the bucket and object key of the stored
+	// video to upload responses, for integrations that manage their own
+	// CDN or sign their own URLs. It is off so storage internals stay
+	// hidden unless an operator opts users in.
+	flagStorageDetails = "storage_details"
+	// flagStageTimings adds how long each processing step took to upload
+	// responses, for debugging slow uploads.
+	flagStageTimings = "stage_timings"
+)
+
+// defaultFeatureFlags are created on startup if missing so gated behavior
+// keeps working until an operator changes the flag through the admin API.
+// The flag cache also falls back to them while it can't read the table.
+var defaultFeatureFlags = []database.FeatureFlag{
+	{Name: flagRenditions, Enabled: true, RolloutPercentage: 100},
+	{Name: flagMRSSFeed, Enabled: true, RolloutPercentage: 100},
+	{Name: flagStorageDetails, Enabled: false, RolloutPercentage: 100},
+	{Name: flagStageTimings, Enabled: false, RolloutPercentage: 100},
+}
+
+func (cfg *apiConfig) ensureFeatureFlags() error {
+	for _, flag := range defaultFeatureFlags {
+		err := cfg.db.EnsureFeatureFlag(flag.Name, flag.Enabled, flag.RolloutPercentage)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// parseTimestamp accepts either plain seconds ("83.5") or a clock-style
+// "[[hh:]mm:]ss[.fff]" timestamp ("00:01:23.5") and returns seconds.
+func parseTimestamp(ts string) (float64, error) {
+	ts = strings.TrimSpace(ts)
+	if ts == "" {
+		return 0, errors.New("timestamp is empty")
+	}
+
+	parts := strings.Split(ts, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", ts)
+	}
+
+	var seconds float64
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid timestamp %q", ts)
+		}
+		// Only the seconds may be fractional, and minutes and seconds must
+		// stay below 60 when a larger unit is present
+		if i < len(parts)-1 && n != math.Trunc(n) {
+			return 0, fmt.Errorf("invalid timestamp %q", ts)
+		}
+		if i > 0 && n >= 60 {
+			return 0, fmt.Errorf("invalid timestamp %q", ts)
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
+
+// probeDuration returns the container duration in seconds. The input may be
+// a local path or a URL; ffprobe only fetches the byte ranges it needs.
+func probeDuration(ctx context.Context, input string) (float64, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", input)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return 0, err
+	}
+
+	duration, err := strconv.ParseFloat(strings.TrimSpace(out.String()), 64)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't parse duration %q: %w", out.String(), err)
+	}
+	return duration, nil
+}
+
+// extractFrame writes the single frame at the given offset to outputPath as
+// a JPEG. Seeking before -i lets ffmpeg jump straight to the nearest
+// keyframe, so remote inputs only download the ranges around the frame.
+func (cfg *apiConfig) extractFrame(input string, seconds float64, outputPath string) error {
+	cmd := cfg.ffmpegCommand(context.Background(), "-y", "-ss", strconv.FormatFloat(seconds, 'f', 3, 64), "-i", input, "-frames:v", "1", "-q:v", "2", "-f", "image2", outputPath)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("ffmpeg frame extraction failed: %w: %s", err, lastLine(stderr.String()))
+	}
+	return nil
+}
+
+// frameSourceExpiry is how long ffmpeg may read a presigned frame source.
+const frameSourceExpiry = 15 * time.Minute
+
+var errSegmentedWithoutOriginal = errors.New("video is stored as segments and has no original")
+
+// frameSource finds a file ffmpeg can take video's frames from. The stored
+// URL can't be used as is: it may only open signed, and a segmented
+// video's is a manifest whose segments can't be handed to ffmpeg signed,
+// so those are read from their original instead. Where the storage can
+// presign, ffmpeg reads the ranges it needs from a presigned URL; local
+// storage, and storage that can't sign, have the file downloaded to a
+// temp file. cleanup removes that file, and must be called when ffmpeg is
+// done.
+func (cfg *apiConfig) frameSource(ctx context.Context, video database.Video) (src string, cleanup func(), err error) {
+	var key string
+	size := video.SizeBytes
+	switch {
+	case !isSegmentedURL(*video.VideoURL):
+		key, err = cfg.bucketKeyFromURL(*video.VideoURL)
+		if err != nil {
+			return "", nil, err
+		}
+	case video.OriginalKey != nil:
+		key, size = *video.OriginalKey, video.OriginalSizeBytes
+	default:
+		return "", nil, errSegmentedWithoutOriginal
+	}
+
+	if _, local := cfg.storage.(*storage.Local); !local {
+		src, err = cfg.storage.Presign(ctx, key, frameSourceExpiry)
+		if err == nil {
+			return src, func() {}, nil
+		}
+		if !errors.Is(err, storage.ErrCantSign) && !errors.Is(err, storage.ErrNotSupported) {
+			return "", nil, fmt.Errorf("couldn't presign %s: %w", key, err)
+		}
+	}
+
+	if size <= 0 {
+		size = cfg.maxVideoUploadBytes
+	}
+	if !cfg.tempSpace.tryReserve(size) {
+		return "", nil, fmt.Errorf("%w: couldn't reserve %d bytes", errNoTempSpace, size)
+	}
+	path, err := cfg.downloadObject(ctx, key, "tubely-frame-src-*"+filepath.Ext(key))
+	if err != nil {
+		cfg.tempSpace.release(size)
+		return "", nil, err
+	}
+	return path, func() {
+		os.Remove(path)
+		cfg.tempSpace.release(size)
+	}, nil
+}
+
+// downloadObject copies a stored object to a new temp file and returns its
+// path.
+func (cfg *apiConfig) downloadObject(ctx context.Context, key, pattern string) (string, error) {
+	body, err := cfg.storage.Get(ctx, key, nil)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get %s: %w", key, err)
+	}
+	defer body.Close()
+
+	f, err := os.CreateTemp(cfg.tempDir, pattern)
+	if err != nil {
+		return "", fmt.Errorf("couldn't create temp file: %w", err)
+	}
+	_, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("couldn't download %s: %w", key, err)
+	}
+	return f.Name(), nil
+}
+
+// lastLine returns the final non-empty line of ffmpeg's stderr, which is
+// usually the actual error message.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
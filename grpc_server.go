@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/uploadpb"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcUploadServer exposes the upload pipeline to internal services over a
+// gRPC stream. It goes through the same ingestVideo path as the HTTP
+// handler.
+type grpcUploadServer struct {
+	uploadpb.UnimplementedVideoUploadServer
+	cfg *apiConfig
+}
+
+// serveGRPC listens for internal gRPC uploads on the given port.
+func (cfg *apiConfig) serveGRPC(port string) error {
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+	srv := grpc.NewServer()
+	uploadpb.RegisterVideoUploadServer(srv, &grpcUploadServer{cfg: cfg})
+	log.Printf("Serving gRPC uploads on port %s", port)
+	return srv.Serve(lis)
+}
+
+func (s *grpcUploadServer) UploadVideo(stream uploadpb.VideoUpload_UploadVideoServer) (err error) {
+	cfg := s.cfg
+	ctx := cfg.withTunables(stream.Context())
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	// Continue the caller's trace, which travels in the metadata
+	carrier := propagation.HeaderCarrier{}
+	for key, values := range md {
+		for _, v := range values {
+			carrier.Set(key, v)
+		}
+	}
+	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+	ctx, span := tracer.Start(ctx, "grpc UploadVideo", trace.WithSpanKind(trace.SpanKindServer))
+	defer func() {
+		if err != nil {
+			span.SetStatus(otelcodes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	// Internal callers authenticate with the admin API key
+	headers := http.Header{}
+	for _, v := range md.Get("authorization") {
+		headers.Add("Authorization", v)
+	}
+	err = cfg.checkAdminKey(headers)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	first, err := stream.Recv()
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "couldn't read upload metadata: %v", err)
+	}
+	meta := first.GetMetadata()
+	if meta == nil {
+		return status.Error(codes.InvalidArgument, "first message must carry upload metadata")
+	}
+
+	videoID, err := uuid.Parse(meta.GetVideoId())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "invalid video ID")
+	}
+	span.SetAttributes(videoIDAttr(videoID))
+	mediaType, _, err := mime.ParseMediaType(meta.GetContentType())
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "unsupported media type: %s", meta.GetContentType())
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "couldn't get video metadata: %v", err)
+	}
+	if video.ID == uuid.Nil {
+		return status.Errorf(codes.NotFound, "video %s not found", videoID)
+	}
+	if !acceptsMediaType(video.MediaKind, mediaType) {
+		return status.Errorf(codes.InvalidArgument, "unsupported media type for %s: %s", video.MediaKind, mediaType)
+	}
+
+	err = cfg.selectEncodingProfile(&video, meta.GetEncodingProfile())
+	if errors.Is(err, errUnknownEncodingProfile) || errors.Is(err, errEncodingProfileNotSupported) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "couldn't save encoding profile: %v", err)
+	}
+
+	if !cfg.uploads.tryAcquire(video.UserID, cfg.tunables(ctx).maxUploadsPerUser) {
+		return status.Error(codes.ResourceExhausted, "too many uploads in progress for this user")
+	}
+	defer cfg.uploads.release(video.UserID)
+
+	perr := checkProcessingAllowed(video)
+	if perr != nil {
+		return status.Error(perr.grpcCode(), perr.Message)
+	}
+
+	plog := newProcessingLog(ctx, videoID)
+	defer cfg.saveProcessingLog(ctx, plog)
+
+	limit, err := cfg.checkVideoLimit(ctx, video.UserID, videoID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "couldn't check video limit: %v", err)
+	}
+	if limit.reached() {
+		return status.Errorf(codes.ResourceExhausted, "video limit reached: %d of %d videos", limit.VideoCount, limit.MaxVideos)
+	}
+
+	// Uploads count against the owner's quota the same as over HTTP
+	var src io.Reader = &chunkReader{stream: stream, remaining: cfg.maxVideoUploadBytes}
+	remainingQuota, err := cfg.remainingQuota(ctx, video.UserID, videoID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "couldn't check storage quota: %v", err)
+	}
+	if remainingQuota >= 0 {
+		src = newQuotaReader(io.NopCloser(src), remainingQuota)
+	}
+
+	// Streams carry no length up front, so reserve for the largest upload
+	tempBytes := cfg.maxVideoUploadBytes * tempCopiesPerUpload
+	if !cfg.tempSpace.tryReserve(tempBytes) {
+		return status.Error(codes.Unavailable, "server is busy processing other uploads, try again shortly")
+	}
+	defer cfg.tempSpace.release(tempBytes)
+
+	// Versioned videos move on to a new key, the same as over HTTP. Only a
+	// requested version can be rejected
+	video.Version, _ = nextVideoVersion(video, "")
+
+	err = cfg.ingestVideo(ctx, &video, src, plog)
+	if err != nil {
+		var perr *processingError
+		switch {
+		case errors.Is(err, errQuotaExceeded):
+			cfg.notifyUploadRejected(ctx, video, rejectQuotaExceeded, "Upload exceeds remaining storage quota")
+			return status.Error(codes.ResourceExhausted, err.Error())
+		case errors.Is(err, errUploadTooLarge):
+			cfg.notifyUploadRejected(ctx, video, rejectTooLarge, "Video exceeds the upload size limit")
+			return status.Errorf(codes.ResourceExhausted, "%v of %d bytes", err, cfg.maxVideoUploadBytes)
+		case errors.Is(err, errEmptyUpload):
+			cfg.notifyUploadRejected(ctx, video, rejectEmptyFile, "Empty file")
+			return status.Error(codes.InvalidArgument, err.Error())
+		case errors.As(err, &perr):
+			log.Println(perr)
+			if perr.rejectsFile() {
+				cfg.notifyUploadRejected(ctx, video, perr.Code, perr.Message)
+			}
+			return status.Error(perr.grpcCode(), perr.Message)
+		}
+		return status.Errorf(codes.Internal, "couldn't receive upload: %v", err)
+	}
+
+	resp := &uploadpb.UploadVideoResponse{
+		VideoId:          video.ID.String(),
+		SizeBytes:        video.SizeBytes,
+		ProcessingStatus: video.ProcessingStatus,
+	}
+	if video.VideoURL != nil {
+		resp.VideoUrl = *video.VideoURL
+	}
+	if video.ThumbnailURL != nil {
+		resp.ThumbnailUrl = *video.ThumbnailURL
+	}
+	return stream.SendAndClose(resp)
+}
+
+var errUploadTooLarge = errors.New("upload exceeds the size limit")
+
+// chunkReader adapts the chunk messages of an upload stream to an
+// io.Reader, failing once more than remaining bytes arrive.
+type chunkReader struct {
+	stream    uploadpb.VideoUpload_UploadVideoServer
+	buf       []byte
+	remaining int64
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		msg, err := c.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		chunk := msg.GetChunk()
+		c.remaining -= int64(len(chunk))
+		if c.remaining < 0 {
+			return 0, errUploadTooLarge
+		}
+		c.buf = chunk
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// grpcCode maps a processing error onto a gRPC status code, mirroring
+// httpStatus.
+func (e *processingError) grpcCode() codes.Code {
+	switch e.httpStatus() {
+	case http.StatusUnprocessableEntity, http.StatusBadRequest, http.StatusUnsupportedMediaType:
+		return codes.InvalidArgument
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusConflict:
+		return codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	}
+	return codes.Internal
+}
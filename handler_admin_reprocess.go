@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Where a forced reprocess read the video's content from.
+const (
+	reprocessFromOriginal  = "original"
+	reprocessFromProcessed = "processed"
+)
+
+type reprocessResponse struct {
+	// Source is "original" when the kept original upload was processed
+	// again, and "processed" when only the stored file was left to use
+	Source string                        `json:"source"`
+	Video  database.Video                `json:"video"`
+	Steps  []database.ProcessingLogEntry `json:"steps"`
+}
+
+// handlerVideoReprocess runs a video through the whole pipeline again with
+// the current settings, for support to fix a specific broken video
+// whoever owns it. The kept original is used when there is one, otherwise
+// the stored file is. Assets derived from the content are regenerated and
+// a poisoned video is moved back to failed first. Backoff and quotas don't
+// apply. The response carries the processing steps; a failed run answers
+// with the failure's status.
+func (cfg *apiConfig) handlerVideoReprocess(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	source, srcKey, srcSize := reprocessFromOriginal, "", video.OriginalSizeBytes
+	switch {
+	case video.OriginalKey != nil:
+		srcKey = *video.OriginalKey
+	case video.VideoURL != nil && isSegmentedURL(*video.VideoURL):
+		respondWithError(w, http.StatusConflict, "Video is stored as segments and has no original to reprocess", fmt.Errorf("video %s has no original and its processed file is a manifest", video.ID))
+		return
+	case video.VideoURL != nil:
+		source, srcSize = reprocessFromProcessed, video.SizeBytes
+		srcKey, err = cfg.bucketKeyFromURL(*video.VideoURL)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't locate video file", err)
+			return
+		}
+	default:
+		respondWithError(w, http.StatusConflict, "Video has no stored content to reprocess", fmt.Errorf("video %s has neither an original nor a processed file", video.ID))
+		return
+	}
+
+	if video.LifecycleStage == database.StagePoisoned {
+		err = cfg.db.TransitionVideo(&video, database.StageFailed, video.ProcessingError)
+		if err != nil {
+			respondWithError(w, http.StatusConflict, "Couldn't reset poisoned video", err)
+			return
+		}
+	}
+	if !database.CanTransition(video.LifecycleStage, database.StageUploaded) {
+		respondWithError(w, http.StatusConflict, "Video is being processed", fmt.Errorf("video %s is %s", video.ID, video.LifecycleStage))
+		return
+	}
+
+	if srcSize <= 0 {
+		srcSize = cfg.maxVideoUploadBytes
+	}
+	tempBytes := srcSize * tempCopiesPerUpload
+	if !cfg.tempSpace.tryReserve(tempBytes) {
+		w.Header().Set("Retry-After", "30")
+		respondWithError(w, http.StatusServiceUnavailable, "Server is busy processing other uploads, try again shortly", fmt.Errorf("couldn't reserve %d bytes of temp space", tempBytes))
+		return
+	}
+	defer cfg.tempSpace.release(tempBytes)
+
+	src, err := cfg.storage.Get(r.Context(), srcKey, nil)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't read stored video", err)
+		return
+	}
+	defer src.Close()
+
+	// The audio track is cut from the stored file, which is about to be
+	// rewritten. Forgetting the content hash makes the pipeline treat the
+	// content as new, so thumbnail candidates are made again too.
+	cfg.removeAudioTrack(r.Context(), &video)
+	video.SourceHash = ""
+
+	// A versioned video gets a fresh URL so CDNs drop what they cached
+	video.Version, _ = nextVideoVersion(video, "")
+
+	plog := newProcessingLog(r.Context(), videoID)
+	defer cfg.saveProcessingLog(r.Context(), plog)
+
+	// The stored file passed the size limit when it was uploaded. It isn't
+	// capped again: a lower MAX_VIDEO_UPLOAD_BYTES would truncate it, and
+	// the truncated copy would replace the original.
+	err = cfg.ingestVideo(r.Context(), &video, src, plog)
+	var perr *processingError
+	switch {
+	case errors.As(err, &perr):
+		cfg.respondWithReprocessed(w, r, perr.httpStatus(), source, video, plog)
+		return
+	case errors.Is(err, errEmptyUpload):
+		respondWithError(w, http.StatusUnprocessableEntity, "Stored video is empty", err)
+		return
+	case err != nil:
+		respondWithError(w, http.StatusBadGateway, "Couldn't read stored video", err)
+		return
+	}
+
+	cfg.respondWithReprocessed(w, r, http.StatusOK, source, video, plog)
+}
+
+func (cfg *apiConfig) respondWithReprocessed(w http.ResponseWriter, r *http.Request, code int, source string, video database.Video, plog *processingLog) {
+	video, err := cfg.signVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+	respondWithJSON(w, code, reprocessResponse{
+		Source: source,
+		Video:  video,
+		Steps:  plog.entries(),
+	})
+}
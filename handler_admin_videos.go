@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerPoisonedVideosList(w http.ResponseWriter, r *http.Request) {
+	videos, err := cfg.db.GetVideosInStage(database.StagePoisoned)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+	err = cfg.signVideos(r.Context(), videos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, videos)
+}
+
+// adminVideosListLimit caps how many videos an admin list returns.
+const adminVideosListLimit = 500
+
+// handlerNeedsAttentionVideosList lists videos a verification flagged.
+func (cfg *apiConfig) handlerNeedsAttentionVideosList(w http.ResponseWriter, r *http.Request) {
+	videos, err := cfg.db.GetVideosNeedingAttention(adminVideosListLimit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+	err = cfg.signVideos(r.Context(), videos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, videos)
+}
+
+// handlerVideoRetryReset clears a video's failure count and backoff, and
+// moves a poisoned video back to failed so its owner can upload again. Use
+// it once whatever made processing fail has been fixed.
+func (cfg *apiConfig) handlerVideoRetryReset(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	if video.LifecycleStage == database.StagePoisoned {
+		err = cfg.db.TransitionVideo(&video, database.StageFailed, video.ProcessingError)
+		if err != nil {
+			respondWithError(w, http.StatusConflict, "Couldn't reset video", err)
+			return
+		}
+	}
+	err = cfg.db.SetProcessingAttempts(&video, 0, nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reset processing attempts", err)
+		return
+	}
+
+	cfg.respondWithSignedVideo(w, r, http.StatusOK, video)
+}
+
+// handlerAdminVideosList lists every user's videos, a page at a time like
+// the owner's own listing.
+func (cfg *apiConfig) handlerAdminVideosList(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+
+	videos, err := cfg.db.GetAllVideosPage(limit, offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+	err = cfg.signVideos(r.Context(), videos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, videos)
+}
+
+// handlerAdminStorageGet reports what every user's videos take up in
+// storage, broken down like a user's own usage, and how much of the temp
+// space cap is reserved by uploads in progress.
+func (cfg *apiConfig) handlerAdminStorageGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.StorageBreakdown
+		TotalBytes             int64 `json:"total_bytes"`
+		TempSpaceReservedBytes int64 `json:"temp_space_reserved_bytes"`
+		TempSpaceCapBytes      int64 `json:"temp_space_cap_bytes"`
+	}
+
+	breakdown, err := cfg.db.GetStorageBreakdown()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get storage usage", err)
+		return
+	}
+	resp := response{
+		StorageBreakdown: breakdown,
+		TotalBytes:       breakdown.Total(),
+	}
+	resp.TempSpaceReservedBytes, resp.TempSpaceCapBytes = cfg.tempSpace.usage()
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
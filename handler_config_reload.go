@@ -0,0 +1,24 @@
+package main
+
+import "net/http"
+
+// handlerConfigReload does the same as sending the process SIGHUP, and
+// reports which changed settings still need a restart.
+func (cfg *apiConfig) handlerConfigReload(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		RestartRequired []string `json:"restart_required"`
+	}
+
+	changed, err := cfg.reloadConfig()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't reload config", err)
+		return
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		RestartRequired: changed,
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const integrityCheckTimeout = 30 * time.Second
+
+func (cfg *apiConfig) handlerDBIntegrityCheck(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		OK         bool     `json:"ok"`
+		Results    []string `json:"results"`
+		DurationMS int64    `json:"duration_ms"`
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), integrityCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	results, err := cfg.db.IntegrityCheck(ctx)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		respondWithError(w, http.StatusGatewayTimeout, "Integrity check timed out", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't run integrity check", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		OK:         len(results) == 1 && results[0] == "ok",
+		Results:    results,
+		DurationMS: time.Since(start).Milliseconds(),
+	})
+}
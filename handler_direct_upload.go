@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// directUploadPrefix leads the keys clients upload to with a presigned URL,
+// as in "direct-uploads/<videoID>/<random>". A staged file is removed once
+// it has been processed or rejected; abandoned ones are swept up with the
+// leftovers of failed uploads.
+const directUploadPrefix = "direct-uploads/"
+
+type directUploadURLResponse struct {
+	UploadURL string `json:"upload_url"`
+	Method    string `json:"method"`
+	// Headers must be sent with the upload exactly as given, or the
+	// signature won't match
+	Headers   map[string]string `json:"headers"`
+	Key       string            `json:"key"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// directUploadDir is where the video's staged uploads are kept.
+func directUploadDir(videoID uuid.UUID) string {
+	return directUploadPrefix + videoID.String() + "/"
+}
+
+// handlerVideoUploadURL hands the owner a presigned URL to PUT the video's
+// file straight to storage, so the bytes never pass through the server.
+// Once the upload is done, the client calls upload-complete with the
+// returned key to have it processed like a regular upload. Bucket CORS has
+// to allow PUT from the app's origin for browsers to use it.
+func (cfg *apiConfig) handlerVideoUploadURL(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ContentType string `json:"content_type"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(params.ContentType)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse media type", err)
+		return
+	}
+	if !acceptsMediaType(video.MediaKind, mediaType) {
+		respondWithError(w, http.StatusBadRequest, "Unsupported media type", fmt.Errorf("unsupported media type: %s", mediaType))
+		return
+	}
+
+	// Don't hand out a URL for a file that won't be processed
+	perr := checkProcessingAllowed(video)
+	if perr != nil {
+		respondWithProcessingError(w, perr)
+		return
+	}
+	limit, err := cfg.checkVideoLimit(r.Context(), video.UserID, video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video limit", err)
+		return
+	}
+	if limit.reached() {
+		respondWithVideoLimit(w, limit)
+		return
+	}
+
+	name := make([]byte, 16)
+	_, err = rand.Read(name)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate upload key", err)
+		return
+	}
+	key := directUploadDir(video.ID) + base64.RawURLEncoding.EncodeToString(name)
+
+	ttl := cfg.tunables(r.Context()).directUploadURLTTL
+	uploadURL, err := cfg.storage.PresignPut(r.Context(), key, mediaType, ttl)
+	if errors.Is(err, storage.ErrNotSupported) || errors.Is(err, storage.ErrCantSign) {
+		respondWithError(w, http.StatusNotImplemented, "Direct uploads aren't available with this storage backend", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't create upload URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, directUploadURLResponse{
+		UploadURL: uploadURL,
+		Method:    http.MethodPut,
+		Headers:   map[string]string{"Content-Type": mediaType},
+		Key:       key,
+		ExpiresAt: time.Now().Add(ttl).UTC(),
+	})
+}
+
+// handlerVideoUploadComplete processes a file the owner uploaded with a
+// presigned URL, with the same checks and response as a regular upload.
+// The staged file is kept when processing fails for reasons other than the
+// file itself, so the call can be retried.
+func (cfg *apiConfig) handlerVideoUploadComplete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key string `json:"key"`
+		// Version works like the version form field of a regular upload
+		Version int `json:"version"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+	userID := video.UserID
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !strings.HasPrefix(params.Key, directUploadDir(video.ID)) || path.Clean(params.Key) != params.Key {
+		respondWithError(w, http.StatusBadRequest, "Key isn't an upload URL of this video", fmt.Errorf("key %q isn't under %s", params.Key, directUploadDir(video.ID)))
+		return
+	}
+
+	err = cfg.selectEncodingProfile(&video, r.URL.Query().Get("encoding_profile"))
+	if errors.Is(err, errUnknownEncodingProfile) || errors.Is(err, errEncodingProfileNotSupported) {
+		respondWithError(w, http.StatusBadRequest, "Invalid encoding profile", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save encoding profile", err)
+		return
+	}
+	err = cfg.selectOutputFormat(&video, r.URL.Query().Get("output_format"))
+	if errors.Is(err, errUnknownOutputFormat) || errors.Is(err, errOutputFormatNotSupported) || errors.Is(err, errSegmentsNeedCDN) {
+		respondWithError(w, http.StatusBadRequest, "Invalid output format", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save output format", err)
+		return
+	}
+
+	perr := checkProcessingAllowed(video)
+	if perr != nil {
+		if video.NextAttemptAt != nil {
+			retryAfter := int(math.Ceil(time.Until(*video.NextAttemptAt).Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+		}
+		respondWithProcessingError(w, perr)
+		return
+	}
+
+	if !cfg.uploads.tryAcquire(userID, cfg.tunables(r.Context()).maxUploadsPerUser) {
+		w.Header().Set("Retry-After", "30")
+		respondWithError(w, http.StatusTooManyRequests, "Too many uploads in progress, wait for one to finish", fmt.Errorf("user %s is at the concurrent upload limit", userID))
+		return
+	}
+	defer cfg.uploads.release(userID)
+
+	plog := newProcessingLog(r.Context(), video.ID)
+	defer cfg.saveProcessingLog(r.Context(), plog)
+
+	limit, err := cfg.checkVideoLimit(r.Context(), userID, video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video limit", err)
+		return
+	}
+	if limit.reached() {
+		cfg.notifyUploadRejected(r.Context(), video, rejectVideoLimitReached, "Video limit reached")
+		respondWithVideoLimit(w, limit)
+		return
+	}
+
+	staged, err := cfg.storage.Stat(r.Context(), params.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusConflict, "Nothing has been uploaded to the upload URL", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't check uploaded file", err)
+		return
+	}
+
+	// Checks on the file itself reject it for good, so it is removed
+	if staged.Size > cfg.maxVideoUploadBytes {
+		cfg.removeDirectUpload(r.Context(), params.Key)
+		cfg.notifyUploadRejected(r.Context(), video, rejectTooLarge, "Video exceeds the upload size limit")
+		respondWithUploadTooLarge(w, "Video exceeds the upload size limit", cfg.maxVideoUploadBytes, fmt.Errorf("uploaded file is %d bytes", staged.Size))
+		return
+	}
+	remainingQuota, err := cfg.remainingQuota(r.Context(), userID, video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check storage quota", err)
+		return
+	}
+	if remainingQuota >= 0 && staged.Size > remainingQuota {
+		cfg.removeDirectUpload(r.Context(), params.Key)
+		cfg.notifyUploadRejected(r.Context(), video, rejectQuotaExceeded, "Upload exceeds remaining storage quota")
+		respondWithQuotaExceeded(w, fmt.Errorf("uploaded size %d exceeds remaining quota %d for user %s", staged.Size, remainingQuota, userID))
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(staged.ContentType)
+	if err != nil || !acceptsMediaType(video.MediaKind, mediaType) {
+		cfg.removeDirectUpload(r.Context(), params.Key)
+		cfg.notifyUploadRejected(r.Context(), video, rejectUnsupportedMediaType, fmt.Sprintf("Unsupported media type %s", staged.ContentType))
+		respondWithError(w, http.StatusBadRequest, "Unsupported media type", fmt.Errorf("unsupported media type: %s", staged.ContentType))
+		return
+	}
+
+	tempBytes := max(staged.Size, 1) * tempCopiesPerUpload
+	if !cfg.tempSpace.tryReserve(tempBytes) {
+		w.Header().Set("Retry-After", "30")
+		respondWithError(w, http.StatusServiceUnavailable, "Server is busy processing other uploads, try again shortly", fmt.Errorf("couldn't reserve %d bytes of temp space", tempBytes))
+		return
+	}
+	defer cfg.tempSpace.release(tempBytes)
+
+	free, err := diskFreeBytes(cfg.tempDir)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check free disk space", err)
+		return
+	}
+	needed := int64(float64(staged.Size) * cfg.tunables(r.Context()).diskHeadroomFactor)
+	if free < needed {
+		respondWithError(w, http.StatusInsufficientStorage, "Not enough disk space to process this upload", fmt.Errorf("need %d bytes in %s, %d free", needed, cfg.tempDir, free))
+		return
+	}
+
+	requestedVersion := ""
+	if params.Version > 0 {
+		requestedVersion = strconv.Itoa(params.Version)
+	}
+	version, err := nextVideoVersion(video, requestedVersion)
+	if errors.Is(err, errVersionNotIncreasing) {
+		respondWithError(w, http.StatusConflict, "Version must be greater than the video's current version", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid version", err)
+		return
+	}
+	video.Version = version
+
+	created := video.VideoURL == nil
+
+	src, err := cfg.storage.Get(r.Context(), params.Key, nil)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't read uploaded file", err)
+		return
+	}
+	defer src.Close()
+
+	// The staged object can be written again after it was checked, so the
+	// limit is enforced on the read too. Going over it fails the upload
+	// rather than cutting the file short.
+	err = cfg.ingestVideo(r.Context(), &video, http.MaxBytesReader(w, src, cfg.maxVideoUploadBytes), plog)
+	if err != nil {
+		if errors.Is(err, errEmptyUpload) || errors.As(err, new(*http.MaxBytesError)) || errors.As(err, &perr) && perr.rejectsFile() {
+			cfg.removeDirectUpload(r.Context(), params.Key)
+		}
+		cfg.respondToIngestError(w, r, video, err)
+		return
+	}
+	cfg.removeDirectUpload(r.Context(), params.Key)
+
+	cfg.respondWithUploadedVideo(w, r, video, userID, created, plog)
+}
+
+// removeDirectUploads deletes every staged upload of a deleted video,
+// including ones an upload-complete racing the delete hasn't got to.
+func (cfg *apiConfig) removeDirectUploads(ctx context.Context, videoID uuid.UUID) {
+	staged, err := cfg.storage.List(ctx, directUploadDir(videoID))
+	if err != nil {
+		log.Printf("Couldn't list staged uploads of video %s: %v", videoID, err)
+		return
+	}
+	for _, object := range staged {
+		cfg.removeDirectUpload(ctx, object.Key)
+	}
+}
+
+// removeDirectUpload deletes a staged upload that is no longer needed.
+// Failures are only logged; the cleanup sweep catches what is left.
+func (cfg *apiConfig) removeDirectUpload(ctx context.Context, key string) {
+	err := cfg.storage.Delete(ctx, key)
+	if err != nil {
+		log.Printf("Couldn't remove staged upload %s: %v", key, err)
+	}
+}
+
+// removeStaleDirectUploads deletes staged uploads last written before
+// cutoff, which were never completed.
+func (cfg *apiConfig) removeStaleDirectUploads(ctx context.Context, cutoff time.Time) {
+	objects, err := cfg.storage.List(ctx, directUploadPrefix)
+	if err != nil {
+		log.Printf("Couldn't list staged uploads: %v", err)
+		return
+	}
+	for _, obj := range objects {
+		if obj.LastModified.Before(cutoff) {
+			cfg.removeDirectUpload(ctx, obj.Key)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+func (cfg *apiConfig) handlerFeatureFlagsList(w http.ResponseWriter, r *http.Request) {
+	flags, err := cfg.db.GetFeatureFlags()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve feature flags", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, flags)
+}
+
+func (cfg *apiConfig) handlerFeatureFlagUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Enabled           bool `json:"enabled"`
+		RolloutPercentage *int `json:"rollout_percentage"`
+	}
+
+	name := r.PathValue("name")
+	if name == "" {
+		respondWithError(w, http.StatusBadRequest, "Flag name is required", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	rollout := 100
+	if params.RolloutPercentage != nil {
+		rollout = *params.RolloutPercentage
+	}
+	if rollout < 0 || rollout > 100 {
+		respondWithError(w, http.StatusBadRequest, "Rollout percentage must be between 0 and 100", fmt.Errorf("invalid rollout percentage: %d", rollout))
+		return
+	}
+
+	flag, err := cfg.db.UpsertFeatureFlag(name, params.Enabled, rollout)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update feature flag", err)
+		return
+	}
+	cfg.flags.Invalidate()
+
+	respondWithJSON(w, http.StatusOK, flag)
+}
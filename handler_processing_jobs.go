@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// processingJobResponse is a processing job and, once it has succeeded, the
+// receipt a direct or chunked upload answers with.
+type processingJobResponse struct {
+	database.ProcessingJob
+	Video *videoWithAssets `json:"video,omitempty"`
+}
+
+// handlerProcessingJobGet reports how far a queued upload has got. Once the
+// job has succeeded, the video has its new file and the response has the
+// video with its assets.
+func (cfg *apiConfig) handlerProcessingJobGet(w http.ResponseWriter, r *http.Request) {
+	jobID, err := uuid.Parse(r.PathValue("jobID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	job, ok, err := cfg.db.GetProcessingJob(jobID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get processing job", err)
+		return
+	}
+	if !ok || job.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Processing job not found", nil)
+		return
+	}
+
+	resp := processingJobResponse{ProcessingJob: job}
+	if job.Status == database.JobStatusSucceeded {
+		video, err := cfg.db.GetVideo(job.VideoID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video metadata", err)
+			return
+		}
+		// A video deleted since has no receipt
+		if video.ID != uuid.Nil {
+			receipt, err := cfg.uploadReceipt(r.Context(), video, userID)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't build upload receipt", err)
+				return
+			}
+			resp.Video = &receipt
+		}
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerProcessingLogGet(w http.ResponseWriter, r *http.Request) {
+	type upload struct {
+		UploadID  uuid.UUID                     `json:"upload_id"`
+		StartedAt time.Time                     `json:"started_at"`
+		Steps     []database.ProcessingLogEntry `json:"steps"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't view this video's processing log", nil)
+		return
+	}
+
+	entries, err := cfg.db.GetProcessingLog(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get processing log", err)
+		return
+	}
+
+	// Entries arrive grouped by upload, newest upload first
+	uploads := []upload{}
+	for _, entry := range entries {
+		if len(uploads) == 0 || uploads[len(uploads)-1].UploadID != entry.UploadID {
+			uploads = append(uploads, upload{
+				UploadID:  entry.UploadID,
+				StartedAt: entry.StartedAt,
+			})
+		}
+		uploads[len(uploads)-1].Steps = append(uploads[len(uploads)-1].Steps, entry)
+	}
+
+	respondWithJSON(w, http.StatusOK, uploads)
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 )
 
+// handlerRefresh exchanges a refresh token for a new access token and a
+// new refresh token. The presented one stops working, and presenting it
+// again revokes all of the user's refresh tokens.
 func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
 	refreshToken, err := auth.GetBearerToken(r.Header)
@@ -18,24 +24,39 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := cfg.db.GetUserByRefreshToken(refreshToken)
+	nextToken, err := auth.MakeRefreshToken()
 	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
+		return
+	}
+	tun := cfg.tunables(r.Context())
+	rotated, err := cfg.db.RotateRefreshToken(refreshToken, nextToken, time.Now().UTC().Add(tun.refreshTokenTTL))
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token was already used, sign in again", err)
+		return
+	}
+	if errors.Is(err, database.ErrRefreshTokenInvalid) {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
 		return
 	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't rotate refresh token", err)
+		return
+	}
 
 	accessToken, err := auth.MakeJWT(
-		user.ID,
-		cfg.jwtSecret,
-		time.Hour,
+		rotated.UserID,
+		cfg.jwtKeys,
+		tun.accessTokenTTL,
 	)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, response{
-		Token: accessToken,
+		Token:        accessToken,
+		RefreshToken: rotated.Token,
 	})
 }
 
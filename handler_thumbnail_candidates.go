@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func (cfg *apiConfig) handlerThumbnailCandidatesList(w http.ResponseWriter, r *http.Request) {
+	type candidate struct {
+		database.ThumbnailCandidate
+		Selected bool `json:"selected"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	candidates, err := cfg.db.GetThumbnailCandidates(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail candidates", err)
+		return
+	}
+
+	resp := make([]candidate, 0, len(candidates))
+	for _, c := range candidates {
+		selected := video.ThumbnailURL != nil && *video.ThumbnailURL == c.URL
+		c.URL, err = cfg.signURL(r.Context(), c.URL, "")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign thumbnail URL", err)
+			return
+		}
+		resp = append(resp, candidate{
+			ThumbnailCandidate: c,
+			Selected:           selected,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerThumbnailCandidateSelect(w http.ResponseWriter, r *http.Request) {
+	position, err := strconv.Atoi(r.PathValue("position"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid candidate position", err)
+		return
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	candidates, err := cfg.db.GetThumbnailCandidates(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail candidates", err)
+		return
+	}
+
+	for _, c := range candidates {
+		if c.Position != position {
+			continue
+		}
+		cfg.useThumbnail(r.Context(), &video, c.URL)
+		// The owner chose this frame, so a replaced video keeps it
+		video.ThumbnailAuto = false
+		video.ThumbnailSourceHash = c.SourceHash
+		err = cfg.db.UpdateVideo(video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't update video metadata with thumbnail URL", err)
+			return
+		}
+		cfg.respondWithSignedVideo(w, r, http.StatusOK, video)
+		return
+	}
+
+	respondWithError(w, http.StatusNotFound, "Thumbnail candidate not found", nil)
+}
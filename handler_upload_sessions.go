@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// maxUploadChunkSize caps a single chunk of an upload session.
+const maxUploadChunkSize = 64 << 20 // 64 MB
+
+// uploadSessionCleanupInterval is how often expired upload sessions are
+// removed.
+const uploadSessionCleanupInterval = 10 * time.Minute
+
+// uploadSessionDirPrefix leads the name of the temp directory a session's
+// chunks are kept in, one file per chunk number. The directory outlives
+// restarts along with the session's record.
+const uploadSessionDirPrefix = tempFilePrefix + "session-"
+
+type uploadSessionResponse struct {
+	database.UploadSession
+	Chunks        []database.UploadChunk `json:"chunks"`
+	ReceivedBytes int64                  `json:"received_bytes"`
+	MaxChunkBytes int64                  `json:"max_chunk_bytes"`
+}
+
+func newUploadSessionResponse(session database.UploadSession, chunks []database.UploadChunk) uploadSessionResponse {
+	resp := uploadSessionResponse{
+		UploadSession: session,
+		Chunks:        chunks,
+		MaxChunkBytes: maxUploadChunkSize,
+	}
+	for _, chunk := range chunks {
+		resp.ReceivedBytes += chunk.Size
+	}
+	return resp
+}
+
+func (cfg *apiConfig) uploadSessionDir(id uuid.UUID) string {
+	return filepath.Join(cfg.tempDir, uploadSessionDirPrefix+id.String())
+}
+
+// handlerUploadSessionCreate starts an upload of a video's file in
+// numbered chunks, which can be sent in any order and resent after a
+// failure. The file's size is declared up front so the quota is checked
+// before any of it is sent.
+func (cfg *apiConfig) handlerUploadSessionCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		VideoID         uuid.UUID `json:"video_id"`
+		ContentType     string    `json:"content_type"`
+		Size            int64     `json:"size"`
+		EncodingProfile string    `json:"encoding_profile"`
+		OutputFormat    string    `json:"output_format"`
+		Version         int       `json:"version"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Size <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Size must be positive", nil)
+		return
+	}
+	if params.Size > cfg.maxVideoUploadBytes {
+		respondWithUploadTooLarge(w, "Video exceeds the upload size limit", cfg.maxVideoUploadBytes, fmt.Errorf("declared size %d", params.Size))
+		return
+	}
+
+	video, err := cfg.db.GetVideo(params.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video metadata", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You don't have access to this video", nil)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(params.ContentType)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse media type", err)
+		return
+	}
+	if !acceptsMediaType(video.MediaKind, mediaType) {
+		cfg.notifyUploadRejected(r.Context(), video, rejectUnsupportedMediaType, fmt.Sprintf("Unsupported media type %s", mediaType))
+		respondWithError(w, http.StatusBadRequest, "Unsupported media type", fmt.Errorf("unsupported media type: %s", mediaType))
+		return
+	}
+	_, err = nextVideoVersion(video, sessionVersion(params.Version))
+	if errors.Is(err, errVersionNotIncreasing) {
+		respondWithError(w, http.StatusConflict, "Version must be greater than the video's current version", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid version", err)
+		return
+	}
+
+	err = cfg.selectEncodingProfile(&video, params.EncodingProfile)
+	if errors.Is(err, errUnknownEncodingProfile) || errors.Is(err, errEncodingProfileNotSupported) {
+		respondWithError(w, http.StatusBadRequest, "Invalid encoding profile", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save encoding profile", err)
+		return
+	}
+	err = cfg.selectOutputFormat(&video, params.OutputFormat)
+	if errors.Is(err, errUnknownOutputFormat) || errors.Is(err, errOutputFormatNotSupported) || errors.Is(err, errSegmentsNeedCDN) {
+		respondWithError(w, http.StatusBadRequest, "Invalid output format", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save output format", err)
+		return
+	}
+
+	// Don't start receiving a file that won't be processed
+	perr := checkProcessingAllowed(video)
+	if perr != nil {
+		respondWithProcessingError(w, perr)
+		return
+	}
+	limit, err := cfg.checkVideoLimit(r.Context(), userID, video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video limit", err)
+		return
+	}
+	if limit.reached() {
+		cfg.notifyUploadRejected(r.Context(), video, rejectVideoLimitReached, "Video limit reached")
+		respondWithVideoLimit(w, limit)
+		return
+	}
+	remainingQuota, err := cfg.remainingQuota(r.Context(), userID, video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check storage quota", err)
+		return
+	}
+	if remainingQuota >= 0 && params.Size > remainingQuota {
+		cfg.notifyUploadRejected(r.Context(), video, rejectQuotaExceeded, "Upload exceeds remaining storage quota")
+		respondWithQuotaExceeded(w, fmt.Errorf("declared size %d exceeds remaining quota %d for user %s", params.Size, remainingQuota, userID))
+		return
+	}
+
+	session, err := cfg.db.CreateUploadSession(database.UploadSession{
+		UserID:      userID,
+		VideoID:     video.ID,
+		ContentType: mediaType,
+		Size:        params.Size,
+		Version:     params.Version,
+		ExpiresAt:   time.Now().Add(cfg.tunables(r.Context()).uploadSessionExpiry),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload session", err)
+		return
+	}
+	err = os.MkdirAll(cfg.uploadSessionDir(session.ID), 0o700)
+	if err != nil {
+		cfg.discardUploadSession(session.ID)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload session", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, newUploadSessionResponse(session, []database.UploadChunk{}))
+}
+
+// sessionVersion turns a session's version into the form nextVideoVersion
+// takes.
+func sessionVersion(version int) string {
+	if version <= 0 {
+		return ""
+	}
+	return strconv.Itoa(version)
+}
+
+// getOwnedUploadSession authenticates the request and loads the unexpired
+// session named by the sessionID path value, responding with an error and
+// returning false unless the caller owns it.
+func (cfg *apiConfig) getOwnedUploadSession(w http.ResponseWriter, r *http.Request) (database.UploadSession, bool) {
+	sessionID, err := uuid.Parse(r.PathValue("sessionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.UploadSession{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.UploadSession{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.UploadSession{}, false
+	}
+
+	session, ok, err := cfg.db.GetUploadSession(sessionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload session", err)
+		return database.UploadSession{}, false
+	}
+	if !ok || session.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Upload session not found", nil)
+		return database.UploadSession{}, false
+	}
+	if time.Now().After(session.ExpiresAt) {
+		respondWithError(w, http.StatusGone, "Upload session has expired", nil)
+		return database.UploadSession{}, false
+	}
+	return session, true
+}
+
+// handlerUploadSessionGet reports which chunks have arrived, so a client
+// can resume after losing track.
+func (cfg *apiConfig) handlerUploadSessionGet(w http.ResponseWriter, r *http.Request) {
+	session, ok := cfg.getOwnedUploadSession(w, r)
+	if !ok {
+		return
+	}
+	chunks, err := cfg.db.GetUploadChunks(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload chunks", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, newUploadSessionResponse(session, chunks))
+}
+
+// handlerUploadChunkPut stores the body as chunk n of the session,
+// replacing an earlier copy of it. A chunk only counts once all of it has
+// arrived.
+func (cfg *apiConfig) handlerUploadChunkPut(w http.ResponseWriter, r *http.Request) {
+	session, ok := cfg.getOwnedUploadSession(w, r)
+	if !ok {
+		return
+	}
+	number, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || number < 0 {
+		respondWithError(w, http.StatusBadRequest, "Chunk number must be a non-negative integer", err)
+		return
+	}
+	// Every chunk but the last is at least a byte, so no session has more
+	// chunks than bytes
+	if int64(number) >= session.Size {
+		respondWithError(w, http.StatusBadRequest, "Chunk number is past the end of the upload", fmt.Errorf("chunk %d of a %d byte upload", number, session.Size))
+		return
+	}
+
+	if r.ContentLength > 0 {
+		free, err := diskFreeBytes(cfg.tempDir)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check free disk space", err)
+			return
+		}
+		if free < r.ContentLength {
+			respondWithError(w, http.StatusInsufficientStorage, "Not enough disk space to receive this chunk", fmt.Errorf("need %d bytes in %s, %d free", r.ContentLength, cfg.tempDir, free))
+			return
+		}
+	}
+
+	dir := cfg.uploadSessionDir(session.ID)
+	tmp, err := os.CreateTemp(dir, ".chunk-*")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create chunk file", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, http.MaxBytesReader(w, r.Body, maxUploadChunkSize))
+	if errors.As(err, new(*http.MaxBytesError)) {
+		respondWithUploadTooLarge(w, "Chunk exceeds the chunk size limit", maxUploadChunkSize, err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't receive chunk", err)
+		return
+	}
+	if size == 0 {
+		respondWithError(w, http.StatusBadRequest, "Empty chunk", nil)
+		return
+	}
+	err = tmp.Close()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write chunk file", err)
+		return
+	}
+
+	chunks, err := cfg.db.GetUploadChunks(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload chunks", err)
+		return
+	}
+	received := size
+	for _, chunk := range chunks {
+		if chunk.Number != number {
+			received += chunk.Size
+		}
+	}
+	if received > session.Size {
+		respondWithUploadTooLarge(w, "Chunks add up to more than the declared size", session.Size, fmt.Errorf("%d bytes received for a %d byte upload", received, session.Size))
+		return
+	}
+
+	err = os.Rename(tmp.Name(), filepath.Join(dir, strconv.Itoa(number)))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store chunk", err)
+		return
+	}
+	chunk := database.UploadChunk{Number: number, Size: size}
+	err = cfg.db.RecordUploadChunk(session.ID, chunk)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record chunk", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, chunk)
+}
+
+// handlerUploadSessionComplete assembles the chunks, which must be
+// numbered from 0 without gaps and add up to the declared size, and runs
+// the file through the pipeline with the checks and response of a regular
+// upload. The session is kept when processing fails for reasons other than
+// the file itself, so completing can be retried without sending it again.
+func (cfg *apiConfig) handlerUploadSessionComplete(w http.ResponseWriter, r *http.Request) {
+	session, ok := cfg.getOwnedUploadSession(w, r)
+	if !ok {
+		return
+	}
+	userID := session.UserID
+
+	chunks, err := cfg.db.GetUploadChunks(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload chunks", err)
+		return
+	}
+	var received int64
+	for i, chunk := range chunks {
+		if chunk.Number != i {
+			respondWithError(w, http.StatusConflict, fmt.Sprintf("Chunk %d is missing", i), nil)
+			return
+		}
+		received += chunk.Size
+	}
+	if received != session.Size {
+		respondWithError(w, http.StatusConflict, "Chunks don't add up to the declared size", fmt.Errorf("%d of %d bytes received", received, session.Size))
+		return
+	}
+
+	video, err := cfg.db.GetVideo(session.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video metadata", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		cfg.discardUploadSession(session.ID)
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	if !cfg.uploads.tryAcquire(userID, cfg.tunables(r.Context()).maxUploadsPerUser) {
+		w.Header().Set("Retry-After", "30")
+		respondWithError(w, http.StatusTooManyRequests, "Too many uploads in progress, wait for one to finish", fmt.Errorf("user %s is at the concurrent upload limit", userID))
+		return
+	}
+	defer cfg.uploads.release(userID)
+
+	tempBytes := session.Size * tempCopiesPerUpload
+	if !cfg.tempSpace.tryReserve(tempBytes) {
+		w.Header().Set("Retry-After", "30")
+		respondWithError(w, http.StatusServiceUnavailable, "Server is busy processing other uploads, try again shortly", fmt.Errorf("couldn't reserve %d bytes of temp space", tempBytes))
+		return
+	}
+	defer cfg.tempSpace.release(tempBytes)
+
+	free, err := diskFreeBytes(cfg.tempDir)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check free disk space", err)
+		return
+	}
+	needed := int64(float64(session.Size) * cfg.tunables(r.Context()).diskHeadroomFactor)
+	if free < needed {
+		respondWithError(w, http.StatusInsufficientStorage, "Not enough disk space to process this upload", fmt.Errorf("need %d bytes in %s, %d free", needed, cfg.tempDir, free))
+		return
+	}
+
+	perr := checkProcessingAllowed(video)
+	if perr != nil {
+		respondWithProcessingError(w, perr)
+		return
+	}
+	version, err := nextVideoVersion(video, sessionVersion(session.Version))
+	if errors.Is(err, errVersionNotIncreasing) {
+		respondWithError(w, http.StatusConflict, "Version must be greater than the video's current version", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid version", err)
+		return
+	}
+	video.Version = version
+	created := video.VideoURL == nil
+
+	plog := newProcessingLog(r.Context(), video.ID)
+	defer cfg.saveProcessingLog(r.Context(), plog)
+	defer cfg.followSteps(video.ID, plog)()
+
+	receiveStep := plog.start(stageReceive, 0)
+	assembled, hash, err := cfg.assembleUploadChunks(session, chunks)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't assemble upload", err)
+		return
+	}
+	defer os.Remove(assembled)
+	receiveStep.finish(session.Size, fmt.Sprintf("assembled %d chunks", len(chunks)))
+
+	err = cfg.processReceivedVideo(r.Context(), &video, assembled, session.Size, hash, plog)
+	if err != nil {
+		if errors.As(err, &perr) && perr.rejectsFile() {
+			cfg.discardUploadSession(session.ID)
+		}
+		cfg.respondToIngestError(w, r, video, err)
+		return
+	}
+	cfg.discardUploadSession(session.ID)
+
+	cfg.respondWithUploadedVideo(w, r, video, userID, created, plog)
+}
+
+// assembleUploadChunks concatenates the chunks into a temp file, checking
+// each is still the size it was recorded at, and returns the file's path
+// and content hash.
+func (cfg *apiConfig) assembleUploadChunks(session database.UploadSession, chunks []database.UploadChunk) (string, string, error) {
+	dst, err := os.CreateTemp(cfg.tempDir, "tubely-upload-*.mp4")
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't create temp file: %w", err)
+	}
+	defer dst.Close()
+
+	hash := cfg.contentHash.New()
+	out := io.MultiWriter(dst, hash)
+	dir := cfg.uploadSessionDir(session.ID)
+	for _, chunk := range chunks {
+		err := appendChunk(out, filepath.Join(dir, strconv.Itoa(chunk.Number)), chunk.Size)
+		if err != nil {
+			os.Remove(dst.Name())
+			return "", "", err
+		}
+	}
+	err = dst.Close()
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", "", fmt.Errorf("couldn't write temp file: %w", err)
+	}
+	return dst.Name(), hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func appendChunk(out io.Writer, path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	written, err := io.Copy(out, f)
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return fmt.Errorf("chunk %s is %d bytes, %d were recorded", filepath.Base(path), written, size)
+	}
+	return nil
+}
+
+// handlerUploadSessionDelete abandons a session and removes its chunks.
+func (cfg *apiConfig) handlerUploadSessionDelete(w http.ResponseWriter, r *http.Request) {
+	session, ok := cfg.getOwnedUploadSession(w, r)
+	if !ok {
+		return
+	}
+	err := cfg.db.DeleteUploadSession(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload session", err)
+		return
+	}
+	cfg.removeUploadSessionDir(session.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// discardUploadSession removes a session that is done with, logging
+// failures.
+func (cfg *apiConfig) discardUploadSession(id uuid.UUID) {
+	err := cfg.db.DeleteUploadSession(id)
+	if err != nil {
+		log.Printf("Couldn't delete upload session %s: %v", id, err)
+	}
+	cfg.removeUploadSessionDir(id)
+}
+
+func (cfg *apiConfig) removeUploadSessionDir(id uuid.UUID) {
+	err := os.RemoveAll(cfg.uploadSessionDir(id))
+	if err != nil {
+		log.Printf("Couldn't remove chunks of upload session %s: %v", id, err)
+	}
+}
+
+// cleanExpiredUploadSessions periodically removes sessions past their
+// expiry, along with their chunks, until ctx is cancelled.
+func (cfg *apiConfig) cleanExpiredUploadSessions(ctx context.Context) {
+	ticker := time.NewTicker(uploadSessionCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		sessions, err := cfg.db.GetExpiredUploadSessions(time.Now())
+		if err != nil {
+			log.Printf("Couldn't list expired upload sessions: %v", err)
+		}
+		for _, session := range sessions {
+			cfg.discardUploadSession(session.ID)
+		}
+		if len(sessions) > 0 {
+			log.Printf("Removed %d expired upload sessions", len(sessions))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
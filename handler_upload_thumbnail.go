@@ -1,19 +1,24 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
 	"os"
-	"path/filepath"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+// defaultMaxThumbnailUploadBytes is MAX_THUMBNAIL_UPLOAD_BYTES when it
+// isn't set.
+const defaultMaxThumbnailUploadBytes = 10 << 20 // 10 MB
+
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 
@@ -29,99 +34,246 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
-
-	// Set max memory to 10 MB
-	const maxMemory = 10 << 20 // 10 MB
-
-	// Parse the form
-	err = r.ParseMultipartForm(maxMemory)
+	// Get the video's metadata
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse multipart form", err)
+		respondWithError(w, http.StatusNotFound, "Couldn't get video metadata", err)
 		return
 	}
 
+	// Check ownership of the video before reading the upload
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You don't have permission to upload a thumbnail for this video", nil)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxThumbnailUploadBytes)
+
 	// Extract the file
-	file, header, err := r.FormFile("thumbnail")
+	part, err := nextFormFile(r, "thumbnail", cfg.tunables(r.Context()).multipartMaxHeaderBytes, nil)
+	if errors.As(err, new(*http.MaxBytesError)) {
+		respondWithUploadTooLarge(w, "Thumbnail exceeds the upload size limit", cfg.maxThumbnailUploadBytes, err)
+		return
+	}
+	if errors.Is(err, errMultipartHeaderTooLarge) {
+		respondWithError(w, http.StatusBadRequest, "Multipart part headers are too large", err)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Couldn't get thumbnail file", err)
 		return
 	}
-	defer file.Close()
+	defer part.Close()
 
-	// Get the media type from the form file's Content-Type header
+	file := bufio.NewReader(part)
+	if _, err := file.Peek(1); errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusUnprocessableEntity, "Empty file", fmt.Errorf("empty thumbnail upload for video %s", videoID))
+		return
+	}
 
-	mediaType := header.Header.Get("Content-Type")
+	// The extension comes from the content, whatever the form header says
+	body, detected, err := sniffThumbnail(file)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read thumbnail", err)
+		return
+	}
+	ext, ok := thumbnailExtensions[detected]
+	if !ok {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Thumbnail content isn't a JPEG or PNG image", fmt.Errorf("%w: content is %s", errContentMismatch, detected))
+		return
+	}
 
-	// Use the media type to determine the file extension
-	exts, err := mime.ExtensionsByType(mediaType)
-	if err != nil || len(exts) == 0 {
-		respondWithError(w, http.StatusBadRequest, "Unsupported media type", fmt.Errorf("unsupported media type: %s", mediaType))
+	// With STRICT_MIME on, the declared type has to match the content too
+	if cfg.strictMIME {
+		mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Unsupported media type", err)
+			return
+		}
+		body, err = checkImageFormat(body, mediaType)
+		if err != nil {
+			respondWithError(w, http.StatusUnprocessableEntity, "Thumbnail content doesn't match its media type", err)
+			return
+		}
+	}
+
+	// Catch a landscape thumbnail on a portrait video, or the reverse,
+	// before it is stored
+	var mismatch *aspectMismatch
+	aspectCheck := cfg.tunables(r.Context()).thumbnailAspectCheck
+	if aspectCheck != thumbnailAspectOff {
+		body, mismatch = checkThumbnailAspect(video, body)
+		if mismatch != nil && aspectCheck == thumbnailAspectReject {
+			respondWithAspectMismatch(w, mismatch)
+			return
+		}
+	}
+
+	thumbnailURL, err := cfg.saveThumbnail(r.Context(), body, ext)
+	if errors.As(err, new(*http.MaxBytesError)) {
+		respondWithUploadTooLarge(w, "Thumbnail exceeds the upload size limit", cfg.maxThumbnailUploadBytes, err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail", err)
+		return
+	}
+
+	// Update the record in the database
+	cfg.useThumbnail(r.Context(), &video, thumbnailURL)
+	video.ThumbnailAuto = false
+	video.ThumbnailSourceHash = ""
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video metadata with thumbnail URL", err)
 		return
 	}
-	ext := exts[0] // Use the first extension
 
-	if ext != ".jpg" && ext != ".png" {
-		respondWithError(w, http.StatusBadRequest, "Unsupported file type", fmt.Errorf("unsupported file type: %s", ext))
+	video, err = cfg.signVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+	cfg.setUploadResponseHeaders(w, video, video.ThumbnailURL, "preview")
+	respondWithJSON(w, http.StatusOK, struct {
+		database.Video
+		// AspectMismatch is set when THUMBNAIL_ASPECT_CHECK is "warn" and
+		// the thumbnail's orientation doesn't match the video's
+		AspectMismatch *aspectMismatch `json:"aspect_mismatch,omitempty"`
+	}{
+		Video:          video,
+		AspectMismatch: mismatch,
+	})
+}
+
+// handlerVideoThumbnail sets a video's thumbnail either from an uploaded
+// image (multipart, same as handlerUploadThumbnail) or from a frame of the
+// already-uploaded video given as {"timestamp": "00:01:23.5"}.
+func (cfg *apiConfig) handlerVideoThumbnail(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		cfg.handlerUploadThumbnail(w, r)
+		return
+	}
+
+	type parameters struct {
+		Timestamp string `json:"timestamp"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	seconds, err := parseTimestamp(params.Timestamp)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid timestamp", err)
 		return
 	}
 
-	// Get the video's metadata
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Couldn't get video metadata", err)
 		return
 	}
-
-	// Check ownership of the video
 	if video.UserID != userID {
 		respondWithError(w, http.StatusUnauthorized, "You don't have permission to upload a thumbnail for this video", nil)
 		return
 	}
-	// Use crypto/rand.Read to fill a 32 byte slice with random bytes
-	key := make([]byte, 32)
-	_, err = rand.Read(key)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random bytes for thumbnail filename", err)
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, "Video file hasn't been uploaded yet", nil)
 		return
 	}
-	// Convert to random base64 string
-	randomName := base64.RawURLEncoding.EncodeToString(key)
 
-	// Create the full path
-	assetPath := filepath.Join(cfg.assetsRoot, fmt.Sprintf("%s%s", randomName, ext))
-	fmt.Println("Saving thumbnail to", assetPath)
+	src, cleanup, err := cfg.frameSource(r.Context(), video)
+	switch {
+	case errors.Is(err, errSegmentedWithoutOriginal):
+		respondWithError(w, http.StatusConflict, "Frames can't be taken from a video stored as segments without its original", err)
+		return
+	case errors.Is(err, errNoTempSpace):
+		w.Header().Set("Retry-After", "30")
+		respondWithError(w, http.StatusServiceUnavailable, "Server is busy processing other uploads, try again shortly", err)
+		return
+	case err != nil:
+		respondWithError(w, http.StatusBadGateway, "Couldn't read video file", err)
+		return
+	}
+	defer cleanup()
+
+	probe, err := cfg.localTranscoder.probeVideo(r.Context(), src)
+	if err == nil && probe.durationSeconds <= 0 {
+		err = errors.New("ffprobe reported no duration")
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video duration", err)
+		return
+	}
+	if seconds >= probe.durationSeconds {
+		respondWithError(w, http.StatusUnprocessableEntity, "Timestamp is past the end of the video", fmt.Errorf("timestamp %.3fs is outside video duration %.3fs", seconds, probe.durationSeconds))
+		return
+	}
 
-	// Use os.Create to create the file
-	dst, err := os.Create(assetPath)
+	frameFile, err := os.CreateTemp("", "tubely-frame-*.jpg")
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create thumbnail file", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
 		return
 	}
-	defer dst.Close()
+	defer os.Remove(frameFile.Name())
+	defer frameFile.Close()
 
-	// Copy the file data to the destination file
-	_, err = io.Copy(dst, file)
+	err = cfg.localTranscoder.extractFrame(r.Context(), src, seconds, frameFile.Name())
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't write thumbnail file", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't extract frame", err)
 		return
 	}
 
-	thumbnailURL := fmt.Sprintf("http://localhost:%s/assets/%s%s", cfg.port, randomName, ext)
+	thumbnailURL, err := cfg.saveThumbnail(r.Context(), frameFile, ".jpg")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail", err)
+		return
+	}
 
-	// Update the record in the database
-	video.ThumbnailURL = &thumbnailURL
+	cfg.useThumbnail(r.Context(), &video, thumbnailURL)
+	video.ThumbnailAuto = false
+	video.ThumbnailSourceHash = video.SourceHash
 	err = cfg.db.UpdateVideo(video)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't update video metadata with thumbnail URL", err)
 		return
 	}
 
+	video, err = cfg.signVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+	cfg.setUploadResponseHeaders(w, video, video.ThumbnailURL, "preview")
 	respondWithJSON(w, http.StatusOK, video)
 }
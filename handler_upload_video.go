@@ -1,31 +1,38 @@
 package main
 
 import (
+	"context"
 	// Standard library imports
 	"bytes"
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"math"
 	"mime"
 	"net/http"
-	"os"
+	"net/url"
 	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 
 	// Third-party imports
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
+// handlerUploadVideo receives a video's file and queues it for processing,
+// responding 202 with the processing job once the file is in. The job is at
+// /api/jobs/{jobID}, named by Location, and the video's status and progress
+// follow it through the pipeline. Because the file isn't processed yet, the
+// response can't be the 201 with the video at Location and the receipt of
+// its assets that a direct or chunked upload answers with: the job gives
+// the receipt once it has succeeded.
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
 
-	// Set upload limit of 1 GB
-	const maxUploadSize = 1 << 30 // 1 GB
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	// Cap the upload at MAX_VIDEO_UPLOAD_BYTES
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxVideoUploadBytes)
 
 	// Extract the videoID from the URL path
 	videoIDString := r.PathValue("videoID")
@@ -44,14 +51,12 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	fmt.Println("\nUploading video for video", videoID, "by user", userID)
-
 	// Get the video metadata from the database
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
@@ -65,168 +70,430 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Parse the uploaded file from the form data
-	file, header, err := r.FormFile("video")
+	err = cfg.selectEncodingProfile(&video, r.URL.Query().Get("encoding_profile"))
+	if errors.Is(err, errUnknownEncodingProfile) || errors.Is(err, errEncodingProfileNotSupported) {
+		respondWithError(w, http.StatusBadRequest, "Invalid encoding profile", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't get video file from form data", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save encoding profile", err)
+		return
+	}
+	err = cfg.selectOutputFormat(&video, r.URL.Query().Get("output_format"))
+	if errors.Is(err, errUnknownOutputFormat) || errors.Is(err, errOutputFormatNotSupported) || errors.Is(err, errSegmentsNeedCDN) {
+		respondWithError(w, http.StatusBadRequest, "Invalid output format", err)
 		return
 	}
-	defer file.Close()
-
-	// Validate the media type and get the file extension using mime.ParseMediaType
-	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse media type", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save output format", err)
 		return
 	}
 
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Unsupported media type", fmt.Errorf("unsupported media type: %s", mediaType))
+	// Don't spend time receiving a file that won't be processed
+	perr := checkProcessingAllowed(video)
+	if perr != nil {
+		if video.NextAttemptAt != nil {
+			retryAfter := int(math.Ceil(time.Until(*video.NextAttemptAt).Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+		}
+		respondWithProcessingError(w, perr)
 		return
 	}
 
-	// Save the uploaded file to a temporary location on disk
-	tempFile, err := os.CreateTemp("", "tubely-upload-*.mp4")
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
+	// Keep any one user from monopolizing processing capacity
+	if !cfg.uploads.tryAcquire(userID, cfg.tunables(r.Context()).maxUploadsPerUser) {
+		w.Header().Set("Retry-After", "30")
+		respondWithError(w, http.StatusTooManyRequests, "Too many uploads in progress, wait for one to finish", fmt.Errorf("user %s is at the concurrent upload limit", userID))
 		return
 	}
-	defer os.Remove(tempFile.Name()) // Clean up temp file after processing
-	defer tempFile.Close()
+	defer cfg.uploads.release(userID)
 
-	// Copy the uploaded file to the temporary file
-	_, err = io.Copy(tempFile, file)
+	// Queued jobs count too, or a user could fill the queue while each
+	// request returns early
+	activeJobs, err := cfg.db.CountActiveProcessingJobs(userID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't copy uploaded file to temp file", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count processing jobs", err)
+		return
+	}
+	if maxJobs := cfg.tunables(r.Context()).maxUploadsPerUser; maxJobs > 0 && activeJobs >= maxJobs {
+		w.Header().Set("Retry-After", "30")
+		respondWithError(w, http.StatusTooManyRequests, "Too many uploads waiting to be processed, wait for one to finish", fmt.Errorf("user %s has %d processing jobs", userID, activeJobs))
 		return
 	}
 
-	aspectRatio, err := getVideoAspectRatio(tempFile.Name())
+	// Record the pipeline steps so the owner can see what happened to
+	// their file
+	plog := newProcessingLog(r.Context(), videoID)
+	defer cfg.saveProcessingLog(r.Context(), plog)
 
+	// A user at MAX_VIDEOS_PER_USER can still replace the files they have
+	limit, err := cfg.checkVideoLimit(r.Context(), userID, videoID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get video aspect ratio", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video limit", err)
+		return
+	}
+	if limit.reached() {
+		cfg.notifyUploadRejected(r.Context(), video, rejectVideoLimitReached, "Video limit reached")
+		respondWithVideoLimit(w, limit)
 		return
 	}
-	var aspectString string
 
-	switch aspectRatio {
-	case "16:9":
-		aspectString = "landscape"
-	case "9:16":
-		aspectString = "portrait"
-	default:
-		aspectString = "other"
+	// Reject uploads that can't fit in the user's remaining quota before
+	// reading the body, and cap the body at the remaining quota otherwise
+	remainingQuota, err := cfg.remainingQuota(r.Context(), userID, videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check storage quota", err)
+		return
+	}
+	if remainingQuota >= 0 {
+		if r.ContentLength > remainingQuota {
+			cfg.notifyUploadRejected(r.Context(), video, rejectQuotaExceeded, "Upload exceeds remaining storage quota")
+			respondWithQuotaExceeded(w, fmt.Errorf("content length %d exceeds remaining quota %d for user %s", r.ContentLength, remainingQuota, userID))
+			return
+		}
+		r.Body = newQuotaReader(r.Body, remainingQuota)
 	}
 
-	// Reset the file pointer to the beginning of the file for future use
-	_, err = tempFile.Seek(0, io.SeekStart)
+	// Reserve temp space for every copy of the upload up front. Without a
+	// Content-Length assume the largest allowed upload.
+	uploadSize := r.ContentLength
+	if uploadSize < 0 {
+		uploadSize = cfg.maxVideoUploadBytes
+	}
+	tempBytes := uploadSize * tempCopiesPerUpload
+	if !cfg.tempSpace.tryReserve(tempBytes) {
+		w.Header().Set("Retry-After", "30")
+		respondWithError(w, http.StatusServiceUnavailable, "Server is busy processing other uploads, try again shortly", fmt.Errorf("couldn't reserve %d bytes of temp space", tempBytes))
+		return
+	}
+	defer cfg.tempSpace.release(tempBytes)
+
+	// Make sure the disk can actually hold the upload and its intermediate
+	// files, since space may be used by things outside this process
+	if r.ContentLength > 0 {
+		free, err := diskFreeBytes(cfg.tempDir)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check free disk space", err)
+			return
+		}
+		needed := int64(float64(r.ContentLength) * cfg.tunables(r.Context()).diskHeadroomFactor)
+		if free < needed {
+			respondWithError(w, http.StatusInsufficientStorage, "Not enough disk space to process this upload", fmt.Errorf("need %d bytes in %s, %d free", needed, cfg.tempDir, free))
+			return
+		}
+	}
+
+	// Stream the file part straight into processing instead of spooling
+	// the whole form to disk first
+	fields := url.Values{}
+	file, err := nextFormFile(r, "video", cfg.tunables(r.Context()).multipartMaxHeaderBytes, fields)
+	if errors.Is(err, errQuotaExceeded) {
+		cfg.notifyUploadRejected(r.Context(), video, rejectQuotaExceeded, "Upload exceeds remaining storage quota")
+		respondWithQuotaExceeded(w, err)
+		return
+	}
+	if errors.As(err, new(*http.MaxBytesError)) {
+		cfg.notifyUploadRejected(r.Context(), video, rejectTooLarge, "Video exceeds the upload size limit")
+		respondWithUploadTooLarge(w, "Video exceeds the upload size limit", cfg.maxVideoUploadBytes, err)
+		return
+	}
+	if errors.Is(err, errMultipartHeaderTooLarge) {
+		cfg.notifyUploadRejected(r.Context(), video, rejectMalformedUpload, "Multipart part headers are too large")
+		respondWithError(w, http.StatusBadRequest, "Multipart part headers are too large", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't reset file pointer", err)
+		cfg.notifyUploadRejected(r.Context(), video, rejectMalformedUpload, "Couldn't get video file from form data")
+		respondWithError(w, http.StatusBadRequest, "Couldn't get video file from form data", err)
 		return
 	}
+	defer file.Close()
 
-	// Process the video for fast start to optimize for streaming
-	processedFilePath, err := processVideoForFastStart(tempFile.Name())
+	// Validate the media type and get the file extension using mime.ParseMediaType
+	mediaType, _, err := mime.ParseMediaType(file.Header.Get("Content-Type"))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't process video for fast start", err)
+		cfg.notifyUploadRejected(r.Context(), video, rejectUnsupportedMediaType, "Couldn't parse media type")
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse media type", err)
 		return
 	}
-	defer os.Remove(processedFilePath) // Clean up processed file after uploading
 
-	// Create the video URL that will be stored in the database and returned to the client.
-	s3Key := fmt.Sprintf("%s/%s.mp4", aspectString, videoID.String())
-	videoURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, s3Key)
-	fmt.Printf("\nVideoURL = %s", videoURL)
-	
+	if !acceptsMediaType(video.MediaKind, mediaType) {
+		cfg.notifyUploadRejected(r.Context(), video, rejectUnsupportedMediaType, fmt.Sprintf("Unsupported media type %s", mediaType))
+		respondWithError(w, http.StatusBadRequest, "Unsupported media type", fmt.Errorf("unsupported media type: %s", mediaType))
+		return
+	}
 
-	// Open the processed file for reading
-	processedFile, err := os.Open(processedFilePath)
+	// A version sent ahead of the file goes into the stored file's key
+	version, err := nextVideoVersion(video, fields.Get("version"))
+	if errors.Is(err, errVersionNotIncreasing) {
+		respondWithError(w, http.StatusConflict, "Version must be greater than the video's current version", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't open processed video file", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid version", err)
 		return
 	}
-	defer processedFile.Close()
+	video.Version = version
 
-	_, err = cfg.s3Client.PutObject(context.Background(), &s3.PutObjectInput{
-		Bucket:      aws.String(cfg.s3Bucket),
-		Key:         aws.String(s3Key),
-		Body:        processedFile,
-		ContentType: aws.String(mediaType),
-	})
+	job, err := cfg.enqueueVideo(&video, file, plog)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't upload video to S3", err)
+		cfg.respondToIngestError(w, r, video, err)
 		return
 	}
-	// Update the database with the video URL
-	video.VideoURL = &videoURL
-	err = cfg.db.UpdateVideo(video)
+
+	cfg.setQueuedUploadResponseHeaders(w, video, job)
+	respondWithJSON(w, http.StatusAccepted, job)
+}
+
+// respondToIngestError answers an upload whose file couldn't be received
+// or processed, notifying the rejected-upload webhook when the file itself
+// was the problem.
+func (cfg *apiConfig) respondToIngestError(w http.ResponseWriter, r *http.Request, video database.Video, err error) {
+	var perr *processingError
+	switch {
+	case errors.Is(err, errQuotaExceeded):
+		cfg.notifyUploadRejected(r.Context(), video, rejectQuotaExceeded, "Upload exceeds remaining storage quota")
+		respondWithQuotaExceeded(w, err)
+	case errors.As(err, new(*http.MaxBytesError)):
+		cfg.notifyUploadRejected(r.Context(), video, rejectTooLarge, "Video exceeds the upload size limit")
+		respondWithUploadTooLarge(w, "Video exceeds the upload size limit", cfg.maxVideoUploadBytes, err)
+	case errors.Is(err, errEmptyUpload):
+		cfg.notifyUploadRejected(r.Context(), video, rejectEmptyFile, "Empty file")
+		respondWithError(w, http.StatusUnprocessableEntity, "Empty file", fmt.Errorf("empty video upload for video %s", video.ID))
+	case errors.As(err, &perr):
+		if perr.rejectsFile() {
+			cfg.notifyUploadRejected(r.Context(), video, perr.Code, perr.Message)
+		}
+		respondWithProcessingError(w, perr)
+	default:
+		respondWithError(w, http.StatusInternalServerError, "Couldn't receive uploaded file", err)
+	}
+}
+
+// respondWithUploadedVideo responds with the processed video and a receipt
+// of everything generated for it: 201 when the upload created the video's
+// media, 200 when it replaced it.
+func (cfg *apiConfig) respondWithUploadedVideo(w http.ResponseWriter, r *http.Request, video database.Video, userID uuid.UUID, created bool, plog *processingLog) {
+	resp, err := cfg.uploadReceipt(r.Context(), video, userID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video metadata with video URL", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build upload receipt", err)
 		return
 	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	cfg.setUploadResponseHeaders(w, resp.Video, resp.Video.VideoURL, "enclosure")
+	if cfg.flags.Enabled(flagStageTimings, userID) {
+		resp.StageTimings = plog.timings()
+	}
+	respondWithJSON(w, status, resp)
+}
 
-	// Respond with the signed video URL
-	respondWithJSON(w, http.StatusOK, video)
+// uploadReceipt is the processed video, signed, with everything generated
+// for it.
+func (cfg *apiConfig) uploadReceipt(ctx context.Context, video database.Video, userID uuid.UUID) (videoWithAssets, error) {
+	assets, err := cfg.buildVideoAssets(ctx, video)
+	if err != nil {
+		return videoWithAssets{}, fmt.Errorf("couldn't list video assets: %w", err)
+	}
+	if cfg.flags.Enabled(flagStorageDetails, userID) {
+		err = cfg.addStorageLocation(&assets, video)
+		if err != nil {
+			return videoWithAssets{}, fmt.Errorf("couldn't locate video file: %w", err)
+		}
+	}
+	signed, err := cfg.signVideo(ctx, video)
+	if err != nil {
+		return videoWithAssets{}, fmt.Errorf("couldn't sign video URLs: %w", err)
+	}
+	return videoWithAssets{
+		Video:  signed,
+		Assets: assets,
+	}, nil
 }
 
-func getVideoAspectRatio(filePath string) (string, error) {
-	// Run ffprobe to get the video's width and height
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
+// probeVideoFile reads the video's dimensions and duration and classifies
+// its aspect ratio.
+func probeVideoFile(ctx context.Context, filePath string) (videoProbe, error) {
+	// Run ffprobe to get the video's width, height and duration
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_streams", "-show_format", filePath)
 
 	// Set Stdout to a pointer to a new bytes.Buffer
-	var out bytes.Buffer
+	var out, stderr bytes.Buffer
 	cmd.Stdout = &out
+	cmd.Stderr = &stderr
 	err := cmd.Run()
 	if err != nil {
-		return "", err
+		return videoProbe{}, encryptionFailure(err, stderr.Bytes())
 	}
 
 	// Unmarshal the output into a struct
 	type FFProbeOutput struct {
-		Streams []struct {
-			Width  int `json:"width"`
-			Height int `json:"height"`
-		} `json:"streams"`
+		Streams []ffprobeStream `json:"streams"`
+		Format  struct {
+			Duration string `json:"duration"`
+			BitRate  string `json:"bit_rate"`
+		} `json:"format"`
 	}
 
 	var ffprobeOutput FFProbeOutput
 	err = json.Unmarshal(out.Bytes(), &ffprobeOutput)
 	if err != nil {
-		return "", err
+		return videoProbe{}, err
+	}
+
+	// Protected files probe fine but can't be decoded, so turn them away
+	// here rather than with an opaque ffmpeg failure later
+	err = checkStreamsEncrypted(ffprobeOutput.Streams)
+	if err != nil {
+		return videoProbe{}, err
 	}
 
-	if len(ffprobeOutput.Streams) == 0 {
-		return "", errors.New("no streams found in ffprobe output")
+	stream, err := primaryVideoStream(ffprobeOutput.Streams)
+	if err != nil {
+		return videoProbe{}, err
+	}
+
+	probe := videoProbe{
+		width:     stream.Width,
+		height:    stream.Height,
+		codec:     stream.CodecName,
+		frameRate: parseFrameRate(stream.AvgFrameRate),
+	}
+	for _, s := range ffprobeOutput.Streams {
+		if s.CodecType == "audio" {
+			probe.hasAudio = true
+		}
+	}
+	// A missing or unparseable duration just leaves it unknown
+	probe.durationSeconds, _ = strconv.ParseFloat(ffprobeOutput.Format.Duration, 64)
+	bitRate, err := strconv.ParseInt(ffprobeOutput.Format.BitRate, 10, 64)
+	if err == nil {
+		probe.bitrateKbps = bitRate / 1000
 	}
 
-	// Return the aspect ratio as a string in the format "width:height"
+	// Classify the aspect ratio as a string in the format "width:height"
 
 	// Calculate the actual ratio of the video
-	ratio := float64(ffprobeOutput.Streams[0].Width) / float64(ffprobeOutput.Streams[0].Height)
+	ratio := float64(stream.Width) / float64(stream.Height)
 
 	// Check for Landscape (16:9)
 	if math.Abs(ratio-(16.0/9.0)) < 0.1 {
-		return "16:9", nil
+		probe.aspect = "16:9"
+		return probe, nil
 	}
 
 	// Check for Portrait (9:16)
 	if math.Abs(ratio-(9.0/16.0)) < 0.1 {
-		return "9:16", nil
+		probe.aspect = "9:16"
+		return probe, nil
 	}
 
-	// If it's anything else (like a square 1:1 or old 4:3)
-	return "other", nil
+	// Anything else (like a square 1:1 or old 4:3) is given as its ratio
+	// in lowest terms
+	probe.aspect = reducedRatio(stream.Width, stream.Height)
+	return probe, nil
 }
 
-func processVideoForFastStart(filePath string) (string, error) {
+// recordProbe stores what probing found out about the upload on the
+// video, so clients don't have to probe the file themselves. Values ffprobe
+// couldn't tell are left unset.
+func recordProbe(video *database.Video, probe videoProbe) {
+	video.Width, video.Height = &probe.width, &probe.height
+	video.DurationSeconds, video.BitrateKbps, video.FrameRate, video.Codec = nil, nil, nil, nil
+	if probe.durationSeconds > 0 {
+		video.DurationSeconds = &probe.durationSeconds
+	}
+	if probe.bitrateKbps > 0 {
+		video.BitrateKbps = &probe.bitrateKbps
+	}
+	if probe.frameRate > 0 {
+		video.FrameRate = &probe.frameRate
+	}
+	if probe.codec != "" {
+		video.Codec = &probe.codec
+	}
+}
+
+// parseFrameRate reads an ffprobe frame rate such as "30000/1001". Rates
+// ffprobe couldn't tell, given as "0/0", come out as 0.
+func parseFrameRate(rate string) float64 {
+	num, den, ok := strings.Cut(rate, "/")
+	if !ok {
+		fps, _ := strconv.ParseFloat(rate, 64)
+		return fps
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// errNoVideoStream means the file has no stream with picture dimensions
+// other than cover art.
+var errNoVideoStream = errors.New("no video stream found")
+
+// primaryVideoStream picks the stream the video's dimensions come from. The
+// first stream isn't always it: cover art is stored as an attached picture
+// video stream, and audio or data streams can come first. With several real
+// video streams the one with the most pixels wins.
+func primaryVideoStream(streams []ffprobeStream) (ffprobeStream, error) {
+	var primary ffprobeStream
+	found := false
+	for _, s := range streams {
+		if s.CodecType != "video" || s.Disposition.AttachedPic != 0 || s.Width <= 0 || s.Height <= 0 {
+			continue
+		}
+		if !found || s.Width*s.Height > primary.Width*primary.Height {
+			primary = s
+			found = true
+		}
+	}
+	if !found {
+		return ffprobeStream{}, &videoRejection{
+			reason:  errNoVideoStream,
+			message: "The file has no video stream. Upload audio-only files to an audio record.",
+		}
+	}
+	return primary, nil
+}
+
+// videoEncodeArgs are the ffmpeg input and codec arguments for a video.
+// With a profile the streams are re-encoded with its settings; without one
+// they are copied as they are.
+func videoEncodeArgs(filePath string, profile *encodingProfile) []string {
+	args := []string{"-i", filePath}
+	if profile != nil {
+		return append(args, profile.ffmpegArgs()...)
+	}
+	return append(args, "-c", "copy")
+}
+
+// fragmentedMP4Args write an MP4 whose index comes first and whose media
+// follows in fragments, so it plays progressively like a faststart file but
+// can be written in one pass to a pipe.
+var fragmentedMP4Args = []string{"-movflags", "frag_keyframe+empty_moov+default_base_moof", "-f", "mp4"}
+
+// processVideoForFastStart moves the file's playback metadata to the front.
+func (cfg *apiConfig) processVideoForFastStart(filePath string, encodeArgs []string) (string, error) {
 	// Create a new string for the output file path
 	outputFilePath := filePath[:len(filePath)-len(".mp4")] + "-faststart.mp4"
 
+	args := append(encodeArgs, "-movflags", "faststart", "-f", "mp4", outputFilePath)
+
 	// Run ffmpeg to process the video for fast start
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputFilePath)
+	cmd := cfg.ffmpegCommand(context.Background(), args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
 	err := cmd.Run()
 	if err != nil {
-		return "", err
+		return "", encryptionFailure(err, stderr.Bytes())
 	}
 
 	return outputFilePath, nil
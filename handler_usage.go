@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerUsageGet reports the caller's storage use, with kept originals and
+// renditions counted separately from processed videos so users can see
+// what purging them would reclaim.
+func (cfg *apiConfig) handlerUsageGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.StorageBreakdown
+		TotalBytes     int64  `json:"total_bytes"`
+		QuotaBytes     *int64 `json:"quota_bytes"`
+		RemainingBytes *int64 `json:"remaining_bytes"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	breakdown, err := cfg.db.GetUserStorageBreakdown(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get storage usage", err)
+		return
+	}
+
+	resp := response{
+		StorageBreakdown: breakdown,
+		TotalBytes:       breakdown.Total(),
+	}
+	quota := cfg.tunables(r.Context()).userQuotaBytes
+	if quota > 0 {
+		remaining := max(quota-resp.TotalBytes, 0)
+		resp.QuotaBytes = &quota
+		resp.RemainingBytes = &remaining
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// audioSourceURLExpiry is how long ffmpeg gets to read the processed video
+// when extracting its audio track.
+const audioSourceURLExpiry = 15 * time.Minute
+
+type audioTrackResponse struct {
+	AudioURL string `json:"audio_url"`
+}
+
+// handlerVideoAudioExtract extracts a video's audio track on demand, for
+// podcast-style listening, and stores it next to the video as
+// "<aspect>/<videoID>/audio.m4a". A track already extracted is returned as
+// is; uploading new content removes it.
+func (cfg *apiConfig) handlerVideoAudioExtract(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+	if video.MediaKind == database.MediaKindAudio {
+		respondWithError(w, http.StatusBadRequest, "Audio records are already audio only", nil)
+		return
+	}
+	if video.VideoURL == nil || video.LifecycleStage != database.StageReady {
+		respondWithError(w, http.StatusConflict, "Video has no processed file yet", fmt.Errorf("video %s is %s", video.ID, video.LifecycleStage))
+		return
+	}
+	if video.AudioURL != nil {
+		cfg.respondWithAudioTrack(w, r, http.StatusOK, *video.AudioURL)
+		return
+	}
+	// ffmpeg would need to follow the manifest to segments it can't be
+	// given signed URLs for
+	if isSegmentedURL(*video.VideoURL) {
+		respondWithError(w, http.StatusConflict, "Audio can't be extracted from a video stored as segments", fmt.Errorf("video %s is stored as %s", video.ID, storedOutputFormat(*video.VideoURL)))
+		return
+	}
+
+	videoKey, err := cfg.bucketKeyFromURL(*video.VideoURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't locate video file", err)
+		return
+	}
+	srcURL, err := cfg.storage.Presign(r.Context(), videoKey, audioSourceURLExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't read video file", err)
+		return
+	}
+
+	// The track is never larger than the video it comes from
+	if !cfg.tempSpace.tryReserve(video.SizeBytes) {
+		w.Header().Set("Retry-After", "30")
+		respondWithError(w, http.StatusServiceUnavailable, "Server is busy processing other uploads, try again shortly", fmt.Errorf("couldn't reserve %d bytes of temp space", video.SizeBytes))
+		return
+	}
+	defer cfg.tempSpace.release(video.SizeBytes)
+
+	tempFile, err := os.CreateTemp(cfg.tempDir, "tubely-audio-*.m4a")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
+		return
+	}
+	tempFile.Close()
+	defer os.Remove(tempFile.Name())
+
+	err = cfg.extractAudioTrack(r.Context(), srcURL, tempFile.Name())
+	if errors.Is(err, errNoAudioTrack) {
+		respondWithError(w, http.StatusNotFound, "Video has no audio track", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't extract audio track", err)
+		return
+	}
+
+	track, err := os.Open(tempFile.Name())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read audio track", err)
+		return
+	}
+	defer track.Close()
+
+	// Versioned videos already keep their files in a directory of their own
+	audioDir := path.Dir(videoKey)
+	if path.Base(audioDir) != video.ID.String() {
+		audioDir = path.Join(audioDir, video.ID.String())
+	}
+	audioKey := path.Join(audioDir, "audio.m4a")
+	err = cfg.storage.Put(r.Context(), audioKey, track, "audio/mp4")
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't store audio track", err)
+		return
+	}
+
+	audioURL := cfg.storage.URL(audioKey)
+	err = cfg.db.SetAudioURL(video.ID, &audioURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	cfg.respondWithAudioTrack(w, r, http.StatusCreated, audioURL)
+}
+
+// respondWithAudioTrack answers with the audio track's URL, signed like the
+// video's own.
+func (cfg *apiConfig) respondWithAudioTrack(w http.ResponseWriter, r *http.Request, code int, audioURL string) {
+	signed, err := cfg.signURL(r.Context(), audioURL, "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign audio URL", err)
+		return
+	}
+	respondWithJSON(w, code, audioTrackResponse{AudioURL: signed})
+}
+
+// removeAudioTrack deletes the video's extracted audio track, which no
+// longer matches once its content changes. Failures are logged.
+func (cfg *apiConfig) removeAudioTrack(ctx context.Context, video *database.Video) {
+	if video.AudioURL == nil {
+		return
+	}
+	audioURL := *video.AudioURL
+	err := cfg.db.SetAudioURL(video.ID, nil)
+	if err != nil {
+		log.Printf("Couldn't clear audio track of video %s: %v", video.ID, err)
+		return
+	}
+	video.AudioURL = nil
+
+	key, err := cfg.bucketKeyFromURL(audioURL)
+	if err != nil {
+		log.Printf("Couldn't remove audio track: %v", err)
+		return
+	}
+	err = cfg.storage.Delete(ctx, key)
+	if err != nil {
+		log.Printf("Couldn't remove audio track %s: %v", key, err)
+	}
+}
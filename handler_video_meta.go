@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -12,6 +16,7 @@ import (
 func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		database.CreateVideoParams
+		ProcessingOptions database.ProcessingOptions `json:"processing_options"`
 	}
 
 	token, err := auth.GetBearerToken(r.Header)
@@ -19,7 +24,7 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -33,16 +38,53 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	params.UserID = userID
+	if params.MediaKind == "" {
+		params.MediaKind = database.MediaKindVideo
+	}
+	if !validMediaKind(params.MediaKind) {
+		respondWithError(w, http.StatusBadRequest, "Invalid media kind", fmt.Errorf("unknown media kind %q", params.MediaKind))
+		return
+	}
+
+	if params.Visibility == "" {
+		params.Visibility = database.VisibilityPublic
+	}
+	err = validateVisibility(params.Visibility)
+	if err == nil {
+		err = cfg.checkVisibilityServable(params.Visibility)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid visibility", err)
+		return
+	}
+
+	err = validateProcessingOptions(params.MediaKind, params.ProcessingOptions)
+	if err == nil {
+		err = cfg.checkOutputFormatServable(params.ProcessingOptions.OutputFormat)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid processing options", err)
+		return
+	}
 
-	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
+	video, err := cfg.db.CreateVideo(params.CreateVideoParams, params.ProcessingOptions)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
 		return
 	}
+	if video.Visibility == database.VisibilityUnlisted {
+		video, err = cfg.assignShareSlug(r.Context(), video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create share slug", err)
+			return
+		}
+	}
 
-	respondWithJSON(w, http.StatusCreated, video)
+	cfg.respondWithSignedVideo(w, r, http.StatusCreated, video)
 }
 
+// handlerVideoMetaDelete deletes a video and everything stored for it. Its
+// owner and admins may delete it.
 func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -56,7 +98,7 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -67,20 +109,78 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
+	if video.ID == uuid.Nil {
+		cfg.respondToRepeatDelete(w, r, videoID, userID)
+		return
+	}
 	if video.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
+		// Admins can delete any video
+		user, err := cfg.db.GetUser(userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+			return
+		}
+		if user == nil || !user.HasRole(database.RoleAdmin) {
+			respondWithError(w, http.StatusForbidden, "You can't delete this video", nil)
+			return
+		}
+	}
+
+	// The candidates' rows go with the video's
+	candidates, err := cfg.db.GetThumbnailCandidates(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail candidates", err)
 		return
 	}
 
+	cfg.rememberDeletedVideo(r, video)
 	err = cfg.db.DeleteVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
+	cfg.removeVideoAssets(r.Context(), video, candidates)
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// removeVideoAssets deletes everything stored for a deleted video: its
+// processed file or segment tree, kept original, audio track, renditions,
+// storyboard, animated preview, thumbnail candidates and thumbnail, with
+// their WebP copies, and any staged direct upload. Failures are logged,
+// since the record is already gone.
+func (cfg *apiConfig) removeVideoAssets(ctx context.Context, video database.Video, candidates []database.ThumbnailCandidate) {
+	if video.VideoURL != nil {
+		cfg.releaseVideoFile(ctx, video.ID, *video.VideoURL)
+	}
+	if video.OriginalKey != nil {
+		err := cfg.deleteOriginal(ctx, *video.OriginalKey)
+		if err != nil {
+			log.Printf("Couldn't remove original %s: %v", *video.OriginalKey, err)
+		}
+	}
+	cfg.removeAudioTrack(ctx, &video)
+	cfg.removeRenditions(ctx, video.Renditions)
+	cfg.removeStoryboard(ctx, video.Storyboard)
+	cfg.removeAnimatedPreview(ctx, video.AnimatedPreviewURL)
+	cfg.removeDirectUploads(ctx, video.ID)
+
+	// The thumbnail is usually one of the candidates
+	thumbnails := map[string]bool{}
+	for _, candidate := range candidates {
+		thumbnails[candidate.URL] = true
+	}
+	if video.ThumbnailURL != nil {
+		thumbnails[*video.ThumbnailURL] = true
+	}
+	for url := range thumbnails {
+		err := cfg.removeThumbnail(ctx, url)
+		if err != nil {
+			log.Printf("Couldn't remove thumbnail %s: %v", url, err)
+		}
+	}
+}
+
 func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -94,27 +194,97 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
+	// Videos the caller can't see answer the same as missing ones, so IDs
+	// can't be probed
+	if video.ID == uuid.Nil || !cfg.canViewVideo(r, video) {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	cfg.respondWithVideo(w, r, video)
+}
+
+// respondWithVideo answers with the video as JSON, or as JSON-LD when the
+// client prefers it, with its URLs signed when the distribution needs it.
+func (cfg *apiConfig) respondWithVideo(w http.ResponseWriter, r *http.Request, video database.Video) {
+	video, err := cfg.signVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept")
+	if prefersJSONLD(r.Header.Get("Accept")) {
+		respondWithJSONLD(w, http.StatusOK, buildVideoObject(video))
+		return
+	}
 
 	respondWithJSON(w, http.StatusOK, video)
 }
 
+// respondWithSignedVideo answers with the video as JSON, its URLs signed
+// as signVideo signs them. Every response carrying a video goes through
+// here or respondWithVideo, so none hands out a URL that needs a signature
+// without one.
+func (cfg *apiConfig) respondWithSignedVideo(w http.ResponseWriter, r *http.Request, code int, video database.Video) {
+	video, err := cfg.signVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+	respondWithJSON(w, code, video)
+}
+
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	limit, offset, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+
+	videos, err := cfg.db.GetVideosPage(userID, limit, offset)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
+	err = cfg.signVideos(r.Context(), videos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
 
 	respondWithJSON(w, http.StatusOK, videos)
 }
+
+// parsePage reads the optional limit and offset query parameters of a video
+// listing, responding with an error and returning false if either is
+// invalid. Without a limit every video is returned.
+func parsePage(w http.ResponseWriter, r *http.Request) (limit, offset int, ok bool) {
+	var err error
+	limit, offset = -1, 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit", err)
+			return 0, 0, false
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid offset", err)
+			return 0, 0, false
+		}
+	}
+	return limit, offset, true
+}
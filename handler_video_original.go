@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// handlerVideoOriginalDelete purges the kept original upload for a video.
+// The processed video is untouched, but the video can no longer be
+// reprocessed from its source.
+func (cfg *apiConfig) handlerVideoOriginalDelete(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+	if video.OriginalKey == nil {
+		respondWithError(w, http.StatusNotFound, "Video has no stored original", fmt.Errorf("video %s has no original key", video.ID))
+		return
+	}
+
+	err := cfg.deleteOriginal(r.Context(), *video.OriginalKey)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't delete original from storage", err)
+		return
+	}
+
+	reclaimed := video.OriginalSizeBytes
+	video.OriginalKey = nil
+	video.OriginalSizeBytes = 0
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct {
+		ReclaimedBytes int64 `json:"reclaimed_bytes"`
+	}{
+		ReclaimedBytes: reclaimed,
+	})
+}
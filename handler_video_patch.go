@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// processingLockTimeout bounds how long processing options stay locked, so
+// a video stuck mid-pipeline doesn't keep them locked forever.
+const processingLockTimeout = time.Hour
+
+// processingOptionFields returns the JSON names of the fields in
+// database.ProcessingOptions. Deriving them from the struct means a new
+// option is locked during processing without touching this handler.
+func processingOptionFields() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(database.ProcessingOptions{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// processingOptionsLocked reports whether the pipeline may still read the
+// video's processing options.
+func processingOptionsLocked(video database.Video) bool {
+	if database.IsTerminalStage(video.LifecycleStage) {
+		return false
+	}
+	return video.LifecycleChangedAt == nil || time.Since(*video.LifecycleChangedAt) < processingLockTimeout
+}
+
+// handlerVideoPatch edits a video's metadata and processing options. The
+// title, description and visibility can change at any time; processing
+// options are rejected with 409 while the video is being processed. A video
+// made unlisted gets a share slug to share it by.
+func (cfg *apiConfig) handlerVideoPatch(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title             *string                    `json:"title"`
+		Description       *string                    `json:"description"`
+		Visibility        *string                    `json:"visibility"`
+		ProcessingOptions map[string]json.RawMessage `json:"processing_options"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	if len(params.ProcessingOptions) > 0 {
+		known := processingOptionFields()
+		changed := make([]string, 0, len(params.ProcessingOptions))
+		for name := range params.ProcessingOptions {
+			if !known[name] {
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown processing option %q", name), nil)
+				return
+			}
+			changed = append(changed, name)
+		}
+		sort.Strings(changed)
+
+		if processingOptionsLocked(video) {
+			respondWithError(w, http.StatusConflict, fmt.Sprintf("Can't change %s while the video is being processed; try again once it finishes", strings.Join(changed, ", ")), nil)
+			return
+		}
+
+		// Unmarshalling onto the current options keeps the ones not
+		// mentioned in the request
+		dat, err := json.Marshal(params.ProcessingOptions)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't apply processing options", err)
+			return
+		}
+		err = json.Unmarshal(dat, &video.ProcessingOptions)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid processing options", err)
+			return
+		}
+		err = validateProcessingOptions(video.MediaKind, video.ProcessingOptions)
+		if err == nil {
+			err = cfg.checkOutputFormatServable(video.ProcessingOptions.OutputFormat)
+		}
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid processing options", err)
+			return
+		}
+	}
+
+	if params.Title != nil {
+		video.Title = *params.Title
+	}
+	if params.Description != nil {
+		video.Description = *params.Description
+	}
+	if params.Visibility != nil {
+		err = validateVisibility(*params.Visibility)
+		if err == nil {
+			err = cfg.checkVisibilityServable(*params.Visibility)
+		}
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid visibility", err)
+			return
+		}
+		video.Visibility = *params.Visibility
+	}
+
+	err = cfg.db.UpdateVideoMetadata(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if params.Visibility != nil {
+		err = cfg.db.SetVideoVisibility(video.ID, video.Visibility)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't update video visibility", err)
+			return
+		}
+	}
+	if video.Visibility == database.VisibilityUnlisted {
+		video, err = cfg.assignShareSlug(r.Context(), video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create share slug", err)
+			return
+		}
+	}
+
+	cfg.respondWithSignedVideo(w, r, http.StatusOK, video)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// progressKeepAlive is how often an idle progress stream gets a comment
+// line, so proxies don't time it out.
+const progressKeepAlive = 15 * time.Second
+
+// Phases reported by the progress stream, as each event's name.
+const (
+	progressAwaitingUpload = "awaiting_upload"
+	progressReceived       = "received"
+	progressProbing        = "probing"
+	progressProcessing     = "processing"
+	// progressUploading is storing the processed file, with its progress
+	// as a percentage when the size is known up front
+	progressUploading = "uploading"
+	progressReady     = "ready"
+	progressFailed    = "failed"
+)
+
+type videoProgressEvent struct {
+	Phase    string                    `json:"phase"`
+	Stage    string                    `json:"stage"`
+	Step     string                    `json:"step,omitempty"`
+	Progress *int                      `json:"progress,omitempty"`
+	Error    *database.ProcessingError `json:"error,omitempty"`
+}
+
+func (e videoProgressEvent) equal(other videoProgressEvent) bool {
+	return e.Phase == other.Phase && e.Stage == other.Stage && e.Step == other.Step && equalProgress(e.Progress, other.Progress)
+}
+
+// done reports whether the video won't make progress without another
+// upload.
+func (e videoProgressEvent) done() bool {
+	return e.Phase == progressReady || e.Phase == progressFailed
+}
+
+// progressPhase boils a video's stage and pipeline step down to a phase.
+// The step is more precise, so it wins while the video is in the pipeline.
+func progressPhase(stage, step string) string {
+	switch step {
+	case "":
+	case stageReceive:
+		return progressReceived
+	case stageProbe:
+		return progressProbing
+	case stageStore:
+		return progressUploading
+	default:
+		return progressProcessing
+	}
+	switch stage {
+	case database.StageAwaitingUpload:
+		return progressAwaitingUpload
+	case database.StageUploaded:
+		return progressReceived
+	case database.StageReady:
+		return progressReady
+	case database.StageRejected, database.StageFailed, database.StagePoisoned:
+		return progressFailed
+	}
+	return progressProcessing
+}
+
+func (cfg *apiConfig) videoProgress(video database.Video) videoProgressEvent {
+	step := cfg.statuses.step(video.ID)
+	return videoProgressEvent{
+		Phase:    progressPhase(video.LifecycleStage, step),
+		Stage:    video.LifecycleStage,
+		Step:     step,
+		Progress: cfg.statuses.currentProgress(video.ID),
+		Error:    video.ProcessingError,
+	}
+}
+
+// handlerVideoProgress streams a video's progress through processing as
+// Server-Sent Events, one event per change, named after the phase, with
+// the details as JSON data. The first event is where the video is now. The
+// stream ends after the ready or failed event. It takes the same bearer
+// token as the rest of the API, so browsers have to read it with fetch
+// rather than EventSource.
+func (cfg *apiConfig) handlerVideoProgress(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	// Subscribe before reading the video so a change between the read and
+	// the first event isn't missed
+	changes, cancel := cfg.statuses.subscribe(videoID)
+	defer cancel()
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't view this video's progress", nil)
+		return
+	}
+
+	// Streams count against the same limit as held status requests
+	if !cfg.statusWaits.tryAcquire(userID, maxStatusWaitsPerUser) {
+		w.Header().Set("Retry-After", "1")
+		respondWithError(w, http.StatusTooManyRequests, "Too many status requests waiting, wait for one to return", fmt.Errorf("user %s is at the status wait limit", userID))
+		return
+	}
+	defer cfg.statusWaits.release(userID)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Tell nginx not to buffer the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	current := cfg.videoProgress(video)
+	if writeProgressEvent(w, rc, current) != nil || current.done() {
+		return
+	}
+
+	keepAlive := time.NewTicker(progressKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-changes:
+			video, err = cfg.db.GetVideo(videoID)
+			if err != nil {
+				return
+			}
+			latest := cfg.videoProgress(video)
+			if latest.equal(current) {
+				continue
+			}
+			current = latest
+			if writeProgressEvent(w, rc, current) != nil || current.done() {
+				return
+			}
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		case <-cfg.statuses.done():
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeProgressEvent(w http.ResponseWriter, rc *http.ResponseController, event videoProgressEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Phase, data)
+	if err != nil {
+		return err
+	}
+	return rc.Flush()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// maxStatusWait caps how long a status request may be held with ?wait.
+const maxStatusWait = 60 * time.Second
+
+// maxStatusWaitsPerUser bounds how many status requests one user can have
+// held open at once.
+const maxStatusWaitsPerUser = 10
+
+type videoStatusResponse struct {
+	ID     uuid.UUID `json:"id"`
+	Status string    `json:"status"`
+	Stage  string    `json:"stage"`
+	Step   string    `json:"step,omitempty"`
+	// Progress is the percentage of the current step done, for steps
+	// that report it
+	Progress *int                      `json:"progress,omitempty"`
+	Error    *database.ProcessingError `json:"error"`
+
+	DerivedAssets []derivedAssetStatus `json:"derived_assets"`
+}
+
+// handlerVideoStatus reports where a video is in processing. With
+// ?wait=30s it long-polls: the response is held until the stage, pipeline
+// step or step progress changes or the wait runs out, for clients that
+// can't use streaming responses. Videos that have finished the lifecycle answer immediately.
+func (cfg *apiConfig) handlerVideoStatus(w http.ResponseWriter, r *http.Request) {
+	wait, err := parseStatusWait(r.URL.Query().Get("wait"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid wait", err)
+		return
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	// Subscribe before reading the video so a change between the read and
+	// the wait isn't missed
+	var changes <-chan struct{}
+	if wait > 0 {
+		var cancel func()
+		changes, cancel = cfg.statuses.subscribe(videoID)
+		defer cancel()
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't view this video's status", nil)
+		return
+	}
+	current, err := cfg.videoStatus(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video status", err)
+		return
+	}
+
+	if wait <= 0 || database.IsTerminalStage(video.LifecycleStage) {
+		respondWithJSON(w, http.StatusOK, current)
+		return
+	}
+
+	if !cfg.statusWaits.tryAcquire(userID, maxStatusWaitsPerUser) {
+		w.Header().Set("Retry-After", "1")
+		respondWithError(w, http.StatusTooManyRequests, "Too many status requests waiting, wait for one to return", fmt.Errorf("user %s is at the status wait limit", userID))
+		return
+	}
+	defer cfg.statusWaits.release(userID)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-changes:
+			video, err = cfg.db.GetVideo(videoID)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+				return
+			}
+			latest, err := cfg.videoStatus(video)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't get video status", err)
+				return
+			}
+			if latest.Stage == current.Stage && latest.Step == current.Step && equalProgress(latest.Progress, current.Progress) {
+				continue
+			}
+			respondWithJSON(w, http.StatusOK, latest)
+			return
+		case <-timer.C:
+		case <-cfg.statuses.done():
+		case <-r.Context().Done():
+			return
+		}
+
+		// Out of time: answer with whatever the video looks like now
+		video, err = cfg.db.GetVideo(videoID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+			return
+		}
+		latest, err := cfg.videoStatus(video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video status", err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, latest)
+		return
+	}
+}
+
+func (cfg *apiConfig) videoStatus(video database.Video) (videoStatusResponse, error) {
+	derived, err := cfg.derivedAssetStatuses(video)
+	if err != nil {
+		return videoStatusResponse{}, err
+	}
+	return videoStatusResponse{
+		ID:            video.ID,
+		Status:        video.ProcessingStatus,
+		Stage:         video.LifecycleStage,
+		Step:          cfg.statuses.step(video.ID),
+		Progress:      cfg.statuses.currentProgress(video.ID),
+		Error:         video.ProcessingError,
+		DerivedAssets: derived,
+	}, nil
+}
+
+func equalProgress(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// parseStatusWait reads the ?wait parameter as a Go duration ("30s") or a
+// number of seconds, capped at maxStatusWait. Empty means don't wait.
+func parseStatusWait(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(v)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(v)
+		if convErr != nil {
+			return 0, err
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 {
+		return 0, fmt.Errorf("wait %s is negative", v)
+	}
+	return min(wait, maxStatusWait), nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// Outcomes of checking one stored asset.
+const (
+	assetCheckOK       = "ok"
+	assetCheckMissing  = "missing"
+	assetCheckMismatch = "mismatch"
+	assetCheckError    = "error"
+)
+
+type assetCheck struct {
+	Asset        string `json:"asset"`
+	Location     string `json:"location"`
+	Status       string `json:"status"`
+	ExpectedSize int64  `json:"expected_size,omitempty"`
+	ActualSize   int64  `json:"actual_size,omitempty"`
+	Detail       string `json:"detail,omitempty"`
+}
+
+type videoVerification struct {
+	VideoID uuid.UUID    `json:"video_id"`
+	OK      bool         `json:"ok"`
+	Assets  []assetCheck `json:"assets"`
+}
+
+// handlerVideoVerify checks that every stored object of a video still
+// exists and matches the size recorded when it was stored. Any problem
+// flags the video as needing attention; a clean check clears the flag.
+// The owner or an admin may call it.
+func (cfg *apiConfig) handlerVideoVerify(w http.ResponseWriter, r *http.Request) {
+	var video database.Video
+	if cfg.isAdmin(r) {
+		videoID, err := uuid.Parse(r.PathValue("videoID"))
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+			return
+		}
+		video, err = cfg.db.GetVideo(videoID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+			return
+		}
+		if video.ID == uuid.Nil {
+			respondWithError(w, http.StatusNotFound, "Video not found", nil)
+			return
+		}
+	} else {
+		var ok bool
+		video, ok = cfg.getOwnedVideo(w, r)
+		if !ok {
+			return
+		}
+	}
+
+	report := videoVerification{
+		VideoID: video.ID,
+		OK:      true,
+		Assets:  []assetCheck{},
+	}
+	if video.VideoURL != nil {
+		// The recorded size of HLS and DASH output covers the whole
+		// segment tree, so only the manifest's existence is checked
+		size := video.SizeBytes
+		if isSegmentedURL(*video.VideoURL) {
+			size = 0
+		}
+		report.Assets = append(report.Assets, cfg.checkBucketURL(r.Context(), "video", *video.VideoURL, size))
+	}
+	for _, rendition := range video.Renditions {
+		report.Assets = append(report.Assets, cfg.checkBucketURL(r.Context(), "rendition_"+rendition.Name, rendition.URL, rendition.SizeBytes))
+	}
+	if video.Storyboard != nil {
+		report.Assets = append(report.Assets,
+			cfg.checkBucketURL(r.Context(), "storyboard", video.Storyboard.URL, 0),
+			cfg.checkBucketURL(r.Context(), "storyboard_sprite", video.Storyboard.SpriteURL, 0),
+		)
+	}
+	if video.OriginalKey != nil {
+		report.Assets = append(report.Assets, cfg.checkBucketKey(r.Context(), "original", *video.OriginalKey, video.OriginalSizeBytes))
+	}
+	if video.ThumbnailURL != nil {
+		report.Assets = append(report.Assets, cfg.checkLocalAsset(r.Context(), "thumbnail", *video.ThumbnailURL))
+	}
+	for _, check := range report.Assets {
+		if check.Status != assetCheckOK {
+			report.OK = false
+		}
+	}
+
+	if report.OK == video.NeedsAttention {
+		err := cfg.db.SetNeedsAttention(video.ID, !report.OK)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+func (cfg *apiConfig) checkBucketURL(ctx context.Context, asset, rawURL string, expectedSize int64) assetCheck {
+	key, err := cfg.bucketKeyFromURL(rawURL)
+	if err != nil {
+		return assetCheck{Asset: asset, Location: rawURL, Status: assetCheckError, Detail: err.Error()}
+	}
+	return cfg.checkBucketKey(ctx, asset, key, expectedSize)
+}
+
+// checkBucketKey compares an object's size against the recorded one. A
+// recorded size of zero means none was recorded and only existence is
+// checked.
+func (cfg *apiConfig) checkBucketKey(ctx context.Context, asset, key string, expectedSize int64) assetCheck {
+	check := assetCheck{
+		Asset:        asset,
+		Location:     key,
+		ExpectedSize: expectedSize,
+	}
+
+	obj, err := cfg.storage.Stat(ctx, key)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		check.Status = assetCheckMissing
+		return check
+	case err != nil:
+		check.Status = assetCheckError
+		check.Detail = err.Error()
+		return check
+	}
+
+	check.ActualSize = obj.Size
+	check.Status = assetCheckOK
+	if expectedSize > 0 && check.ActualSize != expectedSize {
+		check.Status = assetCheckMismatch
+		check.Detail = "size differs from the one recorded at upload"
+	}
+	return check
+}
+
+// checkLocalAsset checks an asset such as a thumbnail exists. No size is
+// recorded for thumbnails, so that is all it checks.
+func (cfg *apiConfig) checkLocalAsset(ctx context.Context, asset, assetURL string) assetCheck {
+	check := assetCheck{Asset: asset, Location: assetURL}
+	key, ok := cfg.assets.KeyFromURL(assetURL)
+	if !ok {
+		check.Status = assetCheckError
+		check.Detail = "not stored by this server"
+		return check
+	}
+
+	obj, err := cfg.assets.Stat(ctx, key)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		check.Status = assetCheckMissing
+	case err != nil:
+		check.Status = assetCheckError
+		check.Detail = err.Error()
+	default:
+		check.Status = assetCheckOK
+		check.ActualSize = obj.Size
+	}
+	return check
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	hlsMasterPlaylist  = "master.m3u8"
+	hlsVariantPlaylist = "index.m3u8"
+	// hlsSegmentSeconds is a multiple of renditionKeyframeSeconds, so
+	// every segment of a ladder variant starts on a keyframe
+	hlsSegmentSeconds = 6
+
+	hlsPlaylistContentType = "application/vnd.apple.mpegurl"
+)
+
+// segmentHLS writes each variant's segments and playlist to a directory of
+// its own under workDir, and a master playlist pointing at them.
+func (cfg *apiConfig) segmentHLS(ctx context.Context, job transcodeJob, variants []segmentVariant, workDir string) error {
+	master := []string{"#EXTM3U", "#EXT-X-VERSION:3"}
+	for _, variant := range variants {
+		err := cfg.segmentHLSVariant(ctx, job, variant, workDir)
+		if err != nil {
+			return err
+		}
+		peak, average, err := variantBandwidth(filepath.Join(workDir, variant.name))
+		if err != nil {
+			return err
+		}
+		streamInf := fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d", peak, average)
+		if variant.width > 0 && variant.height > 0 {
+			streamInf += fmt.Sprintf(",RESOLUTION=%dx%d", variant.width, variant.height)
+		}
+		master = append(master, streamInf, variant.name+"/"+hlsVariantPlaylist)
+	}
+	return os.WriteFile(filepath.Join(workDir, hlsMasterPlaylist), []byte(strings.Join(master, "\n")+"\n"), 0o600)
+}
+
+// segmentHLSVariant encodes or copies the variant into HLS segments under
+// its directory in workDir.
+func (cfg *apiConfig) segmentHLSVariant(ctx context.Context, job transcodeJob, variant segmentVariant, workDir string) error {
+	dir := filepath.Join(workDir, variant.name)
+	err := os.Mkdir(dir, 0o700)
+	if err != nil {
+		return err
+	}
+
+	weight := 1
+	if variant.encodes(job) {
+		weight = job.threads
+	}
+	weight, err = cfg.ffmpegThreads.acquire(ctx, weight, cfg.tunables(ctx).maxFFmpegThreads)
+	if err != nil {
+		return err
+	}
+	defer cfg.ffmpegThreads.release(weight)
+
+	args := []string{"-y"}
+	if variant.rung != nil {
+		args = append(args, variant.rung.encodeArgs(job.srcPath, variant.width, variant.height, job.threads)...)
+	} else {
+		args = append(args, job.videoEncodeArgs()...)
+	}
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hlsSegmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, "seg%05d.ts"),
+		filepath.Join(dir, hlsVariantPlaylist),
+	)
+	cmd := cfg.ffmpegCommand(ctx, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return encryptionFailure(err, stderr.Bytes())
+	}
+	return nil
+}
+
+// variantBandwidth measures a variant's peak and average bitrate, in bits
+// per second, from its playlist's segment durations and the sizes of the
+// segment files. The master playlist has to give both.
+func variantBandwidth(dir string) (peak, average int64, err error) {
+	data, err := os.ReadFile(filepath.Join(dir, hlsVariantPlaylist))
+	if err != nil {
+		return 0, 0, err
+	}
+	var segmentSeconds, totalSeconds float64
+	var totalBytes int64
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			seconds, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			segmentSeconds, err = strconv.ParseFloat(seconds, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("bad segment duration %q: %w", line, err)
+			}
+		case line != "" && !strings.HasPrefix(line, "#"):
+			info, err := os.Stat(filepath.Join(dir, line))
+			if err != nil {
+				return 0, 0, err
+			}
+			totalBytes += info.Size()
+			totalSeconds += segmentSeconds
+			if segmentSeconds > 0 {
+				peak = max(peak, int64(float64(info.Size()*8)/segmentSeconds))
+			}
+		}
+	}
+	if totalSeconds == 0 {
+		return 0, 0, fmt.Errorf("no segments in %s", filepath.Join(dir, hlsVariantPlaylist))
+	}
+	average = int64(float64(totalBytes*8) / totalSeconds)
+	return max(peak, average), average, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+var errImageFormatMismatch = errors.New("image content doesn't match its declared type")
+
+// imageFormats maps the thumbnail media types accepted on upload to the
+// format names the image package reports for them.
+var imageFormats = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+}
+
+// checkImageFormat sniffs the image format from the start of src and
+// confirms it is the one mediaType declares, so a PNG labeled image/jpeg
+// isn't stored with a .jpg extension. It returns a reader that still yields
+// the whole image. Content the image package can't recognize is a mismatch
+// too.
+func checkImageFormat(src io.Reader, mediaType string) (io.Reader, error) {
+	var header bytes.Buffer
+	_, format, err := image.DecodeConfig(io.TeeReader(src, &header))
+	rest := io.MultiReader(&header, src)
+	if err != nil {
+		return rest, fmt.Errorf("%w: declared %s, content isn't a readable image: %v", errImageFormatMismatch, mediaType, err)
+	}
+	if imageFormats[mediaType] != format {
+		return rest, fmt.Errorf("%w: declared %s, content is %s", errImageFormatMismatch, mediaType, format)
+	}
+	return rest, nil
+}
@@ -18,6 +18,9 @@ type TokenType string
 
 const (
 	TokenTypeAccess TokenType = "tubely-access"
+	// TokenTypeService tokens belong to service accounts, which may only
+	// read video metadata. ValidateJWT rejects them.
+	TokenTypeService TokenType = "tubely-service"
 )
 
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
@@ -40,25 +43,45 @@ func CheckPasswordHash(password, hash string) (bool, error) {
 
 func MakeJWT(
 	userID uuid.UUID,
-	tokenSecret string,
+	keys *KeySet,
 	expiresIn time.Duration,
 ) (string, error) {
-	signingKey := []byte(tokenSecret)
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
 		Issuer:    string(TokenTypeAccess),
 		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
 		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
 		Subject:   userID.String(),
 	})
-	return token.SignedString(signingKey)
+	return keys.sign(token)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+func ValidateJWT(tokenString string, keys *KeySet) (uuid.UUID, error) {
+	return validateJWT(tokenString, keys, TokenTypeAccess)
+}
+
+// MakeServiceJWT issues a token for a service account. It doesn't expire;
+// the account is revoked instead.
+func MakeServiceJWT(accountID uuid.UUID, keys *KeySet) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:   string(TokenTypeService),
+		IssuedAt: jwt.NewNumericDate(time.Now().UTC()),
+		Subject:  accountID.String(),
+	})
+	return keys.sign(token)
+}
+
+// ValidateServiceJWT returns the service account ID from a token made by
+// MakeServiceJWT.
+func ValidateServiceJWT(tokenString string, keys *KeySet) (uuid.UUID, error) {
+	return validateJWT(tokenString, keys, TokenTypeService)
+}
+
+func validateJWT(tokenString string, keys *KeySet, tokenType TokenType) (uuid.UUID, error) {
 	claimsStruct := jwt.RegisteredClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		keys.keyFunc,
 	)
 	if err != nil {
 		return uuid.Nil, err
@@ -73,7 +96,7 @@ func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
 	if err != nil {
 		return uuid.Nil, err
 	}
-	if issuer != string(TokenTypeAccess) {
+	if issuer != string(tokenType) {
 		return uuid.Nil, errors.New("invalid issuer")
 	}
 
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrUnknownKeyID means a token names a signing key the server doesn't
+// have, usually one that was rotated out.
+var ErrUnknownKeyID = errors.New("unknown signing key ID")
+
+// KeySet holds the secrets tokens may be signed with. New tokens are signed
+// with the current key and carry its ID in the "kid" header; tokens are
+// validated with the key their header names. Keeping the previous key in
+// the set while its tokens expire lets the secret be rotated without
+// logging everyone out.
+type KeySet struct {
+	currentID string
+	keys      map[string][]byte
+	// legacy validates tokens without a kid, which were issued before the
+	// set had IDs. nil rejects them.
+	legacy []byte
+}
+
+// NewKeySet returns a set signing with keys[currentID]. legacy, when not
+// empty, is the secret for tokens that carry no key ID.
+func NewKeySet(keys map[string]string, currentID, legacy string) (*KeySet, error) {
+	if _, ok := keys[currentID]; !ok {
+		return nil, fmt.Errorf("current key ID %q isn't in the key set", currentID)
+	}
+	ks := &KeySet{
+		currentID: currentID,
+		keys:      make(map[string][]byte, len(keys)),
+	}
+	for id, secret := range keys {
+		if id == "" || secret == "" {
+			return nil, errors.New("key IDs and secrets can't be empty")
+		}
+		ks.keys[id] = []byte(secret)
+	}
+	if legacy != "" {
+		ks.legacy = []byte(legacy)
+	}
+	return ks, nil
+}
+
+// SingleKey returns a set of one secret without an ID, which signs and
+// validates tokens the way a lone shared secret always has.
+func SingleKey(secret string) *KeySet {
+	return &KeySet{legacy: []byte(secret)}
+}
+
+// sign signs token with the current key, naming it in the header.
+func (ks *KeySet) sign(token *jwt.Token) (string, error) {
+	if ks.currentID == "" {
+		return token.SignedString(ks.legacy)
+	}
+	token.Header["kid"] = ks.currentID
+	return token.SignedString(ks.keys[ks.currentID])
+}
+
+// keyFunc picks the key a token was signed with from its kid header.
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	kid, ok := token.Header["kid"]
+	if !ok {
+		if ks.legacy == nil {
+			return nil, errors.New("token has no key ID")
+		}
+		return ks.legacy, nil
+	}
+	id, _ := kid.(string)
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKeyID, kid)
+	}
+	return key, nil
+}
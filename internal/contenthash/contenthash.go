@@ -0,0 +1,59 @@
+// Package contenthash is the single place content digests are computed, so
+// every content-addressed name, checksum and ETag uses the same configured
+// algorithm.
+package contenthash
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"lukechampine.com/blake3"
+)
+
+type Algorithm string
+
+const (
+	SHA256 Algorithm = "sha256"
+	SHA1   Algorithm = "sha1"
+	BLAKE3 Algorithm = "blake3"
+)
+
+// Default is used when no algorithm is configured.
+const Default = SHA256
+
+// Parse validates an algorithm name. An empty name selects Default.
+func Parse(name string) (Algorithm, error) {
+	switch Algorithm(name) {
+	case "":
+		return Default, nil
+	case SHA256, SHA1, BLAKE3:
+		return Algorithm(name), nil
+	}
+	return "", fmt.Errorf("unsupported hash algorithm %q (want sha256, sha1 or blake3)", name)
+}
+
+// New returns a fresh hash.Hash for the algorithm, for callers that hash
+// while copying, such as through an io.MultiWriter.
+func (a Algorithm) New() hash.Hash {
+	switch a {
+	case SHA1:
+		return sha1.New()
+	case BLAKE3:
+		return blake3.New(32, nil)
+	}
+	return sha256.New()
+}
+
+// Sum reads r to the end and returns its hex digest.
+func (a Algorithm) Sum(r io.Reader) (string, error) {
+	h := a.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// GetCheckpoint returns where the named long-running job got to, or "" if
+// it hasn't saved a checkpoint.
+func (c Client) GetCheckpoint(name string) (string, error) {
+	query := `
+	SELECT value
+	FROM checkpoints
+	WHERE name = ?
+	`
+	var value string
+	err := c.db.QueryRow(query, name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return value, err
+}
+
+func (c Client) SetCheckpoint(name, value string) error {
+	query := `
+	INSERT INTO checkpoints (name, value, updated_at)
+	VALUES (?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(name) DO UPDATE SET
+		value = excluded.value,
+		updated_at = excluded.updated_at
+	`
+	_, err := c.exec(query, name, value)
+	return err
+}
+
+func (c Client) DeleteCheckpoint(name string) error {
+	_, err := c.exec(`DELETE FROM checkpoints WHERE name = ?`, name)
+	return err
+}
@@ -8,7 +8,10 @@ import (
 )
 
 type Client struct {
-	db *sql.DB
+	db    *sql.DB
+	path  string
+	stats *Stats
+	hooks *hooks
 }
 
 func NewClient(pathToDB string) (Client, error) {
@@ -16,7 +19,12 @@ func NewClient(pathToDB string) (Client, error) {
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{db}
+	c := Client{
+		db:    db,
+		path:  pathToDB,
+		stats: &Stats{},
+		hooks: &hooks{},
+	}
 	err = c.autoMigrate()
 	if err != nil {
 		return Client{}, err
@@ -39,6 +47,11 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	err = c.addColumnIfNotExists("users", "role", "TEXT NOT NULL DEFAULT 'user'")
+	if err != nil {
+		return err
+	}
 	refreshTokenTable := `
 	CREATE TABLE IF NOT EXISTS refresh_tokens (
 		token TEXT PRIMARY KEY,
@@ -55,6 +68,11 @@ func (c *Client) autoMigrate() error {
 		return err
 	}
 
+	err = c.addColumnIfNotExists("refresh_tokens", "replaced_by", "TEXT")
+	if err != nil {
+		return err
+	}
+
 	videoTable := `
 	CREATE TABLE IF NOT EXISTS videos (
 		id TEXT PRIMARY KEY,
@@ -72,9 +90,397 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	err = c.addColumnIfNotExists("videos", "size_bytes", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "loudness_lufs", "REAL")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "processing_status", "TEXT NOT NULL DEFAULT 'awaiting_upload'")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "processing_error", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "original_key", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "original_size_bytes", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "lifecycle_stage", "TEXT NOT NULL DEFAULT 'awaiting_upload'")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "lifecycle_changed_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "processing_options", "TEXT NOT NULL DEFAULT '{}'")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "processing_attempts", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "next_attempt_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "needs_attention", "BOOLEAN NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "media_kind", "TEXT NOT NULL DEFAULT 'video'")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "duration_seconds", "REAL")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "bitrate_kbps", "INTEGER")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "thumbnail_auto", "BOOLEAN NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "source_hash", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "thumbnail_source_hash", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "audio_url", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "share_slug", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "visibility", "TEXT NOT NULL DEFAULT 'public'")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "artifacts_cleaned_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "version", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "thumbnail_webp_url", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "renditions", "TEXT NOT NULL DEFAULT '[]'")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "storyboard", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "animated_preview_url", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "width", "INTEGER")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "height", "INTEGER")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "frame_rate", "REAL")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("videos", "codec", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	// Upload deduplication looks videos up by their content
+	_, err = c.db.Exec(`CREATE INDEX IF NOT EXISTS idx_videos_source_hash ON videos(source_hash)`)
+	if err != nil {
+		return err
+	}
+
+	// Videos without a share slug leave it NULL, which doesn't collide
+	_, err = c.db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_videos_share_slug ON videos(share_slug)`)
+	if err != nil {
+		return err
+	}
+
+	// Videos uploaded before processing status was tracked are ready
+	_, err = c.db.Exec(`
+	UPDATE videos SET processing_status = 'ready'
+	WHERE processing_status = 'awaiting_upload' AND video_url IS NOT NULL
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Carry the coarse status over to the lifecycle stage for videos from
+	// before the stage was tracked
+	_, err = c.db.Exec(`
+	UPDATE videos SET lifecycle_stage = processing_status
+	WHERE lifecycle_stage = 'awaiting_upload' AND processing_status != 'awaiting_upload'
+	`)
+	if err != nil {
+		return err
+	}
+
+	featureFlagTable := `
+	CREATE TABLE IF NOT EXISTS feature_flags (
+		name TEXT PRIMARY KEY,
+		enabled BOOLEAN NOT NULL DEFAULT 0,
+		rollout_percentage INTEGER NOT NULL DEFAULT 100,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	_, err = c.db.Exec(featureFlagTable)
+	if err != nil {
+		return err
+	}
+
+	processingLogTable := `
+	CREATE TABLE IF NOT EXISTS processing_log_entries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		upload_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		step TEXT NOT NULL,
+		status TEXT NOT NULL,
+		started_at TIMESTAMP NOT NULL,
+		finished_at TIMESTAMP,
+		input_bytes INTEGER,
+		output_bytes INTEGER,
+		detail TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_processing_log_entries_video_id
+		ON processing_log_entries(video_id);
+	`
+	_, err = c.db.Exec(processingLogTable)
+	if err != nil {
+		return err
+	}
+
+	thumbnailCandidateTable := `
+	CREATE TABLE IF NOT EXISTS thumbnail_candidates (
+		video_id TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		score REAL NOT NULL,
+		PRIMARY KEY(video_id, position),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(thumbnailCandidateTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("thumbnail_candidates", "source_hash", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	serviceAccountTable := `
+	CREATE TABLE IF NOT EXISTS service_accounts (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		revoked_at TIMESTAMP
+	);
+	`
+	_, err = c.db.Exec(serviceAccountTable)
+	if err != nil {
+		return err
+	}
+
+	checkpointTable := `
+	CREATE TABLE IF NOT EXISTS checkpoints (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	_, err = c.db.Exec(checkpointTable)
+	if err != nil {
+		return err
+	}
+
+	deletedVideoTable := `
+	CREATE TABLE IF NOT EXISTS deleted_videos (
+		video_id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		deleted_at TIMESTAMP NOT NULL,
+		video TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_deleted_videos_deleted_at
+	ON deleted_videos(deleted_at);
+	`
+	_, err = c.db.Exec(deletedVideoTable)
+	if err != nil {
+		return err
+	}
+
+	uploadSessionTables := `
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		version INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_upload_sessions_expires_at
+	ON upload_sessions(expires_at);
+	CREATE TABLE IF NOT EXISTS upload_session_chunks (
+		session_id TEXT NOT NULL,
+		number INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		PRIMARY KEY (session_id, number)
+	);
+	`
+	_, err = c.db.Exec(uploadSessionTables)
+	if err != nil {
+		return err
+	}
+
+	processingJobTable := `
+	CREATE TABLE IF NOT EXISTS processing_jobs (
+		id TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		source_size INTEGER NOT NULL,
+		source_hash TEXT NOT NULL,
+		version INTEGER NOT NULL DEFAULT 0,
+		error TEXT,
+		created_at TIMESTAMP NOT NULL,
+		started_at TIMESTAMP,
+		finished_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_processing_jobs_status_created_at
+	ON processing_jobs(status, created_at);
+	CREATE INDEX IF NOT EXISTS idx_processing_jobs_user_id
+	ON processing_jobs(user_id);
+	`
+	_, err = c.db.Exec(processingJobTable)
+	if err != nil {
+		return err
+	}
+
+	storedObjectTable := `
+	CREATE TABLE IF NOT EXISTS stored_objects (
+		content_hash TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		size_bytes INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY(content_hash, object_key)
+	);
+	CREATE INDEX IF NOT EXISTS idx_stored_objects_object_key
+	ON stored_objects(object_key);
+	`
+	_, err = c.db.Exec(storedObjectTable)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
+// addColumnIfNotExists adds a column to an existing table so that databases
+// created before the column was introduced keep working.
+func (c *Client) addColumnIfNotExists(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// Close closes the database.
+func (c Client) Close() error {
+	return c.db.Close()
+}
+
 func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
@@ -82,6 +488,27 @@ func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM processing_log_entries"); err != nil {
+		return fmt.Errorf("failed to reset table processing_log_entries: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM thumbnail_candidates"); err != nil {
+		return fmt.Errorf("failed to reset table thumbnail_candidates: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM service_accounts"); err != nil {
+		return fmt.Errorf("failed to reset table service_accounts: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM checkpoints"); err != nil {
+		return fmt.Errorf("failed to reset table checkpoints: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM upload_session_chunks"); err != nil {
+		return fmt.Errorf("failed to reset table upload_session_chunks: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM upload_sessions"); err != nil {
+		return fmt.Errorf("failed to reset table upload_sessions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM processing_jobs"); err != nil {
+		return fmt.Errorf("failed to reset table processing_jobs: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
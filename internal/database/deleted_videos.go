@@ -0,0 +1,60 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeletedVideo is what a video looked like when it was deleted, kept for a
+// while so a repeated delete can confirm what went.
+type DeletedVideo struct {
+	DeletedAt time.Time `json:"deleted_at"`
+	Video     Video     `json:"video"`
+}
+
+// RecordDeletedVideo keeps the video's last state as of now.
+func (c Client) RecordDeletedVideo(video Video) error {
+	snapshot, err := json.Marshal(video)
+	if err != nil {
+		return err
+	}
+	query := `
+	INSERT OR REPLACE INTO deleted_videos (video_id, user_id, deleted_at, video)
+	VALUES (?, ?, ?, ?)
+	`
+	_, err = c.exec(query, video.ID, video.UserID, time.Now().UTC(), string(snapshot))
+	return err
+}
+
+// GetDeletedVideo returns the recorded state of a video deleted at or after
+// since. ok is false when there is none.
+func (c Client) GetDeletedVideo(id uuid.UUID, since time.Time) (deleted DeletedVideo, ok bool, err error) {
+	query := `
+	SELECT deleted_at, video
+	FROM deleted_videos
+	WHERE video_id = ? AND deleted_at >= ?
+	`
+	var snapshot string
+	err = c.db.QueryRow(query, id, since).Scan(&deleted.DeletedAt, &snapshot)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DeletedVideo{}, false, nil
+	}
+	if err != nil {
+		return DeletedVideo{}, false, err
+	}
+	err = json.Unmarshal([]byte(snapshot), &deleted.Video)
+	if err != nil {
+		return DeletedVideo{}, false, err
+	}
+	return deleted, true, nil
+}
+
+// PruneDeletedVideos forgets videos deleted before cutoff.
+func (c Client) PruneDeletedVideos(cutoff time.Time) error {
+	_, err := c.exec(`DELETE FROM deleted_videos WHERE deleted_at < ?`, cutoff)
+	return err
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type FeatureFlag struct {
+	Name              string    `json:"name"`
+	Enabled           bool      `json:"enabled"`
+	RolloutPercentage int       `json:"rollout_percentage"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+func (c Client) GetFeatureFlags() ([]FeatureFlag, error) {
+	query := `
+	SELECT name, enabled, rollout_percentage, updated_at
+	FROM feature_flags
+	ORDER BY name
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := []FeatureFlag{}
+	for rows.Next() {
+		var flag FeatureFlag
+		if err := rows.Scan(&flag.Name, &flag.Enabled, &flag.RolloutPercentage, &flag.UpdatedAt); err != nil {
+			return nil, err
+		}
+		flags = append(flags, flag)
+	}
+	return flags, rows.Err()
+}
+
+func (c Client) GetFeatureFlag(name string) (FeatureFlag, error) {
+	query := `
+	SELECT name, enabled, rollout_percentage, updated_at
+	FROM feature_flags
+	WHERE name = ?
+	`
+	var flag FeatureFlag
+	err := c.db.QueryRow(query, name).Scan(&flag.Name, &flag.Enabled, &flag.RolloutPercentage, &flag.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return FeatureFlag{}, nil
+		}
+		return FeatureFlag{}, err
+	}
+	return flag, nil
+}
+
+func (c Client) UpsertFeatureFlag(name string, enabled bool, rolloutPercentage int) (FeatureFlag, error) {
+	query := `
+	INSERT INTO feature_flags (name, enabled, rollout_percentage, updated_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(name) DO UPDATE SET
+		enabled = excluded.enabled,
+		rollout_percentage = excluded.rollout_percentage,
+		updated_at = CURRENT_TIMESTAMP
+	`
+	_, err := c.exec(query, name, enabled, rolloutPercentage)
+	if err != nil {
+		return FeatureFlag{}, err
+	}
+	return c.GetFeatureFlag(name)
+}
+
+// EnsureFeatureFlag creates a flag with the given defaults unless it already
+// exists, leaving any values set through the admin API untouched.
+func (c Client) EnsureFeatureFlag(name string, enabled bool, rolloutPercentage int) error {
+	query := `
+	INSERT OR IGNORE INTO feature_flags (name, enabled, rollout_percentage, updated_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err := c.exec(query, name, enabled, rolloutPercentage)
+	return err
+}
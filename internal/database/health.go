@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	busyRetryAttempts = 5
+	busyRetryDelay    = 50 * time.Millisecond
+)
+
+// Stats counts lock contention seen by write queries.
+type Stats struct {
+	BusyRetries   atomic.Int64
+	LockedRetries atomic.Int64
+}
+
+// Stats returns the live contention counters for the client.
+func (c Client) Stats() *Stats {
+	return c.stats
+}
+
+// exec runs a write query, retrying with a short backoff when SQLite reports
+// the database as busy or locked by another connection.
+func (c Client) exec(query string, args ...any) (sql.Result, error) {
+	var result sql.Result
+	var err error
+	for attempt := 0; attempt < busyRetryAttempts; attempt++ {
+		result, err = c.db.Exec(query, args...)
+		var sqliteErr sqlite3.Error
+		if !errors.As(err, &sqliteErr) {
+			return result, err
+		}
+		switch sqliteErr.Code {
+		case sqlite3.ErrBusy:
+			c.stats.BusyRetries.Add(1)
+		case sqlite3.ErrLocked:
+			c.stats.LockedRetries.Add(1)
+		default:
+			return result, err
+		}
+		time.Sleep(busyRetryDelay * time.Duration(attempt+1))
+	}
+	return result, err
+}
+
+type FileStats struct {
+	FileSizeBytes int64
+	WALSizeBytes  int64
+	PageCount     int64
+	PageSize      int64
+}
+
+// FileStats reports the on-disk size of the database and its write-ahead
+// log. File sizes come from stat and the page counts are single-row pragmas,
+// so collecting them never holds a lock long enough to stall uploads.
+func (c Client) FileStats(ctx context.Context) (FileStats, error) {
+	var stats FileStats
+
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return FileStats{}, err
+	}
+	stats.FileSizeBytes = info.Size()
+
+	walInfo, err := os.Stat(c.path + "-wal")
+	if err == nil {
+		stats.WALSizeBytes = walInfo.Size()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return FileStats{}, err
+	}
+
+	err = c.db.QueryRowContext(ctx, "PRAGMA page_count").Scan(&stats.PageCount)
+	if err != nil {
+		return FileStats{}, err
+	}
+	err = c.db.QueryRowContext(ctx, "PRAGMA page_size").Scan(&stats.PageSize)
+	if err != nil {
+		return FileStats{}, err
+	}
+	return stats, nil
+}
+
+// IntegrityCheck runs PRAGMA integrity_check and returns the reported
+// problems, or a single "ok" row for a healthy database. The context bounds
+// how long the check may run.
+func (c Client) IntegrityCheck(ctx context.Context) ([]string, error) {
+	rows, err := c.db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []string{}
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,270 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Coarse processing statuses, derived from the lifecycle stage.
+const (
+	ProcessingStatusAwaitingUpload = "awaiting_upload"
+	ProcessingStatusProcessing     = "processing"
+	ProcessingStatusReady          = "ready"
+	ProcessingStatusFailed         = "failed"
+)
+
+// Lifecycle stages of a video, from creation to a final outcome.
+const (
+	StageAwaitingUpload = "awaiting_upload"
+	StageUploaded       = "uploaded"
+	StageScanning       = "scanning"
+	StageProcessing     = "processing"
+	StageModeration     = "moderation"
+	StageReady          = "ready"
+	StageRejected       = "rejected"
+	StageFailed         = "failed"
+	// StagePoisoned is for videos that failed processing too many times.
+	// Only an admin can move them back to failed so they can be retried.
+	StagePoisoned = "poisoned"
+)
+
+// lifecycleTransitions lists the stages each stage may move to. A finished
+// video can only go back to uploaded, when its file is replaced, except that
+// a ready video whose stored file turns out to be invalid can be rejected.
+var lifecycleTransitions = map[string][]string{
+	StageAwaitingUpload: {StageUploaded},
+	StageUploaded:       {StageScanning, StageProcessing, StageFailed},
+	StageScanning:       {StageProcessing, StageRejected, StageFailed},
+	StageProcessing:     {StageModeration, StageReady, StageFailed},
+	StageModeration:     {StageReady, StageRejected, StageFailed},
+	StageReady:          {StageUploaded, StageRejected},
+	StageRejected:       {StageUploaded},
+	StageFailed:         {StageUploaded, StagePoisoned},
+	StagePoisoned:       {StageFailed},
+}
+
+var (
+	ErrIllegalTransition = errors.New("illegal lifecycle transition")
+	ErrStaleTransition   = errors.New("video is no longer in the expected lifecycle stage")
+)
+
+// CanTransition reports whether a video may move from one lifecycle stage to
+// another.
+func CanTransition(from, to string) bool {
+	for _, next := range lifecycleTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTerminalStage reports whether a video has finished the lifecycle, so
+// nothing is working on it.
+func IsTerminalStage(stage string) bool {
+	switch stage {
+	case StageAwaitingUpload, StageReady, StageRejected, StageFailed, StagePoisoned:
+		return true
+	}
+	return false
+}
+
+// CoarseStatus maps a lifecycle stage onto the processing status older
+// clients understand.
+func CoarseStatus(stage string) string {
+	switch stage {
+	case StageAwaitingUpload:
+		return ProcessingStatusAwaitingUpload
+	case StageReady:
+		return ProcessingStatusReady
+	case StageRejected, StageFailed, StagePoisoned:
+		return ProcessingStatusFailed
+	}
+	return ProcessingStatusProcessing
+}
+
+// TransitionVideo moves a video from its current lifecycle stage to another
+// and updates the struct to match. It is the only place the stage, status
+// and processing error columns are written. The update only applies if the
+// stored video is still in the stage the struct holds, so two writers racing
+// on the same video can't both win; the loser gets ErrStaleTransition. perr
+// is recorded for failed and rejected videos and cleared otherwise.
+func (c Client) TransitionVideo(video *Video, to string, perr *ProcessingError) error {
+	from := video.LifecycleStage
+	if !CanTransition(from, to) {
+		return fmt.Errorf("%w: %s to %s", ErrIllegalTransition, from, to)
+	}
+	if to != StageFailed && to != StageRejected && to != StagePoisoned {
+		perr = nil
+	}
+
+	now := time.Now().UTC()
+	query := `
+	UPDATE videos
+	SET lifecycle_stage = ?, lifecycle_changed_at = ?, processing_status = ?, processing_error = ?
+	WHERE id = ? AND lifecycle_stage = ?
+	`
+	res, err := c.exec(query, to, now, CoarseStatus(to), perr, video.ID, from)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: expected %s", ErrStaleTransition, from)
+	}
+
+	video.LifecycleStage = to
+	video.LifecycleChangedAt = &now
+	video.ProcessingStatus = CoarseStatus(to)
+	video.ProcessingError = perr
+	for _, fn := range c.hooks.stageChange {
+		fn(video.ID)
+	}
+	return nil
+}
+
+// hooks are callbacks run after writes other parts of the server react to.
+type hooks struct {
+	stageChange []func(videoID uuid.UUID)
+}
+
+// OnStageChange registers fn to run after every successful TransitionVideo.
+// Register hooks at startup, before the client is shared between
+// goroutines.
+func (c Client) OnStageChange(fn func(videoID uuid.UUID)) {
+	c.hooks.stageChange = append(c.hooks.stageChange, fn)
+}
+
+// SetProcessingAttempts records how many times in a row processing has
+// failed for the video and when it may next be attempted.
+func (c Client) SetProcessingAttempts(video *Video, attempts int, nextAttemptAt *time.Time) error {
+	query := `
+	UPDATE videos
+	SET processing_attempts = ?, next_attempt_at = ?
+	WHERE id = ?
+	`
+	_, err := c.exec(query, attempts, nextAttemptAt, video.ID)
+	if err != nil {
+		return err
+	}
+	video.ProcessingAttempts = attempts
+	video.NextAttemptAt = nextAttemptAt
+	return nil
+}
+
+// GetFailedVideosToClean returns up to limit failed or poisoned videos
+// that have been in that stage since before cutoff and haven't been
+// cleaned up since they got there, oldest first.
+func (c Client) GetFailedVideosToClean(cutoff time.Time, limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE lifecycle_stage IN (?, ?)
+		AND lifecycle_changed_at < ?
+		AND (artifacts_cleaned_at IS NULL OR artifacts_cleaned_at < lifecycle_changed_at)
+	ORDER BY lifecycle_changed_at
+	LIMIT ?
+	`
+	rows, err := c.db.Query(query, StageFailed, StagePoisoned, cutoff.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
+
+// SetArtifactsCleaned records that a failed video's leftovers were removed,
+// so it isn't cleaned again until it fails again.
+func (c Client) SetArtifactsCleaned(videoID uuid.UUID) error {
+	_, err := c.exec(`UPDATE videos SET artifacts_cleaned_at = ? WHERE id = ?`, time.Now().UTC(), videoID)
+	return err
+}
+
+// GetVideosInStage returns every video in the given lifecycle stage, most
+// recently changed first.
+func (c Client) GetVideosInStage(stage string) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE lifecycle_stage = ?
+	ORDER BY lifecycle_changed_at DESC
+	`
+	rows, err := c.db.Query(query, stage)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, nil
+}
+
+// FailInterruptedVideos moves every video that was part way through the
+// lifecycle to failed, apart from those with a queued processing job, which
+// will still be processed. Anything else was being processed by the
+// previous run, so at startup nothing can still be working on it.
+func (c Client) FailInterruptedVideos(perr ProcessingError) (int64, error) {
+	query := `
+	UPDATE videos
+	SET lifecycle_stage = ?, processing_status = ?, processing_error = ?
+	WHERE lifecycle_stage IN (?, ?, ?, ?)
+	AND id NOT IN (SELECT video_id FROM processing_jobs WHERE status = ?)
+	`
+	res, err := c.exec(query, StageFailed, ProcessingStatusFailed, perr, StageUploaded, StageScanning, StageProcessing, StageModeration, JobStatusQueued)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ProcessingError describes why processing a video failed in terms a client
+// can act on. Code values are stable and safe to branch on.
+type ProcessingError struct {
+	Stage     string `json:"stage"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+}
+
+func (e ProcessingError) Value() (driver.Value, error) {
+	dat, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return string(dat), nil
+}
+
+func (e *ProcessingError) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), e)
+	case []byte:
+		return json.Unmarshal(v, e)
+	default:
+		return fmt.Errorf("unsupported processing error type %T", src)
+	}
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Processing job statuses.
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+)
+
+// ProcessingJob is a received upload waiting for, or going through, the
+// processing pipeline in the background.
+type ProcessingJob struct {
+	ID      uuid.UUID `json:"id"`
+	VideoID uuid.UUID `json:"video_id"`
+	UserID  uuid.UUID `json:"user_id"`
+	Status  string    `json:"status"`
+	// SourceSize and SourceHash describe the received file
+	SourceSize int64  `json:"source_size"`
+	SourceHash string `json:"-"`
+	// Version is stored with the processed file
+	Version    int              `json:"version"`
+	Error      *ProcessingError `json:"error"`
+	CreatedAt  time.Time        `json:"created_at"`
+	StartedAt  *time.Time       `json:"started_at"`
+	FinishedAt *time.Time       `json:"finished_at"`
+}
+
+const processingJobColumns = `id, video_id, user_id, status, source_size, source_hash, version, error, created_at, started_at, finished_at`
+
+func scanProcessingJob(row interface{ Scan(...any) error }) (ProcessingJob, error) {
+	var job ProcessingJob
+	err := row.Scan(&job.ID, &job.VideoID, &job.UserID, &job.Status, &job.SourceSize, &job.SourceHash,
+		&job.Version, &job.Error, &job.CreatedAt, &job.StartedAt, &job.FinishedAt)
+	return job, err
+}
+
+// CreateProcessingJob queues a job. The caller picks its ID.
+func (c Client) CreateProcessingJob(job ProcessingJob) (ProcessingJob, error) {
+	job.Status = JobStatusQueued
+	job.CreatedAt = time.Now().UTC()
+	job.Error = nil
+	query := `
+	INSERT INTO processing_jobs (id, video_id, user_id, status, source_size, source_hash, version, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.exec(query, job.ID, job.VideoID, job.UserID, job.Status, job.SourceSize, job.SourceHash, job.Version, job.CreatedAt)
+	if err != nil {
+		return ProcessingJob{}, err
+	}
+	return job, nil
+}
+
+// GetProcessingJob returns the job with the given ID. ok is false when
+// there is none.
+func (c Client) GetProcessingJob(id uuid.UUID) (job ProcessingJob, ok bool, err error) {
+	query := `SELECT ` + processingJobColumns + ` FROM processing_jobs WHERE id = ?`
+	job, err = scanProcessingJob(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ProcessingJob{}, false, nil
+	}
+	if err != nil {
+		return ProcessingJob{}, false, err
+	}
+	return job, true, nil
+}
+
+// ClaimNextProcessingJob marks the oldest queued job as running and
+// returns it. ok is false when nothing is queued. Workers racing for the
+// same job can't both get it.
+func (c Client) ClaimNextProcessingJob() (job ProcessingJob, ok bool, err error) {
+	for {
+		query := `
+		SELECT ` + processingJobColumns + `
+		FROM processing_jobs
+		WHERE status = ?
+		ORDER BY created_at
+		LIMIT 1
+		`
+		job, err = scanProcessingJob(c.db.QueryRow(query, JobStatusQueued))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ProcessingJob{}, false, nil
+		}
+		if err != nil {
+			return ProcessingJob{}, false, err
+		}
+
+		now := time.Now().UTC()
+		res, err := c.exec(`UPDATE processing_jobs SET status = ?, started_at = ? WHERE id = ? AND status = ?`,
+			JobStatusRunning, now, job.ID, JobStatusQueued)
+		if err != nil {
+			return ProcessingJob{}, false, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return ProcessingJob{}, false, err
+		}
+		if n == 0 {
+			// Another worker took it first
+			continue
+		}
+		job.Status = JobStatusRunning
+		job.StartedAt = &now
+		return job, true, nil
+	}
+}
+
+// RequeueProcessingJob puts a running job back in the queue, for a worker
+// that stopped before starting on it.
+func (c Client) RequeueProcessingJob(id uuid.UUID) error {
+	_, err := c.exec(`UPDATE processing_jobs SET status = ?, started_at = NULL WHERE id = ? AND status = ?`,
+		JobStatusQueued, id, JobStatusRunning)
+	return err
+}
+
+// FinishProcessingJob records a job's outcome: failed with perr, or
+// succeeded when perr is nil.
+func (c Client) FinishProcessingJob(id uuid.UUID, perr *ProcessingError) error {
+	status := JobStatusSucceeded
+	if perr != nil {
+		status = JobStatusFailed
+	}
+	query := `
+	UPDATE processing_jobs
+	SET status = ?, error = ?, finished_at = ?
+	WHERE id = ?
+	`
+	_, err := c.exec(query, status, perr, time.Now().UTC(), id)
+	return err
+}
+
+// CountActiveProcessingJobs counts the user's queued and running jobs.
+func (c Client) CountActiveProcessingJobs(userID uuid.UUID) (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM processing_jobs
+	WHERE user_id = ? AND status IN (?, ?)
+	`
+	var n int
+	err := c.db.QueryRow(query, userID, JobStatusQueued, JobStatusRunning).Scan(&n)
+	return n, err
+}
+
+// FailRunningProcessingJobs fails every job marked as running. At startup
+// nothing can still be working on them.
+func (c Client) FailRunningProcessingJobs(perr ProcessingError) (int64, error) {
+	query := `
+	UPDATE processing_jobs
+	SET status = ?, error = ?, finished_at = ?
+	WHERE status = ?
+	`
+	res, err := c.exec(query, JobStatusFailed, perr, time.Now().UTC(), JobStatusRunning)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteFinishedProcessingJobs removes jobs that finished before cutoff.
+func (c Client) DeleteFinishedProcessingJobs(cutoff time.Time) (int64, error) {
+	query := `
+	DELETE FROM processing_jobs
+	WHERE status IN (?, ?) AND finished_at < ?
+	`
+	res, err := c.exec(query, JobStatusSucceeded, JobStatusFailed, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ProcessingLogEntry struct {
+	UploadID    uuid.UUID  `json:"upload_id"`
+	VideoID     uuid.UUID  `json:"-"`
+	Step        string     `json:"step"`
+	Status      string     `json:"status"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+	InputBytes  *int64     `json:"input_bytes"`
+	OutputBytes *int64     `json:"output_bytes"`
+	Detail      string     `json:"detail"`
+}
+
+func (c Client) CreateProcessingLogEntries(entries []ProcessingLogEntry) error {
+	query := `
+	INSERT INTO processing_log_entries (
+		upload_id,
+		video_id,
+		step,
+		status,
+		started_at,
+		finished_at,
+		input_bytes,
+		output_bytes,
+		detail
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, entry := range entries {
+		_, err := tx.Exec(
+			query,
+			entry.UploadID,
+			entry.VideoID,
+			entry.Step,
+			entry.Status,
+			entry.StartedAt,
+			entry.FinishedAt,
+			entry.InputBytes,
+			entry.OutputBytes,
+			entry.Detail,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetProcessingLog returns every logged step for the video, newest upload
+// first and steps in the order they ran.
+func (c Client) GetProcessingLog(videoID uuid.UUID) ([]ProcessingLogEntry, error) {
+	query := `
+	SELECT
+		e.upload_id,
+		e.video_id,
+		e.step,
+		e.status,
+		e.started_at,
+		e.finished_at,
+		e.input_bytes,
+		e.output_bytes,
+		e.detail
+	FROM processing_log_entries e
+	JOIN (
+		SELECT upload_id, MIN(started_at) AS upload_started_at
+		FROM processing_log_entries
+		WHERE video_id = ?
+		GROUP BY upload_id
+	) u ON u.upload_id = e.upload_id
+	WHERE e.video_id = ?
+	ORDER BY u.upload_started_at DESC, e.id ASC
+	`
+	rows, err := c.db.Query(query, videoID, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []ProcessingLogEntry{}
+	for rows.Next() {
+		var entry ProcessingLogEntry
+		if err := rows.Scan(
+			&entry.UploadID,
+			&entry.VideoID,
+			&entry.Step,
+			&entry.Status,
+			&entry.StartedAt,
+			&entry.FinishedAt,
+			&entry.InputBytes,
+			&entry.OutputBytes,
+			&entry.Detail,
+		); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// PruneProcessingLog keeps the log entries of the most recent keepUploads
+// uploads of a video and deletes the rest.
+func (c Client) PruneProcessingLog(videoID uuid.UUID, keepUploads int) error {
+	query := `
+	DELETE FROM processing_log_entries
+	WHERE video_id = ?
+	AND upload_id NOT IN (
+		SELECT upload_id
+		FROM processing_log_entries
+		WHERE video_id = ?
+		GROUP BY upload_id
+		ORDER BY MIN(started_at) DESC
+		LIMIT ?
+	)
+	`
+	_, err := c.exec(query, videoID, videoID, keepUploads)
+	return err
+}
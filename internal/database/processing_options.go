@@ -0,0 +1,70 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// ProcessingOptions are the per-video settings the processing pipeline
+// consumes. This struct is the schema for them: every field is treated as
+// processing-affecting, so it can't be changed while the video is being
+// processed. Plain metadata such as the title belongs on Video instead.
+type ProcessingOptions struct {
+	// EncodingProfile names the preset the video is encoded with. Empty
+	// keeps the uploaded streams as they are.
+	EncodingProfile string `json:"encoding_profile,omitempty"`
+	// OutputFormat is "mp4" for a single progressive file, or "hls" or
+	// "dash" for segments under a manifest. Empty follows the server.
+	OutputFormat string `json:"output_format,omitempty"`
+
+	// The flags below override the server's setting for this video. Nil
+	// follows the server.
+
+	// GenerateThumbnails picks a thumbnail from candidate frames when the
+	// owner hasn't uploaded one. Turning it off also stops the single
+	// frame thumbnail AUTO_THUMBNAIL would use. Audio records have no
+	// frames.
+	GenerateThumbnails *bool `json:"generate_thumbnails,omitempty"`
+	// MeasureLoudness measures integrated loudness while processing.
+	MeasureLoudness *bool `json:"measure_loudness,omitempty"`
+	// KeepOriginal stores the untouched upload so the video can be
+	// reprocessed later.
+	KeepOriginal *bool `json:"keep_original,omitempty"`
+	// GenerateRenditions encodes lower resolution copies of the video for
+	// adaptive playback. Audio records have no picture to scale.
+	GenerateRenditions *bool `json:"generate_renditions,omitempty"`
+	// GenerateStoryboard makes a sprite sheet and WebVTT file for seek bar
+	// previews. Audio records have no frames.
+	GenerateStoryboard *bool `json:"generate_storyboard,omitempty"`
+	// GenerateAnimatedPreview makes a short looping clip for hover
+	// previews. Audio records have no frames.
+	GenerateAnimatedPreview *bool `json:"generate_animated_preview,omitempty"`
+}
+
+// Enabled resolves a flag against the server's setting.
+func Enabled(flag *bool, serverDefault bool) bool {
+	if flag == nil {
+		return serverDefault
+	}
+	return *flag
+}
+
+func (o ProcessingOptions) Value() (driver.Value, error) {
+	dat, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+	return string(dat), nil
+}
+
+func (o *ProcessingOptions) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), o)
+	case []byte:
+		return json.Unmarshal(v, o)
+	default:
+		return fmt.Errorf("unsupported processing options type %T", src)
+	}
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+var allStages = []string{
+	StageAwaitingUpload,
+	StageUploaded,
+	StageScanning,
+	StageProcessing,
+	StageModeration,
+	StageReady,
+	StageRejected,
+	StageFailed,
+	StagePoisoned,
+}
+
+func newTestClient(t *testing.T) Client {
+	t.Helper()
+	c, err := NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { c.db.Close() })
+	return c
+}
+
+// newVideoInStage creates a video and puts it straight into a stage,
+// bypassing the transition rules under test.
+func newVideoInStage(t *testing.T, c Client, stage string) Video {
+	t.Helper()
+	video, err := c.CreateVideo(CreateVideoParams{Title: "t", UserID: uuid.New()}, ProcessingOptions{})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	_, err = c.db.Exec(`UPDATE videos SET lifecycle_stage = ?, processing_status = ? WHERE id = ?`, stage, CoarseStatus(stage), video.ID)
+	if err != nil {
+		t.Fatalf("setting stage: %v", err)
+	}
+	video, err = c.GetVideo(video.ID)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	return video
+}
+
+func TestTransitionVideo(t *testing.T) {
+	c := newTestClient(t)
+	perr := &ProcessingError{Code: "test", Message: "test failure"}
+
+	for _, from := range allStages {
+		for _, to := range allStages {
+			legal := slices.Contains(lifecycleTransitions[from], to)
+			t.Run(from+"->"+to, func(t *testing.T) {
+				if got := CanTransition(from, to); got != legal {
+					t.Fatalf("CanTransition(%s, %s) = %v, want %v", from, to, got, legal)
+				}
+
+				video := newVideoInStage(t, c, from)
+				before := video
+				err := c.TransitionVideo(&video, to, perr)
+				stored, getErr := c.GetVideo(video.ID)
+				if getErr != nil {
+					t.Fatalf("GetVideo: %v", getErr)
+				}
+
+				if !legal {
+					if !errors.Is(err, ErrIllegalTransition) {
+						t.Fatalf("TransitionVideo = %v, want ErrIllegalTransition", err)
+					}
+					if video.LifecycleStage != from || video.ProcessingStatus != before.ProcessingStatus || video.LifecycleChangedAt != before.LifecycleChangedAt {
+						t.Errorf("struct changed on an illegal transition: %+v", video)
+					}
+					if stored.LifecycleStage != from || stored.ProcessingStatus != CoarseStatus(from) ||
+						stored.LifecycleChangedAt != nil || stored.ProcessingError != nil {
+						t.Errorf("illegal transition wrote the row: stage %s, status %s, changed %v, error %v",
+							stored.LifecycleStage, stored.ProcessingStatus, stored.LifecycleChangedAt, stored.ProcessingError)
+					}
+					return
+				}
+
+				if err != nil {
+					t.Fatalf("TransitionVideo: %v", err)
+				}
+				if stored.LifecycleStage != to || video.LifecycleStage != to {
+					t.Errorf("stage is %s stored, %s in struct, want %s", stored.LifecycleStage, video.LifecycleStage, to)
+				}
+				if stored.ProcessingStatus != CoarseStatus(to) {
+					t.Errorf("status = %s, want %s", stored.ProcessingStatus, CoarseStatus(to))
+				}
+				keepsError := to == StageFailed || to == StageRejected || to == StagePoisoned
+				if (stored.ProcessingError != nil) != keepsError {
+					t.Errorf("processing error = %v, want recorded %v", stored.ProcessingError, keepsError)
+				}
+			})
+		}
+	}
+}
+
+func TestTransitionVideoStale(t *testing.T) {
+	c := newTestClient(t)
+	video := newVideoInStage(t, c, StageUploaded)
+
+	// Another writer moves the video on first
+	other := video
+	err := c.TransitionVideo(&other, StageProcessing, nil)
+	if err != nil {
+		t.Fatalf("TransitionVideo: %v", err)
+	}
+
+	err = c.TransitionVideo(&video, StageFailed, nil)
+	if !errors.Is(err, ErrStaleTransition) {
+		t.Fatalf("TransitionVideo = %v, want ErrStaleTransition", err)
+	}
+	if video.LifecycleStage != StageUploaded {
+		t.Errorf("stale struct moved to %s", video.LifecycleStage)
+	}
+	stored, err := c.GetVideo(video.ID)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if stored.LifecycleStage != StageProcessing {
+		t.Errorf("stored stage = %s, want %s", stored.LifecycleStage, StageProcessing)
+	}
+}
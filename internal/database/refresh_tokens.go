@@ -2,16 +2,26 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is unknown, expired or revoked")
+	// ErrRefreshTokenReused means a token that was already rotated was
+	// presented again, so one of its holders isn't its owner
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+)
+
 type RefreshToken struct {
 	CreateRefreshTokenParams
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	RevokedAt *time.Time `json:"revoked_at"`
+	// ReplacedBy is the token this one was rotated to
+	ReplacedBy *string `json:"-"`
 }
 
 type CreateRefreshTokenParams struct {
@@ -30,7 +40,7 @@ func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToke
 			expires_at
 		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
 	`
-	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt)
+	_, err := c.exec(query, params.Token, params.UserID.String(), params.ExpiresAt)
 	if err != nil {
 		return RefreshToken{}, err
 	}
@@ -41,23 +51,107 @@ func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToke
 func (c Client) RevokeRefreshToken(token string) error {
 	query := `
 		UPDATE refresh_tokens
-		SET revoked_at = CURRENT_TIMESTAMP
-		WHERE token = ?
+		SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE token = ? AND revoked_at IS NULL
 	`
-	_, err := c.db.Exec(query, token)
+	_, err := c.exec(query, token)
 	return err
 }
 
+// RevokeUserRefreshTokens revokes every live refresh token of a user,
+// signing them out everywhere once their access tokens expire.
+func (c Client) RevokeUserRefreshTokens(userID uuid.UUID) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND revoked_at IS NULL
+	`
+	_, err := c.exec(query, userID.String())
+	return err
+}
+
+// RotateRefreshToken exchanges a live refresh token for nextToken, issued
+// to the same user and expiring at nextExpiresAt, and returns the new one.
+// The old token is revoked in the same transaction, so it can only be
+// exchanged once. It returns
+// ErrRefreshTokenInvalid for a token that can't be exchanged, and
+// ErrRefreshTokenReused for one that already was, after revoking every
+// token of its user: the token leaked, and it isn't known which holder
+// is the user.
+func (c Client) RotateRefreshToken(token, nextToken string, nextExpiresAt time.Time) (RefreshToken, error) {
+	rt, err := c.GetRefreshToken(token)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if rt.Token == "" {
+		return RefreshToken{}, ErrRefreshTokenInvalid
+	}
+	if rt.ReplacedBy != nil {
+		err := c.RevokeUserRefreshTokens(rt.UserID)
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		return RefreshToken{}, ErrRefreshTokenReused
+	}
+	if rt.RevokedAt != nil || !time.Now().Before(rt.ExpiresAt) {
+		return RefreshToken{}, ErrRefreshTokenInvalid
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	defer tx.Rollback()
+
+	// Another request may have rotated the token since it was read
+	result, err := tx.Exec(`
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP, replaced_by = ?
+		WHERE token = ? AND revoked_at IS NULL
+	`, nextToken, token)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if rows == 0 {
+		tx.Rollback()
+		err := c.RevokeUserRefreshTokens(rt.UserID)
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		return RefreshToken{}, ErrRefreshTokenReused
+	}
+	_, err = tx.Exec(`
+		INSERT INTO refresh_tokens (
+			token,
+			created_at,
+			updated_at,
+			user_id,
+			expires_at
+		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+	`, nextToken, rt.UserID.String(), nextExpiresAt)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return RefreshToken{}, err
+	}
+	return c.GetRefreshToken(nextToken)
+}
+
 func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
 	query := `
-		SELECT token, created_at, updated_at, user_id, expires_at, revoked_at
+		SELECT token, created_at, updated_at, user_id, expires_at, revoked_at, replaced_by
 		FROM refresh_tokens
 		WHERE token = ?
 	`
 	var rt RefreshToken
 	var userID string
 	err := c.db.QueryRow(query, token).
-		Scan(&rt.Token, &rt.CreatedAt, &rt.UpdatedAt, &userID, &rt.ExpiresAt, &rt.RevokedAt)
+		Scan(&rt.Token, &rt.CreatedAt, &rt.UpdatedAt, &userID, &rt.ExpiresAt, &rt.RevokedAt, &rt.ReplacedBy)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return RefreshToken{}, nil
@@ -78,6 +172,6 @@ func (c Client) DeleteRefreshToken(token string) error {
 		DELETE FROM refresh_tokens
 		WHERE token = ?
 	`
-	_, err := c.db.Exec(query, token)
+	_, err := c.exec(query, token)
 	return err
 }
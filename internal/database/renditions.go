@@ -0,0 +1,55 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// Rendition is one of the lower resolution copies of a video made for
+// adaptive playback.
+type Rendition struct {
+	// Name is the rendition's rung on the ladder, such as "720p"
+	Name      string `json:"name"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	URL       string `json:"url"`
+	SizeBytes int64  `json:"size_bytes"`
+	// BitrateKbps is what the rendition was encoded for, video and audio
+	// together
+	BitrateKbps int `json:"bitrate_kbps"`
+}
+
+// Renditions are stored as a JSON array, highest resolution first.
+type Renditions []Rendition
+
+func (r Renditions) Value() (driver.Value, error) {
+	if r == nil {
+		r = Renditions{}
+	}
+	dat, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(dat), nil
+}
+
+func (r *Renditions) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), r)
+	case []byte:
+		return json.Unmarshal(v, r)
+	default:
+		return fmt.Errorf("unsupported renditions type %T", src)
+	}
+}
+
+// URLs returns the renditions' URLs.
+func (r Renditions) URLs() []string {
+	urls := make([]string, 0, len(r))
+	for _, rendition := range r {
+		urls = append(urls, rendition.URL)
+	}
+	return urls
+}
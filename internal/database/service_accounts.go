@@ -0,0 +1,96 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ServiceAccount is a non-user identity, such as the analytics service,
+// that may read every video's metadata but nothing else.
+type ServiceAccount struct {
+	ID        uuid.UUID  `json:"id"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+func (c Client) CreateServiceAccount(name string) (ServiceAccount, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO service_accounts (id, name, created_at)
+	VALUES (?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err := c.exec(query, id, name)
+	if err != nil {
+		return ServiceAccount{}, err
+	}
+	return c.GetServiceAccount(id)
+}
+
+// GetServiceAccount returns the account, or a zero ServiceAccount if there
+// is none with that ID.
+func (c Client) GetServiceAccount(id uuid.UUID) (ServiceAccount, error) {
+	query := `
+	SELECT id, name, created_at, revoked_at
+	FROM service_accounts
+	WHERE id = ?
+	`
+	account, err := scanServiceAccount(c.db.QueryRow(query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ServiceAccount{}, nil
+	}
+	return account, err
+}
+
+func (c Client) GetServiceAccounts() ([]ServiceAccount, error) {
+	query := `
+	SELECT id, name, created_at, revoked_at
+	FROM service_accounts
+	ORDER BY created_at, id
+	`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []ServiceAccount{}
+	for rows.Next() {
+		account, err := scanServiceAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// RevokeServiceAccount stops the account's token from being accepted. It
+// reports false if there was no unrevoked account with that ID.
+func (c Client) RevokeServiceAccount(id uuid.UUID) (bool, error) {
+	query := `
+	UPDATE service_accounts
+	SET revoked_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND revoked_at IS NULL
+	`
+	result, err := c.exec(query, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func scanServiceAccount(row rowScanner) (ServiceAccount, error) {
+	var account ServiceAccount
+	var id string
+	err := row.Scan(&id, &account.Name, &account.CreatedAt, &account.RevokedAt)
+	if err != nil {
+		return ServiceAccount{}, err
+	}
+	account.ID, err = uuid.Parse(id)
+	return account, err
+}
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// StoredObject is a processed file in storage, recorded under the hash of
+// its content so identical output is only stored once.
+type StoredObject struct {
+	ContentHash string
+	Key         string
+	// UserID is the owner of the video the file was stored for
+	UserID    uuid.UUID
+	SizeBytes int64
+	CreatedAt time.Time
+}
+
+// RecordStoredObject remembers a processed file by its content hash.
+func (c Client) RecordStoredObject(obj StoredObject) error {
+	query := `
+	INSERT OR REPLACE INTO stored_objects (content_hash, object_key, user_id, size_bytes, created_at)
+	VALUES (?, ?, ?, ?, ?)
+	`
+	_, err := c.exec(query, obj.ContentHash, obj.Key, obj.UserID, obj.SizeBytes, time.Now().UTC())
+	return err
+}
+
+// FindStoredObjects returns the processed files recorded with the content
+// hash, oldest first, only those stored for userID's videos unless it is
+// nil. Rows can outlive their files, so callers check a file is still in
+// use before pointing at it.
+func (c Client) FindStoredObjects(contentHash string, userID *uuid.UUID) ([]StoredObject, error) {
+	query := `
+	SELECT content_hash, object_key, user_id, size_bytes, created_at
+	FROM stored_objects
+	WHERE content_hash = ?
+		AND (? IS NULL OR user_id = ?)
+	ORDER BY created_at, object_key
+	`
+	rows, err := c.db.Query(query, contentHash, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var objects []StoredObject
+	for rows.Next() {
+		var obj StoredObject
+		if err := rows.Scan(&obj.ContentHash, &obj.Key, &obj.UserID, &obj.SizeBytes, &obj.CreatedAt); err != nil {
+			return nil, err
+		}
+		objects = append(objects, obj)
+	}
+	return objects, rows.Err()
+}
+
+// DeleteStoredObject forgets a processed file that was removed from
+// storage.
+func (c Client) DeleteStoredObject(key string) error {
+	_, err := c.exec(`DELETE FROM stored_objects WHERE object_key = ?`, key)
+	return err
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// Storyboard is a sprite sheet of frames taken at regular intervals and a
+// WebVTT file mapping each interval to its tile, which players use for
+// previews while hovering over the seek bar.
+type Storyboard struct {
+	// URL is the WebVTT file players load
+	URL       string `json:"url"`
+	SpriteURL string `json:"sprite_url"`
+	// IntervalSeconds is the time between frames
+	IntervalSeconds float64 `json:"interval_seconds"`
+	TileWidth       int     `json:"tile_width"`
+	TileHeight      int     `json:"tile_height"`
+	Columns         int     `json:"columns"`
+	Rows            int     `json:"rows"`
+}
+
+// Storyboards are stored as a JSON object, or NULL when there is none.
+func (s Storyboard) Value() (driver.Value, error) {
+	dat, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return string(dat), nil
+}
+
+func (s *Storyboard) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	case []byte:
+		return json.Unmarshal(v, s)
+	default:
+		return fmt.Errorf("unsupported storyboard type %T", src)
+	}
+}
+
+// URLs returns the URLs of the storyboard's files.
+func (s Storyboard) URLs() []string {
+	return []string{s.URL, s.SpriteURL}
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"github.com/google/uuid"
+)
+
+type ThumbnailCandidate struct {
+	VideoID  uuid.UUID `json:"-"`
+	Position int       `json:"position"`
+	URL      string    `json:"url"`
+	Score    float64   `json:"score"`
+	// SourceHash is the content hash of the upload the frame came from
+	SourceHash string `json:"-"`
+}
+
+// ReplaceThumbnailCandidates swaps the stored candidates for a video with a
+// new set, returning the URLs of the ones it removed.
+func (c Client) ReplaceThumbnailCandidates(videoID uuid.UUID, candidates []ThumbnailCandidate) ([]string, error) {
+	old, err := c.GetThumbnailCandidates(videoID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM thumbnail_candidates WHERE video_id = ?`, videoID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+	INSERT INTO thumbnail_candidates (video_id, position, url, score, source_hash)
+	VALUES (?, ?, ?, ?, ?)
+	`
+	for _, candidate := range candidates {
+		_, err := tx.Exec(query, videoID, candidate.Position, candidate.URL, candidate.Score, candidate.SourceHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	removed := make([]string, 0, len(old))
+	for _, candidate := range old {
+		removed = append(removed, candidate.URL)
+	}
+	return removed, nil
+}
+
+func (c Client) GetThumbnailCandidates(videoID uuid.UUID) ([]ThumbnailCandidate, error) {
+	query := `
+	SELECT video_id, position, url, score, source_hash
+	FROM thumbnail_candidates
+	WHERE video_id = ?
+	ORDER BY position
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := []ThumbnailCandidate{}
+	for rows.Next() {
+		var candidate ThumbnailCandidate
+		if err := rows.Scan(&candidate.VideoID, &candidate.Position, &candidate.URL, &candidate.Score, &candidate.SourceHash); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, rows.Err()
+}
+
+// DeleteStaleThumbnailCandidates removes a video's candidates that weren't
+// generated from the upload with sourceHash, returning their URLs.
+func (c Client) DeleteStaleThumbnailCandidates(videoID uuid.UUID, sourceHash string) ([]string, error) {
+	candidates, err := c.GetThumbnailCandidates(videoID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.exec(`DELETE FROM thumbnail_candidates WHERE video_id = ? AND source_hash != ?`, videoID, sourceHash)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	for _, candidate := range candidates {
+		if candidate.SourceHash != sourceHash {
+			removed = append(removed, candidate.URL)
+		}
+	}
+	return removed, nil
+}
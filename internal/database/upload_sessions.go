@@ -0,0 +1,139 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UploadSession is a video upload sent as numbered chunks, assembled once
+// the client completes it.
+type UploadSession struct {
+	ID          uuid.UUID `json:"id"`
+	UserID      uuid.UUID `json:"user_id"`
+	VideoID     uuid.UUID `json:"video_id"`
+	ContentType string    `json:"content_type"`
+	// Size is the length of the whole file, which the chunks must add up
+	// to
+	Size int64 `json:"size"`
+	// Version is stored with the processed file like a regular upload's
+	// version field; 0 picks the next one
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UploadChunk is a chunk of an upload session that was fully received.
+type UploadChunk struct {
+	Number int   `json:"number"`
+	Size   int64 `json:"size"`
+}
+
+func (c Client) CreateUploadSession(session UploadSession) (UploadSession, error) {
+	session.ID = uuid.New()
+	session.CreatedAt = time.Now().UTC()
+	query := `
+	INSERT INTO upload_sessions (id, user_id, video_id, content_type, size, version, created_at, expires_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.exec(query, session.ID, session.UserID, session.VideoID, session.ContentType,
+		session.Size, session.Version, session.CreatedAt, session.ExpiresAt.UTC())
+	if err != nil {
+		return UploadSession{}, err
+	}
+	return session, nil
+}
+
+// GetUploadSession returns the session with the given ID. ok is false when
+// there is none.
+func (c Client) GetUploadSession(id uuid.UUID) (session UploadSession, ok bool, err error) {
+	query := `
+	SELECT id, user_id, video_id, content_type, size, version, created_at, expires_at
+	FROM upload_sessions
+	WHERE id = ?
+	`
+	err = c.db.QueryRow(query, id).Scan(&session.ID, &session.UserID, &session.VideoID,
+		&session.ContentType, &session.Size, &session.Version, &session.CreatedAt, &session.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UploadSession{}, false, nil
+	}
+	if err != nil {
+		return UploadSession{}, false, err
+	}
+	return session, true, nil
+}
+
+// GetExpiredUploadSessions returns the sessions that expired before now.
+func (c Client) GetExpiredUploadSessions(now time.Time) ([]UploadSession, error) {
+	query := `
+	SELECT id, user_id, video_id, content_type, size, version, created_at, expires_at
+	FROM upload_sessions
+	WHERE expires_at < ?
+	`
+	rows, err := c.db.Query(query, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []UploadSession{}
+	for rows.Next() {
+		var session UploadSession
+		err := rows.Scan(&session.ID, &session.UserID, &session.VideoID, &session.ContentType,
+			&session.Size, &session.Version, &session.CreatedAt, &session.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// RecordUploadChunk marks a chunk as received, replacing an earlier copy
+// of it.
+func (c Client) RecordUploadChunk(sessionID uuid.UUID, chunk UploadChunk) error {
+	query := `
+	INSERT OR REPLACE INTO upload_session_chunks (session_id, number, size)
+	VALUES (?, ?, ?)
+	`
+	_, err := c.exec(query, sessionID, chunk.Number, chunk.Size)
+	return err
+}
+
+// GetUploadChunks returns the session's received chunks in order.
+func (c Client) GetUploadChunks(sessionID uuid.UUID) ([]UploadChunk, error) {
+	query := `
+	SELECT number, size
+	FROM upload_session_chunks
+	WHERE session_id = ?
+	ORDER BY number
+	`
+	rows, err := c.db.Query(query, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chunks := []UploadChunk{}
+	for rows.Next() {
+		var chunk UploadChunk
+		err := rows.Scan(&chunk.Number, &chunk.Size)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+// DeleteUploadSession removes the session and its chunk records.
+func (c Client) DeleteUploadSession(id uuid.UUID) error {
+	_, err := c.exec(`DELETE FROM upload_session_chunks WHERE session_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.exec(`DELETE FROM upload_sessions WHERE id = ?`, id)
+	return err
+}
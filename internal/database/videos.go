@@ -6,14 +6,47 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
 )
 
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID                  uuid.UUID         `json:"id"`
+	CreatedAt           time.Time         `json:"created_at"`
+	UpdatedAt           time.Time         `json:"updated_at"`
+	ThumbnailURL        *string           `json:"thumbnail_url"`
+	VideoURL            *string           `json:"video_url"`
+	SizeBytes           int64             `json:"size_bytes"`
+	LoudnessLUFS        *float64          `json:"loudness_lufs"`
+	ProcessingStatus    string            `json:"processing_status"`
+	LifecycleStage      string            `json:"lifecycle_stage"`
+	LifecycleChangedAt  *time.Time        `json:"-"`
+	ProcessingError     *ProcessingError  `json:"processing_error"`
+	ProcessingAttempts  int               `json:"processing_attempts"`
+	NextAttemptAt       *time.Time        `json:"next_attempt_at"`
+	OriginalKey         *string           `json:"-"`
+	OriginalSizeBytes   int64             `json:"original_size_bytes"`
+	ProcessingOptions   ProcessingOptions `json:"processing_options"`
+	NeedsAttention      bool              `json:"needs_attention"`
+	DurationSeconds     *float64          `json:"duration_seconds"`
+	BitrateKbps         *int64            `json:"bitrate_kbps"`
+	ThumbnailAuto       bool              `json:"thumbnail_auto"`
+	SourceHash          string            `json:"source_hash"`
+	ThumbnailSourceHash string            `json:"-"`
+	AudioURL            *string           `json:"audio_url"`
+	ShareSlug           *string           `json:"share_slug"`
+	ArtifactsCleanedAt  *time.Time        `json:"-"`
+	Version             int               `json:"version"`
+	ThumbnailWebPURL    *string           `json:"thumbnail_webp_url"`
+	Renditions          Renditions        `json:"renditions"`
+	Storyboard          *Storyboard       `json:"storyboard"`
+	AnimatedPreviewURL  *string           `json:"animated_preview_url"`
+	// Width, Height, FrameRate and Codec describe the upload as ffprobe
+	// read it. Codec is the video stream's, or the audio stream's for
+	// audio records, which have no picture.
+	Width     *int     `json:"width"`
+	Height    *int     `json:"height"`
+	FrameRate *float64 `json:"frame_rate"`
+	Codec     *string  `json:"codec"`
 	CreateVideoParams
 }
 
@@ -21,11 +54,29 @@ type CreateVideoParams struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
 	UserID      uuid.UUID `json:"user_id"`
+	MediaKind   string    `json:"media_kind"`
+	Visibility  string    `json:"visibility"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+// Media kinds a record can hold. The kind is fixed when the record is
+// created and decides which uploads it accepts.
+const (
+	MediaKindVideo = "video"
+	MediaKindAudio = "audio"
+)
+
+// Visibilities decide who can see a video. Public videos are listed and
+// open to anyone, unlisted ones are open to anyone with their share link,
+// and private ones only to their owner.
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+// videoColumns is the column list shared by every query that returns full
+// video rows. Keep it in sync with scanVideo.
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
@@ -33,13 +84,129 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
+		user_id,
+		size_bytes,
+		loudness_lufs,
+		processing_status,
+		processing_error,
+		original_key,
+		original_size_bytes,
+		lifecycle_stage,
+		lifecycle_changed_at,
+		processing_options,
+		processing_attempts,
+		next_attempt_at,
+		needs_attention,
+		media_kind,
+		duration_seconds,
+		bitrate_kbps,
+		thumbnail_auto,
+		source_hash,
+		thumbnail_source_hash,
+		audio_url,
+		share_slug,
+		artifacts_cleaned_at,
+		version,
+		thumbnail_webp_url,
+		renditions,
+		storyboard,
+		animated_preview_url,
+		width,
+		height,
+		frame_rate,
+		codec,
+		visibility`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.UserID,
+		&video.SizeBytes,
+		&video.LoudnessLUFS,
+		&video.ProcessingStatus,
+		&video.ProcessingError,
+		&video.OriginalKey,
+		&video.OriginalSizeBytes,
+		&video.LifecycleStage,
+		&video.LifecycleChangedAt,
+		&video.ProcessingOptions,
+		&video.ProcessingAttempts,
+		&video.NextAttemptAt,
+		&video.NeedsAttention,
+		&video.MediaKind,
+		&video.DurationSeconds,
+		&video.BitrateKbps,
+		&video.ThumbnailAuto,
+		&video.SourceHash,
+		&video.ThumbnailSourceHash,
+		&video.AudioURL,
+		&video.ShareSlug,
+		&video.ArtifactsCleanedAt,
+		&video.Version,
+		&video.ThumbnailWebPURL,
+		&video.Renditions,
+		&video.Storyboard,
+		&video.AnimatedPreviewURL,
+		&video.Width,
+		&video.Height,
+		&video.FrameRate,
+		&video.Codec,
+		&video.Visibility,
+	)
+	return video, err
+}
+
+// GetVideosPage returns up to limit of the user's videos, newest first,
+// skipping the first offset. A negative limit returns them all.
+func (c Client) GetVideosPage(userID uuid.UUID, limit, offset int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE user_id = ?
-	ORDER BY created_at DESC
+	ORDER BY created_at DESC, id
+	LIMIT ? OFFSET ?
+	`
+
+	rows, err := c.db.Query(query, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, nil
+}
+
+// GetAllVideosPage is GetVideosPage across every user, for service
+// accounts.
+func (c Client) GetAllVideosPage(limit, offset int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	ORDER BY created_at DESC, id
+	LIMIT ? OFFSET ?
 	`
 
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.db.Query(query, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -47,17 +214,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
@@ -66,7 +224,7 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 	return videos, nil
 }
 
-func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
+func (c Client) CreateVideo(params CreateVideoParams, options ProcessingOptions) (Video, error) {
 	id := uuid.New()
 	query := `
 	INSERT INTO videos (
@@ -75,10 +233,21 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		user_id,
+		media_kind,
+		visibility,
+		processing_options
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	mediaKind := params.MediaKind
+	if mediaKind == "" {
+		mediaKind = MediaKindVideo
+	}
+	visibility := params.Visibility
+	if visibility == "" {
+		visibility = VisibilityPublic
+	}
+	_, err := c.exec(query, id, params.Title, params.Description, params.UserID, mediaKind, visibility, options)
 	if err != nil {
 		return Video{}, err
 	}
@@ -88,29 +257,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -121,35 +273,369 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
-func (c Client) UpdateVideo(video Video) error {
+// GetVideoByChecksum returns a ready video, other than excludeID, whose
+// stored file was processed from an upload with the given content hash,
+// media kind and encoding profile. A nil userID searches every user's
+// videos. It returns a zero Video when there is none.
+func (c Client) GetVideoByChecksum(sourceHash, mediaKind, encodingProfile string, userID *uuid.UUID, excludeID uuid.UUID) (Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE source_hash = ?
+		AND media_kind = ?
+		AND COALESCE(json_extract(processing_options, '$.encoding_profile'), '') = ?
+		AND lifecycle_stage = ?
+		AND video_url IS NOT NULL
+		AND id != ?
+		AND (? IS NULL OR user_id = ?)
+	ORDER BY created_at, id
+	LIMIT 1
+	`
+
+	video, err := scanVideo(c.db.QueryRow(query, sourceHash, mediaKind, encodingProfile, StageReady, excludeID, userID, userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Video{}, nil
+		}
+		return Video{}, err
+	}
+	return video, nil
+}
+
+// CountVideoURLReferences returns how many videos other than excludeID
+// point at videoURL. Deduplicated uploads share one stored file, so it
+// may only be removed once nothing else refers to it.
+func (c Client) CountVideoURLReferences(videoURL string, excludeID uuid.UUID) (int, error) {
+	var n int
+	err := c.db.QueryRow(`SELECT COUNT(*) FROM videos WHERE video_url = ? AND id != ?`, videoURL, excludeID).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// GetReadyVideos returns up to limit of the user's finished public videos,
+// newest first.
+func (c Client) GetReadyVideos(userID uuid.UUID, limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ? AND lifecycle_stage = ? AND visibility = ?
+	ORDER BY created_at DESC
+	LIMIT ?
+	`
+
+	rows, err := c.db.Query(query, userID, StageReady, VisibilityPublic, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, nil
+}
+
+// GetReadyVideosAfter pages through every user's ready videos in ID order,
+// starting after afterID ("" for the beginning). Walking by ID rather than
+// offset lets a job resume from the last ID it handled.
+func (c Client) GetReadyVideosAfter(afterID string, limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE lifecycle_stage = ? AND id > ?
+	ORDER BY id
+	LIMIT ?
+	`
+
+	rows, err := c.db.Query(query, StageReady, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+// ErrShareSlugTaken means another video already uses the share slug.
+var ErrShareSlugTaken = errors.New("share slug already taken")
+
+// SetShareSlug gives the video a share slug unless it already has one, and
+// returns the video as stored, so a slug set concurrently wins. It returns
+// ErrShareSlugTaken when another video uses slug.
+func (c Client) SetShareSlug(videoID uuid.UUID, slug string) (Video, error) {
+	_, err := c.exec(`UPDATE videos SET share_slug = ? WHERE id = ? AND share_slug IS NULL`, slug, videoID)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return Video{}, ErrShareSlugTaken
+	}
+	if err != nil {
+		return Video{}, err
+	}
+	return c.GetVideo(videoID)
+}
+
+// GetVideoByShareSlug returns the video with the share slug, or a zero
+// Video when there is none.
+func (c Client) GetVideoByShareSlug(slug string) (Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE share_slug = ?
+	`
+
+	video, err := scanVideo(c.db.QueryRow(query, slug))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Video{}, nil
+		}
+		return Video{}, err
+	}
+	return video, nil
+}
+
+// SetAudioURL records the video's extracted audio track, or clears it.
+func (c Client) SetAudioURL(videoID uuid.UUID, audioURL *string) error {
+	_, err := c.exec(`UPDATE videos SET audio_url = ? WHERE id = ?`, audioURL, videoID)
+	return err
+}
+
+// SetNeedsAttention flags or clears a video for an admin to look at.
+func (c Client) SetNeedsAttention(videoID uuid.UUID, needsAttention bool) error {
+	query := `
+	UPDATE videos
+	SET needs_attention = ?
+	WHERE id = ?
+	`
+	_, err := c.exec(query, needsAttention, videoID)
+	return err
+}
+
+// GetVideosNeedingAttention returns up to limit flagged videos across all
+// users, newest first.
+func (c Client) GetVideosNeedingAttention(limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE needs_attention = 1
+	ORDER BY created_at DESC
+	LIMIT ?
+	`
+
+	rows, err := c.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, rows.Err()
+}
+
+// UpdateVideoMetadata saves the owner-editable fields. It is separate from
+// UpdateVideo so an edit made while the video is processing isn't
+// overwritten when the pipeline saves its results. Visibility is saved on
+// its own with SetVideoVisibility, since uploads call this with a copy of
+// the video loaded before they started.
+func (c Client) UpdateVideoMetadata(video Video) error {
 	query := `
 	UPDATE videos
 	SET
 		title = ?,
 		description = ?,
+		processing_options = ?
+	WHERE id = ?
+	`
+	_, err := c.exec(query, video.Title, video.Description, video.ProcessingOptions, video.ID)
+	return err
+}
+
+// SetVideoVisibility changes who can see the video.
+func (c Client) SetVideoVisibility(id uuid.UUID, visibility string) error {
+	query := `
+	UPDATE videos
+	SET visibility = ?
+	WHERE id = ?
+	`
+	_, err := c.exec(query, visibility, id)
+	return err
+}
+
+// UpdateVideo saves the results of processing and other system-managed
+// fields.
+func (c Client) UpdateVideo(video Video) error {
+	query := `
+	UPDATE videos
+	SET
 		thumbnail_url = ?,
 		video_url = ?,
-		user_id = ?
+		size_bytes = ?,
+		loudness_lufs = ?,
+		original_key = ?,
+		original_size_bytes = ?,
+		duration_seconds = ?,
+		bitrate_kbps = ?,
+		thumbnail_auto = ?,
+		source_hash = ?,
+		thumbnail_source_hash = ?,
+		version = ?,
+		thumbnail_webp_url = ?,
+		renditions = ?,
+		storyboard = ?,
+		animated_preview_url = ?,
+		width = ?,
+		height = ?,
+		frame_rate = ?,
+		codec = ?
 	WHERE id = ?
 	`
 
-	_, err := c.db.Exec(
+	_, err := c.exec(
 		query,
-		video.Title,
-		video.Description,
 		&video.ThumbnailURL,
 		&video.VideoURL,
-		video.UserID,
+		video.SizeBytes,
+		video.LoudnessLUFS,
+		video.OriginalKey,
+		video.OriginalSizeBytes,
+		video.DurationSeconds,
+		video.BitrateKbps,
+		video.ThumbnailAuto,
+		video.SourceHash,
+		video.ThumbnailSourceHash,
+		video.Version,
+		video.ThumbnailWebPURL,
+		video.Renditions,
+		video.Storyboard,
+		video.AnimatedPreviewURL,
+		video.Width,
+		video.Height,
+		video.FrameRate,
+		video.Codec,
 		video.ID,
 	)
 	return err
 }
 
 func (c Client) DeleteVideo(id uuid.UUID) error {
+	_, err := c.exec(`DELETE FROM processing_log_entries WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.exec(`DELETE FROM thumbnail_candidates WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err = c.exec(query, id)
 	return err
 }
+
+// GetUserStorageUsage returns the total number of stored bytes owned by the
+// user, including kept originals, ignoring excludeID so a replacement upload
+// isn't charged twice.
+func (c Client) GetUserStorageUsage(userID, excludeID uuid.UUID) (int64, error) {
+	query := `
+	SELECT COALESCE(SUM(size_bytes + original_size_bytes + ` + renditionBytes + `), 0)
+	FROM videos
+	WHERE user_id = ? AND id != ?
+	`
+	var total int64
+	err := c.db.QueryRow(query, userID, excludeID).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// CountUserVideosWithMedia returns how many of the user's videos hold an
+// uploaded file, ignoring excludeID so replacing a file is never counted as
+// a new video.
+func (c Client) CountUserVideosWithMedia(userID, excludeID uuid.UUID) (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM videos
+	WHERE user_id = ? AND id != ? AND video_url IS NOT NULL
+	`
+	var count int
+	err := c.db.QueryRow(query, userID, excludeID).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// renditionBytes adds up the sizes in a video row's renditions column.
+const renditionBytes = `(SELECT COALESCE(SUM(json_extract(value, '$.size_bytes')), 0) FROM json_each(renditions))`
+
+type StorageBreakdown struct {
+	VideoCount     int64 `json:"video_count"`
+	VideoBytes     int64 `json:"video_bytes"`
+	OriginalBytes  int64 `json:"original_bytes"`
+	RenditionBytes int64 `json:"rendition_bytes"`
+}
+
+// Total is everything the breakdown counts against the user's quota.
+func (b StorageBreakdown) Total() int64 {
+	return b.VideoBytes + b.OriginalBytes + b.RenditionBytes
+}
+
+// storageBreakdownQuery adds up the sizes in StorageBreakdown over the
+// video rows a WHERE clause can be appended to select.
+const storageBreakdownQuery = `
+	SELECT
+		COUNT(*),
+		COALESCE(SUM(size_bytes), 0),
+		COALESCE(SUM(original_size_bytes), 0),
+		COALESCE(SUM(` + renditionBytes + `), 0)
+	FROM videos
+	`
+
+// GetUserStorageBreakdown reports the user's processed, original and
+// rendition bytes separately.
+func (c Client) GetUserStorageBreakdown(userID uuid.UUID) (StorageBreakdown, error) {
+	return c.getStorageBreakdown(storageBreakdownQuery+`WHERE user_id = ?`, userID)
+}
+
+// GetStorageBreakdown reports the same as GetUserStorageBreakdown over
+// every user's videos.
+func (c Client) GetStorageBreakdown() (StorageBreakdown, error) {
+	return c.getStorageBreakdown(storageBreakdownQuery)
+}
+
+func (c Client) getStorageBreakdown(query string, args ...any) (StorageBreakdown, error) {
+	var breakdown StorageBreakdown
+	err := c.db.QueryRow(query, args...).Scan(&breakdown.VideoCount, &breakdown.VideoBytes, &breakdown.OriginalBytes, &breakdown.RenditionBytes)
+	if err != nil {
+		return StorageBreakdown{}, err
+	}
+	return breakdown, nil
+}
@@ -0,0 +1,520 @@
+// Package devs3 is a small in-process stand-in for S3, used by DEV_MODE so
+// the server can run without AWS. It stores objects as files under a local
+// directory and speaks enough of the S3 REST API (path-style PUT, GET, HEAD
+// and DELETE of single objects, multipart uploads and ListObjectsV2) for the
+// AWS SDK to talk to it unchanged.
+//
+// Requests signed with SigV4, either in the Authorization header or as a
+// presigned URL, are verified against the fixed development credentials.
+// Anonymous GET and HEAD are allowed, standing in for the public CloudFront
+// distribution that serves the bucket in production.
+//
+// It is not hardened for untrusted traffic and must never be used in
+// production.
+package devs3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// Development credentials. They only mean anything to this server.
+const (
+	AccessKeyID     = "TUBELYDEVS3"
+	SecretAccessKey = "tubely-dev-s3-secret"
+)
+
+const (
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// maxClockSkew matches how far S3 lets a request's signing time drift.
+	maxClockSkew = 15 * time.Minute
+	// metaDir holds object metadata next to the bucket directories. Bucket
+	// names can't start with a dot, so it never collides with one.
+	metaDir = ".meta"
+	// uploadsDir holds the parts of multipart uploads in progress.
+	uploadsDir = ".uploads"
+)
+
+// Credentials returns the static credentials clients must sign with.
+func Credentials() aws.Credentials {
+	return aws.Credentials{
+		AccessKeyID:     AccessKeyID,
+		SecretAccessKey: SecretAccessKey,
+		Source:          "devs3",
+	}
+}
+
+type Server struct {
+	root     string
+	basePath string
+	region   string
+	signer   *v4.Signer
+}
+
+// New serves objects stored under root. basePath is the path the server is
+// mounted at, such as "/devs3"; requests are expected at
+// basePath/<bucket>/<key> and must not have the prefix stripped, since it is
+// part of what clients sign.
+func New(root, basePath, region string) (*Server, error) {
+	err := os.MkdirAll(root, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		root:     root,
+		basePath: strings.TrimRight(basePath, "/"),
+		region:   region,
+		signer: v4.NewSigner(func(o *v4.SignerOptions) {
+			// S3 signs the path exactly as sent
+			o.DisableURIPathEscaping = true
+		}),
+	}, nil
+}
+
+type objectMeta struct {
+	ContentType  string    `json:"content_type"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if bucket, ok := s.splitBucketPath(r.URL.Path); ok {
+		s.serveBucket(w, r, bucket)
+		return
+	}
+
+	bucket, key, ok := s.splitPath(r.URL.Path)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "InvalidURI", "Requests must be path-style: /<bucket>/<key>")
+		return
+	}
+
+	signed, err := s.verify(r)
+	if err != nil {
+		writeError(w, r, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+	if !signed && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, http.StatusForbidden, "AccessDenied", "Anonymous requests may only read objects")
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.createMultipartUpload(w, r, bucket, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.uploadPart(w, r, query.Get("uploadId"), query.Get("partNumber"))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeMultipartUpload(w, r, bucket, key, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		s.abortMultipartUpload(w, r, query.Get("uploadId"))
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		s.getObject(w, r, bucket, key)
+	case r.Method == http.MethodPut:
+		s.putObject(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		s.deleteObject(w, r, bucket, key)
+	default:
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", fmt.Sprintf("%s isn't supported", r.Method))
+	}
+}
+
+// serveBucket handles requests addressed to a bucket rather than an
+// object. Only signed listings are supported; the public distribution
+// doesn't allow listing.
+func (s *Server) serveBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	signed, err := s.verify(r)
+	if err != nil {
+		writeError(w, r, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+	if !signed {
+		writeError(w, r, http.StatusForbidden, "AccessDenied", "Anonymous requests may only read objects")
+		return
+	}
+	if r.Method != http.MethodGet || r.URL.Query().Get("list-type") != "2" {
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "Only ListObjectsV2 is supported on buckets")
+		return
+	}
+	s.listObjects(w, r, bucket)
+}
+
+// splitPath returns the bucket and key for a request path, rejecting
+// anything that could escape the storage directory.
+func (s *Server) splitPath(p string) (bucket, key string, ok bool) {
+	rest, found := strings.CutPrefix(p, s.basePath+"/")
+	if !found {
+		return "", "", false
+	}
+	bucket, key, found = strings.Cut(rest, "/")
+	if !found || bucket == "" || key == "" || strings.HasPrefix(bucket, ".") {
+		return "", "", false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", "", false
+		}
+	}
+	return bucket, key, true
+}
+
+func (s *Server) objectPath(bucket, key string) string {
+	return filepath.Join(s.root, bucket, filepath.FromSlash(key))
+}
+
+func (s *Server) metaPath(bucket, key string) string {
+	return filepath.Join(s.root, metaDir, bucket, filepath.FromSlash(key)+".json")
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	f, err := os.Open(s.objectPath(bucket, key))
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	defer f.Close()
+
+	meta, err := s.readMeta(bucket, key)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	w.Header().Set("ETag", meta.ETag)
+	w.Header().Set("Accept-Ranges", "bytes")
+	// ServeContent handles Range, HEAD and conditional requests
+	http.ServeContent(w, r, "", meta.LastModified, f)
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "CopyObject isn't supported")
+		return
+	}
+
+	dst := s.objectPath(bucket, key)
+	err := os.MkdirAll(filepath.Dir(dst), 0o755)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	// Write to a temp file and rename, so readers never see a partial
+	// object and a failed upload leaves the previous one in place
+	tmp, md5Sum, ok := receiveBody(w, r, filepath.Dir(dst))
+	if !ok {
+		return
+	}
+	defer os.Remove(tmp)
+
+	meta := objectMeta{
+		ContentType:  r.Header.Get("Content-Type"),
+		ETag:         `"` + hex.EncodeToString(md5Sum) + `"`,
+		LastModified: time.Now().UTC().Truncate(time.Second),
+	}
+	err = s.writeMeta(bucket, key, meta)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	w.Header().Set("ETag", meta.ETag)
+	w.WriteHeader(http.StatusOK)
+}
+
+// receiveBody writes the request body to a temp file in dir, checking it
+// against x-amz-content-sha256 when the client sent a payload hash. It
+// returns the file's path and MD5; on failure it has already written the
+// error response.
+func receiveBody(w http.ResponseWriter, r *http.Request, dir string) (tmpPath string, md5Sum []byte, ok bool) {
+	if strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "aws-chunked uploads aren't supported")
+		return "", nil, false
+	}
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return "", nil, false
+	}
+	defer tmp.Close()
+	fail := func(status int, code, message string) (string, []byte, bool) {
+		os.Remove(tmp.Name())
+		writeError(w, r, status, code, message)
+		return "", nil, false
+	}
+
+	md5Hash := md5.New()
+	var sha256Hash hash.Hash
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	writers := []io.Writer{tmp, md5Hash}
+	if payloadHash != "" && payloadHash != unsignedPayload {
+		sha256Hash = sha256.New()
+		writers = append(writers, sha256Hash)
+	}
+	_, err = io.Copy(io.MultiWriter(writers...), r.Body)
+	if err != nil {
+		return fail(http.StatusBadRequest, "IncompleteBody", err.Error())
+	}
+	if sha256Hash != nil && hex.EncodeToString(sha256Hash.Sum(nil)) != payloadHash {
+		return fail(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match what was computed.")
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fail(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+	return tmp.Name(), md5Hash.Sum(nil), true
+}
+
+func (s *Server) deleteObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	// Like S3, deleting a missing key succeeds
+	for _, p := range []string{s.objectPath(bucket, key), s.metaPath(bucket, key)} {
+		err := os.Remove(p)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) readMeta(bucket, key string) (objectMeta, error) {
+	var meta objectMeta
+	dat, err := os.ReadFile(s.metaPath(bucket, key))
+	if errors.Is(err, os.ErrNotExist) {
+		// Files dropped into the directory by hand have no metadata
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	return meta, json.Unmarshal(dat, &meta)
+}
+
+func (s *Server) writeMeta(bucket, key string, meta objectMeta) error {
+	p := s.metaPath(bucket, key)
+	err := os.MkdirAll(filepath.Dir(p), 0o755)
+	if err != nil {
+		return err
+	}
+	dat, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, dat, 0o644)
+}
+
+// verify checks the request's SigV4 signature by signing a copy of it the
+// same way a client would and comparing the results. It reports whether
+// the request was signed at all.
+func (s *Server) verify(r *http.Request) (bool, error) {
+	query := r.URL.Query()
+	switch {
+	case query.Get("X-Amz-Signature") != "":
+		return true, s.verifyPresigned(r, query)
+	case r.Header.Get("Authorization") != "":
+		return true, s.verifyHeader(r)
+	}
+	return false, nil
+}
+
+func (s *Server) verifyHeader(r *http.Request) error {
+	authz := r.Header.Get("Authorization")
+	algorithm, params, _ := strings.Cut(authz, " ")
+	if algorithm != "AWS4-HMAC-SHA256" {
+		return fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	fields := map[string]string{}
+	for _, part := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		fields[k] = v
+	}
+
+	signingTime, err := s.checkCredentialAndTime(fields["Credential"], r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return err
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return errors.New("missing x-amz-content-sha256 header")
+	}
+
+	req, err := s.signableCopy(r, fields["SignedHeaders"], r.URL.Query())
+	if err != nil {
+		return err
+	}
+	err = s.signer.SignHTTP(r.Context(), Credentials(), req, payloadHash, "s3", s.region, signingTime)
+	if err != nil {
+		return err
+	}
+
+	_, expected, _ := strings.Cut(req.Header.Get("Authorization"), "Signature=")
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return errors.New("the request signature we calculated does not match the signature you provided")
+	}
+	return nil
+}
+
+func (s *Server) verifyPresigned(r *http.Request, query url.Values) error {
+	if query.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" {
+		return fmt.Errorf("unsupported signing algorithm %q", query.Get("X-Amz-Algorithm"))
+	}
+	signingTime, err := s.checkCredentialAndTime(query.Get("X-Amz-Credential"), query.Get("X-Amz-Date"))
+	if err != nil {
+		return err
+	}
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires <= 0 {
+		return errors.New("invalid X-Amz-Expires")
+	}
+	if time.Now().After(signingTime.Add(time.Duration(expires) * time.Second)) {
+		return errors.New("request has expired")
+	}
+
+	// The signer adds these itself
+	unsigned := url.Values{}
+	for k, v := range query {
+		switch k {
+		case "X-Amz-Algorithm", "X-Amz-Credential", "X-Amz-Date", "X-Amz-SignedHeaders", "X-Amz-Signature":
+			continue
+		}
+		unsigned[k] = v
+	}
+
+	req, err := s.signableCopy(r, query.Get("X-Amz-SignedHeaders"), unsigned)
+	if err != nil {
+		return err
+	}
+	signedURL, _, err := s.signer.PresignHTTP(r.Context(), Credentials(), req, unsignedPayload, "s3", s.region, signingTime)
+	if err != nil {
+		return err
+	}
+	parsed, err := url.Parse(signedURL)
+	if err != nil {
+		return err
+	}
+
+	expected := parsed.Query().Get("X-Amz-Signature")
+	if !hmac.Equal([]byte(expected), []byte(query.Get("X-Amz-Signature"))) {
+		return errors.New("the request signature we calculated does not match the signature you provided")
+	}
+	return nil
+}
+
+// checkCredentialAndTime validates the access key and region in a
+// credential scope ("<key>/<date>/<region>/s3/aws4_request") and that the
+// signing time is close to now.
+func (s *Server) checkCredentialAndTime(credential, amzDate string) (time.Time, error) {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[0] != AccessKeyID {
+		return time.Time{}, errors.New("the AWS access key ID you provided does not exist in our records")
+	}
+	if parts[2] != s.region || parts[3] != "s3" {
+		return time.Time{}, fmt.Errorf("credential scope must be for s3 in %s", s.region)
+	}
+
+	signingTime, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return time.Time{}, errors.New("invalid X-Amz-Date")
+	}
+	if skew := time.Since(signingTime); skew > maxClockSkew || skew < -maxClockSkew {
+		return time.Time{}, errors.New("the difference between the request time and the current time is too large")
+	}
+	return signingTime, nil
+}
+
+// signableCopy rebuilds the request as the client saw it before signing:
+// only the signed headers, the original path and the given query.
+func (s *Server) signableCopy(r *http.Request, signedHeaders string, query url.Values) (*http.Request, error) {
+	if signedHeaders == "" {
+		return nil, errors.New("missing signed headers")
+	}
+
+	u := &url.URL{
+		Scheme:   "http",
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequestWithContext(context.WithoutCancel(r.Context()), r.Method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = r.Host
+
+	for _, name := range strings.Split(signedHeaders, ";") {
+		switch name {
+		case "host":
+			continue
+		case "content-length":
+			req.ContentLength = r.ContentLength
+			continue
+		}
+		values := r.Header.Values(name)
+		if len(values) == 0 {
+			return nil, fmt.Errorf("signed header %s is missing", name)
+		}
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	return req, nil
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if status >= 500 {
+		log.Printf("devs3: %s %s: %s", r.Method, r.URL.Path, message)
+	}
+	type errorBody struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string   `xml:"Code"`
+		Message  string   `xml:"Message"`
+		Resource string   `xml:"Resource"`
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	dat, err := xml.Marshal(errorBody{Code: code, Message: message, Resource: path.Clean(r.URL.Path)})
+	if err != nil {
+		return
+	}
+	w.Write(append([]byte(xml.Header), dat...))
+}
@@ -0,0 +1,135 @@
+package devs3
+
+import (
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMaxKeys matches S3's page size for ListObjectsV2.
+const defaultMaxKeys = 1000
+
+type listEntry struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+	StorageClass string    `xml:"StorageClass"`
+}
+
+// splitBucketPath returns the bucket for a request addressed to a bucket
+// rather than an object, such as a listing.
+func (s *Server) splitBucketPath(p string) (string, bool) {
+	rest, found := strings.CutPrefix(p, s.basePath+"/")
+	if !found {
+		return "", false
+	}
+	bucket := strings.TrimSuffix(rest, "/")
+	if bucket == "" || strings.Contains(bucket, "/") || strings.HasPrefix(bucket, ".") {
+		return "", false
+	}
+	return bucket, true
+}
+
+// listObjects implements ListObjectsV2 without delimiters: every key under
+// the prefix, in lexical order, a page at a time. The continuation token is
+// the last key of the previous page.
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	maxKeys := defaultMaxKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer")
+			return
+		}
+		maxKeys = min(n, defaultMaxKeys)
+	}
+	after := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		after = token
+	}
+
+	keys := []string{}
+	bucketDir := filepath.Join(s.root, bucket)
+	err := filepath.WalkDir(bucketDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip bodies still being received
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(bucketDir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	sort.Strings(keys)
+
+	truncated := len(keys) > maxKeys
+	if truncated {
+		keys = keys[:maxKeys]
+	}
+	contents := make([]listEntry, 0, len(keys))
+	for _, key := range keys {
+		info, err := os.Stat(s.objectPath(bucket, key))
+		if err != nil {
+			// Deleted since the walk
+			continue
+		}
+		meta, err := s.readMeta(bucket, key)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+		contents = append(contents, listEntry{
+			Key:          key,
+			LastModified: meta.LastModified,
+			ETag:         meta.ETag,
+			Size:         info.Size(),
+			StorageClass: "STANDARD",
+		})
+	}
+
+	result := struct {
+		XMLName               xml.Name    `xml:"ListBucketResult"`
+		Name                  string      `xml:"Name"`
+		Prefix                string      `xml:"Prefix"`
+		KeyCount              int         `xml:"KeyCount"`
+		MaxKeys               int         `xml:"MaxKeys"`
+		IsTruncated           bool        `xml:"IsTruncated"`
+		ContinuationToken     string      `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string      `xml:"NextContinuationToken,omitempty"`
+		Contents              []listEntry `xml:"Contents"`
+	}{
+		Name:              bucket,
+		Prefix:            prefix,
+		KeyCount:          len(contents),
+		MaxKeys:           maxKeys,
+		IsTruncated:       truncated,
+		ContinuationToken: query.Get("continuation-token"),
+		Contents:          contents,
+	}
+	if truncated && len(keys) > 0 {
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	writeXML(w, result)
+}
@@ -0,0 +1,255 @@
+package devs3
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxParts matches S3's limit on parts per multipart upload.
+const maxParts = 10000
+
+// multipartUpload is what CreateMultipartUpload records about an upload.
+type multipartUpload struct {
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+}
+
+func (s *Server) uploadDir(uploadID string) (string, bool) {
+	// Upload IDs are generated here as hex; anything else would let a
+	// client pick the directory
+	if len(uploadID) != 32 || strings.Trim(uploadID, "0123456789abcdef") != "" {
+		return "", false
+	}
+	return filepath.Join(s.root, uploadsDir, uploadID), true
+}
+
+func (s *Server) readUpload(w http.ResponseWriter, r *http.Request, uploadID string) (string, multipartUpload, bool) {
+	var upload multipartUpload
+	dir, ok := s.uploadDir(uploadID)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return "", upload, false
+	}
+	dat, err := os.ReadFile(filepath.Join(dir, "upload.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return "", upload, false
+	}
+	if err == nil {
+		err = json.Unmarshal(dat, &upload)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return "", upload, false
+	}
+	return dir, upload, true
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	uploadID := hex.EncodeToString(id)
+	dir, _ := s.uploadDir(uploadID)
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	dat, err := json.Marshal(multipartUpload{
+		Bucket:      bucket,
+		Key:         key,
+		ContentType: r.Header.Get("Content-Type"),
+	})
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "upload.json"), dat, 0o644)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Bucket: bucket, Key: key, UploadID: uploadID})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, uploadID, partNumber string) {
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 || n > maxParts {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("Part number must be an integer between 1 and %d", maxParts))
+		return
+	}
+	dir, _, ok := s.readUpload(w, r, uploadID)
+	if !ok {
+		return
+	}
+
+	tmp, md5Sum, ok := receiveBody(w, r, dir)
+	if !ok {
+		return
+	}
+	defer os.Remove(tmp)
+
+	// A retried part replaces the earlier attempt
+	err = os.Rename(tmp, filepath.Join(dir, fmt.Sprintf("part-%05d", n)))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("ETag", `"`+hex.EncodeToString(md5Sum)+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, uploadID string) {
+	dir, upload, ok := s.readUpload(w, r, uploadID)
+	if !ok {
+		return
+	}
+	if upload.Bucket != bucket || upload.Key != key {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+
+	var body struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body)
+	if err != nil || len(body.Parts) == 0 {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed.")
+		return
+	}
+
+	dst := s.objectPath(bucket, key)
+	err = os.MkdirAll(filepath.Dir(dst), 0o755)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// The object's ETag is the MD5 of the parts' MD5s, suffixed with the
+	// part count, as S3 does for multipart objects
+	etags := md5.New()
+	last := 0
+	for _, part := range body.Parts {
+		if part.PartNumber <= last {
+			writeError(w, r, http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order.")
+			return
+		}
+		last = part.PartNumber
+
+		partSum, err := appendPart(tmp, filepath.Join(dir, fmt.Sprintf("part-%05d", part.PartNumber)))
+		if errors.Is(err, os.ErrNotExist) {
+			writeError(w, r, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %d was not uploaded.", part.PartNumber))
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+		if strings.Trim(part.ETag, `"`) != hex.EncodeToString(partSum) {
+			writeError(w, r, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %d's ETag doesn't match.", part.PartNumber))
+			return
+		}
+		etags.Write(partSum)
+	}
+	err = tmp.Close()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	meta := objectMeta{
+		ContentType:  upload.ContentType,
+		ETag:         fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(etags.Sum(nil)), len(body.Parts)),
+		LastModified: time.Now().UTC().Truncate(time.Second),
+	}
+	err = s.writeMeta(bucket, key, meta)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	err = os.Rename(tmp.Name(), dst)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	os.RemoveAll(dir)
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string   `xml:"Bucket"`
+		Key     string   `xml:"Key"`
+		ETag    string   `xml:"ETag"`
+	}{Bucket: bucket, Key: key, ETag: meta.ETag})
+}
+
+func (s *Server) abortMultipartUpload(w http.ResponseWriter, r *http.Request, uploadID string) {
+	dir, _, ok := s.readUpload(w, r, uploadID)
+	if !ok {
+		return
+	}
+	err := os.RemoveAll(dir)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// appendPart copies a part file onto dst and returns the part's MD5.
+func appendPart(dst io.Writer, partPath string) ([]byte, error) {
+	f, err := os.Open(partPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sum := md5.New()
+	_, err = io.Copy(io.MultiWriter(dst, sum), f)
+	if err != nil {
+		return nil, err
+	}
+	return sum.Sum(nil), nil
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	dat, err := xml.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(append([]byte(xml.Header), dat...))
+}
@@ -0,0 +1,101 @@
+package featureflags
+
+import (
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type Store interface {
+	GetFeatureFlags() ([]database.FeatureFlag, error)
+}
+
+// Cache keeps an in-process copy of the feature flags table so checking a
+// flag on the upload path doesn't cost a query. Entries are reloaded once they
+// are older than the TTL.
+type Cache struct {
+	store    Store
+	ttl      time.Duration
+	defaults map[string]database.FeatureFlag
+
+	mu       sync.Mutex
+	flags    map[string]database.FeatureFlag
+	loadedAt time.Time
+}
+
+// NewCache reads flags from store. defaults are the values a flag takes
+// while the store doesn't have it, including before the first load from
+// the store succeeds.
+func NewCache(store Store, ttl time.Duration, defaults []database.FeatureFlag) *Cache {
+	c := &Cache{
+		store:    store,
+		ttl:      ttl,
+		defaults: make(map[string]database.FeatureFlag, len(defaults)),
+	}
+	for _, flag := range defaults {
+		c.defaults[flag.Name] = flag
+	}
+	return c
+}
+
+// Enabled reports whether the named flag is on for the user. Users are
+// bucketed by a hash of the flag name and their ID, so the same user always
+// lands on the same side of a partial rollout. A flag the store doesn't
+// have takes its default, and one without a default is off.
+func (c *Cache) Enabled(name string, userID uuid.UUID) bool {
+	flag, ok := c.get(name)
+	if !ok {
+		flag, ok = c.defaults[name]
+	}
+	if !ok || !flag.Enabled {
+		return false
+	}
+	if flag.RolloutPercentage >= 100 {
+		return true
+	}
+	if flag.RolloutPercentage <= 0 {
+		return false
+	}
+	return bucket(name, userID) < flag.RolloutPercentage
+}
+
+// Invalidate forces the next lookup to reload flags from the store.
+func (c *Cache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loadedAt = time.Time{}
+}
+
+func (c *Cache) get(name string) (database.FeatureFlag, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.loadedAt) > c.ttl {
+		flags, err := c.store.GetFeatureFlags()
+		if err != nil {
+			// Keep serving the last known values rather than flipping
+			// every flag off because of a transient database error.
+			log.Printf("Couldn't reload feature flags: %v", err)
+		} else {
+			c.flags = make(map[string]database.FeatureFlag, len(flags))
+			for _, flag := range flags {
+				c.flags[flag.Name] = flag
+			}
+		}
+		c.loadedAt = time.Now()
+	}
+
+	flag, ok := c.flags[name]
+	return flag, ok
+}
+
+func bucket(name string, userID uuid.UUID) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write(userID[:])
+	return int(h.Sum32() % 100)
+}
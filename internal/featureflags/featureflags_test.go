@@ -0,0 +1,81 @@
+package featureflags
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type fakeStore struct {
+	flags []database.FeatureFlag
+	err   error
+}
+
+func (s fakeStore) GetFeatureFlags() ([]database.FeatureFlag, error) {
+	return s.flags, s.err
+}
+
+func TestCacheDefaults(t *testing.T) {
+	defaults := []database.FeatureFlag{
+		{Name: "on", Enabled: true, RolloutPercentage: 100},
+		{Name: "off", Enabled: false, RolloutPercentage: 100},
+	}
+	tests := []struct {
+		name  string
+		store fakeStore
+		want  map[string]bool
+	}{
+		{
+			name:  "failed first load",
+			store: fakeStore{err: errors.New("database is locked")},
+			want:  map[string]bool{"on": true, "off": false, "unknown": false},
+		},
+		{
+			name:  "flags missing from the store",
+			store: fakeStore{},
+			want:  map[string]bool{"on": true, "off": false, "unknown": false},
+		},
+		{
+			name: "stored values win",
+			store: fakeStore{flags: []database.FeatureFlag{
+				{Name: "on", Enabled: false, RolloutPercentage: 100},
+				{Name: "off", Enabled: true, RolloutPercentage: 100},
+			}},
+			want: map[string]bool{"on": false, "off": true, "unknown": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(tt.store, time.Minute, defaults)
+			for name, want := range tt.want {
+				if got := c.Enabled(name, uuid.New()); got != want {
+					t.Errorf("Enabled(%q) = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheRollout(t *testing.T) {
+	c := NewCache(fakeStore{flags: []database.FeatureFlag{
+		{Name: "canary", Enabled: true, RolloutPercentage: 10},
+	}}, time.Minute, nil)
+
+	on := 0
+	for range 1000 {
+		userID := uuid.New()
+		enabled := c.Enabled("canary", userID)
+		if enabled != c.Enabled("canary", userID) {
+			t.Fatalf("user %s changed sides of the rollout", userID)
+		}
+		if enabled {
+			on++
+		}
+	}
+	if on < 50 || on > 150 {
+		t.Errorf("%d of 1000 users in a 10%% rollout", on)
+	}
+}
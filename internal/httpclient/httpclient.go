@@ -0,0 +1,285 @@
+// Package httpclient provides the HTTP client used for every outbound request
+// the server makes on behalf of users, so timeouts, redirect limits, SSRF
+// protection and response size caps are applied consistently.
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrBlockedAddress   = errors.New("destination address is not allowed")
+	ErrTooManyRedirects = errors.New("too many redirects")
+	ErrBodyTooLarge     = errors.New("response body exceeds size limit")
+)
+
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries, including the first. Values
+	// below 1 mean a single attempt.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+type Policy struct {
+	Timeout         time.Duration
+	MaxRedirects    int
+	AllowPrivateIPs bool
+	// MaxBodyBytes caps how much of a response body may be read. Zero means
+	// no limit.
+	MaxBodyBytes int64
+	Retry        RetryPolicy
+}
+
+type Client struct {
+	policy Policy
+	client *http.Client
+}
+
+func New(policy Policy) *Client {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dialContext := dialer.DialContext
+	if !policy.AllowPrivateIPs {
+		// The check also runs on the address actually being connected to,
+		// in case anything reaches the dialer without going through
+		// guardedDialer.
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			return checkAddress(address)
+		}
+		guarded := &guardedDialer{resolver: net.DefaultResolver, dial: dialer.DialContext}
+		dialContext = guarded.DialContext
+	}
+	return newClient(policy, dialContext)
+}
+
+func newClient(policy Policy, dialContext func(ctx context.Context, network, address string) (net.Conn, error)) *Client {
+	transport := &http.Transport{
+		// Never route through an environment-configured proxy, which would
+		// bypass the address check.
+		Proxy:                 nil,
+		DialContext:           dialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return &Client{
+		policy: policy,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   policy.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > policy.MaxRedirects {
+					return ErrTooManyRedirects
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// Do sends the request, retrying transport errors and 5xx/429 responses for
+// requests that can be safely replayed. The returned body enforces the
+// policy's size cap.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	attempts := c.policy.Retry.MaxAttempts
+	if attempts < 1 || !replayable(req) {
+		attempts = 1
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			err := c.wait(req.Context(), attempt)
+			if err != nil {
+				return nil, err
+			}
+			if req.GetBody != nil {
+				req.Body, err = req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		resp, err = c.client.Do(req)
+		if err != nil {
+			if errors.Is(err, ErrBlockedAddress) || errors.Is(err, ErrTooManyRedirects) {
+				return nil, err
+			}
+			continue
+		}
+		if retryableStatus(resp.StatusCode) && attempt < attempts-1 {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if c.policy.MaxBodyBytes > 0 {
+		resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: c.policy.MaxBodyBytes}
+	}
+	return resp, nil
+}
+
+func (c *Client) wait(ctx context.Context, attempt int) error {
+	backoff := c.policy.Retry.InitialBackoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	backoff <<= attempt - 1
+	if maxBackoff := c.policy.Retry.MaxBackoff; maxBackoff > 0 && backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	// Non-idempotent requests opt in by setting an idempotency key
+	return req.Header.Get("Idempotency-Key") != "" && (req.Body == nil || req.GetBody != nil)
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// resolver looks up the addresses of a host. *net.Resolver is one.
+type resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// guardedDialer resolves a host once and refuses it when any address it
+// resolves to isn't public. It then connects to an address it checked, so
+// a second lookup can't swap in another one (DNS rebinding).
+type guardedDialer struct {
+	resolver resolver
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func (d *guardedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else {
+		addrs, err = d.resolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	for _, addr := range addrs {
+		err := checkAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := d.dial(ctx, network, net.JoinHostPort(addr.Unmap().String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// checkAddress runs checkAddr on the IP of a host:port address.
+func checkAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+	}
+	return checkAddr(addr)
+}
+
+// checkAddr rejects loopback, private, link-local (including the
+// 169.254.169.254 metadata endpoint) and other non-public addresses.
+func checkAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() || addr.IsUnspecified() {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, addr)
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("%w: %s", ErrBlockedAddress, addr)
+		}
+	}
+	return nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Distinguish a body that ends exactly at the limit from one that
+		// keeps going
+		var probe [1]byte
+		n, err := b.ReadCloser.Read(probe[:])
+		if n > 0 {
+			return 0, ErrBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,244 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+// stubResolver answers lookups from a fixed table. A host with several
+// entries in answers gets the next one on each lookup, like a DNS server
+// rebinding the name between requests.
+type stubResolver struct {
+	mu      sync.Mutex
+	answers map[string][][]netip.Addr
+	lookups map[string]int
+}
+
+func (r *stubResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	answers, ok := r.answers[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if r.lookups == nil {
+		r.lookups = map[string]int{}
+	}
+	i := min(r.lookups[host], len(answers)-1)
+	r.lookups[host]++
+	return answers[i], nil
+}
+
+// recordingDial stands in for the network. It records the addresses it is
+// asked to connect to and connects them all to target.
+type recordingDial struct {
+	mu     sync.Mutex
+	target string
+	dialed []string
+}
+
+func (d *recordingDial) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, address)
+	d.mu.Unlock()
+	if d.target == "" {
+		return nil, errors.New("stub network has no target")
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, d.target)
+}
+
+func addrs(ips ...string) []netip.Addr {
+	out := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		out = append(out, netip.MustParseAddr(ip))
+	}
+	return out
+}
+
+func TestCheckAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"127.8.9.10", true},
+		{"::1", true},
+		{"10.0.0.1", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"fc00::1", true},
+		{"fd12:3456::1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"100.64.0.1", true},
+		{"198.18.0.1", true},
+		{"224.0.0.1", true},
+		{"ff02::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"64:ff9b::a9fe:a9fe", true},
+		{"8.8.8.8", false},
+		{"93.184.216.34", false},
+		{"172.32.0.1", false},
+		{"2606:4700:4700::1111", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			err := checkAddr(netip.MustParseAddr(tt.addr))
+			if blocked := errors.Is(err, ErrBlockedAddress); blocked != tt.blocked {
+				t.Errorf("checkAddr(%s) = %v, want blocked %v", tt.addr, err, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestGuardedDialer(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		answers map[string][][]netip.Addr
+		blocked bool
+		dialed  string
+	}{
+		{
+			name:    "public host",
+			address: "example.test:443",
+			answers: map[string][][]netip.Addr{"example.test": {addrs("93.184.216.34")}},
+			dialed:  "93.184.216.34:443",
+		},
+		{
+			name:    "host resolving to loopback",
+			address: "localhost.test:80",
+			answers: map[string][][]netip.Addr{"localhost.test": {addrs("127.0.0.1")}},
+			blocked: true,
+		},
+		{
+			name:    "host resolving to a private address",
+			address: "intranet.test:80",
+			answers: map[string][][]netip.Addr{"intranet.test": {addrs("10.1.2.3")}},
+			blocked: true,
+		},
+		{
+			name:    "host resolving to the metadata endpoint",
+			address: "metadata.test:80",
+			answers: map[string][][]netip.Addr{"metadata.test": {addrs("169.254.169.254")}},
+			blocked: true,
+		},
+		{
+			name:    "host with a private address among public ones",
+			address: "mixed.test:80",
+			answers: map[string][][]netip.Addr{"mixed.test": {addrs("93.184.216.34", "192.168.0.10")}},
+			blocked: true,
+		},
+		{
+			name:    "loopback literal",
+			address: "127.0.0.1:8080",
+			blocked: true,
+		},
+		{
+			name:    "IPv4-mapped loopback literal",
+			address: "[::ffff:127.0.0.1]:8080",
+			blocked: true,
+		},
+		{
+			name:    "metadata literal",
+			address: "169.254.169.254:80",
+			blocked: true,
+		},
+		{
+			name:    "public literal",
+			address: "8.8.8.8:53",
+			dialed:  "8.8.8.8:53",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := &recordingDial{}
+			d := &guardedDialer{resolver: &stubResolver{answers: tt.answers}, dial: network.dial}
+			_, err := d.DialContext(context.Background(), "tcp", tt.address)
+			if blocked := errors.Is(err, ErrBlockedAddress); blocked != tt.blocked {
+				t.Fatalf("DialContext(%s) = %v, want blocked %v", tt.address, err, tt.blocked)
+			}
+			if tt.blocked {
+				if len(network.dialed) != 0 {
+					t.Errorf("blocked address was dialed: %v", network.dialed)
+				}
+				return
+			}
+			if len(network.dialed) != 1 || network.dialed[0] != tt.dialed {
+				t.Errorf("dialed %v, want [%s]", network.dialed, tt.dialed)
+			}
+		})
+	}
+}
+
+// TestGuardedDialerRebinding checks that every connection is checked
+// against its own lookup, and that the address dialed is the one checked
+// rather than the hostname, which the network would resolve again.
+func TestGuardedDialerRebinding(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][][]netip.Addr{
+		"rebind.test": {addrs("93.184.216.34"), addrs("127.0.0.1")},
+	}}
+	network := &recordingDial{}
+	d := &guardedDialer{resolver: resolver, dial: network.dial}
+
+	_, err := d.DialContext(context.Background(), "tcp", "rebind.test:80")
+	if errors.Is(err, ErrBlockedAddress) {
+		t.Fatalf("first lookup to a public address was blocked: %v", err)
+	}
+	if len(network.dialed) != 1 || network.dialed[0] != "93.184.216.34:80" {
+		t.Fatalf("dialed %v, want the checked address 93.184.216.34:80", network.dialed)
+	}
+
+	_, err = d.DialContext(context.Background(), "tcp", "rebind.test:80")
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Fatalf("second lookup rebound to loopback, got %v, want ErrBlockedAddress", err)
+	}
+	if len(network.dialed) != 1 {
+		t.Errorf("rebound address was dialed: %v", network.dialed)
+	}
+}
+
+// TestRedirectToMetadataEndpoint follows a public server's redirect to the
+// cloud metadata endpoint, which must be refused.
+func TestRedirectToMetadataEndpoint(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	// The test server listens on loopback, so the stub network stands in
+	// for a public address that leads to it
+	network := &recordingDial{target: srv.Listener.Addr().String()}
+	d := &guardedDialer{
+		resolver: &stubResolver{answers: map[string][][]netip.Addr{"origin.test": {addrs("93.184.216.34")}}},
+		dial:     network.dial,
+	}
+	c := newClient(Policy{MaxRedirects: 5}, d.DialContext)
+
+	req, err := http.NewRequest(http.MethodGet, "http://origin.test/video.mp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("redirect to the metadata endpoint was followed")
+	}
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Fatalf("got %v, want ErrBlockedAddress", err)
+	}
+	if len(network.dialed) != 1 || network.dialed[0] != "93.184.216.34:80" {
+		t.Errorf("dialed %v, want only the origin", network.dialed)
+	}
+}
@@ -0,0 +1,505 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	gcsDefaultEndpoint = "https://storage.googleapis.com"
+	gcsScope           = "https://www.googleapis.com/auth/devstorage.read_write"
+	// gcsChunkSize is how much of an upload is buffered and sent per
+	// request. Resumable uploads need chunks in multiples of 256 KiB.
+	gcsChunkSize = 8 << 20
+	// gcsMaxPresign is the longest a V4 signed URL may be valid for.
+	gcsMaxPresign = 7 * 24 * time.Hour
+)
+
+// ErrCantSign is returned by GCS.Presign when the credentials have no
+// private key to sign URLs with, as with those from the metadata server.
+var ErrCantSign = errors.New("signed URLs need service account key credentials")
+
+// GCS stores objects in a Google Cloud Storage bucket through its JSON API,
+// served publicly from baseURL.
+type GCS struct {
+	client   *http.Client
+	endpoint string
+	bucket   string
+	baseURL  string
+	// signer signs Presign URLs; nil when the credentials can't
+	signer *gcsSigner
+}
+
+// GCSOptions configures how the bucket is reached.
+type GCSOptions struct {
+	// Endpoint replaces https://storage.googleapis.com, for emulators such
+	// as fake-gcs-server. Requests to it are sent without credentials.
+	Endpoint string
+}
+
+// NewGCS authenticates with Application Default Credentials: the file
+// named by GOOGLE_APPLICATION_CREDENTIALS, gcloud's user credentials, or
+// the metadata server on Google Cloud.
+func NewGCS(ctx context.Context, bucket, baseURL string, opts GCSOptions) (*GCS, error) {
+	g := &GCS{
+		client:   http.DefaultClient,
+		endpoint: gcsDefaultEndpoint,
+		bucket:   bucket,
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+	}
+	if opts.Endpoint != "" {
+		g.endpoint = strings.TrimSuffix(opts.Endpoint, "/")
+		return g, nil
+	}
+
+	creds, err := google.FindDefaultCredentials(ctx, gcsScope)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find Google credentials: %w", err)
+	}
+	g.client = oauth2.NewClient(ctx, creds.TokenSource)
+	if len(creds.JSON) > 0 {
+		g.signer, err = newGCSSigner(creds.JSON)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+func (g *GCS) objectURL(key string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", g.endpoint, url.PathEscape(g.bucket), url.PathEscape(key))
+}
+
+func (g *GCS) uploadURL(uploadType, key string) string {
+	q := url.Values{"uploadType": {uploadType}, "name": {key}}
+	return fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", g.endpoint, url.PathEscape(g.bucket), q.Encode())
+}
+
+func (g *GCS) do(ctx context.Context, method, rawURL string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return g.client.Do(req)
+}
+
+// Put sends bodies that fit in one chunk as a single upload, and anything
+// larger as a resumable upload of gcsChunkSize chunks. GCS only creates the
+// object once the last chunk arrives, and the session is cancelled if
+// reading the body fails, so nothing partial is left behind.
+func (g *GCS) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	buf := make([]byte, gcsChunkSize)
+	n, err := io.ReadFull(body, buf)
+	last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	if err != nil && !last {
+		return err
+	}
+	if last {
+		return g.putSimple(ctx, key, buf[:n], contentType)
+	}
+
+	session, err := g.startResumable(ctx, key, contentType)
+	if err != nil {
+		return err
+	}
+	err = g.sendChunks(ctx, session, body, buf)
+	if err != nil {
+		// The session would expire on its own after a week; cancelling it
+		// frees it now. Done without ctx, which may be what was cancelled.
+		cancelCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		resp, cancelErr := g.do(cancelCtx, http.MethodDelete, session, nil, nil)
+		if cancelErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (g *GCS) putSimple(ctx context.Context, key string, data []byte, contentType string) error {
+	resp, err := g.do(ctx, http.MethodPost, g.uploadURL("media", key), bytes.NewReader(data),
+		http.Header{"Content-Type": {contentType}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return gcsError(resp)
+	}
+	return nil
+}
+
+// startResumable opens an upload session and returns its URL.
+func (g *GCS) startResumable(ctx context.Context, key, contentType string) (string, error) {
+	resp, err := g.do(ctx, http.MethodPost, g.uploadURL("resumable", key), nil,
+		http.Header{"X-Upload-Content-Type": {contentType}})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", gcsError(resp)
+	}
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return "", errors.New("GCS didn't return an upload session")
+	}
+	return session, nil
+}
+
+// sendChunks uploads buf, which holds a full first chunk, and then the rest
+// of body. Each chunk but the last leaves the total size open; the last
+// one states it, which completes the upload.
+func (g *GCS) sendChunks(ctx context.Context, session string, body io.Reader, buf []byte) error {
+	var offset int64
+	chunk, next := buf, make([]byte, gcsChunkSize)
+	for {
+		n, err := io.ReadFull(body, next)
+		last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !last {
+			return err
+		}
+
+		total := "*"
+		if last && n == 0 {
+			total = strconv.FormatInt(offset+int64(len(chunk)), 10)
+		}
+		err = g.sendChunk(ctx, session, chunk, offset, total)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(chunk))
+		if last {
+			if n == 0 {
+				return nil
+			}
+			total = strconv.FormatInt(offset+int64(n), 10)
+			return g.sendChunk(ctx, session, next[:n], offset, total)
+		}
+		chunk, next = next, chunk
+	}
+}
+
+func (g *GCS) sendChunk(ctx context.Context, session string, chunk []byte, offset int64, total string) error {
+	contentRange := fmt.Sprintf("bytes %d-%d/%s", offset, offset+int64(len(chunk))-1, total)
+	resp, err := g.do(ctx, http.MethodPut, session, bytes.NewReader(chunk),
+		http.Header{"Content-Range": {contentRange}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// 308 acknowledges a chunk of an upload that isn't complete yet
+	if total == "*" && resp.StatusCode == http.StatusPermanentRedirect {
+		return nil
+	}
+	if total != "*" && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated) {
+		return nil
+	}
+	return gcsError(resp)
+}
+
+func (g *GCS) Get(ctx context.Context, key string, r *Range) (io.ReadCloser, error) {
+	header := http.Header{}
+	if r != nil {
+		if r.Length > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.Offset, r.Offset+r.Length-1))
+		} else {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", r.Offset))
+		}
+	}
+	resp, err := g.do(ctx, http.MethodGet, g.objectURL(key)+"?alt=media", nil, header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return nil, gcsError(resp)
+	}
+	return resp.Body, nil
+}
+
+// gcsObject is an object resource of the JSON API.
+type gcsObject struct {
+	Name        string    `json:"name"`
+	Size        string    `json:"size"`
+	ContentType string    `json:"contentType"`
+	ETag        string    `json:"etag"`
+	Updated     time.Time `json:"updated"`
+}
+
+func (o gcsObject) object() Object {
+	size, _ := strconv.ParseInt(o.Size, 10, 64)
+	return Object{
+		Key:          o.Name,
+		Size:         size,
+		ContentType:  o.ContentType,
+		ETag:         o.ETag,
+		LastModified: o.Updated,
+	}
+}
+
+func (g *GCS) Stat(ctx context.Context, key string) (Object, error) {
+	resp, err := g.do(ctx, http.MethodGet, g.objectURL(key), nil, nil)
+	if err != nil {
+		return Object{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Object{}, gcsError(resp)
+	}
+	var obj gcsObject
+	err = json.NewDecoder(resp.Body).Decode(&obj)
+	if err != nil {
+		return Object{}, err
+	}
+	return obj.object(), nil
+}
+
+func (g *GCS) Delete(ctx context.Context, key string) error {
+	resp, err := g.do(ctx, http.MethodDelete, g.objectURL(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusOK ||
+		resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return gcsError(resp)
+}
+
+// Presign returns a V4 signed URL, which needs a service account key to
+// sign with.
+func (g *GCS) Presign(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if g.signer == nil {
+		return "", ErrCantSign
+	}
+	if expires > gcsMaxPresign {
+		return "", fmt.Errorf("GCS signed URLs can't last longer than %v", gcsMaxPresign)
+	}
+	return g.signer.signURL(http.MethodGet, g.endpoint, g.bucket, key, "", expires, time.Now())
+}
+
+func (g *GCS) PresignPut(ctx context.Context, key, contentType string, expires time.Duration) (string, error) {
+	if g.signer == nil {
+		return "", ErrCantSign
+	}
+	if expires > gcsMaxPresign {
+		return "", fmt.Errorf("GCS signed URLs can't last longer than %v", gcsMaxPresign)
+	}
+	return g.signer.signURL(http.MethodPut, g.endpoint, g.bucket, key, contentType, expires, time.Now())
+}
+
+func (g *GCS) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects := []Object{}
+	pageToken := ""
+	for {
+		q := url.Values{"prefix": {prefix}}
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		listURL := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", g.endpoint, url.PathEscape(g.bucket), q.Encode())
+		resp, err := g.do(ctx, http.MethodGet, listURL, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Items         []gcsObject `json:"items"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = gcsError(resp)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&page)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			objects = append(objects, item.object())
+		}
+		if page.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (g *GCS) URL(key string) string {
+	return g.baseURL + "/" + key
+}
+
+func (g *GCS) KeyFromURL(rawURL string) (string, bool) {
+	key, ok := strings.CutPrefix(rawURL, g.baseURL+"/")
+	if !ok || key == "" {
+		return "", false
+	}
+	key, err := url.PathUnescape(key)
+	if err != nil {
+		return "", false
+	}
+	return key, true
+}
+
+// gcsError turns an unsuccessful response into an error, wrapping
+// ErrNotFound for missing objects.
+func gcsError(resp *http.Response) error {
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	msg := strings.TrimSpace(string(data))
+	if json.Unmarshal(data, &body) == nil && body.Error.Message != "" {
+		msg = body.Error.Message
+	}
+	err := fmt.Errorf("GCS responded %s: %s", resp.Status, msg)
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	return err
+}
+
+// gcsSigner signs URLs with a service account's private key.
+type gcsSigner struct {
+	email string
+	key   *rsa.PrivateKey
+}
+
+// newGCSSigner reads the key from a credentials file. Credentials of other
+// kinds, such as gcloud's user credentials, give a nil signer.
+func newGCSSigner(credsJSON []byte) (*gcsSigner, error) {
+	var creds struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	err := json.Unmarshal(credsJSON, &creds)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse Google credentials: %w", err)
+	}
+	if creds.Type != "service_account" || creds.PrivateKey == "" {
+		return nil, nil
+	}
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, errors.New("service account private key isn't PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse service account private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("service account private key isn't an RSA key")
+	}
+	return &gcsSigner{email: creds.ClientEmail, key: key}, nil
+}
+
+// signURL builds a V4 signed URL for method on the object, following
+// https://cloud.google.com/storage/docs/access-control/signing-urls-manually.
+// A contentType is signed as a header the request has to carry.
+func (s *gcsSigner) signURL(method, endpoint, bucket, key, contentType string, expires time.Duration, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	now = now.UTC()
+	datetime := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/auto/storage/goog4_request"
+
+	resource := "/" + gcsEscape(bucket, false) + "/" + gcsEscape(key, true)
+	canonicalHeaders := "host:" + u.Host + "\n"
+	signedHeaders := "host"
+	if contentType != "" {
+		canonicalHeaders = "content-type:" + contentType + "\n" + canonicalHeaders
+		signedHeaders = "content-type;host"
+	}
+	query := map[string]string{
+		"X-Goog-Algorithm":     "GOOG4-RSA-SHA256",
+		"X-Goog-Credential":    s.email + "/" + scope,
+		"X-Goog-Date":          datetime,
+		"X-Goog-Expires":       strconv.Itoa(int(expires.Seconds())),
+		"X-Goog-SignedHeaders": signedHeaders,
+	}
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, gcsEscape(name, false)+"="+gcsEscape(query[name], false))
+	}
+	canonicalQuery := strings.Join(pairs, "&")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		resource,
+		canonicalQuery,
+		canonicalHeaders,
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"GOOG4-RSA-SHA256",
+		datetime,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s://%s%s?%s&X-Goog-Signature=%s",
+		u.Scheme, u.Host, resource, canonicalQuery, hex.EncodeToString(signature)), nil
+}
+
+// gcsEscape percent-encodes everything but RFC 3986's unreserved
+// characters, and slashes too when keepSlash is set, as V4 signing expects.
+func gcsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3 stores objects in an S3 bucket, served publicly from baseURL (a
+// CloudFront distribution, or the dev fake's bucket URL).
+type S3 struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	presign  *s3.PresignClient
+	bucket   string
+	baseURL  string
+}
+
+// partMaxBackoff caps the wait between attempts at one part.
+const partMaxBackoff = 10 * time.Second
+
+// S3Options tunes how objects are written.
+type S3Options struct {
+	// PartAttempts is how many times each part of a multipart upload (or
+	// the single request of a small one) is tried before the upload fails
+	// and is aborted. Zero keeps the SDK's default.
+	PartAttempts int
+}
+
+func NewS3(client *s3.Client, bucket, baseURL string, opts S3Options) *S3 {
+	return &S3{
+		client:   client,
+		uploader: manager.NewUploader(client, opts.uploaderOptions),
+		presign:  s3.NewPresignClient(client),
+		bucket:   bucket,
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// uploaderOptions gives every request the upload manager sends its own
+// retries. Parts are buffered, so a retried part re-sends the same bytes
+// while the parts already uploaded stay put.
+func (o S3Options) uploaderOptions(u *manager.Uploader) {
+	if o.PartAttempts <= 0 {
+		return
+	}
+	u.ClientOptions = append(u.ClientOptions, func(so *s3.Options) {
+		so.Retryer = retry.NewStandard(func(ro *retry.StandardOptions) {
+			ro.MaxAttempts = o.PartAttempts
+			ro.MaxBackoff = partMaxBackoff
+			// One flaky part mustn't use up the retry budget of the
+			// others
+			ro.RateLimiter = ratelimit.None
+		})
+	})
+}
+
+// Put goes through the upload manager, which sends small bodies in one
+// request and streams larger or unsized ones as a multipart upload. Parts
+// are retried on their own; a multipart upload is only aborted once a part
+// runs out of attempts, so nothing partial is left behind.
+func (s *S3) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (s *S3) Get(ctx context.Context, key string, r *Range) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if r != nil {
+		if r.Length > 0 {
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", r.Offset, r.Offset+r.Length-1))
+		} else {
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-", r.Offset))
+		}
+	}
+	out, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return out.Body, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (Object, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return Object{}, notFound(err)
+	}
+	return Object{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ContentType:  aws.ToString(out.ContentType),
+		ETag:         aws.ToString(out.ETag),
+		LastModified: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *S3) Presign(ctx context.Context, key string, expires time.Duration) (string, error) {
+	req, err := s.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *S3) PresignPut(ctx context.Context, key, contentType string, expires time.Duration) (string, error) {
+	req, err := s.presign.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects := []Object{}
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, Object{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				ETag:         aws.ToString(obj.ETag),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+func (s *S3) URL(key string) string {
+	return s.baseURL + "/" + key
+}
+
+func (s *S3) KeyFromURL(rawURL string) (string, bool) {
+	key, ok := strings.CutPrefix(rawURL, s.baseURL+"/")
+	if !ok || key == "" {
+		return "", false
+	}
+	key, err := url.PathUnescape(key)
+	if err != nil {
+		return "", false
+	}
+	return key, true
+}
+
+// notFound maps S3's missing-object errors to ErrNotFound. HEAD responses
+// have no body, so a missing key comes back as NotFound rather than
+// NoSuchKey.
+func notFound(err error) error {
+	var noSuchKey *types.NoSuchKey
+	var nf *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &nf) {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	return err
+}
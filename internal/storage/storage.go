@@ -0,0 +1,62 @@
+// Package storage abstracts where uploaded media is kept, so handlers don't
+// depend on a particular backend.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned by Get and Stat when there is no object at the
+// key.
+var ErrNotFound = errors.New("object not found")
+
+// ErrNotSupported is returned for operations a backend can't offer, such
+// as signed uploads to local files.
+var ErrNotSupported = errors.New("not supported by this storage")
+
+// Object describes a stored object.
+type Object struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+}
+
+// Range selects part of an object: Length bytes from Offset, or everything
+// from Offset when Length is zero or less.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// Storage is a flat key-value store for media files. Keys are
+// slash-separated paths such as "landscape/<id>.mp4".
+type Storage interface {
+	// Put stores body under key, replacing any existing object. body may be
+	// a stream of unknown length; if reading it fails nothing is stored.
+	Put(ctx context.Context, key string, body io.Reader, contentType string) error
+	// Get opens the object, or the part of it selected by r if r isn't nil.
+	Get(ctx context.Context, key string, r *Range) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (Object, error)
+	// Delete removes the object. Deleting a missing object isn't an error.
+	Delete(ctx context.Context, key string) error
+	// Presign returns a URL that grants read access to the object until it
+	// expires.
+	Presign(ctx context.Context, key string, expires time.Duration) (string, error)
+	// PresignPut returns a URL that lets a client PUT the object itself
+	// until it expires. The request should carry contentType as its
+	// Content-Type; not every backend signs it, so check the stored type.
+	PresignPut(ctx context.Context, key, contentType string, expires time.Duration) (string, error)
+	// List returns every object whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]Object, error)
+
+	// URL is where the object is publicly served from.
+	URL(key string) string
+	// KeyFromURL is the inverse of URL. It returns false for URLs this
+	// storage doesn't serve.
+	KeyFromURL(rawURL string) (string, bool)
+}
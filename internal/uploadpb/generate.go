@@ -0,0 +1,5 @@
+// Package uploadpb holds the generated gRPC bindings for the internal video
+// upload service.
+package uploadpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative upload.proto
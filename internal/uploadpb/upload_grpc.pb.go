@@ -0,0 +1,156 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: upload.proto
+
+package uploadpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	VideoUpload_UploadVideo_FullMethodName = "/tubely.upload.v1.VideoUpload/UploadVideo"
+)
+
+// VideoUploadClient is the client API for VideoUpload service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// VideoUpload lets internal services upload videos without going through
+// the multipart HTTP endpoint. Calls authenticate with the admin API key in
+// the "authorization" metadata as "ApiKey <key>".
+type VideoUploadClient interface {
+	// UploadVideo accepts a video as a stream. The first message must carry
+	// the metadata and every later message a chunk of the file.
+	UploadVideo(ctx context.Context, opts ...grpc.CallOption) (VideoUpload_UploadVideoClient, error)
+}
+
+type videoUploadClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewVideoUploadClient(cc grpc.ClientConnInterface) VideoUploadClient {
+	return &videoUploadClient{cc}
+}
+
+func (c *videoUploadClient) UploadVideo(ctx context.Context, opts ...grpc.CallOption) (VideoUpload_UploadVideoClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &VideoUpload_ServiceDesc.Streams[0], VideoUpload_UploadVideo_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &videoUploadUploadVideoClient{ClientStream: stream}
+	return x, nil
+}
+
+type VideoUpload_UploadVideoClient interface {
+	Send(*UploadVideoRequest) error
+	CloseAndRecv() (*UploadVideoResponse, error)
+	grpc.ClientStream
+}
+
+type videoUploadUploadVideoClient struct {
+	grpc.ClientStream
+}
+
+func (x *videoUploadUploadVideoClient) Send(m *UploadVideoRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *videoUploadUploadVideoClient) CloseAndRecv() (*UploadVideoResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(UploadVideoResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// VideoUploadServer is the server API for VideoUpload service.
+// All implementations must embed UnimplementedVideoUploadServer
+// for forward compatibility
+//
+// VideoUpload lets internal services upload videos without going through
+// the multipart HTTP endpoint. Calls authenticate with the admin API key in
+// the "authorization" metadata as "ApiKey <key>".
+type VideoUploadServer interface {
+	// UploadVideo accepts a video as a stream. The first message must carry
+	// the metadata and every later message a chunk of the file.
+	UploadVideo(VideoUpload_UploadVideoServer) error
+	mustEmbedUnimplementedVideoUploadServer()
+}
+
+// UnimplementedVideoUploadServer must be embedded to have forward compatible implementations.
+type UnimplementedVideoUploadServer struct {
+}
+
+func (UnimplementedVideoUploadServer) UploadVideo(VideoUpload_UploadVideoServer) error {
+	return status.Errorf(codes.Unimplemented, "method UploadVideo not implemented")
+}
+func (UnimplementedVideoUploadServer) mustEmbedUnimplementedVideoUploadServer() {}
+
+// UnsafeVideoUploadServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to VideoUploadServer will
+// result in compilation errors.
+type UnsafeVideoUploadServer interface {
+	mustEmbedUnimplementedVideoUploadServer()
+}
+
+func RegisterVideoUploadServer(s grpc.ServiceRegistrar, srv VideoUploadServer) {
+	s.RegisterService(&VideoUpload_ServiceDesc, srv)
+}
+
+func _VideoUpload_UploadVideo_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(VideoUploadServer).UploadVideo(&videoUploadUploadVideoServer{ServerStream: stream})
+}
+
+type VideoUpload_UploadVideoServer interface {
+	SendAndClose(*UploadVideoResponse) error
+	Recv() (*UploadVideoRequest, error)
+	grpc.ServerStream
+}
+
+type videoUploadUploadVideoServer struct {
+	grpc.ServerStream
+}
+
+func (x *videoUploadUploadVideoServer) SendAndClose(m *UploadVideoResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *videoUploadUploadVideoServer) Recv() (*UploadVideoRequest, error) {
+	m := new(UploadVideoRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// VideoUpload_ServiceDesc is the grpc.ServiceDesc for VideoUpload service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var VideoUpload_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tubely.upload.v1.VideoUpload",
+	HandlerType: (*VideoUploadServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "UploadVideo",
+			Handler:       _VideoUpload_UploadVideo_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "upload.proto",
+}
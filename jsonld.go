@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const mediaTypeJSONLD = "application/ld+json"
+
+// videoObject is a schema.org VideoObject, or an AudioObject for audio
+// records. It is the single builder for
+// structured data about a video so every place that emits JSON-LD agrees.
+type videoObject struct {
+	Context      string `json:"@context"`
+	Type         string `json:"@type"`
+	Name         string `json:"name"`
+	Description  string `json:"description,omitempty"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+	UploadDate   string `json:"uploadDate"`
+	Duration     string `json:"duration,omitempty"`
+	ContentURL   string `json:"contentUrl,omitempty"`
+	EmbedURL     string `json:"embedUrl,omitempty"`
+}
+
+func buildVideoObject(video database.Video) videoObject {
+	objType := "VideoObject"
+	if video.MediaKind == database.MediaKindAudio {
+		objType = "AudioObject"
+	}
+	obj := videoObject{
+		Context:     "https://schema.org",
+		Type:        objType,
+		Name:        video.Title,
+		Description: video.Description,
+		UploadDate:  video.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if video.ThumbnailURL != nil {
+		obj.ThumbnailURL = *video.ThumbnailURL
+	}
+	if video.VideoURL != nil {
+		obj.ContentURL = *video.VideoURL
+	}
+	if video.DurationSeconds != nil {
+		obj.Duration = fmt.Sprintf("PT%dS", int64(math.Round(*video.DurationSeconds)))
+	}
+	return obj
+}
+
+// prefersJSONLD reports whether the Accept header ranks JSON-LD above plain
+// JSON. Wildcards never select JSON-LD, so clients that don't ask for it
+// keep getting the default representation.
+func prefersJSONLD(accept string) bool {
+	var ldQ, jsonQ float64 = -1, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(qs, 64)
+			if err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case mediaTypeJSONLD:
+			ldQ = max(ldQ, q)
+		case "application/json", "application/*", "*/*":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return ldQ > 0 && ldQ >= jsonQ
+}
+
+func respondWithJSONLD(w http.ResponseWriter, code int, payload interface{}) {
+	w.Header().Set("Content-Type", mediaTypeJSONLD)
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshalling JSON-LD: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(code)
+	w.Write(dat)
+}
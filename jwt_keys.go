@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+// loadJWTKeys builds the token signing keys. Without JWT_KEYS every token is
+// signed and checked with JWT_SECRET alone. JWT_KEYS is a JSON object of key
+// IDs to secrets, e.g. {"2024-06": "...", "2024-12": "..."}, and JWT_KEY_ID
+// names the one new tokens are signed with. To rotate, add the new key and
+// point JWT_KEY_ID at it; drop the old key once its tokens have expired.
+// JWT_SECRET, when set alongside, still validates tokens issued before key
+// IDs were used.
+func loadJWTKeys() (*auth.KeySet, error) {
+	secret := os.Getenv("JWT_SECRET")
+	val := os.Getenv("JWT_KEYS")
+	if val == "" {
+		if secret == "" {
+			return nil, errors.New("JWT_SECRET environment variable is not set")
+		}
+		return auth.SingleKey(secret), nil
+	}
+
+	var keys map[string]string
+	err := json.Unmarshal([]byte(val), &keys)
+	if err != nil {
+		return nil, fmt.Errorf("JWT_KEYS must be a JSON object of key IDs to secrets: %w", err)
+	}
+	keySet, err := auth.NewKeySet(keys, os.Getenv("JWT_KEY_ID"), secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_KEYS or JWT_KEY_ID: %w", err)
+	}
+	return keySet, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// integratedLoudnessRe matches the integrated loudness line of the summary
+// ffmpeg's ebur128 filter prints to stderr when it finishes, e.g.
+//
+//	Integrated loudness:
+//	  I:         -19.6 LUFS
+var integratedLoudnessRe = regexp.MustCompile(`Integrated loudness:\s+I:\s+(-?[0-9.]+|-inf) LUFS`)
+
+// measureLoudness runs an EBU R128 pass over the first audio stream and
+// returns its integrated loudness in LUFS. Videos without an audio track, or
+// with pure silence, return nil.
+func (cfg *apiConfig) measureLoudness(filePath string) (*float64, error) {
+	cmd := cfg.ffmpegCommand(context.Background(), "-nostats", "-hide_banner", "-i", filePath, "-map", "0:a:0", "-filter:a", "ebur128", "-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		if strings.Contains(stderr.String(), "matches no streams") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("ffmpeg loudness pass failed: %w", err)
+	}
+
+	// The filter logs a running measurement before the summary, so only
+	// look at the summary block.
+	output := stderr.String()
+	if i := strings.LastIndex(output, "Summary:"); i >= 0 {
+		output = output[i:]
+	}
+
+	matches := integratedLoudnessRe.FindStringSubmatch(output)
+	if matches == nil {
+		return nil, fmt.Errorf("couldn't find integrated loudness in ffmpeg output")
+	}
+	if matches[1] == "-inf" {
+		return nil, nil
+	}
+
+	lufs, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse integrated loudness %q: %w", matches[1], err)
+	}
+	return &lufs, nil
+}
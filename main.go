@@ -2,30 +2,108 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/contenthash"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/featureflags"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 	//"github.com/google/uuid"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
+// shutdownTimeout is how long in-flight requests get to finish after a
+// shutdown signal before their connections are dropped.
+const shutdownTimeout = 30 * time.Second
+
 type apiConfig struct {
-	db               database.Client
-	jwtSecret        string
-	platform         string
-	filepathRoot     string
-	assetsRoot       string
-	s3Bucket         string
-	s3Region         string
+	db           database.Client
+	jwtKeys      *auth.KeySet
+	platform     string
+	filepathRoot string
+	assetsRoot   string
+	// storageBucket is the S3 or GCS bucket videos are stored in, empty
+	// with STORAGE_BACKEND=local
+	storageBucket    string
 	s3CfDistribution string
-	port             string
-	s3Client         *s3.Client
+	// cdnInvalidator is nil unless CLOUDFRONT_DISTRIBUTION_ID is set
+	cdnInvalidator *cdnInvalidator
+	// cdnURLSigner is nil unless the distribution needs signed URLs
+	cdnURLSigner *cdnURLSigner
+	// presignVideoURLs hands out presigned bucket URLs instead of the
+	// distribution's, for deployments without CloudFront
+	presignVideoURLs bool
+	// mediaServedUnsigned is set when /media serves the video files to
+	// anyone at stable paths, as with STORAGE_BACKEND=local
+	mediaServedUnsigned bool
+	port                string
+	adminAPIKey         string
+	webhookSecret       string
+	flags               *featureflags.Cache
+	metrics             *metrics
+
+	tempDir   string
+	tempSpace *tempSpace
+	uploads   *userUploadLimiter
+	// tusUploads holds resumable uploads still being assembled
+	tusUploads *tusRegistry
+
+	statuses    *statusRegistry
+	statusWaits *userUploadLimiter
+	probes      *probeLimiter
+	// jobs runs queued uploads through the pipeline
+	jobs *jobQueue
+	// ffmpegThreads shares MAX_FFMPEG_THREADS between transcodes
+	ffmpegThreads *threadBudget
+
+	// storage holds videos and originals; assets holds thumbnails, served
+	// from /assets unless THUMBNAIL_STORAGE puts them in the bucket
+	storage storage.Storage
+	assets  storage.Storage
+	// thumbnailKeyPrefix leads thumbnail keys, keeping them apart from
+	// videos when both share the bucket
+	thumbnailKeyPrefix string
+	// generateWebPThumbnails stores a WebP copy of every thumbnail
+	generateWebPThumbnails bool
+
+	// remoteTranscoder is nil unless TRANSCODER_URL is set
+	localTranscoder  transcoder
+	remoteTranscoder transcoder
+	// capabilities is what ffmpeg was found able to do at startup
+	capabilities *capabilities
+
+	contentHash contenthash.Algorithm
+	assetETags  *assetETags
+	dedupScope  dedupScope
+	// strictMIME rejects thumbnails whose content isn't the declared type
+	strictMIME bool
+	// maxVideoUploadBytes caps a single video upload over any transport,
+	// and maxThumbnailUploadBytes the body of a thumbnail upload
+	maxVideoUploadBytes     int64
+	maxThumbnailUploadBytes int64
+	// ffmpegGlobalArgs go before the arguments of every ffmpeg run
+	ffmpegGlobalArgs []string
+	// padPortraitToLandscape pads portrait videos to 16:9 over a blurred
+	// copy of themselves
+	padPortraitToLandscape bool
+
+	uploadResponseHeaders http.Header
+
+	currentTunables atomic.Pointer[tunables]
+	startupEnv      map[string]string
 }
 
 func main() {
@@ -41,9 +119,9 @@ func main() {
 		log.Fatalf("Couldn't connect to database: %v", err)
 	}
 
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatal("JWT_SECRET environment variable is not set")
+	jwtKeys, err := loadJWTKeys()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	platform := os.Getenv("PLATFORM")
@@ -61,79 +139,373 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+	port := os.Getenv("PORT")
+	if port == "" {
+		log.Fatal("PORT environment variable is not set")
 	}
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	devMode, err := envBool("DEV_MODE", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if devMode && platform != "dev" {
+		log.Fatal("DEV_MODE requires PLATFORM=dev")
 	}
 
+	storageBackend, err := parseStorageBackend(os.Getenv("STORAGE_BACKEND"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if devMode && storageBackend != backendS3 {
+		log.Fatal("DEV_MODE fakes S3, so it requires STORAGE_BACKEND=s3")
+	}
+
+	s3Bucket := os.Getenv("S3_BUCKET")
+	s3Region := os.Getenv("S3_REGION")
 	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	presignVideoURLs, err := envBool("PRESIGN_VIDEO_URLS", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if presignVideoURLs && storageBackend != backendS3 {
+		log.Fatal("PRESIGN_VIDEO_URLS requires STORAGE_BACKEND=s3")
 	}
 
 	ctx := context.Background()
-	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(s3Region))
+
+	shutdownTracing, err := setupTracing(ctx)
 	if err != nil {
-		log.Fatalf("Couldn't create S3 client: %v", err)
+		log.Fatal(err)
 	}
+	var s3Client *s3.Client
+	var cdnInvalidator *cdnInvalidator
+	var cdnURLSigner *cdnURLSigner
+	var bucketURL string
+	var devS3 http.Handler
+	switch {
+	case devMode:
+		if s3Bucket == "" {
+			s3Bucket = devS3DefaultBucket
+		}
+		if s3Region == "" {
+			s3Region = devS3DefaultRegion
+		}
+		devS3Root := os.Getenv("DEV_S3_ROOT")
+		if devS3Root == "" {
+			devS3Root = devS3DefaultRoot
+		}
+		logDevModeBanner(devS3Root)
 
-	s3Client := s3.NewFromConfig(awsCfg)
+		s3Client, devS3, bucketURL, err = newDevS3(devS3Root, "http://localhost:"+port, s3Bucket, s3Region)
+		if err != nil {
+			log.Fatalf("Couldn't start dev S3: %v", err)
+		}
+	case storageBackend == backendS3:
+		if s3Bucket == "" {
+			log.Fatal("S3_BUCKET environment variable is not set")
+		}
+		if s3Region == "" {
+			log.Fatal("S3_REGION environment variable is not set")
+		}
+		if s3CfDistribution == "" && !presignVideoURLs {
+			log.Fatal("S3_CF_DISTRO environment variable is not set")
+		}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+		awsCfg, err := loadAWSConfig(ctx, s3Region)
+		if err != nil {
+			log.Fatalf("Couldn't create S3 client: %v", err)
+		}
+		s3Client = s3.NewFromConfig(awsCfg)
+		bucketURL = "https://" + s3CfDistribution
+		// Records keep the bucket's own URL, which is presigned whenever
+		// it is handed out
+		if presignVideoURLs {
+			bucketURL = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", s3Bucket, s3Region)
+		}
+		if distributionID := os.Getenv("CLOUDFRONT_DISTRIBUTION_ID"); distributionID != "" {
+			cdnInvalidator = newCDNInvalidator(awsCfg, distributionID)
+		}
+		keyPairID, privateKeyPath := os.Getenv("CLOUDFRONT_KEY_PAIR_ID"), os.Getenv("CLOUDFRONT_PRIVATE_KEY_PATH")
+		if (keyPairID != "" || privateKeyPath != "") && presignVideoURLs {
+			log.Fatal("PRESIGN_VIDEO_URLS can't be combined with CloudFront signed URLs")
+		}
+		if keyPairID != "" || privateKeyPath != "" {
+			cdnURLSigner, err = newCDNURLSigner(keyPairID, privateKeyPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	tempDir := os.Getenv("TEMP_DIR")
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+
+	tun, err := loadTunables()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tempSpace, err := newTempSpace(tempDir, tun.tempSpaceCapBytes)
+	if err != nil {
+		log.Fatalf("Couldn't size temp space: %v", err)
+	}
+
+	contentHash, err := contenthash.Parse(os.Getenv("CONTENT_HASH"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dedupScope, err := parseDedupScope(os.Getenv("DEDUP_SCOPE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	strictMIME, err := envBool("STRICT_MIME", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	maxVideoUploadBytes, err := envInt64("MAX_VIDEO_UPLOAD_BYTES", defaultMaxVideoUploadBytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if maxVideoUploadBytes == 0 {
+		log.Fatal("MAX_VIDEO_UPLOAD_BYTES must be positive")
+	}
+	maxThumbnailUploadBytes, err := envInt64("MAX_THUMBNAIL_UPLOAD_BYTES", defaultMaxThumbnailUploadBytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if maxThumbnailUploadBytes == 0 {
+		log.Fatal("MAX_THUMBNAIL_UPLOAD_BYTES must be positive")
+	}
+
+	ffmpegGlobalArgs, err := loadFFmpegGlobalArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	padPortraitToLandscape, err := envBool("PAD_PORTRAIT_TO_LANDSCAPE", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s3PartAttempts, err := envInt64("S3_PART_ATTEMPTS", 0)
+	if err != nil {
+		log.Fatal(err)
 	}
+	s3Options := storage.S3Options{PartAttempts: int(s3PartAttempts)}
 
-	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
-		s3Client:         s3Client,
+	processingWorkers, err := envInt64("PROCESSING_WORKERS", defaultProcessingWorkers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if processingWorkers <= 0 {
+		log.Fatalf("PROCESSING_WORKERS must be positive, not %d", processingWorkers)
 	}
 
-	err = cfg.ensureAssetsDir()
+	uploadResponseHeaders, err := loadUploadResponseHeaders()
 	if err != nil {
-		log.Fatalf("Couldn't create assets directory: %v", err)
+		log.Fatal(err)
 	}
 
+	thumbnailStorage, err := parseThumbnailStorage(os.Getenv("THUMBNAIL_STORAGE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	generateWebPThumbnails, err := envBool("GENERATE_WEBP_THUMBNAILS", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var videoStorage storage.Storage
+	storageBucket := s3Bucket
+	var mediaRoot string
+	switch storageBackend {
+	case backendS3:
+		videoStorage = storage.NewS3(s3Client, s3Bucket, bucketURL, s3Options)
+	case backendLocal:
+		videoStorage, mediaRoot, err = newLocalMediaStorage(port)
+		storageBucket = ""
+	case backendGCS:
+		videoStorage, storageBucket, err = newGCSStorage(ctx)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	var assets storage.Storage = videoStorage
+	thumbnailKeyPrefix := thumbnailS3Prefix
+	if thumbnailStorage == thumbnailsLocal {
+		assets, err = storage.NewLocal(assetsRoot, fmt.Sprintf("http://localhost:%s/assets", port))
+		if err != nil {
+			log.Fatalf("Couldn't create assets directory: %v", err)
+		}
+		thumbnailKeyPrefix = ""
+	}
+
+	cfg := &apiConfig{
+		db:                  db,
+		jwtKeys:             jwtKeys,
+		platform:            platform,
+		filepathRoot:        filepathRoot,
+		assetsRoot:          assetsRoot,
+		storageBucket:       storageBucket,
+		s3CfDistribution:    s3CfDistribution,
+		cdnInvalidator:      cdnInvalidator,
+		cdnURLSigner:        cdnURLSigner,
+		presignVideoURLs:    presignVideoURLs,
+		mediaServedUnsigned: mediaRoot != "",
+		port:                port,
+		adminAPIKey:         os.Getenv("ADMIN_API_KEY"),
+		webhookSecret:       os.Getenv("WEBHOOK_SECRET"),
+		flags:               featureflags.NewCache(db, featureFlagCacheTTL, defaultFeatureFlags),
+		metrics:             newMetrics(db),
+
+		tempDir:    tempDir,
+		tempSpace:  tempSpace,
+		uploads:    newUserUploadLimiter(),
+		tusUploads: newTusRegistry(),
+
+		statuses:    newStatusRegistry(),
+		jobs:        newJobQueue(),
+		statusWaits: newUserUploadLimiter(),
+		probes:      newProbeLimiter(),
+
+		ffmpegThreads: newThreadBudget(),
+
+		storage:            videoStorage,
+		assets:             assets,
+		thumbnailKeyPrefix: thumbnailKeyPrefix,
+
+		generateWebPThumbnails: generateWebPThumbnails,
+
+		contentHash: contentHash,
+		assetETags:  newAssetETags(contentHash),
+		dedupScope:  dedupScope,
+		strictMIME:  strictMIME,
+
+		maxVideoUploadBytes:     maxVideoUploadBytes,
+		maxThumbnailUploadBytes: maxThumbnailUploadBytes,
+
+		ffmpegGlobalArgs:       ffmpegGlobalArgs,
+		padPortraitToLandscape: padPortraitToLandscape,
+
+		uploadResponseHeaders: uploadResponseHeaders,
+
+		startupEnv: snapshotRestartRequiredEnv(),
+	}
+	cfg.currentTunables.Store(tun)
+	cfg.localTranscoder = ffmpegTranscoder{cfg: cfg}
+	if transcoderURL := os.Getenv("TRANSCODER_URL"); transcoderURL != "" {
+		if storageBackend != backendS3 {
+			log.Fatal("TRANSCODER_URL hands the transcoder S3 locations, so it requires STORAGE_BACKEND=s3")
+		}
+		cfg.remoteTranscoder = newRemoteTranscoder(cfg, transcoderURL, os.Getenv("TRANSCODER_API_KEY"), s3Bucket)
+	}
+	cfg.capabilities = cfg.detectCapabilities(ctx)
+	logCapabilities(cfg.capabilities)
+	db.OnStageChange(cfg.statuses.publish)
+
+	err = cfg.ensureFeatureFlags()
+	if err != nil {
+		log.Fatalf("Couldn't create default feature flags: %v", err)
+	}
+
+	err = cfg.recoverProcessingJobs()
+	if err != nil {
+		log.Fatalf("Couldn't recover processing jobs: %v", err)
+	}
+	err = cfg.failInterruptedVideos()
+	if err != nil {
+		log.Fatalf("Couldn't fail interrupted videos: %v", err)
+	}
+
+	go cfg.collectDBMetrics(ctx)
+	go cfg.reloadOnSIGHUP()
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
-
-	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
-	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	assetsFS := http.Dir(assetsRoot)
+	assetsHandler := http.StripPrefix("/assets", cfg.assetCacheMiddleware(assetsFS, http.FileServer(assetsFS)))
+	mux.Handle("/assets/", assetsHandler)
 
-	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	if devS3 != nil {
+		mux.Handle(devS3BasePath+"/", devS3)
+	}
+	if mediaRoot != "" {
+		mux.Handle("/media/", mediaHandler(mediaRoot))
+	}
 
-	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
-	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
-	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
-	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	cfg.registerAPIRoutes(mux)
 
-	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort != "" {
+		go func() {
+			log.Fatal(cfg.serveGRPC(grpcPort))
+		}()
+	}
 
 	srv := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: cfg.serverHandler(mux),
 	}
 
+	// Listen before seeding, since seeded uploads go through the dev S3
+	// handler served here; so does cleanup
+	lis, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go cfg.cleanFailedUploads(ctx)
+	go cfg.cleanExpiredUploadSessions(ctx)
+	cfg.startProcessingWorkers(int(processingWorkers))
+	if devMode {
+		go func() {
+			err := cfg.seedDevData(ctx)
+			if err != nil {
+				log.Printf("Couldn't seed dev data: %v", err)
+			}
+		}()
+	}
+
+	// On SIGINT or SIGTERM stop accepting requests and give in-flight ones
+	// time to finish. Status long-polls and progress streams are released
+	// right away rather than holding the shutdown up.
+	srv.RegisterOnShutdown(cfg.statuses.close)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+		defer cancel()
+		err := srv.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Printf("Couldn't shut down cleanly: %v", err)
+		}
+		// Let running jobs finish in what is left of the timeout
+		err = cfg.jobs.shutdown(shutdownCtx)
+		if err != nil {
+			log.Printf("Processing jobs were still running at shutdown: %v", err)
+		}
+		// Send the spans of the requests that just finished
+		err = shutdownTracing(shutdownCtx)
+		if err != nil {
+			log.Printf("Couldn't flush traces: %v", err)
+		}
+	}()
+
 	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	err = srv.Serve(lis)
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdownDone
 }
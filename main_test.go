@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/contenthash"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/featureflags"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	testJWTSecret    = "test-secret"
+	testUserPassword = "correct horse battery staple"
+)
+
+// newTestConfig builds a config the way main does, with the database,
+// storage and temp files under a test directory and default tunables.
+func newTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+	dir := t.TempDir()
+
+	db, err := database.NewClient(filepath.Join(dir, "tubely.db"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	tun, err := loadTunables()
+	if err != nil {
+		t.Fatalf("loadTunables: %v", err)
+	}
+
+	tempDir := filepath.Join(dir, "tmp")
+	videoStorage, err := storage.NewLocal(filepath.Join(dir, "media"), "http://localhost:8091/media")
+	if err != nil {
+		t.Fatalf("NewLocal: %v", err)
+	}
+	assets, err := storage.NewLocal(filepath.Join(dir, "assets"), "http://localhost:8091/assets")
+	if err != nil {
+		t.Fatalf("NewLocal: %v", err)
+	}
+
+	cfg := &apiConfig{
+		db:           db,
+		jwtKeys:      auth.SingleKey(testJWTSecret),
+		platform:     "dev",
+		filepathRoot: filepath.Join(dir, "app"),
+		assetsRoot:   filepath.Join(dir, "assets"),
+		port:         "8091",
+		adminAPIKey:  "test-admin-key",
+		flags:        featureflags.NewCache(db, featureFlagCacheTTL, defaultFeatureFlags),
+		metrics:      newMetrics(db),
+
+		tempDir:    tempDir,
+		tempSpace:  &tempSpace{capacity: 1 << 40},
+		uploads:    newUserUploadLimiter(),
+		tusUploads: newTusRegistry(),
+
+		statuses:    newStatusRegistry(),
+		jobs:        newJobQueue(),
+		statusWaits: newUserUploadLimiter(),
+		probes:      newProbeLimiter(),
+
+		ffmpegThreads: newThreadBudget(),
+
+		storage: videoStorage,
+		assets:  assets,
+
+		contentHash: contenthash.SHA256,
+		assetETags:  newAssetETags(contenthash.SHA256),
+
+		maxVideoUploadBytes:     defaultMaxVideoUploadBytes,
+		maxThumbnailUploadBytes: defaultMaxThumbnailUploadBytes,
+
+		capabilities: &capabilities{},
+	}
+	cfg.currentTunables.Store(tun)
+	cfg.localTranscoder = ffmpegTranscoder{cfg: cfg}
+	db.OnStageChange(cfg.statuses.publish)
+
+	err = cfg.ensureFeatureFlags()
+	if err != nil {
+		t.Fatalf("ensureFeatureFlags: %v", err)
+	}
+	err = cfg.recoverProcessingJobs()
+	if err != nil {
+		t.Fatalf("recoverProcessingJobs: %v", err)
+	}
+	return cfg
+}
+
+// newTestServer serves the API routes of cfg the way main does.
+func newTestServer(t *testing.T, cfg *apiConfig) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	cfg.registerAPIRoutes(mux)
+	srv := httptest.NewServer(cfg.serverHandler(mux))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// useTestDevS3 moves cfg's video storage to the fake S3 that DEV_MODE
+// runs, served from its own test server.
+func useTestDevS3(t *testing.T, cfg *apiConfig) {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	client, fake, bucketURL, err := newDevS3(t.TempDir(), srv.URL, devS3DefaultBucket, devS3DefaultRegion)
+	if err != nil {
+		t.Fatalf("newDevS3: %v", err)
+	}
+	mux.Handle(devS3BasePath+"/", fake)
+	cfg.storage = storage.NewS3(client, devS3DefaultBucket, bucketURL, storage.S3Options{})
+	cfg.storageBucket = devS3DefaultBucket
+}
+
+// fakeTranscoder stands in for ffmpeg, which the tests can't count on: it
+// reports every file as a short 720p video and stores it as is.
+type fakeTranscoder struct {
+	cfg *apiConfig
+	// frames, when set, records what extractFrame read from
+	frames *frameSources
+}
+
+// frameSources lists the sources fakeTranscoder took frames from.
+type frameSources struct {
+	mu   sync.Mutex
+	srcs []string
+}
+
+func (f *frameSources) add(src string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.srcs = append(f.srcs, src)
+}
+
+func (f *frameSources) list() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.srcs)
+}
+
+func (t fakeTranscoder) probeVideo(ctx context.Context, srcPath string) (videoProbe, error) {
+	return videoProbe{aspect: "16:9", width: 1280, height: 720, durationSeconds: 10, hasAudio: true, codec: "h264"}, nil
+}
+
+func (t fakeTranscoder) probeAudio(ctx context.Context, srcPath string) (audioInfo, error) {
+	return audioInfo{}, errors.New("fakeTranscoder doesn't probe audio")
+}
+
+func (t fakeTranscoder) faststart(ctx context.Context, job transcodeJob) (storedFile, *processingError) {
+	f, err := os.Open(job.srcPath)
+	if err != nil {
+		return storedFile{}, newProcessingError(stageFaststart, err)
+	}
+	defer f.Close()
+	err = t.cfg.storage.Put(ctx, job.key, f, job.contentType)
+	if err != nil {
+		return storedFile{}, newProcessingError(stageStore, err)
+	}
+	removeSource(job)
+	return storedFile{key: job.key, size: job.srcSize}, nil
+}
+
+// extractFrame reads src through, the way ffmpeg would have to, and
+// writes a blank frame.
+func (t fakeTranscoder) extractFrame(ctx context.Context, src string, seconds float64, outPath string) error {
+	if t.frames != nil {
+		t.frames.add(src)
+	}
+	var body io.ReadCloser
+	if strings.Contains(src, "://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("GET %s: %s", src, resp.Status)
+		}
+		body = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		body = f
+	}
+	_, err := io.Copy(io.Discard, body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return jpeg.Encode(out, image.NewRGBA(image.Rect(0, 0, 16, 9)), nil)
+}
+
+// useFakeTranscoder makes cfg process uploads with fakeTranscoder.
+func useFakeTranscoder(cfg *apiConfig) {
+	cfg.localTranscoder = fakeTranscoder{cfg: cfg}
+}
+
+// newTestUser creates a user with testUserPassword and returns it with an
+// access token.
+func newTestUser(t *testing.T, cfg *apiConfig) (*database.User, string) {
+	t.Helper()
+	hash, err := auth.HashPassword(testUserPassword)
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	user, err := cfg.db.CreateUser(database.CreateUserParams{
+		Email:    uuid.NewString() + "@example.com",
+		Password: hash,
+	})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	token, err := auth.MakeJWT(user.ID, cfg.jwtKeys, time.Hour)
+	if err != nil {
+		t.Fatalf("MakeJWT: %v", err)
+	}
+	return user, token
+}
+
+// newTestVideo creates a video owned by userID, waiting for its upload.
+func newTestVideo(t *testing.T, cfg *apiConfig, userID uuid.UUID) database.Video {
+	t.Helper()
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:       "Test video",
+		Description: "A video made by a test",
+		UserID:      userID,
+	}, database.ProcessingOptions{})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	return video
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	// mediaRevalidationCheckpoint names the saved position of the walk
+	// over the library.
+	mediaRevalidationCheckpoint = "media_revalidation"
+	// mediaSniffBytes is how much of each object is fetched to check it.
+	mediaSniffBytes = 4096
+	// mediaRevalidationWorkers bounds concurrent ranged GETs to the bucket.
+	mediaRevalidationWorkers = 4
+
+	defaultMediaRevalidationBatch = 200
+	maxMediaRevalidationBatch     = 1000
+)
+
+// sniffMP4 reports whether data starts like an MP4 file: an ISO base media
+// "ftyp" box. Anything else is described with http.DetectContentType.
+func sniffMP4(data []byte) (bool, string) {
+	if len(data) >= 8 && bytes.Equal(data[4:8], []byte("ftyp")) {
+		return true, "video/mp4"
+	}
+	return false, http.DetectContentType(data)
+}
+
+// sniffM3U8 reports whether data starts like an HLS playlist.
+func sniffM3U8(data []byte) (bool, string) {
+	if bytes.HasPrefix(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), []byte("#EXTM3U")) {
+		return true, hlsPlaylistContentType
+	}
+	return false, http.DetectContentType(data)
+}
+
+// sniffMPD reports whether data starts like a DASH manifest.
+func sniffMPD(data []byte) (bool, string) {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	if bytes.HasPrefix(trimmed, []byte("<?xml")) || bytes.HasPrefix(trimmed, []byte("<MPD")) {
+		return true, dashManifestContentType
+	}
+	return false, http.DetectContentType(data)
+}
+
+type mediaMismatch struct {
+	VideoID     uuid.UUID `json:"video_id"`
+	Key         string    `json:"key"`
+	DetectedAs  string    `json:"detected_as"`
+	Quarantined bool      `json:"quarantined"`
+}
+
+type mediaRevalidationError struct {
+	VideoID uuid.UUID `json:"video_id"`
+	Error   string    `json:"error"`
+}
+
+type mediaRevalidationReport struct {
+	Checked    int                      `json:"checked"`
+	Mismatches []mediaMismatch          `json:"mismatches"`
+	Errors     []mediaRevalidationError `json:"errors"`
+	Checkpoint string                   `json:"checkpoint"`
+	Done       bool                     `json:"done"`
+}
+
+// handlerRevalidateMedia re-checks the stored files of ready videos against
+// the MP4 signature, for files stored before uploads were sniffed. Each call
+// handles one batch (?limit=, default 200) after the saved checkpoint and
+// moves the checkpoint on, so repeated calls walk the whole library and an
+// interrupted walk picks up where it stopped. ?restart=true starts over.
+// Mismatches are only reported unless ?fix=true, which rejects the video so
+// it is no longer served. Objects are only read, never modified.
+func (cfg *apiConfig) handlerRevalidateMedia(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	fix := query.Get("fix") == "true"
+	limit := defaultMediaRevalidationBatch
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxMediaRevalidationBatch {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxMediaRevalidationBatch), err)
+			return
+		}
+		limit = n
+	}
+
+	if query.Get("restart") == "true" {
+		err := cfg.db.DeleteCheckpoint(mediaRevalidationCheckpoint)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't reset checkpoint", err)
+			return
+		}
+	}
+	after, err := cfg.db.GetCheckpoint(mediaRevalidationCheckpoint)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read checkpoint", err)
+		return
+	}
+
+	videos, err := cfg.db.GetReadyVideosAfter(after, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	report := mediaRevalidationReport{
+		Checked:    len(videos),
+		Mismatches: []mediaMismatch{},
+		Errors:     []mediaRevalidationError{},
+		Checkpoint: after,
+		Done:       len(videos) < limit,
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, mediaRevalidationWorkers)
+	for _, video := range videos {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			mismatch, err := cfg.revalidateVideoMedia(r.Context(), video, fix)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				report.Errors = append(report.Errors, mediaRevalidationError{VideoID: video.ID, Error: err.Error()})
+			case mismatch != nil:
+				report.Mismatches = append(report.Mismatches, *mismatch)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The whole batch has been handled by now, so it's safe to move past
+	// its last video. Videos that errored are listed in the report.
+	if len(videos) > 0 {
+		report.Checkpoint = videos[len(videos)-1].ID.String()
+		err = cfg.db.SetCheckpoint(mediaRevalidationCheckpoint, report.Checkpoint)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save checkpoint", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// revalidateVideoMedia fetches the start of a video's stored file and checks
+// it. It returns nil when the file looks like the format it was stored as.
+func (cfg *apiConfig) revalidateVideoMedia(ctx context.Context, video database.Video, fix bool) (*mediaMismatch, error) {
+	if video.VideoURL == nil {
+		return nil, errors.New("video has no stored file")
+	}
+	key, err := cfg.bucketKeyFromURL(*video.VideoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := cfg.storage.Get(ctx, key, &storage.Range{Length: mediaSniffBytes})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't fetch %s: %w", key, err)
+	}
+	defer body.Close()
+	head, err := io.ReadAll(io.LimitReader(body, mediaSniffBytes))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read %s: %w", key, err)
+	}
+
+	sniff := sniffMP4
+	switch storedContentType(video) {
+	case "audio/mpeg":
+		sniff = sniffMP3
+	case hlsPlaylistContentType:
+		sniff = sniffM3U8
+	case dashManifestContentType:
+		sniff = sniffMPD
+	}
+	ok, detected := sniff(head)
+	if ok {
+		return nil, nil
+	}
+
+	mismatch := &mediaMismatch{
+		VideoID:    video.ID,
+		Key:        key,
+		DetectedAs: detected,
+	}
+	if fix {
+		perr := newCodedProcessingError(stageProbe, errCodeUnreadableMedia, false, fmt.Errorf("stored file %s detected as %s", key, detected))
+		err = cfg.db.TransitionVideo(&video, database.StageRejected, &perr.ProcessingError)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't quarantine video: %w", err)
+		}
+		mismatch.Quarantined = true
+	}
+	return mismatch, nil
+}
+
+// bucketKeyFromURL returns the storage key behind a video or original URL.
+func (cfg *apiConfig) bucketKeyFromURL(rawURL string) (string, error) {
+	key, ok := cfg.storage.KeyFromURL(rawURL)
+	if !ok {
+		return "", fmt.Errorf("%s isn't served from the bucket", rawURL)
+	}
+	return key, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// uploadSniffBytes is how much of an upload is read to tell what it is,
+// all http.DetectContentType looks at.
+const uploadSniffBytes = 512
+
+var errContentMismatch = errors.New("upload content isn't an accepted media type")
+
+// uploadSniffers recognize the content each media kind accepts from the
+// start of a file. The Content-Type an upload was sent with only decides
+// whether it gets this far; what's stored is decided by its bytes.
+var uploadSniffers = map[string][]func([]byte) (bool, string){
+	database.MediaKindVideo: {sniffUploadMP4},
+	database.MediaKindAudio: {sniffMP3, sniffUploadMP4},
+}
+
+// mp4ImageBrands are ftyp major brands of still image formats built on the
+// same box structure as MP4, which ffmpeg can't make a video of.
+var mp4ImageBrands = map[string]string{
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+	"avif": "image/avif",
+	"avis": "image/avif",
+}
+
+// sniffUploadMP4 is sniffMP4 with a look at the ftyp box's major brand, so
+// HEIF and AVIF images aren't taken for video.
+func sniffUploadMP4(data []byte) (bool, string) {
+	ok, detected := sniffMP4(data)
+	if !ok {
+		return false, detected
+	}
+	if len(data) >= 12 {
+		if imageType, isImage := mp4ImageBrands[string(data[8:12])]; isImage {
+			return false, imageType
+		}
+	}
+	return true, detected
+}
+
+// sniffUpload reports whether data, the start of an upload, is content a
+// record of the given kind accepts, and what it was detected as.
+func sniffUpload(kind string, data []byte) (bool, string) {
+	generic := http.DetectContentType(data)
+	detected := generic
+	for _, sniff := range uploadSniffers[kind] {
+		ok, sniffed := sniff(data)
+		if ok {
+			return true, sniffed
+		}
+		// A sniffer that knows better than DetectContentType, such as
+		// sniffUploadMP4 finding an image brand, has the last word
+		if sniffed != generic {
+			detected = sniffed
+		}
+	}
+	return false, detected
+}
+
+// checkReceivedContent sniffs the start of a received upload and returns a
+// processing error when it isn't content the record accepts.
+func checkReceivedContent(video database.Video, srcPath string) *processingError {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return newProcessingError(stageReceive, err)
+	}
+	defer f.Close()
+
+	head := make([]byte, uploadSniffBytes)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return newProcessingError(stageReceive, err)
+	}
+	if ok, detected := sniffUpload(video.MediaKind, head[:n]); !ok {
+		return newCodedProcessingError(stageReceive, errCodeUnsupportedMedia, false,
+			fmt.Errorf("%w: %s record, content is %s", errContentMismatch, video.MediaKind, detected))
+	}
+	return nil
+}
+
+// thumbnailExtensions are the extensions thumbnails are stored with, by
+// the media type sniffed from their content.
+var thumbnailExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// sniffThumbnail detects the media type of the image at the start of src.
+// It returns a reader that still yields the whole image.
+func sniffThumbnail(src io.Reader) (io.Reader, string, error) {
+	head := make([]byte, uploadSniffBytes)
+	n, err := io.ReadFull(src, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, "", err
+	}
+	head = head[:n]
+	return io.MultiReader(bytes.NewReader(head), src), http.DetectContentType(head), nil
+}
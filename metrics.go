@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const dbMetricsInterval = 30 * time.Second
+
+type metrics struct {
+	registry *prometheus.Registry
+
+	dbFileSize  prometheus.Gauge
+	dbWALSize   prometheus.Gauge
+	dbPageCount prometheus.Gauge
+
+	videosPoisoned *prometheus.CounterVec
+
+	stageDuration *prometheus.HistogramVec
+}
+
+func newMetrics(db database.Client) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		dbFileSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tubely_db_file_size_bytes",
+			Help: "Size of the SQLite database file.",
+		}),
+		dbWALSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tubely_db_wal_size_bytes",
+			Help: "Size of the SQLite write-ahead log file.",
+		}),
+		dbPageCount: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tubely_db_page_count",
+			Help: "Number of pages in the SQLite database.",
+		}),
+		videosPoisoned: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tubely_videos_poisoned_total",
+			Help: "Videos that stopped being retried after too many processing failures, by failure code.",
+		}, []string{"code"}),
+		stageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "tubely_processing_stage_duration_seconds",
+			Help: "Time spent in each upload processing stage, by stage and outcome.",
+			// 50ms up to about 7 minutes
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+		}, []string{"stage", "status"}),
+	}
+
+	stats := db.Stats()
+	m.registry.MustRegister(
+		m.dbFileSize,
+		m.dbWALSize,
+		m.dbPageCount,
+		m.videosPoisoned,
+		m.stageDuration,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "tubely_db_busy_retries_total",
+			Help: "Write queries retried because the database was busy.",
+		}, func() float64 { return float64(stats.BusyRetries.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "tubely_db_locked_retries_total",
+			Help: "Write queries retried because a table was locked.",
+		}, func() float64 { return float64(stats.LockedRetries.Load()) }),
+	)
+	return m
+}
+
+// collectDBMetrics refreshes the database gauges until ctx is cancelled.
+func (cfg *apiConfig) collectDBMetrics(ctx context.Context) {
+	ticker := time.NewTicker(dbMetricsInterval)
+	defer ticker.Stop()
+
+	for {
+		cfg.refreshDBMetrics(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cfg *apiConfig) refreshDBMetrics(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	stats, err := cfg.db.FileStats(ctx)
+	if err != nil {
+		log.Printf("Couldn't collect database metrics: %v", err)
+		return
+	}
+	cfg.metrics.dbFileSize.Set(float64(stats.FileSizeBytes))
+	cfg.metrics.dbWALSize.Set(float64(stats.WALSizeBytes))
+	cfg.metrics.dbPageCount.Set(float64(stats.PageCount))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var errFaststartNotApplied = errors.New("moov atom isn't ahead of the media data")
+
+// faststartAttempts is how many times ffmpeg is run when its output fails
+// the faststart check before the upload fails.
+const faststartAttempts = 2
+
+// checkFaststart walks the top-level boxes of the MP4 at path and confirms
+// the moov atom, the index players need before they can start, comes
+// before the mdat box holding the media. Without that players have to
+// fetch the end of the file first, which is what faststart is for.
+func checkFaststart(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	var offset int64
+	header := make([]byte, 16)
+	for offset+8 <= size {
+		_, err := f.ReadAt(header[:8], offset)
+		if err != nil {
+			return err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		switch boxSize {
+		case 0:
+			// The box runs to the end of the file
+			boxSize = size - offset
+		case 1:
+			// A 64-bit size follows the type
+			_, err := f.ReadAt(header[8:16], offset+8)
+			if err != nil {
+				return err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if boxSize < 8 {
+			return fmt.Errorf("malformed %q box at offset %d", boxType, offset)
+		}
+
+		switch boxType {
+		case "moov":
+			return nil
+		case "mdat":
+			return fmt.Errorf("%w: mdat at offset %d", errFaststartNotApplied, offset)
+		}
+		offset += boxSize
+	}
+	return fmt.Errorf("%w: no moov atom", errFaststartNotApplied)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// mrssFeedMaxItems caps how many videos a feed lists. Readers only look at
+// recent items, and the cap keeps the response size bounded.
+const mrssFeedMaxItems = 50
+
+const mrssNamespace = "http://search.yahoo.com/mrss/"
+
+// itunesNamespace carries the podcast tags podcast apps read for audio items.
+const itunesNamespace = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+
+type rssFeed struct {
+	XMLName     xml.Name   `xml:"rss"`
+	Version     string     `xml:"version,attr"`
+	XMLNSMedia  string     `xml:"xmlns:media,attr"`
+	XMLNSITunes string     `xml:"xmlns:itunes,attr"`
+	Channel     rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	Description string        `xml:"description,omitempty"`
+	GUID        rssGUID       `xml:"guid"`
+	PubDate     string        `xml:"pubDate"`
+	Enclosure   *rssEnclosure `xml:"enclosure"`
+	Content     *mrssContent  `xml:"media:content"`
+	Thumbnail   *mrssURL      `xml:"media:thumbnail"`
+	MediaTitle  string        `xml:"media:title"`
+	MediaDesc   string        `xml:"media:description,omitempty"`
+	ITunesImage *itunesImage  `xml:"itunes:image"`
+	ITunesDur   int64         `xml:"itunes:duration,omitempty"`
+}
+
+type itunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type mrssContent struct {
+	URL      string `xml:"url,attr"`
+	FileSize int64  `xml:"fileSize,attr,omitempty"`
+	Type     string `xml:"type,attr"`
+	Medium   string `xml:"medium,attr"`
+	Duration int64  `xml:"duration,attr,omitempty"`
+}
+
+type mrssURL struct {
+	URL string `xml:"url,attr"`
+}
+
+// handlerUserFeed serves a user's ready public videos as a Media RSS feed
+// so other platforms can syndicate them. Audio items double as podcast
+// episodes, with the thumbnail as episode artwork. Only audio records have a
+// stored duration.
+func (cfg *apiConfig) handlerUserFeed(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+
+	// Answer the same way whether the user doesn't exist or has been
+	// opted out, so the feed can't be used to probe for accounts
+	if !cfg.flags.Enabled(flagMRSSFeed, userID) {
+		respondWithError(w, http.StatusNotFound, "Feed not found", nil)
+		return
+	}
+	user, err := cfg.db.GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusNotFound, "Feed not found", err)
+		return
+	}
+
+	videos, err := cfg.db.GetReadyVideos(userID, mrssFeedMaxItems)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	baseURL := cfg.publicBaseURL()
+	feed := rssFeed{
+		Version:     "2.0",
+		XMLNSMedia:  mrssNamespace,
+		XMLNSITunes: itunesNamespace,
+		Channel: rssChannel{
+			Title:       "Tubely videos",
+			Link:        fmt.Sprintf("%s/api/users/%s/feed", baseURL, userID),
+			Description: "Recently published videos",
+			Items:       make([]rssItem, 0, len(videos)),
+		},
+	}
+	err = cfg.signVideos(r.Context(), videos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+	for _, video := range videos {
+		feed.Channel.Items = append(feed.Channel.Items, buildRSSItem(baseURL, video))
+	}
+
+	dat, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build feed", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(append([]byte(xml.Header), dat...))
+	if err != nil {
+		log.Printf("Couldn't write feed: %v", err)
+	}
+}
+
+func buildRSSItem(baseURL string, video database.Video) rssItem {
+	item := rssItem{
+		Title:       video.Title,
+		Link:        fmt.Sprintf("%s/api/videos/%s", baseURL, video.ID),
+		Description: video.Description,
+		GUID:        rssGUID{Value: video.ID.String()},
+		PubDate:     video.CreatedAt.UTC().Format(time.RFC1123Z),
+		MediaTitle:  video.Title,
+		MediaDesc:   video.Description,
+	}
+	isAudio := video.MediaKind == database.MediaKindAudio
+	if video.VideoURL != nil {
+		contentType := storedContentType(video)
+		item.Enclosure = &rssEnclosure{
+			URL:    *video.VideoURL,
+			Length: video.SizeBytes,
+			Type:   contentType,
+		}
+		item.Content = &mrssContent{
+			URL:      *video.VideoURL,
+			FileSize: video.SizeBytes,
+			Type:     contentType,
+			Medium:   video.MediaKind,
+		}
+		if video.DurationSeconds != nil {
+			item.Content.Duration = int64(math.Round(*video.DurationSeconds))
+			if isAudio {
+				item.ITunesDur = item.Content.Duration
+			}
+		}
+	}
+	if video.ThumbnailURL != nil {
+		item.Thumbnail = &mrssURL{URL: *video.ThumbnailURL}
+		if isAudio {
+			item.ITunesImage = &itunesImage{Href: *video.ThumbnailURL}
+		}
+	}
+	return item
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// TestUserFeedVisibility checks that the feed, on by default, lists only
+// a user's public videos.
+func TestUserFeedVisibility(t *testing.T) {
+	cfg := newTestConfig(t)
+	srv := newTestServer(t, cfg)
+	user, _ := newTestUser(t, cfg)
+
+	shown := map[string]bool{}
+	for _, visibility := range []string{database.VisibilityPublic, database.VisibilityUnlisted, database.VisibilityPrivate} {
+		video := newProcessedVideo(t, cfg, user.ID, visibility)
+		makeReady(t, cfg, &video)
+		shown[video.ID.String()] = visibility == database.VisibilityPublic
+	}
+
+	resp, body := doRequest(t, srv, http.MethodGet, "/api/users/"+user.ID.String()+"/feed", "", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	for id, want := range shown {
+		if got := strings.Contains(string(body), id); got != want {
+			t.Errorf("feed lists video %s = %v, want %v", id, got, want)
+		}
+	}
+
+	_, err := cfg.db.UpsertFeatureFlag(flagMRSSFeed, false, 100)
+	if err != nil {
+		t.Fatalf("UpsertFeatureFlag: %v", err)
+	}
+	cfg.flags.Invalidate()
+	resp, body = doRequest(t, srv, http.MethodGet, "/api/users/"+user.ID.String()+"/feed", "", "", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status with the feed turned off = %d, want %d: %s", resp.StatusCode, http.StatusNotFound, body)
+	}
+}
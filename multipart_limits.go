@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+// maxSkippedFormParts caps how many parts other than the file an upload may
+// send before it. Clients only ever send the file, so anything beyond a
+// handful of extra fields is abuse.
+const maxSkippedFormParts = 8
+
+// maxFormValueBytes caps a text field sent alongside an upload. They only
+// ever carry short options.
+const maxFormValueBytes = 1024
+
+var errMultipartHeaderTooLarge = errors.New("multipart part headers too large")
+
+// nextFormFile streams the multipart request body up to the file part named
+// field and returns it without reading the file's contents, so uploads are
+// never buffered in memory or spooled to disk. A part whose headers add up to
+// more than maxHeaderBytes is rejected with errMultipartHeaderTooLarge before
+// any of its body is read; mime/multipart on its own accepts up to 10 MB of
+// headers per part. Text fields sent before the file are added to values
+// when it isn't nil, since they can't be read once the file has been.
+func nextFormFile(r *http.Request, field string, maxHeaderBytes int64, values url.Values) (*multipart.Part, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for skipped := 0; ; skipped++ {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, http.ErrMissingFile
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		headerBytes := multipartHeaderSize(part)
+		if maxHeaderBytes > 0 && headerBytes > maxHeaderBytes {
+			part.Close()
+			return nil, fmt.Errorf("%w: %d bytes, limit is %d", errMultipartHeaderTooLarge, headerBytes, maxHeaderBytes)
+		}
+		if part.FormName() == field && part.FileName() != "" {
+			return part, nil
+		}
+		if values != nil && part.FormName() != "" && part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormValueBytes+1))
+			if err != nil {
+				part.Close()
+				return nil, err
+			}
+			if len(value) > maxFormValueBytes {
+				part.Close()
+				return nil, fmt.Errorf("form field %q is longer than %d bytes", part.FormName(), maxFormValueBytes)
+			}
+			values.Add(part.FormName(), string(value))
+		}
+
+		part.Close()
+		if skipped >= maxSkippedFormParts {
+			return nil, fmt.Errorf("no %q file in the first %d form parts", field, maxSkippedFormParts)
+		}
+	}
+}
+
+// multipartHeaderSize approximates the wire size of a part's headers.
+func multipartHeaderSize(part *multipart.Part) int64 {
+	var size int64
+	for key, values := range part.Header {
+		for _, value := range values {
+			// "Key: value\r\n"
+			size += int64(len(key) + len(value) + 4)
+		}
+	}
+	return size
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"image"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const oEmbedVersion = "1.0"
+
+// shareSlugPath leads the path of a share link; the slug follows it.
+const shareSlugPath = "/api/share/"
+
+// embedSize is the player size previews get before maxwidth and maxheight
+// are applied. Dimensions aren't stored, so they follow the aspect the
+// video was filed under.
+func embedSize(video database.Video) (int, int) {
+	switch {
+	case video.MediaKind == database.MediaKindAudio:
+		return 480, 54
+	case storedAspect(video) == "portrait":
+		return 360, 640
+	case storedAspect(video) == "other":
+		return 480, 480
+	}
+	return 640, 360
+}
+
+// fitEmbedSize scales width and height down, keeping their ratio, until
+// they fit the limits. Limits of 0 don't apply.
+func fitEmbedSize(width, height, maxWidth, maxHeight int) (int, int) {
+	if maxWidth > 0 && width > maxWidth {
+		height = height * maxWidth / width
+		width = maxWidth
+	}
+	if maxHeight > 0 && height > maxHeight {
+		width = width * maxHeight / height
+		height = maxHeight
+	}
+	return width, height
+}
+
+// isPubliclyShared reports whether link previews may show the video: a
+// ready video its owner gave a share link, unless it is private.
+func isPubliclyShared(video database.Video) bool {
+	return video.ShareSlug != nil && video.VideoURL != nil && video.LifecycleStage == database.StageReady &&
+		video.Visibility != database.VisibilityPrivate
+}
+
+// oEmbedResponse is an oEmbed 1.0 "video" response, or "rich" for audio
+// records.
+type oEmbedResponse struct {
+	Type            string `json:"type"`
+	Version         string `json:"version"`
+	Title           string `json:"title"`
+	ProviderName    string `json:"provider_name"`
+	ProviderURL     string `json:"provider_url"`
+	HTML            string `json:"html"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+var embedPlayerTemplate = template.Must(template.New("player").Parse(
+	`{{if .Audio}}<audio controls src="{{.Src}}" style="width:{{.Width}}px"></audio>` +
+		`{{else}}<video controls src="{{.Src}}"{{if .Poster}} poster="{{.Poster}}"{{end}} width="{{.Width}}" height="{{.Height}}"></video>{{end}}`,
+))
+
+// embedPlayerHTML is the markup previews embed to play the video.
+func embedPlayerHTML(video database.Video, width, height int) (string, error) {
+	data := struct {
+		Audio         bool
+		Src, Poster   string
+		Width, Height int
+	}{
+		Audio:  video.MediaKind == database.MediaKindAudio,
+		Src:    *video.VideoURL,
+		Width:  width,
+		Height: height,
+	}
+	if video.ThumbnailURL != nil {
+		data.Poster = *video.ThumbnailURL
+	}
+	var html strings.Builder
+	err := embedPlayerTemplate.Execute(&html, data)
+	return html.String(), err
+}
+
+// handlerOEmbed answers oEmbed requests for share links, so platforms can
+// render rich previews of them. Only JSON is offered.
+func (cfg *apiConfig) handlerOEmbed(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" && format != "json" {
+		respondWithError(w, http.StatusNotImplemented, "Only the json format is supported", nil)
+		return
+	}
+
+	maxWidth, err := parseOptionalDimension(query.Get("maxwidth"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid maxwidth", err)
+		return
+	}
+	maxHeight, err := parseOptionalDimension(query.Get("maxheight"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid maxheight", err)
+		return
+	}
+
+	target, err := url.Parse(query.Get("url"))
+	if err != nil || !strings.HasPrefix(target.Path, shareSlugPath) {
+		respondWithError(w, http.StatusNotFound, "Not a share link", err)
+		return
+	}
+	video, err := cfg.db.GetVideoByShareSlug(strings.TrimPrefix(target.Path, shareSlugPath))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	// Private videos answer the same as missing ones so links can't be
+	// probed
+	if !isPubliclyShared(video) {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	signed, err := cfg.signVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	width, height := embedSize(video)
+	width, height = fitEmbedSize(width, height, maxWidth, maxHeight)
+	html, err := embedPlayerHTML(signed, width, height)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build embed", err)
+		return
+	}
+
+	resp := oEmbedResponse{
+		Type:         "video",
+		Version:      oEmbedVersion,
+		Title:        video.Title,
+		ProviderName: "Tubely",
+		ProviderURL:  cfg.publicBaseURL(),
+		HTML:         html,
+		Width:        width,
+		Height:       height,
+	}
+	if video.MediaKind == database.MediaKindAudio {
+		resp.Type = "rich"
+	}
+	// oEmbed requires a thumbnail's size along with it, so one whose size
+	// can't be read is left out. The size is read through the stored URL.
+	if video.ThumbnailURL != nil {
+		thumbWidth, thumbHeight, err := cfg.thumbnailSize(r.Context(), *video.ThumbnailURL)
+		if err == nil {
+			resp.ThumbnailURL = *signed.ThumbnailURL
+			resp.ThumbnailWidth = thumbWidth
+			resp.ThumbnailHeight = thumbHeight
+		}
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// thumbnailSize reads a stored thumbnail's dimensions from its header.
+func (cfg *apiConfig) thumbnailSize(ctx context.Context, thumbnailURL string) (int, int, error) {
+	key, ok := cfg.assets.KeyFromURL(thumbnailURL)
+	if !ok {
+		return 0, 0, fmt.Errorf("%s isn't a stored thumbnail", thumbnailURL)
+	}
+	src, err := cfg.assets.Get(ctx, key, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+	config, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+// publicBaseURL is where the API is reached from outside.
+func (cfg *apiConfig) publicBaseURL() string {
+	return fmt.Sprintf("http://localhost:%s", cfg.port)
+}
+
+var previewPageTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Video.Title}}</title>
+<meta property="og:site_name" content="Tubely">
+<meta property="og:type" content="{{if .Audio}}music.song{{else}}video.other{{end}}">
+<meta property="og:title" content="{{.Video.Title}}">
+<meta property="og:description" content="{{.Video.Description}}">
+<meta property="og:url" content="{{.PageURL}}">
+{{- if .Video.ThumbnailURL}}
+<meta property="og:image" content="{{.Video.ThumbnailURL}}">
+{{- end}}
+<meta property="{{if .Audio}}og:audio{{else}}og:video{{end}}" content="{{.Video.VideoURL}}">
+<meta property="{{if .Audio}}og:audio:type{{else}}og:video:type{{end}}" content="{{.ContentType}}">
+{{- if not .Audio}}
+<meta property="og:video:width" content="{{.Width}}">
+<meta property="og:video:height" content="{{.Height}}">
+{{- end}}
+<link rel="alternate" type="application/json+oembed" href="{{.OEmbedURL}}" title="{{.Video.Title}}">
+</head>
+<body>
+{{.Player}}
+</body>
+</html>
+`))
+
+// respondWithPreviewPage serves a page carrying Open Graph tags and oEmbed
+// discovery for a shared video, which is what link preview crawlers read.
+// Private videos answer as missing.
+func (cfg *apiConfig) respondWithPreviewPage(w http.ResponseWriter, r *http.Request, video database.Video) {
+	if !isPubliclyShared(video) {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	video, err := cfg.signVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	width, height := embedSize(video)
+	player, err := embedPlayerHTML(video, width, height)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build preview", err)
+		return
+	}
+	pageURL := cfg.publicBaseURL() + shareSlugPath + *video.ShareSlug
+	data := struct {
+		Video         database.Video
+		Audio         bool
+		ContentType   string
+		Width, Height int
+		PageURL       string
+		OEmbedURL     string
+		Player        template.HTML
+	}{
+		Video:       video,
+		Audio:       video.MediaKind == database.MediaKindAudio,
+		ContentType: storedContentType(video),
+		Width:       width,
+		Height:      height,
+		PageURL:     pageURL,
+		OEmbedURL:   cfg.publicBaseURL() + "/api/oembed?" + url.Values{"url": {pageURL}, "format": {"json"}}.Encode(),
+		// Built by html/template, so already escaped
+		Player: template.HTML(player),
+	}
+
+	var page strings.Builder
+	err = previewPageTemplate.Execute(&page, data)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build preview", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(page.String()))
+}
+
+func parseOptionalDimension(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q isn't a positive integer", v)
+	}
+	return n, nil
+}
+
+// prefersHTML reports whether the Accept header ranks HTML above JSON, as
+// browsers and link preview crawlers send it.
+func prefersHTML(accept string) bool {
+	var htmlQ, jsonQ float64 = -1, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(qs, 64)
+			if err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "text/html":
+			htmlQ = max(htmlQ, q)
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return htmlQ > 0 && htmlQ > jsonQ
+}
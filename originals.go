@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// originalKey is where the untouched upload for a video is kept when
+// KEEP_ORIGINAL is on. Originals are never served through the CDN.
+func (cfg *apiConfig) originalKey(ctx context.Context, video database.Video, ext string) string {
+	return cfg.videoObjectKey(ctx, video.ID, fmt.Sprintf("originals/%s%s", video.ID, ext))
+}
+
+// storeOriginal uploads the source file as received, before faststart or
+// any other processing, and returns its key.
+func (cfg *apiConfig) storeOriginal(ctx context.Context, video database.Video, srcPath, contentType, ext string) (string, error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	key := cfg.originalKey(ctx, video, ext)
+	err = cfg.storage.Put(ctx, key, src, contentType)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// deleteOriginal removes the kept original from storage.
+func (cfg *apiConfig) deleteOriginal(ctx context.Context, key string) error {
+	return cfg.storage.Delete(ctx, key)
+}
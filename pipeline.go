@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// processVideo runs the processing pipeline over an uploaded source file,
+// stores the result and records the outcome on the video. srcHash is the
+// source's content hash. On failure the classified error is saved on the
+// record as well as returned.
+func (cfg *apiConfig) processVideo(ctx context.Context, video *database.Video, srcPath string, srcSize int64, srcHash string, plog *processingLog) *processingError {
+	perr := cfg.claimVideo(video)
+	if perr != nil {
+		return perr
+	}
+	return cfg.processClaimedVideo(ctx, video, srcPath, srcSize, srcHash, plog)
+}
+
+// claimVideo moves the video to uploaded ahead of processing it. This fails
+// if another upload of it is still being processed.
+func (cfg *apiConfig) claimVideo(video *database.Video) *processingError {
+	err := cfg.db.TransitionVideo(video, database.StageUploaded, nil)
+	if err != nil {
+		return newProcessingError(stageReceive, err)
+	}
+	return nil
+}
+
+// processClaimedVideo is processVideo for a video claimed with claimVideo.
+func (cfg *apiConfig) processClaimedVideo(ctx context.Context, video *database.Video, srcPath string, srcSize int64, srcHash string, plog *processingLog) *processingError {
+	perr := cfg.runPipeline(ctx, video, srcPath, srcSize, srcHash, plog)
+	if perr != nil {
+		plog.failOpenSteps(perr.Message)
+		err := cfg.db.TransitionVideo(video, database.StageFailed, &perr.ProcessingError)
+		if err != nil {
+			log.Printf("Couldn't record processing failure for video %s: %v", video.ID, err)
+		}
+		cfg.recordFailedAttempt(ctx, video, perr)
+		return perr
+	}
+
+	if video.ProcessingAttempts > 0 {
+		err := cfg.db.SetProcessingAttempts(video, 0, nil)
+		if err != nil {
+			log.Printf("Couldn't reset processing attempts for video %s: %v", video.ID, err)
+		}
+	}
+	return nil
+}
+
+// failInterruptedVideos marks videos left part way through processing by a
+// previous run as failed, since nothing will ever finish them.
+func (cfg *apiConfig) failInterruptedVideos() error {
+	n, err := cfg.db.FailInterruptedVideos(database.ProcessingError{
+		Stage:     stageFinalize,
+		Code:      errCodeInterrupted,
+		Message:   errorMessages[errCodeInterrupted],
+		Retryable: true,
+	})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("Marked %d interrupted videos as failed", n)
+	}
+	return nil
+}
+
+func (cfg *apiConfig) runPipeline(ctx context.Context, video *database.Video, srcPath string, srcSize int64, srcHash string, plog *processingLog) *processingError {
+	tun := cfg.tunables(ctx)
+	opts := video.ProcessingOptions
+
+	// Assets derived from a previous upload with different content are
+	// regenerated below or collected once this upload is stored
+	replaced := video.SourceHash != "" && video.SourceHash != srcHash
+
+	// There is no scanner yet, so uploads go straight to processing
+	err := cfg.db.TransitionVideo(video, database.StageProcessing, nil)
+	if err != nil {
+		return newProcessingError(stageFinalize, err)
+	}
+
+	// Audio records don't take encoding profiles
+	isAudio := video.MediaKind == database.MediaKindAudio
+	var profile *encodingProfile
+	profileName := opts.EncodingProfile
+	if profileName != "" && !isAudio {
+		p, ok := encodingProfiles[profileName]
+		if !ok {
+			return newProcessingError(stageFaststart, fmt.Errorf("%w %q", errUnknownEncodingProfile, profileName))
+		}
+		profile = &p
+	}
+	tc := cfg.transcoderFor(ctx, profileName)
+
+	// Audio records skip the aspect ratio check and are stored under their
+	// own prefix
+	probeStep := plog.start(stageProbe, srcSize)
+	var audio audioInfo
+	var aspectString, aspectRatio string
+	var probe videoProbe
+	var padToLandscape bool
+	if isAudio {
+		audio, err = tc.probeAudio(ctx, srcPath)
+		if err != nil {
+			return newProcessingError(stageProbe, err)
+		}
+		video.DurationSeconds = &audio.durationSeconds
+		video.BitrateKbps = nil
+		if audio.bitrateKbps > 0 {
+			video.BitrateKbps = &audio.bitrateKbps
+		}
+		video.Width, video.Height, video.FrameRate, video.Codec = nil, nil, nil, nil
+		if audio.codec != "" {
+			video.Codec = &audio.codec
+		}
+		aspectString = "audio"
+		probeStep.finish(0, fmt.Sprintf("audio, %.1f seconds", audio.durationSeconds))
+	} else {
+		probe, err = tc.probeVideo(ctx, srcPath)
+		if err == nil {
+			err = validateVideo(probe, cfg.tunables(ctx))
+		}
+		if err != nil {
+			return newProcessingError(stageProbe, err)
+		}
+		recordProbe(video, probe)
+		aspectRatio = probe.aspect
+
+		switch aspectRatio {
+		case "16:9":
+			aspectString = "landscape"
+		case "9:16":
+			aspectString = "portrait"
+		default:
+			aspectString = "other"
+		}
+
+		// Platforms that only show landscape get portrait videos padded to
+		// it, and the result is filed as landscape
+		if aspectString == "portrait" && cfg.padPortraitToLandscape {
+			padToLandscape = true
+			aspectString = "landscape"
+			probeStep.finish(0, "classified as portrait, padding to landscape")
+		} else if aspectString == "other" {
+			probeStep.finish(0, fmt.Sprintf("classified as other (%s)", aspectRatio))
+		} else {
+			probeStep.finish(0, fmt.Sprintf("classified as %s", aspectString))
+		}
+	}
+	keyDir := aspectDir(aspectString, aspectRatio, cfg.tunables(ctx).otherAspectSubdirs)
+
+	contentType, ext := "video/mp4", ".mp4"
+	if isAudio {
+		contentType, ext = audio.contentType(), audio.ext()
+	}
+
+	// Keep the untouched source so the video can be reprocessed later
+	if database.Enabled(opts.KeepOriginal, tun.keepOriginal) {
+		originalStep := plog.start(stageOriginal, srcSize)
+		originalKey, err := cfg.storeOriginal(ctx, *video, srcPath, contentType, ext)
+		if err != nil {
+			return newProcessingError(stageOriginal, err)
+		}
+		video.OriginalKey = &originalKey
+		video.OriginalSizeBytes = srcSize
+		originalStep.finish(srcSize, "stored original upload")
+	}
+
+	// Measure integrated loudness so later normalization decisions don't
+	// need to re-read the file. A failed measurement isn't fatal.
+	if database.Enabled(opts.MeasureLoudness, tun.measureLoudness) {
+		loudnessStep := plog.start(stageLoudness, srcSize)
+		loudness, err := cfg.measureLoudness(srcPath)
+		if err != nil {
+			log.Printf("Couldn't measure loudness for video %s: %v", video.ID, err)
+			loudnessStep.fail("couldn't measure loudness")
+		} else if loudness == nil {
+			video.LoudnessLUFS = nil
+			loudnessStep.finish(0, "no audible audio track")
+		} else {
+			video.LoudnessLUFS = loudness
+			loudnessStep.finish(0, fmt.Sprintf("integrated loudness %.1f LUFS", *loudness))
+		}
+	} else if opts.MeasureLoudness != nil {
+		plog.skip(stageLoudness, "loudness measurement is turned off for this video")
+	} else {
+		plog.skip(stageLoudness, "loudness measurement is disabled")
+	}
+
+	// Give the video a thumbnail when the owner hasn't set one, and pick
+	// again when a replaced video still shows a frame picked from the old
+	// upload. With AUTO_THUMBNAIL_CANDIDATES it's the best of several
+	// candidate frames, otherwise the frame at autoThumbnailPosition. The
+	// candidates themselves are regenerated whenever the content changes,
+	// or the video has no recorded content yet, even if the owner's
+	// thumbnail stays. This is best-effort and never fails the upload.
+	// Audio has no frames; its artwork is always uploaded by the owner.
+	// Turning thumbnails off for the video stops all of this.
+	candidateThumbnails := database.Enabled(opts.GenerateThumbnails, tun.autoThumbnailCandidates)
+	autoThumbnails := candidateThumbnails || database.Enabled(opts.GenerateThumbnails, tun.autoThumbnail)
+	generateThumbnail := autoThumbnails && video.ThumbnailURL == nil
+	refreshThumbnail := tun.refreshAutoThumbnails && database.Enabled(opts.GenerateThumbnails, true) && video.ThumbnailURL != nil && video.ThumbnailAuto
+	regenerateCandidates := candidateThumbnails && video.SourceHash != srcHash
+	setThumbnail := generateThumbnail || refreshThumbnail
+	if (setThumbnail || regenerateCandidates) && !isAudio {
+		thumbnailStep := plog.start(stageThumbnail, srcSize)
+		var thumbnailURL, message string
+		var err error
+		if candidateThumbnails {
+			thumbnailURL, err = cfg.generateThumbnailCandidates(ctx, *video, srcPath, srcHash, !setThumbnail)
+			message = fmt.Sprintf("picked the best of %d candidate frames", len(thumbnailCandidatePositions))
+		} else {
+			thumbnailURL, err = cfg.generateFrameThumbnail(ctx, srcPath)
+			message = fmt.Sprintf("used the frame at %.0f%% of the duration", autoThumbnailPosition*100)
+		}
+		switch {
+		case err != nil:
+			log.Printf("Couldn't generate thumbnail for video %s: %v", video.ID, err)
+			if refreshThumbnail {
+				thumbnailStep.fail("couldn't refresh the thumbnail, kept the previous one")
+			} else {
+				thumbnailStep.fail("couldn't generate a thumbnail")
+			}
+		case setThumbnail:
+			cfg.useThumbnail(ctx, video, thumbnailURL)
+			video.ThumbnailAuto = true
+			video.ThumbnailSourceHash = srcHash
+			if refreshThumbnail {
+				message = "refreshed thumbnail for the new upload: " + message
+			}
+			thumbnailStep.finish(0, message)
+		default:
+			thumbnailStep.finish(0, "regenerated candidate frames for the new upload, kept the chosen thumbnail")
+		}
+	}
+
+	// Encode lower resolutions for adaptive playback. This reads the
+	// source, so it runs before faststart removes it, and like thumbnails
+	// it is best-effort. A video padded to landscape isn't the picture its
+	// source shows, so it gets none.
+	var renditions database.Renditions
+	serverRenditions := tun.generateRenditions && cfg.flags.Enabled(flagRenditions, video.UserID)
+	if !isAudio && database.Enabled(opts.GenerateRenditions, serverRenditions) {
+		if padToLandscape {
+			plog.skip(stageRenditions, "renditions aren't made for videos padded to landscape")
+		} else {
+			renditionsStep := plog.start(stageRenditions, srcSize)
+			renditions, err = cfg.generateRenditions(ctx, *video, srcPath, srcHash, keyDir, probe, threadsFor(tun.ffmpegThreadTiers, probe))
+			switch {
+			case err != nil:
+				log.Printf("Couldn't generate renditions for video %s: %v", video.ID, err)
+				renditionsStep.fail("couldn't generate renditions")
+			case len(renditions) == 0:
+				renditionsStep.finish(0, fmt.Sprintf("video is smaller than %s, no renditions made", renditionLadder[len(renditionLadder)-1].name))
+			default:
+				var total int64
+				for _, rendition := range renditions {
+					total += rendition.SizeBytes
+				}
+				renditionsStep.finish(total, fmt.Sprintf("encoded %s", strings.Join(renditionNames(renditions), ", ")))
+			}
+		}
+	}
+
+	// Tile frames into a sprite sheet for seek bar previews. It reads the
+	// source too, and is just as best-effort.
+	var storyboard *database.Storyboard
+	if !isAudio && database.Enabled(opts.GenerateStoryboard, tun.generateStoryboard) {
+		storyboardStep := plog.start(stageStoryboard, srcSize)
+		storyboard, err = cfg.generateStoryboard(ctx, *video, srcPath, srcHash, keyDir, probe, tun.storyboardInterval)
+		if err != nil {
+			log.Printf("Couldn't generate storyboard for video %s: %v", video.ID, err)
+			storyboardStep.fail("couldn't generate a storyboard")
+		} else {
+			storyboardStep.finish(0, fmt.Sprintf("tiled %d frames, %gs apart", storyboard.Columns*storyboard.Rows, storyboard.IntervalSeconds))
+		}
+	}
+
+	// Cut a looping clip for hover previews on listing pages. It's stored
+	// with the thumbnails, and best-effort like them.
+	var animatedPreviewURL *string
+	if !isAudio && database.Enabled(opts.GenerateAnimatedPreview, tun.generateAnimatedPreview) {
+		previewStep := plog.start(stagePreview, srcSize)
+		previewURL, err := cfg.generateAnimatedPreview(ctx, srcPath, tun.animatedPreviewFormat, probe)
+		if err != nil {
+			log.Printf("Couldn't generate animated preview for video %s: %v", video.ID, err)
+			previewStep.fail("couldn't generate an animated preview")
+		} else {
+			animatedPreviewURL = &previewURL
+			previewStep.finish(0, fmt.Sprintf("made a %ds %s preview", animatedPreviewSeconds, strings.ToUpper(tun.animatedPreviewFormat)))
+		}
+	}
+
+	// Create the video URL that will be stored in the database and returned to the client.
+	// HLS and DASH output is a manifest at the top of a segment tree named
+	// after the content, so a new upload never rewrites the tree players
+	// are streaming.
+	format := outputMP4
+	// Presigned URLs are for one object each, which a manifest's segments
+	// wouldn't get
+	if !isAudio && !cfg.presignVideoURLs {
+		format = resolveOutputFormat(opts, tun.outputFormat)
+	}
+	segmented := format != outputMP4
+	s3Key := cfg.videoObjectKey(ctx, video.ID, videoFileName(*video, keyDir, ext, ""))
+	if segmented {
+		s3Key = cfg.videoObjectKey(ctx, video.ID, path.Join(videoFileName(*video, keyDir, "", format+"-"+srcHash[:16]), segmentManifests[format]))
+	}
+	videoURL := cfg.storage.URL(s3Key)
+
+	// An identical upload already processed the same way is reused rather
+	// than transcoded and stored again
+	dup, err := cfg.findDuplicate(*video, srcHash)
+	if err != nil {
+		log.Printf("Couldn't look for a duplicate of video %s: %v", video.ID, err)
+	}
+	// One filed under another aspect was made with different padding
+	// settings, so its file isn't what this upload would produce
+	if !isAudio && dup.VideoURL != nil && storedAspect(dup) != aspectString {
+		dup = database.Video{}
+	}
+	// Nor is one stored in the other output format
+	if dup.VideoURL != nil && storedOutputFormat(*dup.VideoURL) != format {
+		dup = database.Video{}
+	}
+
+	var storedSize int64
+	if dup.VideoURL != nil {
+		videoURL = *dup.VideoURL
+		storedSize = dup.SizeBytes
+		plog.skip(stageFaststart, "reused the processed file of an identical upload")
+		plog.skip(stageStore, "reused the processed file of an identical upload")
+	} else {
+		// Other videos may have been deduplicated onto this video's file;
+		// writing new content over it would change theirs too
+		refs, err := cfg.db.CountVideoURLReferences(videoURL, video.ID)
+		if err != nil {
+			return newProcessingError(stageFinalize, err)
+		}
+		if refs > 0 && !segmented {
+			s3Key = cfg.videoObjectKey(ctx, video.ID, videoFileName(*video, keyDir, ext, srcHash[:16]))
+			videoURL = cfg.storage.URL(s3Key)
+		}
+
+		job := transcodeJob{
+			videoID:        video.ID,
+			userID:         video.UserID,
+			srcPath:        srcPath,
+			srcSize:        srcSize,
+			profile:        profile,
+			profileName:    profileName,
+			fragmented:     tun.fragmentedMP4,
+			padToLandscape: padToLandscape,
+			threads:        threadsFor(tun.ffmpegThreadTiers, probe),
+			key:            s3Key,
+			contentType:    contentType,
+			plog:           plog,
+		}
+		if isAudio {
+			job.audio = &audio
+		}
+		var perr *processingError
+		if segmented {
+			storedSize, perr = cfg.packageSegmented(ctx, job, probe, format)
+		} else {
+			var stored storedFile
+			stored, perr = tc.faststart(ctx, job)
+			storedSize = stored.size
+			videoURL = cfg.storage.URL(stored.key)
+		}
+		if perr != nil {
+			return perr
+		}
+	}
+
+	// Update the database with the video URL
+	previousURL := video.VideoURL
+	previousRenditions := video.Renditions
+	previousStoryboard := video.Storyboard
+	previousPreviewURL := video.AnimatedPreviewURL
+	video.VideoURL = &videoURL
+	video.SizeBytes = storedSize
+	video.SourceHash = srcHash
+	video.Renditions = renditions
+	video.Storyboard = storyboard
+	video.AnimatedPreviewURL = animatedPreviewURL
+	err = cfg.db.UpdateVideo(*video)
+	if err != nil {
+		cfg.removeRenditions(ctx, staleRenditions(renditions, previousRenditions))
+		cfg.removeStoryboard(ctx, staleStoryboard(storyboard, previousStoryboard))
+		cfg.removeAnimatedPreview(ctx, animatedPreviewURL)
+		return newProcessingError(stageFinalize, err)
+	}
+	cfg.removeRenditions(ctx, staleRenditions(previousRenditions, renditions))
+	cfg.removeStoryboard(ctx, staleStoryboard(previousStoryboard, storyboard))
+	cfg.removeAnimatedPreview(ctx, previousPreviewURL)
+	if replaced {
+		cfg.collectStaleDerivedAssets(ctx, *video)
+		cfg.removeAudioTrack(ctx, video)
+	}
+	if previousURL != nil && *previousURL != videoURL {
+		cfg.releaseVideoFile(ctx, video.ID, *previousURL)
+	}
+	// A replacement written over the previous file leaves the old one in
+	// the CDN's cache
+	if previousURL != nil && *previousURL == videoURL && dup.VideoURL == nil {
+		cfg.invalidateCDN(ctx, videoURL)
+	}
+
+	// There is no moderation step yet either
+	err = cfg.db.TransitionVideo(video, database.StageReady, nil)
+	if err != nil {
+		return newProcessingError(stageFinalize, err)
+	}
+	return nil
+}
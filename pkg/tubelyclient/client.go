@@ -0,0 +1,542 @@
+// Package tubelyclient is a Go client for the Tubely HTTP API. It handles
+// authentication headers, streams multipart uploads without buffering them
+// in memory, retries requests the server turns away as busy, and turns
+// error responses into *APIError values.
+package tubelyclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultPageSize is how many videos ListVideos fetches per request.
+const DefaultPageSize = 50
+
+// jobPollInterval is how often WaitForJob checks on a job.
+const jobPollInterval = time.Second
+
+// DefaultMaxRetries is how many times a request the server turns away as
+// busy is retried, unless WithMaxRetries says otherwise.
+const DefaultMaxRetries = 2
+
+// retryBaseDelay is the wait before the first retry of a busy response
+// with no Retry-After, doubling for each retry after it.
+const retryBaseDelay = 500 * time.Millisecond
+
+// maxRetryDelay is the longest the client waits to retry. A server asking
+// for longer gets its error returned instead.
+const maxRetryDelay = 30 * time.Second
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	maxRetries int
+
+	mu    sync.Mutex
+	token string
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces the http.Client used for requests. Uploads can run
+// for a long time, so the client should not have a short overall timeout.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithMaxRetries sets how many times a request answered with 429 or 503
+// is retried, waiting as long as the response's Retry-After asks. Uploads
+// stream their body, so they are never retried. 0 turns retries off.
+func WithMaxRetries(n int) Option {
+	return func(c *Client) {
+		c.maxRetries = n
+	}
+}
+
+// WithToken sets the access token used on authenticated requests.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// New creates a client for the server at baseURL, such as
+// "http://localhost:8091".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		maxRetries: DefaultMaxRetries,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// SetToken replaces the access token, for example after a refresh.
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+func (c *Client) currentToken() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// Login authenticates with email and password. On success the access token
+// is used for every later request made through the client.
+func (c *Client) Login(ctx context.Context, email, password string) (LoginResponse, error) {
+	var resp LoginResponse
+	err := c.doJSON(ctx, http.MethodPost, "/api/login", map[string]string{
+		"email":    email,
+		"password": password,
+	}, &resp)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	c.SetToken(resp.Token)
+	return resp, nil
+}
+
+// Refresh exchanges a refresh token for a new access token, which the
+// client then uses, and a new refresh token to keep for the next refresh.
+// Access tokens are short-lived, so long-running programs refresh before
+// they expire. The old refresh token stops working; refreshing with it
+// again signs the user out everywhere.
+func (c *Client) Refresh(ctx context.Context, refreshToken string) (LoginResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/refresh", nil)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+refreshToken)
+	var resp LoginResponse
+	err = c.do(req, &resp)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	c.SetToken(resp.Token)
+	return resp, nil
+}
+
+// Revoke makes a refresh token unusable, such as when signing out.
+func (c *Client) Revoke(ctx context.Context, refreshToken string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/revoke", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+refreshToken)
+	return c.do(req, nil)
+}
+
+// CreateVideo creates the record a video file is later uploaded to.
+func (c *Client) CreateVideo(ctx context.Context, title, description string) (Video, error) {
+	var video Video
+	err := c.doJSON(ctx, http.MethodPost, "/api/videos", map[string]string{
+		"title":       title,
+		"description": description,
+	}, &video)
+	return video, err
+}
+
+// CreateAudio creates an audio record, such as a podcast episode. Upload
+// the file with UploadVideo and a ContentType of "audio/mpeg" or
+// "audio/mp4"; a thumbnail uploaded to it becomes the episode artwork.
+func (c *Client) CreateAudio(ctx context.Context, title, description string) (Video, error) {
+	var video Video
+	err := c.doJSON(ctx, http.MethodPost, "/api/videos", map[string]string{
+		"title":       title,
+		"description": description,
+		"media_kind":  MediaKindAudio,
+	}, &video)
+	return video, err
+}
+
+// GetVideo fetches a single video.
+func (c *Client) GetVideo(ctx context.Context, videoID uuid.UUID) (Video, error) {
+	var video Video
+	err := c.doJSON(ctx, http.MethodGet, "/api/videos/"+videoID.String(), nil, &video)
+	return video, err
+}
+
+// SetVisibility changes who can see a video. Making it unlisted gives it a
+// ShareSlug to share it by.
+func (c *Client) SetVisibility(ctx context.Context, videoID uuid.UUID, visibility string) (Video, error) {
+	var video Video
+	err := c.doJSON(ctx, http.MethodPatch, "/api/videos/"+videoID.String(), map[string]string{
+		"visibility": visibility,
+	}, &video)
+	return video, err
+}
+
+// DeleteVideo deletes a video.
+func (c *Client) DeleteVideo(ctx context.Context, videoID uuid.UUID) error {
+	return c.doJSON(ctx, http.MethodDelete, "/api/videos/"+videoID.String(), nil, nil)
+}
+
+// ExtractAudio extracts the video's audio track as an M4A file, or returns
+// the one already extracted, and returns its URL.
+func (c *Client) ExtractAudio(ctx context.Context, videoID uuid.UUID) (string, error) {
+	var resp struct {
+		AudioURL string `json:"audio_url"`
+	}
+	err := c.doJSON(ctx, http.MethodPost, "/api/videos/"+videoID.String()+"/audio", nil, &resp)
+	return resp.AudioURL, err
+}
+
+// ListVideos iterates over all of the caller's videos, newest first,
+// fetching pageSize at a time (DefaultPageSize when pageSize is 0).
+// Iteration stops at the first error, which is yielded with a zero Video.
+func (c *Client) ListVideos(ctx context.Context, pageSize int) iter.Seq2[Video, error] {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	return func(yield func(Video, error) bool) {
+		for offset := 0; ; offset += pageSize {
+			query := url.Values{}
+			query.Set("limit", strconv.Itoa(pageSize))
+			query.Set("offset", strconv.Itoa(offset))
+
+			var page []Video
+			err := c.doJSON(ctx, http.MethodGet, "/api/videos?"+query.Encode(), nil, &page)
+			if err != nil {
+				yield(Video{}, err)
+				return
+			}
+			for _, video := range page {
+				if !yield(video, nil) {
+					return
+				}
+			}
+			if len(page) < pageSize {
+				return
+			}
+		}
+	}
+}
+
+// UploadOptions describe the file being uploaded.
+type UploadOptions struct {
+	// Filename is sent as the multipart filename. Defaults to "video.mp4".
+	Filename string
+	// ContentType is the file's media type. Defaults to "video/mp4".
+	ContentType string
+	// EncodingProfile re-encodes the video with a preset: "web-optimized",
+	// "high-quality" or "small-file". Empty keeps the video's current
+	// profile. Ignored for thumbnails.
+	EncodingProfile string
+	// OutputFormat stores the processed video as a single MP4 ("mp4"), or
+	// as segments under an HLS playlist ("hls") or DASH manifest ("dash").
+	// Empty keeps the video's current format. Ignored for thumbnails.
+	OutputFormat string
+	// Version stores the video under "<aspect>/<videoID>/v<Version>" so it
+	// gets a new URL that no CDN has cached. It must be greater than the
+	// video's current version. Zero bumps a versioned video to its next
+	// version. Ignored for thumbnails.
+	Version int
+}
+
+// query returns the upload's processing settings as a query string, or ""
+// when there are none.
+func (opts UploadOptions) query() string {
+	q := url.Values{}
+	if opts.EncodingProfile != "" {
+		q.Set("encoding_profile", opts.EncodingProfile)
+	}
+	if opts.OutputFormat != "" {
+		q.Set("output_format", opts.OutputFormat)
+	}
+	if len(q) == 0 {
+		return ""
+	}
+	return "?" + q.Encode()
+}
+
+// UploadVideo streams src to the server as the video file for videoID,
+// waits for it to be processed and returns the processed video with its
+// assets. The body is written as it is read, so large files are never held
+// in memory. A failure in processing is returned as a *JobError.
+func (c *Client) UploadVideo(ctx context.Context, videoID uuid.UUID, src io.Reader, opts UploadOptions) (Video, error) {
+	job, err := c.QueueVideo(ctx, videoID, src, opts)
+	if err != nil {
+		return Video{}, err
+	}
+	job, err = c.WaitForJob(ctx, job.ID)
+	if err != nil {
+		return Video{}, err
+	}
+	if job.Video != nil {
+		return *job.Video, nil
+	}
+	// Older servers don't report the video with the job
+	return c.GetVideo(ctx, videoID)
+}
+
+// QueueVideo streams src to the server as the video file for videoID and
+// returns once it has been received, with the job processing it in the
+// background.
+func (c *Client) QueueVideo(ctx context.Context, videoID uuid.UUID, src io.Reader, opts UploadOptions) (Job, error) {
+	if opts.Filename == "" {
+		opts.Filename = "video.mp4"
+	}
+	if opts.ContentType == "" {
+		opts.ContentType = "video/mp4"
+	}
+	path := "/api/video_upload/" + videoID.String()
+	path += opts.query()
+	var job Job
+	err := c.doMultipart(ctx, path, "video", src, opts, &job)
+	return job, err
+}
+
+// GetJob returns the current state of a processing job.
+func (c *Client) GetJob(ctx context.Context, jobID uuid.UUID) (Job, error) {
+	var job Job
+	err := c.doJSON(ctx, http.MethodGet, "/api/jobs/"+jobID.String(), nil, &job)
+	return job, err
+}
+
+// WaitForJob polls a processing job until it finishes and returns it. A
+// failed job is returned along with a *JobError.
+func (c *Client) WaitForJob(ctx context.Context, jobID uuid.UUID) (Job, error) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		job, err := c.GetJob(ctx, jobID)
+		if err != nil {
+			return Job{}, err
+		}
+		switch job.Status {
+		case JobStatusSucceeded:
+			return job, nil
+		case JobStatusFailed:
+			return job, &JobError{Job: job}
+		}
+		select {
+		case <-ctx.Done():
+			return job, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// UploadVideoDirect uploads the video file for videoID straight to storage
+// with a presigned URL, then has the server process it, so the bytes don't
+// pass through the server. size is the exact length of src, which the
+// storage needs up front. Servers whose storage can't sign uploads answer
+// with an *APIError of status 501; UploadVideo works with any of them.
+func (c *Client) UploadVideoDirect(ctx context.Context, videoID uuid.UUID, src io.Reader, size int64, opts UploadOptions) (Video, error) {
+	if opts.ContentType == "" {
+		opts.ContentType = "video/mp4"
+	}
+	var target struct {
+		UploadURL string            `json:"upload_url"`
+		Method    string            `json:"method"`
+		Headers   map[string]string `json:"headers"`
+		Key       string            `json:"key"`
+	}
+	err := c.doJSON(ctx, http.MethodPost, "/api/videos/"+videoID.String()+"/upload-url",
+		map[string]string{"content_type": opts.ContentType}, &target)
+	if err != nil {
+		return Video{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, target.Method, target.UploadURL, src)
+	if err != nil {
+		return Video{}, err
+	}
+	req.ContentLength = size
+	for name, value := range target.Headers {
+		req.Header.Set(name, value)
+	}
+	// The URL carries its own authorization, so this doesn't go through do
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return Video{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return Video{}, &APIError{StatusCode: resp.StatusCode, Message: "upload to storage failed: " + strings.TrimSpace(string(body))}
+	}
+
+	path := "/api/videos/" + videoID.String() + "/upload-complete"
+	path += opts.query()
+	var video Video
+	err = c.doJSON(ctx, http.MethodPost, path, map[string]any{"key": target.Key, "version": opts.Version}, &video)
+	return video, err
+}
+
+// UploadThumbnail uploads a JPEG or PNG thumbnail for videoID. contentType
+// must be "image/jpeg" or "image/png".
+func (c *Client) UploadThumbnail(ctx context.Context, videoID uuid.UUID, src io.Reader, contentType string) (Video, error) {
+	ext := ".jpg"
+	if contentType == "image/png" {
+		ext = ".png"
+	}
+	opts := UploadOptions{
+		Filename:    "thumbnail" + ext,
+		ContentType: contentType,
+	}
+	var video Video
+	err := c.doMultipart(ctx, "/api/thumbnail_upload/"+videoID.String(), "thumbnail", src, opts, &video)
+	return video, err
+}
+
+func (c *Client) doJSON(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		dat, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(dat)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.do(req, out)
+}
+
+func (c *Client) doMultipart(ctx context.Context, path, field string, src io.Reader, opts UploadOptions, out any) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	// Write the form on a separate goroutine so the request body is
+	// produced as the transport reads it
+	go func() {
+		// The server reads fields as they arrive, so they go before the file
+		if opts.Version > 0 {
+			err := mw.WriteField("version", strconv.Itoa(opts.Version))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, field, opts.Filename))
+		header.Set("Content-Type", opts.ContentType)
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(part, src)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	err = c.do(req, out)
+	// Unblock the writer if the request ended before reading all of it
+	pr.Close()
+	return err
+}
+
+func (c *Client) do(req *http.Request, out any) error {
+	if token := c.currentToken(); token != "" && req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return parseAPIError(resp)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("couldn't decode response: %w", err)
+	}
+	return nil
+}
+
+// send sends req, retrying while the server answers that it is busy and
+// the body can be sent again.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if attempt >= c.maxRetries || !isBusy(resp.StatusCode) || !canResend(req) {
+			return resp, nil
+		}
+		delay := retryDelay(resp, attempt)
+		if delay > maxRetryDelay {
+			return resp, nil
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func isBusy(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// canResend reports whether req's body can be sent again. Streamed bodies,
+// such as uploads, can't.
+func canResend(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// retryDelay is how long to wait before retrying after resp: what its
+// Retry-After asks, or a backoff from retryBaseDelay without one.
+func retryDelay(resp *http.Response, attempt int) time.Duration {
+	if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+		return d
+	}
+	return retryBaseDelay << attempt
+}
@@ -0,0 +1,411 @@
+package tubelyclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// recordedRequest is what a stub server saw of one request.
+type recordedRequest struct {
+	method string
+	path   string
+	auth   string
+	body   string
+}
+
+// stubServer answers each request with the next of its responses, and
+// with the last one once they run out.
+type stubServer struct {
+	mu        sync.Mutex
+	responses []stubResponse
+	requests  []recordedRequest
+}
+
+type stubResponse struct {
+	status int
+	header map[string]string
+	body   string
+}
+
+func (s *stubServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	s.requests = append(s.requests, recordedRequest{
+		method: r.Method,
+		path:   r.URL.RequestURI(),
+		auth:   r.Header.Get("Authorization"),
+		body:   string(body),
+	})
+	resp := s.responses[min(len(s.requests), len(s.responses))-1]
+	s.mu.Unlock()
+
+	for name, value := range resp.header {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(resp.status)
+	io.WriteString(w, resp.body)
+}
+
+func (s *stubServer) recorded() []recordedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]recordedRequest(nil), s.requests...)
+}
+
+func newStubClient(t *testing.T, opts []Option, responses ...stubResponse) (*Client, *stubServer) {
+	t.Helper()
+	stub := &stubServer{responses: responses}
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+	return New(srv.URL, opts...), stub
+}
+
+func TestLoginAuthenticatesLaterRequests(t *testing.T) {
+	videoID := uuid.New()
+	c, stub := newStubClient(t, nil,
+		stubResponse{status: http.StatusOK, body: `{"token":"access","refresh_token":"refresh"}`},
+		stubResponse{status: http.StatusOK, body: `{"id":"` + videoID.String() + `","title":"Boots","visibility":"public"}`},
+	)
+
+	login, err := c.Login(context.Background(), "user@example.com", "password")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if login.Token != "access" || login.RefreshToken != "refresh" {
+		t.Errorf("Login = %+v", login)
+	}
+	video, err := c.GetVideo(context.Background(), videoID)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if video.ID != videoID || video.Title != "Boots" || video.Visibility != VisibilityPublic {
+		t.Errorf("GetVideo = %+v", video)
+	}
+
+	reqs := stub.recorded()
+	var creds map[string]string
+	json.Unmarshal([]byte(reqs[0].body), &creds)
+	if reqs[0].method != http.MethodPost || reqs[0].path != "/api/login" || creds["email"] != "user@example.com" {
+		t.Errorf("login request = %+v", reqs[0])
+	}
+	if reqs[0].auth != "" {
+		t.Errorf("login sent Authorization %q", reqs[0].auth)
+	}
+	if reqs[1].path != "/api/videos/"+videoID.String() || reqs[1].auth != "Bearer access" {
+		t.Errorf("GetVideo request = %+v", reqs[1])
+	}
+}
+
+func TestRefreshSendsRefreshToken(t *testing.T) {
+	c, stub := newStubClient(t, []Option{WithToken("old-access")},
+		stubResponse{status: http.StatusOK, body: `{"token":"new-access","refresh_token":"new-refresh"}`},
+		stubResponse{status: http.StatusNoContent},
+	)
+
+	_, err := c.Refresh(context.Background(), "old-refresh")
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	err = c.DeleteVideo(context.Background(), uuid.New())
+	if err != nil {
+		t.Fatalf("DeleteVideo: %v", err)
+	}
+
+	reqs := stub.recorded()
+	if reqs[0].auth != "Bearer old-refresh" {
+		t.Errorf("refresh sent Authorization %q, want the refresh token", reqs[0].auth)
+	}
+	if reqs[1].auth != "Bearer new-access" {
+		t.Errorf("request after refresh sent Authorization %q, want the new access token", reqs[1].auth)
+	}
+}
+
+func TestListVideosPages(t *testing.T) {
+	page := func(n int) string {
+		videos := make([]Video, n)
+		for i := range videos {
+			videos[i].ID = uuid.New()
+		}
+		dat, _ := json.Marshal(videos)
+		return string(dat)
+	}
+	c, stub := newStubClient(t, nil,
+		stubResponse{status: http.StatusOK, body: page(2)},
+		stubResponse{status: http.StatusOK, body: page(2)},
+		stubResponse{status: http.StatusOK, body: page(1)},
+	)
+
+	n := 0
+	for _, err := range c.ListVideos(context.Background(), 2) {
+		if err != nil {
+			t.Fatalf("ListVideos: %v", err)
+		}
+		n++
+	}
+	if n != 5 {
+		t.Errorf("listed %d videos, want 5", n)
+	}
+	reqs := stub.recorded()
+	want := []string{"/api/videos?limit=2&offset=0", "/api/videos?limit=2&offset=2", "/api/videos?limit=2&offset=4"}
+	if len(reqs) != len(want) {
+		t.Fatalf("made %d requests, want %d", len(reqs), len(want))
+	}
+	for i, req := range reqs {
+		if req.path != want[i] {
+			t.Errorf("request %d = %s, want %s", i, req.path, want[i])
+		}
+	}
+}
+
+func TestQueueVideoStreamsMultipart(t *testing.T) {
+	jobID := uuid.New()
+	c, stub := newStubClient(t, nil,
+		stubResponse{status: http.StatusAccepted, body: `{"id":"` + jobID.String() + `","status":"queued"}`},
+	)
+
+	job, err := c.QueueVideo(context.Background(), uuid.New(), strings.NewReader("video bytes"), UploadOptions{
+		EncodingProfile: "small-file",
+		Version:         3,
+	})
+	if err != nil {
+		t.Fatalf("QueueVideo: %v", err)
+	}
+	if job.ID != jobID || job.Status != JobStatusQueued {
+		t.Errorf("QueueVideo = %+v", job)
+	}
+
+	req := stub.recorded()[0]
+	if !strings.HasSuffix(req.path, "?encoding_profile=small-file") {
+		t.Errorf("upload path = %s", req.path)
+	}
+	for _, want := range []string{`name="version"`, "3", `name="video"; filename="video.mp4"`, "Content-Type: video/mp4", "video bytes"} {
+		if !strings.Contains(req.body, want) {
+			t.Errorf("upload body is missing %q:\n%s", want, req.body)
+		}
+	}
+	if strings.Index(req.body, `name="version"`) > strings.Index(req.body, `name="video"`) {
+		t.Error("version field was sent after the file")
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	tests := []struct {
+		name string
+		resp stubResponse
+		want APIError
+	}{
+		{
+			name: "message",
+			resp: stubResponse{status: http.StatusNotFound, body: `{"error":"Video not found"}`},
+			want: APIError{StatusCode: http.StatusNotFound, Message: "Video not found"},
+		},
+		{
+			name: "processing error",
+			resp: stubResponse{status: http.StatusUnprocessableEntity, body: `{"error":"The file isn't a supported video.","processing_error":{"stage":"receive","code":"unsupported_media_type","message":"The file isn't a supported video.","retryable":false}}`},
+			want: APIError{
+				StatusCode: http.StatusUnprocessableEntity,
+				Message:    "The file isn't a supported video.",
+				Processing: &ProcessingError{Stage: "receive", Code: "unsupported_media_type", Message: "The file isn't a supported video."},
+			},
+		},
+		{
+			name: "code",
+			resp: stubResponse{status: http.StatusForbidden, body: `{"error":"Upload exceeds remaining storage quota","code":"quota_exceeded"}`},
+			want: APIError{StatusCode: http.StatusForbidden, Message: "Upload exceeds remaining storage quota", Code: "quota_exceeded"},
+		},
+		{
+			name: "size limit",
+			resp: stubResponse{status: http.StatusRequestEntityTooLarge, body: `{"error":"Video exceeds the upload size limit","limit_bytes":1024}`},
+			want: APIError{StatusCode: http.StatusRequestEntityTooLarge, Message: "Video exceeds the upload size limit", LimitBytes: 1024},
+		},
+		{
+			name: "retry after",
+			resp: stubResponse{status: http.StatusTooManyRequests, header: map[string]string{"Retry-After": "120"}, body: `{"error":"Too many uploads in progress"}`},
+			want: APIError{StatusCode: http.StatusTooManyRequests, Message: "Too many uploads in progress", RetryAfter: 2 * time.Minute},
+		},
+		{
+			name: "not JSON",
+			resp: stubResponse{status: http.StatusBadGateway, body: "<html>upstream down</html>"},
+			want: APIError{StatusCode: http.StatusBadGateway, Message: "Bad Gateway"},
+		},
+		{
+			name: "empty body",
+			resp: stubResponse{status: http.StatusInternalServerError},
+			want: APIError{StatusCode: http.StatusInternalServerError, Message: "Internal Server Error"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newStubClient(t, []Option{WithMaxRetries(0)}, tt.resp)
+			_, err := c.GetVideo(context.Background(), uuid.New())
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("GetVideo error = %v, want an *APIError", err)
+			}
+			if apiErr.StatusCode != tt.want.StatusCode || apiErr.Message != tt.want.Message ||
+				apiErr.Code != tt.want.Code || apiErr.LimitBytes != tt.want.LimitBytes || apiErr.RetryAfter != tt.want.RetryAfter {
+				t.Errorf("error = %+v, want %+v", apiErr, tt.want)
+			}
+			if (apiErr.Processing == nil) != (tt.want.Processing == nil) ||
+				apiErr.Processing != nil && *apiErr.Processing != *tt.want.Processing {
+				t.Errorf("processing error = %+v, want %+v", apiErr.Processing, tt.want.Processing)
+			}
+		})
+	}
+}
+
+func TestWaitForJobFailure(t *testing.T) {
+	jobID := uuid.New()
+	c, _ := newStubClient(t, nil,
+		stubResponse{status: http.StatusOK, body: `{"id":"` + jobID.String() + `","status":"failed","error":{"stage":"probe","code":"unreadable_media","message":"The file couldn't be read as a video.","retryable":false}}`},
+	)
+
+	_, err := c.WaitForJob(context.Background(), jobID)
+	var jobErr *JobError
+	if !errors.As(err, &jobErr) {
+		t.Fatalf("WaitForJob error = %v, want a *JobError", err)
+	}
+	if jobErr.Job.Error == nil || jobErr.Job.Error.Code != "unreadable_media" {
+		t.Errorf("job error = %+v", jobErr.Job.Error)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	busy := stubResponse{status: http.StatusServiceUnavailable, header: map[string]string{"Retry-After": "0"}, body: `{"error":"Server is busy"}`}
+	throttled := stubResponse{status: http.StatusTooManyRequests, header: map[string]string{"Retry-After": "0"}, body: `{"error":"Slow down"}`}
+	ok := stubResponse{status: http.StatusOK, body: `{"id":"` + uuid.NewString() + `"}`}
+
+	tests := []struct {
+		name      string
+		opts      []Option
+		responses []stubResponse
+		call      func(*Client) error
+		attempts  int
+		status    int
+	}{
+		{
+			name:      "busy then ok",
+			responses: []stubResponse{busy, ok},
+			call:      getVideo,
+			attempts:  2,
+		},
+		{
+			name:      "throttled then ok",
+			responses: []stubResponse{throttled, throttled, ok},
+			call:      getVideo,
+			attempts:  3,
+		},
+		{
+			name:      "busy without Retry-After",
+			responses: []stubResponse{{status: http.StatusServiceUnavailable}, ok},
+			call:      getVideo,
+			attempts:  2,
+		},
+		{
+			name:      "gives up after the retries",
+			responses: []stubResponse{busy},
+			call:      getVideo,
+			attempts:  1 + DefaultMaxRetries,
+			status:    http.StatusServiceUnavailable,
+		},
+		{
+			name:      "retries turned off",
+			opts:      []Option{WithMaxRetries(0)},
+			responses: []stubResponse{busy, ok},
+			call:      getVideo,
+			attempts:  1,
+			status:    http.StatusServiceUnavailable,
+		},
+		{
+			name:      "Retry-After too long",
+			responses: []stubResponse{{status: http.StatusServiceUnavailable, header: map[string]string{"Retry-After": "3600"}}, ok},
+			call:      getVideo,
+			attempts:  1,
+			status:    http.StatusServiceUnavailable,
+		},
+		{
+			name:      "other errors aren't retried",
+			responses: []stubResponse{{status: http.StatusInternalServerError}, ok},
+			call:      getVideo,
+			attempts:  1,
+			status:    http.StatusInternalServerError,
+		},
+		{
+			name:      "JSON body is sent again",
+			responses: []stubResponse{busy, ok},
+			call: func(c *Client) error {
+				_, err := c.CreateVideo(context.Background(), "Boots", "A video")
+				return err
+			},
+			attempts: 2,
+		},
+		{
+			name:      "uploads aren't retried",
+			responses: []stubResponse{busy, ok},
+			call: func(c *Client) error {
+				_, err := c.QueueVideo(context.Background(), uuid.New(), strings.NewReader("video bytes"), UploadOptions{})
+				return err
+			},
+			attempts: 1,
+			status:   http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, stub := newStubClient(t, tt.opts, tt.responses...)
+			err := tt.call(c)
+
+			var apiErr *APIError
+			switch {
+			case tt.status == 0 && err != nil:
+				t.Fatalf("got %v, want success", err)
+			case tt.status != 0 && (!errors.As(err, &apiErr) || apiErr.StatusCode != tt.status):
+				t.Fatalf("got %v, want a %d *APIError", err, tt.status)
+			}
+			reqs := stub.recorded()
+			if len(reqs) != tt.attempts {
+				t.Fatalf("made %d requests, want %d", len(reqs), tt.attempts)
+			}
+			for i, req := range reqs[1:] {
+				if req.body != reqs[0].body || req.auth != reqs[0].auth {
+					t.Errorf("retry %d sent %+v, want the same request as %+v", i+1, req, reqs[0])
+				}
+			}
+		})
+	}
+}
+
+func TestRetryStopsWithContext(t *testing.T) {
+	c, stub := newStubClient(t, nil,
+		stubResponse{status: http.StatusServiceUnavailable, header: map[string]string{"Retry-After": "10"}},
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := c.GetVideo(ctx, uuid.New())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("waited %v for a retry after the context ended", elapsed)
+	}
+	if n := len(stub.recorded()); n != 1 {
+		t.Errorf("made %d requests, want 1", n)
+	}
+}
+
+func getVideo(c *Client) error {
+	_, err := c.GetVideo(context.Background(), uuid.New())
+	return err
+}
@@ -0,0 +1,266 @@
+package tubelyclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Processing statuses reported in Video.ProcessingStatus.
+const (
+	StatusAwaitingUpload = "awaiting_upload"
+	StatusProcessing     = "processing"
+	StatusReady          = "ready"
+	StatusFailed         = "failed"
+)
+
+// Media kinds reported in Video.MediaKind.
+const (
+	MediaKindVideo = "video"
+	MediaKindAudio = "audio"
+)
+
+// Visibilities reported in Video.Visibility. Unlisted videos are shared by
+// their ShareSlug; private ones are only visible to their owner.
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+type Video struct {
+	ID                uuid.UUID         `json:"id"`
+	CreatedAt         time.Time         `json:"created_at"`
+	UpdatedAt         time.Time         `json:"updated_at"`
+	Title             string            `json:"title"`
+	Description       string            `json:"description"`
+	UserID            uuid.UUID         `json:"user_id"`
+	ThumbnailURL      *string           `json:"thumbnail_url"`
+	ThumbnailWebPURL  *string           `json:"thumbnail_webp_url"`
+	VideoURL          *string           `json:"video_url"`
+	AudioURL          *string           `json:"audio_url"`
+	ShareSlug         *string           `json:"share_slug"`
+	Version           int               `json:"version"`
+	SizeBytes         int64             `json:"size_bytes"`
+	LoudnessLUFS      *float64          `json:"loudness_lufs"`
+	ProcessingStatus  string            `json:"processing_status"`
+	LifecycleStage    string            `json:"lifecycle_stage"`
+	ProcessingError   *ProcessingError  `json:"processing_error"`
+	OriginalSizeBytes int64             `json:"original_size_bytes"`
+	ProcessingOptions ProcessingOptions `json:"processing_options"`
+	MediaKind         string            `json:"media_kind"`
+	Visibility        string            `json:"visibility"`
+	DurationSeconds   *float64          `json:"duration_seconds"`
+	BitrateKbps       *int64            `json:"bitrate_kbps"`
+	// Renditions are lower resolution copies for adaptive playback,
+	// highest first. Empty unless renditions are turned on.
+	Renditions []Rendition `json:"renditions"`
+	// Storyboard has the seek bar preview files, when they are turned on.
+	Storyboard *Storyboard `json:"storyboard"`
+	// AnimatedPreviewURL is a short looping WebP or GIF clip for hover
+	// previews, when they are turned on.
+	AnimatedPreviewURL *string `json:"animated_preview_url"`
+	// Width, Height, FrameRate and Codec describe the upload as it was
+	// probed. Audio records have only a Codec.
+	Width     *int     `json:"width"`
+	Height    *int     `json:"height"`
+	FrameRate *float64 `json:"frame_rate"`
+	Codec     *string  `json:"codec"`
+
+	// Assets is only filled in by UploadVideo and UploadVideoDirect.
+	Assets *Assets `json:"assets,omitempty"`
+	// StageTimings is only filled in by UploadVideoDirect, and only when
+	// the stage_timings feature flag is on for the user.
+	StageTimings []StageTiming `json:"stage_timings,omitempty"`
+}
+
+// StageTiming is how long one processing step of an upload took.
+type StageTiming struct {
+	Stage      string `json:"stage"`
+	Status     string `json:"status"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Assets lists every artifact generated for a video.
+type Assets struct {
+	Video *Asset `json:"video,omitempty"`
+	// Renditions are the lower resolution copies, highest first
+	Renditions          []Rendition          `json:"renditions,omitempty"`
+	Thumbnail           *Asset               `json:"thumbnail,omitempty"`
+	ThumbnailCandidates []ThumbnailCandidate `json:"thumbnail_candidates,omitempty"`
+	ThumbnailWebP       *Asset               `json:"thumbnail_webp,omitempty"`
+	// AnimatedPreview is the short looping clip shown on hover
+	AnimatedPreview *Asset `json:"animated_preview,omitempty"`
+	// Audio is the extracted audio track
+	Audio *Asset `json:"audio,omitempty"`
+	// Storyboard has the seek bar preview's WebVTT file and sprite sheet
+	Storyboard *Storyboard `json:"storyboard,omitempty"`
+}
+
+type Asset struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type,omitempty"`
+	SizeBytes   int64  `json:"size_bytes,omitempty"`
+	// Bucket and Key locate the stored video in S3. The server only sends
+	// them when the storage_details feature flag is on for the user.
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key,omitempty"`
+}
+
+// Rendition is one resolution of a video.
+type Rendition struct {
+	Name        string `json:"name"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	URL         string `json:"url"`
+	SizeBytes   int64  `json:"size_bytes"`
+	BitrateKbps int    `json:"bitrate_kbps"`
+}
+
+// Storyboard is a sprite sheet of frames IntervalSeconds apart and a WebVTT
+// file at URL whose cues point into it.
+type Storyboard struct {
+	URL             string  `json:"url"`
+	SpriteURL       string  `json:"sprite_url"`
+	IntervalSeconds float64 `json:"interval_seconds"`
+	TileWidth       int     `json:"tile_width"`
+	TileHeight      int     `json:"tile_height"`
+	Columns         int     `json:"columns"`
+	Rows            int     `json:"rows"`
+}
+
+type ThumbnailCandidate struct {
+	Position int     `json:"position"`
+	URL      string  `json:"url"`
+	Score    float64 `json:"score"`
+}
+
+// ProcessingOptions are the per-video settings used when processing uploads.
+type ProcessingOptions struct {
+	EncodingProfile string `json:"encoding_profile,omitempty"`
+	// OutputFormat is "mp4", "hls" or "dash"; empty follows the server.
+	OutputFormat string `json:"output_format,omitempty"`
+	// Nil flags follow the server's setting.
+	GenerateThumbnails      *bool `json:"generate_thumbnails,omitempty"`
+	MeasureLoudness         *bool `json:"measure_loudness,omitempty"`
+	KeepOriginal            *bool `json:"keep_original,omitempty"`
+	GenerateRenditions      *bool `json:"generate_renditions,omitempty"`
+	GenerateStoryboard      *bool `json:"generate_storyboard,omitempty"`
+	GenerateAnimatedPreview *bool `json:"generate_animated_preview,omitempty"`
+}
+
+type LoginResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// ProcessingError describes why processing a video failed. Code values are
+// stable and safe to branch on.
+type ProcessingError struct {
+	Stage     string `json:"stage"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+}
+
+// Processing job statuses reported in Job.Status.
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+)
+
+// Job is an uploaded video file being processed in the background.
+type Job struct {
+	ID         uuid.UUID        `json:"id"`
+	VideoID    uuid.UUID        `json:"video_id"`
+	Status     string           `json:"status"`
+	SourceSize int64            `json:"source_size"`
+	Version    int              `json:"version"`
+	Error      *ProcessingError `json:"error"`
+	CreatedAt  time.Time        `json:"created_at"`
+	StartedAt  *time.Time       `json:"started_at"`
+	FinishedAt *time.Time       `json:"finished_at"`
+	// Video is the processed video with its assets, once the job has
+	// succeeded.
+	Video *Video `json:"video,omitempty"`
+}
+
+// JobError is returned when a processing job failed.
+type JobError struct {
+	Job Job
+}
+
+func (e *JobError) Error() string {
+	if e.Job.Error != nil {
+		return fmt.Sprintf("tubely: job %s failed: %s (%s)", e.Job.ID, e.Job.Error.Message, e.Job.Error.Code)
+	}
+	return fmt.Sprintf("tubely: job %s failed", e.Job.ID)
+}
+
+// APIError is returned for any error response from the server. Processing
+// is set when an upload failed in the pipeline.
+type APIError struct {
+	StatusCode int
+	Message    string
+	Processing *ProcessingError
+	// Code identifies some errors for programs, such as "quota_exceeded"
+	Code string
+	// LimitBytes is the size limit an upload rejected with 413 went over
+	LimitBytes int64
+	// RetryAfter is how long the server asked to wait before trying
+	// again, set on some 429 and 503 responses
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	if e.Processing != nil {
+		return fmt.Sprintf("tubely: %d %s (%s)", e.StatusCode, e.Message, e.Processing.Code)
+	}
+	return fmt.Sprintf("tubely: %d %s", e.StatusCode, e.Message)
+}
+
+func parseAPIError(resp *http.Response) error {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Message:    http.StatusText(resp.StatusCode),
+	}
+	var body struct {
+		Error           string           `json:"error"`
+		ProcessingError *ProcessingError `json:"processing_error"`
+		Code            string           `json:"code"`
+		LimitBytes      int64            `json:"limit_bytes"`
+	}
+	dat, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err == nil && json.Unmarshal(dat, &body) == nil {
+		if body.Error != "" {
+			apiErr.Message = body.Error
+		}
+		apiErr.Processing = body.ProcessingError
+		apiErr.Code = body.Code
+		apiErr.LimitBytes = body.LimitBytes
+	}
+	apiErr.RetryAfter, _ = parseRetryAfter(resp.Header.Get("Retry-After"))
+	return apiErr
+}
+
+// parseRetryAfter reads a Retry-After header in either of its forms, a
+// number of seconds or an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
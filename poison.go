@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Failed attempts are spaced out exponentially from processingBackoffBase,
+// up to processingBackoffMax.
+const (
+	processingBackoffBase = time.Minute
+	processingBackoffMax  = time.Hour
+)
+
+func processingBackoff(attempts int) time.Duration {
+	backoff := processingBackoffBase
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= processingBackoffMax {
+			return processingBackoffMax
+		}
+	}
+	return backoff
+}
+
+// checkProcessingAllowed refuses to process a poisoned video, or one still
+// backing off after a failed attempt.
+func checkProcessingAllowed(video database.Video) *processingError {
+	if video.LifecycleStage == database.StagePoisoned {
+		return newCodedProcessingError(stageReceive, errCodePoisoned, false, fmt.Errorf("video %s is poisoned", video.ID))
+	}
+	if video.NextAttemptAt != nil && time.Now().Before(*video.NextAttemptAt) {
+		return newCodedProcessingError(stageReceive, errCodeBackoff, true, fmt.Errorf("video %s can't be retried until %s", video.ID, video.NextAttemptAt.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// recordFailedAttempt counts a failure the file itself caused and either
+// schedules the next allowed attempt or poisons the video once it has
+// failed too many times. Infrastructure failures are marked retryable and
+// aren't counted, since they say nothing about the file.
+func (cfg *apiConfig) recordFailedAttempt(ctx context.Context, video *database.Video, perr *processingError) {
+	if perr.Retryable {
+		return
+	}
+
+	attempts := video.ProcessingAttempts + 1
+	maxAttempts := cfg.tunables(ctx).maxProcessingAttempts
+	if maxAttempts > 0 && attempts >= maxAttempts {
+		err := cfg.db.TransitionVideo(video, database.StagePoisoned, &perr.ProcessingError)
+		if err != nil {
+			log.Printf("Couldn't poison video %s: %v", video.ID, err)
+		} else {
+			cfg.metrics.videosPoisoned.WithLabelValues(perr.Code).Inc()
+			log.Printf("Video %s poisoned after %d failed attempts: %v", video.ID, attempts, perr)
+		}
+		err = cfg.db.SetProcessingAttempts(video, attempts, nil)
+		if err != nil {
+			log.Printf("Couldn't record processing attempts for video %s: %v", video.ID, err)
+		}
+		return
+	}
+
+	next := time.Now().UTC().Add(processingBackoff(attempts))
+	err := cfg.db.SetProcessingAttempts(video, attempts, &next)
+	if err != nil {
+		log.Printf("Couldn't record processing attempts for video %s: %v", video.ID, err)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+// padToLandscapeFilter centers the original, scaled to the full height, in
+// a 1920x1080 frame filled with a blurred copy of itself scaled up to cover
+// it. Its output is labeled [v].
+const padToLandscapeFilter = "[0:v]split=2[bg][fg];" +
+	"[bg]scale=1920:1080:force_original_aspect_ratio=increase,crop=1920:1080,boxblur=20:5[blurred];" +
+	"[fg]scale=-2:1080[centered];" +
+	"[blurred][centered]overlay=(W-w)/2:(H-h)/2,setsar=1[v]"
+
+// defaultPadVideoArgs encode a padded video that has no profile. Padding
+// always re-encodes the video stream; the audio is copied.
+var defaultPadVideoArgs = []string{
+	"-c:v", "libx264",
+	"-preset", "medium",
+	"-crf", "23",
+	"-pix_fmt", "yuv420p",
+	"-c:a", "copy",
+}
+
+// padToLandscapeArgs are the ffmpeg input and codec arguments that pad a
+// portrait video to landscape, encoded with profile when there is one.
+func padToLandscapeArgs(filePath string, profile *encodingProfile) []string {
+	args := []string{"-i", filePath, "-filter_complex", padToLandscapeFilter, "-map", "[v]", "-map", "0:a?"}
+	if profile != nil {
+		return append(args, profile.ffmpegArgs()...)
+	}
+	return append(args, defaultPadVideoArgs...)
+}
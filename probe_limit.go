@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// probeLimiter bounds how many ffprobe processes run at once. Probes are
+// quick, but a burst of uploads would otherwise start one per upload at
+// the same moment. Transcodes aren't counted here, so a slow encode never
+// holds up a probe.
+type probeLimiter struct {
+	mu      sync.Mutex
+	running int
+	// released is closed and replaced whenever a slot frees up
+	released chan struct{}
+}
+
+func newProbeLimiter() *probeLimiter {
+	return &probeLimiter{released: make(chan struct{})}
+}
+
+// acquire waits for a probe slot, with at most limit probes running; a
+// limit of 0 means no limit. The limit is passed on every call so a reload
+// takes effect for the next probe. Every successful acquire must be
+// released.
+func (l *probeLimiter) acquire(ctx context.Context, limit int) error {
+	for {
+		l.mu.Lock()
+		if limit <= 0 || l.running < limit {
+			l.running++
+			l.mu.Unlock()
+			return nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *probeLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	close(l.released)
+	l.released = make(chan struct{})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+
+	"github.com/aws/smithy-go"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Pipeline stages reported in processing errors and the processing log.
+const (
+	stageReceive    = "receive"
+	stageProbe      = "probe"
+	stageLoudness   = "loudness"
+	stageThumbnail  = "thumbnail"
+	stageRenditions = "renditions"
+	stageStoryboard = "storyboard"
+	stagePreview    = "preview"
+	stageFaststart  = "faststart"
+	stageSegment    = "segment"
+	stageOriginal   = "original"
+	stageStore      = "store"
+	stageFinalize   = "finalize"
+)
+
+// Stable error codes clients can branch on.
+const (
+	errCodeUnreadableMedia    = "unreadable_media"
+	errCodeTranscodeFailed    = "transcode_failed"
+	errCodeToolUnavailable    = "processing_unavailable"
+	errCodeStorageUnavailable = "storage_unavailable"
+	errCodeStorageRejected    = "storage_rejected"
+	errCodeDatabase           = "database_error"
+	errCodeTimeout            = "timeout"
+	errCodeInternal           = "internal_error"
+	errCodeVideoBusy          = "video_busy"
+	errCodeInterrupted        = "interrupted"
+	errCodePoisoned           = "poisoned"
+	errCodeBackoff            = "retry_later"
+	errCodeEncryptedMedia     = "encrypted_media"
+	errCodeVideoDeleted       = "video_deleted"
+	errCodeUnsupportedMedia   = "unsupported_media_type"
+	errCodeInvalidMedia       = "invalid_media"
+	errCodeNoTempSpace        = "insufficient_temp_space"
+)
+
+var errorMessages = map[string]string{
+	errCodeUnreadableMedia:    "The file couldn't be read as a video. Check that it's a valid MP4.",
+	errCodeTranscodeFailed:    "The video couldn't be processed. Re-exporting it from your editor may help.",
+	errCodeToolUnavailable:    "Video processing is temporarily unavailable. Please try again later.",
+	errCodeStorageUnavailable: "The processed video couldn't be stored. Please try again.",
+	errCodeStorageRejected:    "The processed video was rejected by storage.",
+	errCodeDatabase:           "The video couldn't be saved. Please try again.",
+	errCodeTimeout:            "Processing took too long and was stopped. Please try again.",
+	errCodeInternal:           "Something went wrong while processing the video.",
+	errCodeVideoBusy:          "This video is already being processed. Wait for it to finish before uploading again.",
+	errCodeInterrupted:        "Processing was interrupted by a server restart. Please upload the video again.",
+	errCodePoisoned:           "This video failed processing too many times and won't be retried. Contact support.",
+	errCodeBackoff:            "This video failed processing recently. Wait before uploading it again.",
+	errCodeEncryptedMedia:     "Encrypted or DRM-protected videos aren't supported. Upload an unprotected copy.",
+	errCodeVideoDeleted:       "The video was deleted before its upload was processed.",
+	errCodeUnsupportedMedia:   "The file's content isn't a supported media type, whatever it was labeled as.",
+	errCodeInvalidMedia:       "The video doesn't meet the upload requirements.",
+	errCodeNoTempSpace:        "The server doesn't have room to process a video this large. Please try again later.",
+}
+
+// processingError is a pipeline failure classified into a stable code. The
+// wrapped error keeps the raw details for the server log; only the embedded
+// ProcessingError is shown to clients.
+type processingError struct {
+	database.ProcessingError
+	err error
+}
+
+func (e *processingError) Error() string {
+	return fmt.Sprintf("%s failed (%s): %v", e.Stage, e.Code, e.err)
+}
+
+func (e *processingError) Unwrap() error {
+	return e.err
+}
+
+// newCodedProcessingError builds a processing error whose code is already
+// known, for failures that don't come from running a stage.
+func newCodedProcessingError(stage, code string, retryable bool, err error) *processingError {
+	return &processingError{
+		ProcessingError: database.ProcessingError{
+			Stage:     stage,
+			Code:      code,
+			Message:   errorMessages[code],
+			Retryable: retryable,
+		},
+		err: err,
+	}
+}
+
+// newProcessingError classifies an error from the given pipeline stage. A
+// video rejected by validation keeps its own message, which says what to
+// fix.
+func newProcessingError(stage string, err error) *processingError {
+	code, retryable := classifyProcessingError(stage, err)
+	perr := newCodedProcessingError(stage, code, retryable, err)
+	var rejection *videoRejection
+	if errors.As(err, &rejection) {
+		perr.Message = rejection.message
+	}
+	return perr
+}
+
+func classifyProcessingError(stage string, err error) (code string, retryable bool) {
+	var exitErr *exec.ExitError
+	var apiErr smithy.APIError
+	var sqliteErr sqlite3.Error
+	var remoteErr *remoteTranscodeError
+
+	switch {
+	case errors.Is(err, database.ErrIllegalTransition), errors.Is(err, database.ErrStaleTransition):
+		return errCodeVideoBusy, true
+	case errors.Is(err, errEncryptedMedia):
+		return errCodeEncryptedMedia, false
+	case errors.As(err, new(*videoRejection)):
+		return errCodeInvalidMedia, false
+	case errors.Is(err, errFaststartNotApplied):
+		// ffmpeg wrote the file but didn't finish the job; that says more
+		// about the ffmpeg build than about the upload
+		return errCodeTranscodeFailed, true
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return errCodeTimeout, true
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, errTranscoderUnavailable):
+		return errCodeToolUnavailable, true
+	case errors.As(err, &remoteErr):
+		return remoteErr.code()
+	case errors.As(err, &exitErr):
+		// ffmpeg/ffprobe ran and rejected the input; retrying the same
+		// file won't help
+		if stage == stageProbe {
+			return errCodeUnreadableMedia, false
+		}
+		return errCodeTranscodeFailed, false
+	case errors.As(err, &apiErr):
+		if apiErr.ErrorFault() == smithy.FaultServer {
+			return errCodeStorageUnavailable, true
+		}
+		return errCodeStorageRejected, false
+	case errors.As(err, &sqliteErr):
+		return errCodeDatabase, true
+	case stage == stageStore, stage == stageOriginal:
+		// Anything else from the S3 client is a transport failure
+		return errCodeStorageUnavailable, true
+	}
+	return errCodeInternal, true
+}
+
+// httpStatus maps a processing error onto the response status for
+// synchronous requests.
+func (e *processingError) httpStatus() int {
+	switch e.Code {
+	case errCodeVideoBusy, errCodePoisoned:
+		return http.StatusConflict
+	case errCodeBackoff:
+		return http.StatusTooManyRequests
+	case errCodeUnsupportedMedia:
+		return http.StatusUnsupportedMediaType
+	case errCodeInvalidMedia:
+		return http.StatusBadRequest
+	case errCodeUnreadableMedia, errCodeTranscodeFailed, errCodeEncryptedMedia:
+		return http.StatusUnprocessableEntity
+	case errCodeToolUnavailable, errCodeStorageUnavailable, errCodeDatabase, errCodeTimeout:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// rejectsFile reports whether the error means the uploaded file itself is
+// unusable, as opposed to the server failing to process it.
+func (e *processingError) rejectsFile() bool {
+	switch e.Code {
+	case errCodeUnreadableMedia, errCodeTranscodeFailed, errCodeEncryptedMedia, errCodeUnsupportedMedia, errCodeInvalidMedia:
+		return true
+	}
+	return false
+}
+
+func respondWithProcessingError(w http.ResponseWriter, perr *processingError) {
+	log.Println(perr)
+	type errorResponse struct {
+		Error           string                    `json:"error"`
+		ProcessingError *database.ProcessingError `json:"processing_error"`
+	}
+	respondWithJSON(w, perr.httpStatus(), errorResponse{
+		Error:           perr.Message,
+		ProcessingError: &perr.ProcessingError,
+	})
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// processingJobsDirName is the temp directory holding the received files of
+// queued jobs, each named after its job, and the intermediate files made
+// from them. Being a directory, the stale temp file sweep leaves it alone;
+// startup removes what no queued job owns.
+const processingJobsDirName = tempFilePrefix + "jobs"
+
+// jobPollInterval is how often idle workers look for jobs they weren't
+// woken for, such as ones queued before a restart.
+const jobPollInterval = 5 * time.Second
+
+// jobTempSpaceRetry is how long a worker waits before trying again to
+// reserve temp space for its job.
+const jobTempSpaceRetry = 5 * time.Second
+
+const defaultProcessingWorkers = 2
+
+// jobQueue coordinates the workers that process queued uploads. The jobs
+// themselves are kept in the database, so queued ones survive a restart.
+type jobQueue struct {
+	wake     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+}
+
+func newJobQueue() *jobQueue {
+	return &jobQueue{
+		wake:    make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+}
+
+// notify wakes an idle worker to look for a job.
+func (q *jobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// shutdown stops workers from taking new jobs and waits until the running
+// ones finish or ctx is done. Jobs still running then are failed as
+// interrupted at the next startup.
+func (q *jobQueue) shutdown(ctx context.Context) error {
+	q.stopOnce.Do(func() {
+		close(q.stopped)
+	})
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (cfg *apiConfig) processingJobsDir() string {
+	return filepath.Join(cfg.tempDir, processingJobsDirName)
+}
+
+func (cfg *apiConfig) jobSourcePath(jobID uuid.UUID) string {
+	// The pipeline names its intermediate files after the source, minus
+	// the .mp4
+	return filepath.Join(cfg.processingJobsDir(), jobID.String()+".mp4")
+}
+
+// startProcessingWorkers runs n workers until the job queue is shut down.
+func (cfg *apiConfig) startProcessingWorkers(n int) {
+	for range n {
+		cfg.jobs.workers.Add(1)
+		go cfg.processingWorker()
+	}
+}
+
+func (cfg *apiConfig) processingWorker() {
+	defer cfg.jobs.workers.Done()
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cfg.jobs.stopped:
+			return
+		default:
+		}
+
+		job, ok, err := cfg.db.ClaimNextProcessingJob()
+		if err != nil {
+			log.Printf("Couldn't claim a processing job: %v", err)
+		}
+		if ok {
+			// There may be more; let another worker look
+			cfg.jobs.notify()
+			cfg.runProcessingJob(job)
+			continue
+		}
+
+		select {
+		case <-cfg.jobs.wake:
+		case <-ticker.C:
+		case <-cfg.jobs.stopped:
+			return
+		}
+	}
+}
+
+// enqueueVideo receives src for the video, claims the video and queues a
+// job to process the file in the background. The job takes the processing
+// log's upload ID, so the steps the worker records join the receive step.
+// Errors from src are returned as is; a video that can't be claimed is
+// returned as a *processingError.
+func (cfg *apiConfig) enqueueVideo(video *database.Video, src io.Reader, plog *processingLog) (database.ProcessingJob, error) {
+	defer cfg.followSteps(video.ID, plog)()
+
+	srcPath, size, srcHash, err := cfg.receiveVideo(src, plog)
+	if err != nil {
+		return database.ProcessingJob{}, err
+	}
+	defer os.Remove(srcPath) // Gone once moved to the job
+
+	perr := checkReceivedContent(*video, srcPath)
+	if perr != nil {
+		return database.ProcessingJob{}, perr
+	}
+
+	perr = cfg.claimVideo(video)
+	if perr != nil {
+		return database.ProcessingJob{}, perr
+	}
+
+	jobID := plog.uploadID
+	err = os.Rename(srcPath, cfg.jobSourcePath(jobID))
+	if err == nil {
+		var job database.ProcessingJob
+		job, err = cfg.db.CreateProcessingJob(database.ProcessingJob{
+			ID:         jobID,
+			VideoID:    video.ID,
+			UserID:     video.UserID,
+			SourceSize: size,
+			SourceHash: srcHash,
+			Version:    video.Version,
+		})
+		if err == nil {
+			cfg.jobs.notify()
+			return job, nil
+		}
+		os.Remove(cfg.jobSourcePath(jobID))
+	}
+
+	// Nothing will process the video now, so don't leave it claimed
+	perr = newProcessingError(stageReceive, err)
+	plog.failOpenSteps(perr.Message)
+	terr := cfg.db.TransitionVideo(video, database.StageFailed, &perr.ProcessingError)
+	if terr != nil {
+		log.Printf("Couldn't record queueing failure for video %s: %v", video.ID, terr)
+	}
+	return database.ProcessingJob{}, perr
+}
+
+// runProcessingJob processes a claimed job and records the outcome. The
+// job's file is removed either way.
+func (cfg *apiConfig) runProcessingJob(job database.ProcessingJob) {
+	srcPath := cfg.jobSourcePath(job.ID)
+
+	// Wait for temp space for the intermediate files, as a synchronous
+	// upload would
+	tempBytes := job.SourceSize * tempCopiesPerUpload
+	for !cfg.tempSpace.tryReserve(tempBytes) {
+		// The cap may have been lowered by a config reload since the
+		// upload was accepted, and a job over the whole cap would wait
+		// forever
+		if !cfg.tempSpace.fits(tempBytes) {
+			os.Remove(srcPath)
+			cfg.failUnstartedJob(job, newCodedProcessingError(stageReceive, errCodeNoTempSpace, true,
+				fmt.Errorf("job needs %d bytes of temp space, more than the cap", tempBytes)))
+			return
+		}
+		select {
+		case <-time.After(jobTempSpaceRetry):
+		case <-cfg.jobs.stopped:
+			err := cfg.db.RequeueProcessingJob(job.ID)
+			if err != nil {
+				log.Printf("Couldn't requeue processing job %s: %v", job.ID, err)
+			}
+			return
+		}
+	}
+	defer cfg.tempSpace.release(tempBytes)
+	defer os.Remove(srcPath)
+
+	var result *database.ProcessingError
+	perr := cfg.processJob(context.Background(), job, srcPath)
+	if perr != nil {
+		log.Printf("Processing job %s failed: %v", job.ID, perr)
+		result = &perr.ProcessingError
+	}
+	err := cfg.db.FinishProcessingJob(job.ID, result)
+	if err != nil {
+		log.Printf("Couldn't record outcome of processing job %s: %v", job.ID, err)
+	}
+}
+
+// failUnstartedJob records perr as the outcome of a job that couldn't
+// start, and fails its video, which the upload left claimed.
+func (cfg *apiConfig) failUnstartedJob(job database.ProcessingJob, perr *processingError) {
+	log.Printf("Processing job %s failed: %v", job.ID, perr)
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		log.Printf("Couldn't get video %s of processing job %s: %v", job.VideoID, job.ID, err)
+	} else if video.ID != uuid.Nil {
+		err = cfg.db.TransitionVideo(&video, database.StageFailed, &perr.ProcessingError)
+		if err != nil {
+			log.Printf("Couldn't record processing failure for video %s: %v", video.ID, err)
+		}
+	}
+	err = cfg.db.FinishProcessingJob(job.ID, &perr.ProcessingError)
+	if err != nil {
+		log.Printf("Couldn't record outcome of processing job %s: %v", job.ID, err)
+	}
+}
+
+func (cfg *apiConfig) processJob(ctx context.Context, job database.ProcessingJob, srcPath string) (perr *processingError) {
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return newProcessingError(stageReceive, err)
+	}
+	if video.ID == uuid.Nil {
+		return newCodedProcessingError(stageReceive, errCodeVideoDeleted, false, fmt.Errorf("video %s was deleted", job.VideoID))
+	}
+	video.Version = job.Version
+
+	plog := newProcessingLog(ctx, video.ID)
+	plog.uploadID = job.ID
+	defer cfg.saveProcessingLog(ctx, plog)
+	defer cfg.followSteps(video.ID, plog)()
+
+	// A panic fails this job instead of taking down the server and every
+	// other upload with it
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		log.Printf("Processing job %s panicked: %v\n%s", job.ID, p, debug.Stack())
+		perr = newCodedProcessingError(stageFinalize, errCodeInternal, true, fmt.Errorf("panic: %v", p))
+		plog.failOpenSteps(perr.Message)
+		err := cfg.db.TransitionVideo(&video, database.StageFailed, &perr.ProcessingError)
+		if err != nil {
+			log.Printf("Couldn't record processing failure for video %s: %v", video.ID, err)
+		}
+	}()
+
+	perr = cfg.processClaimedVideo(ctx, &video, srcPath, job.SourceSize, job.SourceHash, plog)
+	if perr != nil {
+		if perr.rejectsFile() {
+			cfg.notifyUploadRejected(ctx, video, perr.Code, perr.Message)
+		}
+		return perr
+	}
+	cfg.warmCDNCache(ctx, video.VideoURL, video.ThumbnailURL)
+	return nil
+}
+
+// recoverProcessingJobs fails the jobs a previous run was part way
+// through, and removes received files no queued job owns. Call it before
+// failInterruptedVideos, which spares the videos of queued jobs.
+func (cfg *apiConfig) recoverProcessingJobs() error {
+	n, err := cfg.db.FailRunningProcessingJobs(database.ProcessingError{
+		Stage:     stageFinalize,
+		Code:      errCodeInterrupted,
+		Message:   errorMessages[errCodeInterrupted],
+		Retryable: true,
+	})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("Marked %d interrupted processing jobs as failed", n)
+	}
+
+	err = os.MkdirAll(cfg.processingJobsDir(), 0o700)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(cfg.processingJobsDir())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		id, err := uuid.Parse(strings.TrimSuffix(entry.Name(), ".mp4"))
+		if err == nil {
+			job, ok, err := cfg.db.GetProcessingJob(id)
+			if err != nil {
+				return err
+			}
+			if ok && job.Status == database.JobStatusQueued {
+				continue
+			}
+		}
+		p := filepath.Join(cfg.processingJobsDir(), entry.Name())
+		err = os.RemoveAll(p)
+		if err != nil {
+			log.Printf("Couldn't remove leftover job file %s: %v", p, err)
+		}
+	}
+	return nil
+}
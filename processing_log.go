@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// processingLog records the user-visible steps of one upload. Details must be
+// safe to show the video's owner: no file paths, and no raw AWS or ffmpeg
+// errors. Those belong in the server log. Each step is also traced as a
+// span under the context the log was made with.
+type processingLog struct {
+	ctx      context.Context
+	uploadID uuid.UUID
+	videoID  uuid.UUID
+	steps    []*processingStep
+
+	// onStep, when set, is told the name of each step as it starts
+	onStep func(step string)
+}
+
+type processingStep struct {
+	entry database.ProcessingLogEntry
+	done  bool
+	span  trace.Span
+}
+
+func newProcessingLog(ctx context.Context, videoID uuid.UUID) *processingLog {
+	return &processingLog{
+		ctx:      ctx,
+		uploadID: uuid.New(),
+		videoID:  videoID,
+	}
+}
+
+// start begins a step. inputBytes may be 0 when the size isn't meaningful.
+func (l *processingLog) start(step string, inputBytes int64) *processingStep {
+	s := &processingStep{
+		entry: database.ProcessingLogEntry{
+			UploadID:  l.uploadID,
+			VideoID:   l.videoID,
+			Step:      step,
+			StartedAt: time.Now().UTC(),
+		},
+	}
+	_, s.span = tracer.Start(l.ctx, "processing "+step, trace.WithAttributes(
+		videoIDAttr(l.videoID),
+		attribute.String("tubely.upload.id", l.uploadID.String()),
+		attribute.String("tubely.stage", step),
+	))
+	if inputBytes > 0 {
+		s.entry.InputBytes = &inputBytes
+		s.span.SetAttributes(attribute.Int64("tubely.input_bytes", inputBytes))
+	}
+	l.steps = append(l.steps, s)
+	if l.onStep != nil {
+		l.onStep(step)
+	}
+	return s
+}
+
+// skip records a step that was deliberately not run, with the reason.
+func (l *processingLog) skip(step, reason string) {
+	s := l.start(step, 0)
+	s.entry.Status = "skipped"
+	s.entry.Detail = reason
+	s.entry.FinishedAt = &s.entry.StartedAt
+	s.done = true
+	s.span.SetAttributes(attribute.String("tubely.skip_reason", reason))
+	s.span.End()
+}
+
+func (s *processingStep) finish(outputBytes int64, detail string) {
+	now := time.Now().UTC()
+	s.entry.FinishedAt = &now
+	s.entry.Status = "ok"
+	s.entry.Detail = detail
+	if outputBytes > 0 {
+		s.entry.OutputBytes = &outputBytes
+		s.span.SetAttributes(attribute.Int64("tubely.output_bytes", outputBytes))
+	}
+	s.done = true
+	s.span.End()
+}
+
+func (s *processingStep) fail(detail string) {
+	now := time.Now().UTC()
+	s.entry.FinishedAt = &now
+	s.entry.Status = "failed"
+	s.entry.Detail = detail
+	s.done = true
+	s.span.SetStatus(codes.Error, detail)
+	s.span.End()
+}
+
+// failOpenSteps marks every unfinished step as failed with a user-safe
+// reason.
+func (l *processingLog) failOpenSteps(detail string) {
+	for _, s := range l.steps {
+		if !s.done {
+			s.fail(detail)
+		}
+	}
+}
+
+// entries returns the recorded steps. Steps that never finished were
+// interrupted by an error path and are reported as failed.
+func (l *processingLog) entries() []database.ProcessingLogEntry {
+	entries := make([]database.ProcessingLogEntry, 0, len(l.steps))
+	for _, s := range l.steps {
+		if !s.done {
+			s.fail("step did not complete")
+		}
+		entries = append(entries, s.entry)
+	}
+	return entries
+}
+
+// stageTiming is how long one step of an upload took.
+type stageTiming struct {
+	Stage      string `json:"stage"`
+	Status     string `json:"status"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// timings returns how long each step that ran took, in order. Skipped steps
+// are left out.
+func (l *processingLog) timings() []stageTiming {
+	timings := []stageTiming{}
+	for _, s := range l.steps {
+		if !s.done || s.entry.Status == "skipped" {
+			continue
+		}
+		timings = append(timings, stageTiming{
+			Stage:      s.entry.Step,
+			Status:     s.entry.Status,
+			DurationMS: s.entry.FinishedAt.Sub(s.entry.StartedAt).Milliseconds(),
+		})
+	}
+	return timings
+}
+
+// saveProcessingLog persists the log and trims old uploads, and records how
+// long each step took in the stage histogram and the server log. Steps that
+// never finished were interrupted by an error path and are stored as
+// failed. Persisting is best-effort; it never fails the upload.
+func (cfg *apiConfig) saveProcessingLog(ctx context.Context, l *processingLog) {
+	if len(l.steps) == 0 {
+		return
+	}
+	entries := l.entries()
+
+	timings := l.timings()
+	breakdown := make([]string, 0, len(timings))
+	for _, t := range timings {
+		cfg.metrics.stageDuration.WithLabelValues(t.Stage, t.Status).Observe(float64(t.DurationMS) / 1000)
+		breakdown = append(breakdown, fmt.Sprintf("%s %dms", t.Stage, t.DurationMS))
+	}
+	log.Printf("Processing times for video %s: %s", l.videoID, strings.Join(breakdown, ", "))
+
+	err := cfg.db.CreateProcessingLogEntries(entries)
+	if err != nil {
+		log.Printf("Couldn't save processing log for video %s: %v", l.videoID, err)
+		return
+	}
+	err = cfg.db.PruneProcessingLog(l.videoID, cfg.tunables(ctx).processingLogRetention)
+	if err != nil {
+		log.Printf("Couldn't prune processing log for video %s: %v", l.videoID, err)
+	}
+}
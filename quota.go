@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+var errQuotaExceeded = errors.New("upload exceeds remaining storage quota")
+
+// remainingQuota returns how many bytes the user may still store. The video
+// being replaced is excluded from usage since its bytes are freed by the new
+// upload. A negative result means no quota applies to the user.
+func (cfg *apiConfig) remainingQuota(ctx context.Context, userID, videoID uuid.UUID) (int64, error) {
+	quota := cfg.tunables(ctx).userQuotaBytes
+	if quota <= 0 {
+		return -1, nil
+	}
+	used, err := cfg.db.GetUserStorageUsage(userID, videoID)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't get storage usage: %w", err)
+	}
+	remaining := quota - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, nil
+}
+
+// respondWithQuotaExceeded rejects an upload that doesn't fit in the
+// user's remaining quota. The code tells it apart from other 403s.
+func respondWithQuotaExceeded(w http.ResponseWriter, err error) {
+	if err != nil {
+		log.Println(err)
+	}
+	type errorResponse struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	respondWithJSON(w, http.StatusForbidden, errorResponse{
+		Error: "Upload exceeds remaining storage quota",
+		Code:  rejectQuotaExceeded,
+	})
+}
+
+// videoLimit is where a user stands against MAX_VIDEOS_PER_USER.
+type videoLimit struct {
+	VideoCount int `json:"video_count"`
+	MaxVideos  int `json:"max_videos"`
+	Remaining  int `json:"remaining"`
+}
+
+// checkVideoLimit counts the user's videos that hold an uploaded file,
+// other than videoID whose file an upload would only replace. It returns
+// nil when no limit is set.
+func (cfg *apiConfig) checkVideoLimit(ctx context.Context, userID, videoID uuid.UUID) (*videoLimit, error) {
+	maxVideos := cfg.tunables(ctx).maxVideosPerUser
+	if maxVideos <= 0 {
+		return nil, nil
+	}
+	count, err := cfg.db.CountUserVideosWithMedia(userID, videoID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't count videos: %w", err)
+	}
+	return &videoLimit{
+		VideoCount: count,
+		MaxVideos:  maxVideos,
+		Remaining:  max(maxVideos-count, 0),
+	}, nil
+}
+
+// reached reports whether another video may not be uploaded.
+func (l *videoLimit) reached() bool {
+	return l != nil && l.Remaining == 0
+}
+
+func respondWithVideoLimit(w http.ResponseWriter, limit *videoLimit) {
+	type errorResponse struct {
+		Error string `json:"error"`
+		videoLimit
+	}
+	respondWithJSON(w, http.StatusForbidden, errorResponse{
+		Error:      fmt.Sprintf("Video limit reached: %d of %d videos", limit.VideoCount, limit.MaxVideos),
+		videoLimit: *limit,
+	})
+}
+
+// quotaReader aborts a streaming read as soon as the running total would
+// exceed the remaining quota, so uploads without a Content-Length can't use
+// more than their allowance of bandwidth or temp disk.
+type quotaReader struct {
+	r         io.ReadCloser
+	remaining int64
+}
+
+func newQuotaReader(r io.ReadCloser, remaining int64) io.ReadCloser {
+	return &quotaReader{r: r, remaining: remaining}
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if q.remaining < 0 {
+		return 0, errQuotaExceeded
+	}
+	// Read one byte past the allowance so an upload of exactly the
+	// remaining size still succeeds.
+	if int64(len(p)) > q.remaining+1 {
+		p = p[:q.remaining+1]
+	}
+	n, err := q.r.Read(p)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+func (q *quotaReader) Close() error {
+	return q.r.Close()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/httpclient"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// remoteTranscodePollInterval is how often a submitted job is checked.
+const remoteTranscodePollInterval = 2 * time.Second
+
+// The transcoding service is run by the operator, usually inside the same
+// network, so internal addresses are allowed.
+var remoteTranscoderClient = httpclient.New(httpclient.Policy{
+	Timeout:         30 * time.Second,
+	MaxRedirects:    0,
+	AllowPrivateIPs: true,
+	MaxBodyBytes:    64 << 10,
+	Retry: httpclient.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+	},
+})
+
+// errTranscoderUnavailable means the transcoding service couldn't be
+// reached or answered with an error of its own.
+var errTranscoderUnavailable = errors.New("transcoding service unavailable")
+
+// remoteTranscodeError is a job the transcoding service ran and failed.
+// Categories use the pipeline's error codes, so the client sees the same
+// error whichever transcoder ran.
+type remoteTranscodeError struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+func (e *remoteTranscodeError) Error() string {
+	return fmt.Sprintf("remote transcode failed (%s): %s", e.Category, e.Message)
+}
+
+// code maps the job's failure category onto a processing error code.
+// Categories this server doesn't know are treated as the service failing
+// rather than the file.
+func (e *remoteTranscodeError) code() (string, bool) {
+	switch e.Category {
+	case errCodeUnreadableMedia, errCodeTranscodeFailed, errCodeEncryptedMedia:
+		return e.Category, false
+	}
+	return errCodeToolUnavailable, true
+}
+
+// Job states reported by the transcoding service.
+const (
+	remoteJobQueued   = "queued"
+	remoteJobRunning  = "running"
+	remoteJobComplete = "complete"
+	remoteJobFailed   = "failed"
+)
+
+type remoteJobRequest struct {
+	Input       string              `json:"input"`
+	Output      string              `json:"output"`
+	ContentType string              `json:"content_type"`
+	Container   string              `json:"container"`
+	Profile     remoteEncodeProfile `json:"profile"`
+}
+
+type remoteEncodeProfile struct {
+	Name             string `json:"name"`
+	VideoCodec       string `json:"video_codec"`
+	CRF              int    `json:"crf"`
+	Preset           string `json:"preset"`
+	MaxBitrateKbps   int    `json:"max_bitrate_kbps,omitempty"`
+	AudioCodec       string `json:"audio_codec"`
+	AudioBitrateKbps int    `json:"audio_bitrate_kbps"`
+}
+
+type remoteJobStatus struct {
+	ID              string                `json:"id"`
+	Status          string                `json:"status"`
+	ProgressPercent int                   `json:"progress_percent"`
+	Error           *remoteTranscodeError `json:"error"`
+}
+
+// remoteTranscoder submits encodes to a transcoding service, such as a thin
+// adapter in front of AWS MediaConvert. The source is staged in the bucket
+// and the service writes the result straight to its final key; both are
+// given as s3:// locations. Probing stays local.
+//
+// The service speaks a small JSON API:
+//
+//	POST   {url}/jobs       submit a remoteJobRequest, answers {"id": ...}
+//	GET    {url}/jobs/{id}  answers a remoteJobStatus
+//	DELETE {url}/jobs/{id}  cancels the job
+type remoteTranscoder struct {
+	cfg    *apiConfig
+	local  ffmpegTranscoder
+	url    string
+	apiKey string
+	bucket string
+}
+
+func newRemoteTranscoder(cfg *apiConfig, url, apiKey, bucket string) *remoteTranscoder {
+	return &remoteTranscoder{
+		cfg:    cfg,
+		local:  ffmpegTranscoder{cfg: cfg},
+		url:    strings.TrimSuffix(url, "/"),
+		apiKey: apiKey,
+		bucket: bucket,
+	}
+}
+
+func (t *remoteTranscoder) probeVideo(ctx context.Context, srcPath string) (videoProbe, error) {
+	return t.local.probeVideo(ctx, srcPath)
+}
+
+func (t *remoteTranscoder) probeAudio(ctx context.Context, srcPath string) (audioInfo, error) {
+	return t.local.probeAudio(ctx, srcPath)
+}
+
+func (t *remoteTranscoder) extractFrame(ctx context.Context, src string, seconds float64, outPath string) error {
+	return t.local.extractFrame(ctx, src, seconds, outPath)
+}
+
+func (t *remoteTranscoder) location(key string) string {
+	return fmt.Sprintf("s3://%s/%s", t.bucket, key)
+}
+
+// faststart stages the source, runs the job and waits for it, reporting
+// its progress on the video's status. Profiles are the only thing sent to
+// the service; copies never get here. The service can't pad portrait
+// videos, so those are encoded here.
+func (t *remoteTranscoder) faststart(ctx context.Context, job transcodeJob) (storedFile, *processingError) {
+	if job.profile == nil || job.audio != nil || job.padToLandscape {
+		return t.local.faststart(ctx, job)
+	}
+	faststartStep := job.plog.start(stageFaststart, job.srcSize)
+
+	src, err := os.Open(job.srcPath)
+	if err != nil {
+		return storedFile{}, newProcessingError(stageFaststart, err)
+	}
+	inputKey := t.cfg.videoObjectKey(ctx, job.videoID, fmt.Sprintf("transcode-inputs/%s%s", job.videoID, ".mp4"))
+	err = t.cfg.storage.Put(ctx, inputKey, src, "video/mp4")
+	src.Close()
+	if err != nil {
+		return storedFile{}, newProcessingError(stageStore, err)
+	}
+	defer func() {
+		// The request may be gone by now; the staged input still has to go
+		err := t.cfg.storage.Delete(context.WithoutCancel(ctx), inputKey)
+		if err != nil {
+			log.Printf("Couldn't remove staged transcode input %s: %v", inputKey, err)
+		}
+	}()
+	removeSource(job)
+
+	container := "mp4-faststart"
+	if job.fragmented {
+		container = "mp4-fragmented"
+	}
+	jobID, err := t.submit(ctx, remoteJobRequest{
+		Input:       t.location(inputKey),
+		Output:      t.location(job.key),
+		ContentType: job.contentType,
+		Container:   container,
+		Profile: remoteEncodeProfile{
+			Name:             job.profileName,
+			VideoCodec:       "h264",
+			CRF:              job.profile.crf,
+			Preset:           job.profile.preset,
+			MaxBitrateKbps:   job.profile.maxBitrateKbps,
+			AudioCodec:       "aac",
+			AudioBitrateKbps: job.profile.audioBitrateKbps,
+		},
+	})
+	if err != nil {
+		return storedFile{}, newProcessingError(stageFaststart, err)
+	}
+
+	err = t.wait(ctx, job, jobID)
+	if err != nil {
+		if ctx.Err() != nil {
+			t.cancel(jobID)
+		}
+		return storedFile{}, newProcessingError(stageFaststart, err)
+	}
+
+	obj, err := t.cfg.storage.Stat(ctx, job.key)
+	if err != nil {
+		return storedFile{}, newProcessingError(stageStore, err)
+	}
+	faststartStep.finish(obj.Size, fmt.Sprintf("encoded with the %s profile by the transcoding service", job.profileName))
+	job.plog.start(stageStore, 0).finish(obj.Size, "stored by the transcoding service")
+	return storedFile{key: job.key, size: obj.Size}, nil
+}
+
+// wait polls the job until it finishes, publishing its progress.
+func (t *remoteTranscoder) wait(ctx context.Context, job transcodeJob, jobID string) error {
+	ticker := time.NewTicker(remoteTranscodePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		var status remoteJobStatus
+		err := t.do(ctx, http.MethodGet, "/jobs/"+jobID, nil, &status)
+		if err != nil {
+			return err
+		}
+		switch status.Status {
+		case remoteJobQueued, remoteJobRunning:
+			t.cfg.statuses.setProgress(job.videoID, status.ProgressPercent)
+		case remoteJobComplete:
+			t.cfg.statuses.setProgress(job.videoID, 100)
+			return nil
+		case remoteJobFailed:
+			if status.Error == nil {
+				return &remoteTranscodeError{Message: "job failed without a reason"}
+			}
+			return status.Error
+		default:
+			return fmt.Errorf("%w: job %s in unknown state %q", errTranscoderUnavailable, jobID, status.Status)
+		}
+	}
+}
+
+func (t *remoteTranscoder) submit(ctx context.Context, req remoteJobRequest) (string, error) {
+	var created struct {
+		ID string `json:"id"`
+	}
+	err := t.do(ctx, http.MethodPost, "/jobs", req, &created)
+	if err != nil {
+		return "", err
+	}
+	if created.ID == "" {
+		return "", fmt.Errorf("%w: no job ID in response", errTranscoderUnavailable)
+	}
+	return created.ID, nil
+}
+
+// cancel asks the service to stop a job nobody is waiting for any more.
+// It is best effort.
+func (t *remoteTranscoder) cancel(jobID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := t.do(ctx, http.MethodDelete, "/jobs/"+jobID, nil, nil)
+	if err != nil {
+		log.Printf("Couldn't cancel transcode job %s: %v", jobID, err)
+	}
+}
+
+func (t *remoteTranscoder) do(ctx context.Context, method, path string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		dat, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(dat)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, t.url+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if t.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	}
+	// The transcoding service can join the upload's trace
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := remoteTranscoderClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: %w", errTranscoderUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%w: %s %s answered %s", errTranscoderUnavailable, method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("%w: couldn't decode response: %w", errTranscoderUnavailable, err)
+	}
+	return nil
+}
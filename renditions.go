@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// renditionRung is one resolution on the rendition ladder.
+type renditionRung struct {
+	name string
+	// height is the short side of the output, so portrait videos get the
+	// same rungs as landscape ones
+	height           int
+	videoBitrateKbps int
+	audioBitrateKbps int
+}
+
+// renditionLadder lists the renditions made for adaptive playback, highest
+// first.
+var renditionLadder = []renditionRung{
+	{name: "1080p", height: 1080, videoBitrateKbps: 5000, audioBitrateKbps: 192},
+	{name: "720p", height: 720, videoBitrateKbps: 2800, audioBitrateKbps: 128},
+	{name: "480p", height: 480, videoBitrateKbps: 1400, audioBitrateKbps: 96},
+}
+
+// renditionKeyframeSeconds is the keyframe interval of every rendition.
+// Keyframes at the same times in each let a player switch between them at
+// any segment boundary.
+const renditionKeyframeSeconds = 2
+
+// renditionKeyframeExpr forces keyframes every renditionKeyframeSeconds.
+var renditionKeyframeExpr = fmt.Sprintf("expr:gte(t,n_forced*%d)", renditionKeyframeSeconds)
+
+// renditionRungs returns the rungs the video is big enough for. Scaling up
+// adds bytes but no detail.
+func renditionRungs(probe videoProbe) []renditionRung {
+	short := min(probe.width, probe.height)
+	var rungs []renditionRung
+	for _, rung := range renditionLadder {
+		if rung.height <= short {
+			rungs = append(rungs, rung)
+		}
+	}
+	return rungs
+}
+
+// size scales the video to the rung, keeping its aspect ratio. x264 needs
+// even dimensions.
+func (r renditionRung) size(probe videoProbe) (width, height int) {
+	scale := func(long, short int) int {
+		return int(math.Round(float64(long)*float64(r.height)/float64(short)/2)) * 2
+	}
+	if probe.width >= probe.height {
+		return scale(probe.width, probe.height), r.height
+	}
+	return r.height, scale(probe.height, probe.width)
+}
+
+// encodeArgs are the ffmpeg input and codec arguments that encode srcPath
+// at the rung's size and bitrate.
+func (r renditionRung) encodeArgs(srcPath string, width, height, threads int) []string {
+	args := []string{
+		"-i", srcPath,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", fmt.Sprintf("scale=%d:%d", width, height),
+		"-c:v", "libx264",
+		"-preset", "medium",
+		"-b:v", fmt.Sprintf("%dk", r.videoBitrateKbps),
+		"-maxrate", fmt.Sprintf("%dk", r.videoBitrateKbps),
+		"-bufsize", fmt.Sprintf("%dk", 2*r.videoBitrateKbps),
+		"-force_key_frames", renditionKeyframeExpr,
+		"-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", fmt.Sprintf("%dk", r.audioBitrateKbps),
+	}
+	if threads > 0 {
+		args = append(args, "-threads", strconv.Itoa(threads))
+	}
+	return args
+}
+
+// generateRenditions encodes the upload at srcPath at each rung of the
+// ladder it is big enough for and stores the results next to the processed
+// file. srcHash is in their keys, so new content never overwrites the
+// renditions the record still points at. Videos smaller than every rung get
+// none. On failure the renditions already stored are removed again.
+func (cfg *apiConfig) generateRenditions(ctx context.Context, video database.Video, srcPath, srcHash, keyDir string, probe videoProbe, threads int) (database.Renditions, error) {
+	rungs := renditionRungs(probe)
+	if len(rungs) == 0 {
+		return nil, nil
+	}
+
+	workDir, err := os.MkdirTemp(cfg.tempDir, tempFilePrefix+"renditions-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+
+	renditions := database.Renditions{}
+	for _, rung := range rungs {
+		rendition, err := cfg.encodeRendition(ctx, video, rung, srcPath, srcHash, keyDir, workDir, probe, threads)
+		if err != nil {
+			cfg.removeRenditions(ctx, renditions)
+			return nil, fmt.Errorf("couldn't make %s rendition: %w", rung.name, err)
+		}
+		renditions = append(renditions, rendition)
+	}
+	return renditions, nil
+}
+
+func (cfg *apiConfig) encodeRendition(ctx context.Context, video database.Video, rung renditionRung, srcPath, srcHash, keyDir, workDir string, probe videoProbe, threads int) (database.Rendition, error) {
+	width, height := rung.size(probe)
+	outputPath := filepath.Join(workDir, rung.name+".mp4")
+
+	// Renditions share MAX_FFMPEG_THREADS with the main transcode
+	weight, err := cfg.ffmpegThreads.acquire(ctx, threads, cfg.tunables(ctx).maxFFmpegThreads)
+	if err != nil {
+		return database.Rendition{}, err
+	}
+	args := append([]string{"-y"}, rung.encodeArgs(srcPath, width, height, threads)...)
+	args = append(args, "-movflags", "faststart", "-f", "mp4", outputPath)
+	cmd := cfg.ffmpegCommand(ctx, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	cfg.ffmpegThreads.release(weight)
+	if err != nil {
+		return database.Rendition{}, fmt.Errorf("ffmpeg: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	f, err := os.Open(outputPath)
+	if err != nil {
+		return database.Rendition{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return database.Rendition{}, err
+	}
+
+	key := cfg.videoObjectKey(ctx, video.ID, videoFileName(video, keyDir, ".mp4", rung.name+"-"+srcHash[:16]))
+	err = cfg.storage.Put(ctx, key, f, "video/mp4")
+	if err != nil {
+		return database.Rendition{}, err
+	}
+	return database.Rendition{
+		Name:        rung.name,
+		Width:       width,
+		Height:      height,
+		URL:         cfg.storage.URL(key),
+		SizeBytes:   info.Size(),
+		BitrateKbps: rung.videoBitrateKbps + rung.audioBitrateKbps,
+	}, nil
+}
+
+// staleRenditions returns the renditions in previous that current doesn't
+// still use.
+func staleRenditions(previous, current database.Renditions) database.Renditions {
+	var stale database.Renditions
+	for _, rendition := range previous {
+		if !slices.Contains(current.URLs(), rendition.URL) {
+			stale = append(stale, rendition)
+		}
+	}
+	return stale
+}
+
+// removeRenditions deletes rendition files. Failures are logged, since
+// whatever replaced them is already saved.
+func (cfg *apiConfig) removeRenditions(ctx context.Context, renditions database.Renditions) {
+	for _, rendition := range renditions {
+		key, err := cfg.bucketKeyFromURL(rendition.URL)
+		if err != nil {
+			log.Printf("Couldn't remove rendition: %v", err)
+			continue
+		}
+		err = cfg.storage.Delete(ctx, key)
+		if err != nil {
+			log.Printf("Couldn't remove rendition %s: %v", key, err)
+		}
+	}
+}
+
+func renditionNames(renditions database.Renditions) []string {
+	names := make([]string, 0, len(renditions))
+	for _, rendition := range renditions {
+		names = append(names, rendition.Name)
+	}
+	return names
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// REPEAT_DELETE_RESPONSE values: how deleting a video that is already gone
+// is answered.
+const (
+	// repeatDeleteNotFound answers 404, as for any missing video
+	repeatDeleteNotFound = "not_found"
+	// repeatDeletePriorState answers 200 with the video as it was when it
+	// was deleted, for clients that want to confirm what went. Deleted
+	// videos are remembered for DELETED_VIDEO_RETENTION_HOURS.
+	repeatDeletePriorState = "prior_state"
+)
+
+// rememberDeletedVideo keeps the video's state for repeated deletes when
+// they are answered with it, and forgets videos deleted too long ago.
+// Failures are logged; they don't stop the delete.
+func (cfg *apiConfig) rememberDeletedVideo(r *http.Request, video database.Video) {
+	t := cfg.tunables(r.Context())
+	if t.repeatDeleteResponse != repeatDeletePriorState {
+		return
+	}
+	err := cfg.db.RecordDeletedVideo(video)
+	if err != nil {
+		log.Printf("Couldn't remember deletion of video %s: %v", video.ID, err)
+	}
+	err = cfg.db.PruneDeletedVideos(time.Now().UTC().Add(-t.deletedVideoRetention))
+	if err != nil {
+		log.Printf("Couldn't prune deleted videos: %v", err)
+	}
+}
+
+// respondToRepeatDelete answers a delete of a video that no longer exists.
+// Only its owner is told what it was; anyone else gets 404.
+func (cfg *apiConfig) respondToRepeatDelete(w http.ResponseWriter, r *http.Request, videoID, userID uuid.UUID) {
+	t := cfg.tunables(r.Context())
+	if t.repeatDeleteResponse != repeatDeletePriorState {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	deleted, ok, err := cfg.db.GetDeletedVideo(videoID, time.Now().UTC().Add(-t.deletedVideoRetention))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get deleted video", err)
+		return
+	}
+	if !ok || deleted.Video.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, deleted)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// reservedUploadResponseHeaders are set by the server on every upload
+// response and can't be configured.
+var reservedUploadResponseHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Location",
+	"Link",
+}
+
+// loadUploadResponseHeaders reads UPLOAD_RESPONSE_HEADERS, a JSON object of
+// extra headers to send with every successful upload response, e.g.
+// {"Cache-Control": "no-store"}.
+func loadUploadResponseHeaders() (http.Header, error) {
+	headers := http.Header{}
+	val := os.Getenv("UPLOAD_RESPONSE_HEADERS")
+	if val == "" {
+		return headers, nil
+	}
+	var m map[string]string
+	err := json.Unmarshal([]byte(val), &m)
+	if err != nil {
+		return nil, fmt.Errorf("UPLOAD_RESPONSE_HEADERS must be a JSON object of header names to values: %w", err)
+	}
+	for name, value := range m {
+		for _, reserved := range reservedUploadResponseHeaders {
+			if http.CanonicalHeaderKey(name) == reserved {
+				return nil, fmt.Errorf("UPLOAD_RESPONSE_HEADERS can't set %s", reserved)
+			}
+		}
+		headers.Set(name, value)
+	}
+	return headers, nil
+}
+
+// setUploadResponseHeaders sets the headers of a successful upload response:
+// Location points at the video resource, which a 201 reports as created;
+// Link at the asset that was just stored with the given relation; then the
+// configured extras. Call it before respondWithJSON.
+func (cfg *apiConfig) setUploadResponseHeaders(w http.ResponseWriter, video database.Video, assetURL *string, rel string) {
+	h := w.Header()
+	h.Set("Location", "/api/videos/"+video.ID.String())
+	if assetURL != nil {
+		h.Set("Link", fmt.Sprintf("<%s>; rel=%q", *assetURL, rel))
+	}
+	cfg.setConfiguredUploadResponseHeaders(h)
+}
+
+// setQueuedUploadResponseHeaders sets the headers of an upload accepted for
+// background processing: Location points at the processing job, where a
+// 202 says to follow it, and Link at the video resource the job will
+// update; then the configured extras. The job reports the receipt once it
+// has succeeded.
+func (cfg *apiConfig) setQueuedUploadResponseHeaders(w http.ResponseWriter, video database.Video, job database.ProcessingJob) {
+	h := w.Header()
+	h.Set("Location", "/api/jobs/"+job.ID.String())
+	h.Set("Link", fmt.Sprintf(`</api/videos/%s>; rel="related"`, video.ID))
+	cfg.setConfiguredUploadResponseHeaders(h)
+}
+
+func (cfg *apiConfig) setConfiguredUploadResponseHeaders(h http.Header) {
+	for name, values := range cfg.uploadResponseHeaders {
+		h[name] = values
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+var errUserNotFound = errors.New("user not found")
+
+// authenticateUser loads the user whose access token the request carries.
+// The role is read from the database rather than the token, so a change
+// applies to tokens already issued.
+func (cfg *apiConfig) authenticateUser(r *http.Request) (database.User, error) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return database.User{}, err
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		return database.User{}, err
+	}
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		return database.User{}, err
+	}
+	if user == nil {
+		return database.User{}, errUserNotFound
+	}
+	return *user, nil
+}
+
+// requireRole wraps a handler that only users with the role may call.
+func (cfg *apiConfig) requireRole(role string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := cfg.authenticateUser(r)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+			return
+		}
+		if !user.HasRole(role) {
+			respondWithError(w, http.StatusForbidden, "You don't have the "+role+" role", nil)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// newTestAdmin creates a user with the admin role and returns it with an
+// access token.
+func newTestAdmin(t *testing.T, cfg *apiConfig) (*database.User, string) {
+	t.Helper()
+	admin, token := newTestUser(t, cfg)
+	err := cfg.db.SetUserRole(admin.ID, database.RoleAdmin)
+	if err != nil {
+		t.Fatalf("SetUserRole: %v", err)
+	}
+	return admin, token
+}
+
+func TestDeleteVideoRoles(t *testing.T) {
+	cfg := newTestConfig(t)
+	srv := newTestServer(t, cfg)
+	owner, ownerToken := newTestUser(t, cfg)
+	_, otherToken := newTestUser(t, cfg)
+	_, adminToken := newTestAdmin(t, cfg)
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "owner", token: ownerToken, status: http.StatusNoContent},
+		{name: "admin", token: adminToken, status: http.StatusNoContent},
+		{name: "another user", token: otherToken, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			video := newProcessedVideo(t, cfg, owner.ID, "")
+			resp, body := doRequest(t, srv, http.MethodDelete, "/api/videos/"+video.ID.String(), tt.token, "", nil)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			got, err := cfg.db.GetVideo(video.ID)
+			if err != nil {
+				t.Fatalf("GetVideo: %v", err)
+			}
+			if deleted := got.ID == uuid.Nil; deleted != (tt.status == http.StatusNoContent) {
+				t.Errorf("video deleted = %v after a %d", deleted, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestAdminStorage(t *testing.T) {
+	cfg := newTestConfig(t)
+	srv := newTestServer(t, cfg)
+	user, userToken := newTestUser(t, cfg)
+	other, _ := newTestUser(t, cfg)
+	_, adminToken := newTestAdmin(t, cfg)
+	newProcessedVideo(t, cfg, user.ID, "")
+	newProcessedVideo(t, cfg, other.ID, "")
+	newTestVideo(t, cfg, other.ID)
+
+	resp, body := doRequest(t, srv, http.MethodGet, "/api/admin/storage", adminToken, "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	var got struct {
+		database.StorageBreakdown
+		TotalBytes        int64 `json:"total_bytes"`
+		TempSpaceCapBytes int64 `json:"temp_space_cap_bytes"`
+	}
+	err := json.Unmarshal(body, &got)
+	if err != nil {
+		t.Fatalf("response %s: %v", body, err)
+	}
+	// newProcessedVideo stores 1024 bytes
+	if got.VideoCount != 3 || got.VideoBytes != 2048 || got.TotalBytes != 2048 {
+		t.Errorf("storage = %s, want 3 videos of 2048 bytes across users", body)
+	}
+	if got.TempSpaceCapBytes != cfg.tempSpace.capacity {
+		t.Errorf("temp_space_cap_bytes = %d, want %d", got.TempSpaceCapBytes, cfg.tempSpace.capacity)
+	}
+
+	resp, body = doRequest(t, srv, http.MethodGet, "/api/admin/storage", userToken, "", nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("non-admin status = %d, want %d: %s", resp.StatusCode, http.StatusForbidden, body)
+	}
+}
+
+// doAuthorizedRequest sends a bodiless request with the Authorization
+// header as given, so a test can present an API key instead of a token.
+func doAuthorizedRequest(t *testing.T, srv *httptest.Server, method, path, authorization string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestAdminRoutesRoles(t *testing.T) {
+	cfg := newTestConfig(t)
+	srv := newTestServer(t, cfg)
+	_, userToken := newTestUser(t, cfg)
+	_, adminToken := newTestAdmin(t, cfg)
+	apiKey := "ApiKey " + cfg.adminAPIKey
+
+	paths := []string{
+		"/admin/flags",
+		"/admin/videos/poisoned",
+		"/admin/service-accounts",
+		"/api/admin/videos",
+		"/api/admin/storage",
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+		// apiStatus overrides status under /api/admin, which only takes
+		// access tokens
+		apiStatus int
+	}{
+		{name: "admin", authorization: "Bearer " + adminToken, status: http.StatusOK},
+		{name: "non-admin", authorization: "Bearer " + userToken, status: http.StatusForbidden},
+		{name: "no credentials", status: http.StatusUnauthorized},
+		{name: "invalid token", authorization: "Bearer nope", status: http.StatusUnauthorized},
+		{name: "admin API key", authorization: apiKey, status: http.StatusOK, apiStatus: http.StatusUnauthorized},
+		{name: "wrong API key", authorization: "ApiKey nope", status: http.StatusUnauthorized},
+	}
+	for _, path := range paths {
+		for _, tt := range tests {
+			t.Run(path+"/"+tt.name, func(t *testing.T) {
+				want := tt.status
+				if tt.apiStatus != 0 && strings.HasPrefix(path, "/api/") {
+					want = tt.apiStatus
+				}
+				resp, body := doAuthorizedRequest(t, srv, http.MethodGet, path, tt.authorization)
+				if resp.StatusCode != want {
+					t.Errorf("status = %d, want %d: %s", resp.StatusCode, want, body)
+				}
+			})
+		}
+	}
+}
+
+func TestDeleteVideoRejectsAdminKey(t *testing.T) {
+	cfg := newTestConfig(t)
+	srv := newTestServer(t, cfg)
+	owner, _ := newTestUser(t, cfg)
+	video := newProcessedVideo(t, cfg, owner.ID, "")
+
+	resp, body := doAuthorizedRequest(t, srv, http.MethodDelete, "/api/videos/"+video.ID.String(), "ApiKey "+cfg.adminAPIKey)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusUnauthorized, body)
+	}
+	got, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if got.ID == uuid.Nil {
+		t.Error("the admin API key deleted another user's video")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registerAPIRoutes adds the API, admin and metrics endpoints to mux.
+func (cfg *apiConfig) registerAPIRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
+	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+
+	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("GET /api/users/me/usage", cfg.handlerUsageGet)
+	mux.HandleFunc("GET /api/users/{userID}/feed", cfg.handlerUserFeed)
+	mux.HandleFunc("GET /api/admin/videos", cfg.requireRole(database.RoleAdmin, cfg.handlerAdminVideosList))
+	mux.HandleFunc("GET /api/admin/storage", cfg.requireRole(database.RoleAdmin, cfg.handlerAdminStorageGet))
+
+	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", traced("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail))
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail", traced("POST /api/videos/{videoID}/thumbnail", cfg.handlerVideoThumbnail))
+	mux.HandleFunc("GET /api/videos/{videoID}/thumbnail-candidates", cfg.handlerThumbnailCandidatesList)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail-candidates/{position}/select", cfg.handlerThumbnailCandidateSelect)
+	mux.HandleFunc("POST /api/video_upload/{videoID}", traced("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo))
+	mux.HandleFunc("POST /api/videos/{videoID}/upload-url", cfg.handlerVideoUploadURL)
+	mux.HandleFunc("POST /api/videos/{videoID}/upload-complete", traced("POST /api/videos/{videoID}/upload-complete", cfg.handlerVideoUploadComplete))
+	mux.HandleFunc("OPTIONS /api/tus/", tusHandler(cfg.handlerTusOptions))
+	mux.HandleFunc("POST /api/tus/{$}", tusHandler(cfg.handlerTusCreate))
+	mux.HandleFunc("HEAD /api/tus/{uploadID}", tusHandler(cfg.handlerTusHead))
+	mux.HandleFunc("PATCH /api/tus/{uploadID}", tusHandler(traced("PATCH /api/tus/{uploadID}", cfg.handlerTusPatch)))
+	mux.HandleFunc("DELETE /api/tus/{uploadID}", tusHandler(cfg.handlerTusDelete))
+	mux.HandleFunc("POST /api/uploads", cfg.handlerUploadSessionCreate)
+	mux.HandleFunc("GET /api/uploads/{sessionID}", cfg.handlerUploadSessionGet)
+	mux.HandleFunc("PUT /api/uploads/{sessionID}/chunks/{n}", cfg.handlerUploadChunkPut)
+	mux.HandleFunc("POST /api/uploads/{sessionID}/complete", traced("POST /api/uploads/{sessionID}/complete", cfg.handlerUploadSessionComplete))
+	mux.HandleFunc("DELETE /api/uploads/{sessionID}", cfg.handlerUploadSessionDelete)
+	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
+	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("GET /api/share/{slug}", cfg.handlerVideoGetBySlug)
+	mux.HandleFunc("GET /api/oembed", cfg.handlerOEmbed)
+	mux.HandleFunc("GET /api/capabilities", cfg.handlerCapabilities)
+	mux.HandleFunc("POST /api/videos/{videoID}/share-slug", cfg.handlerVideoShareSlugCreate)
+	mux.HandleFunc("PATCH /api/videos/{videoID}", cfg.handlerVideoPatch)
+	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/original", cfg.handlerVideoOriginalDelete)
+	mux.HandleFunc("POST /api/videos/{videoID}/audio", traced("POST /api/videos/{videoID}/audio", cfg.handlerVideoAudioExtract))
+	mux.HandleFunc("GET /api/videos/{videoID}/processing-log", cfg.handlerProcessingLogGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/status", cfg.handlerVideoStatus)
+	mux.HandleFunc("GET /api/videos/{videoID}/progress", cfg.handlerVideoProgress)
+	mux.HandleFunc("GET /api/jobs/{jobID}", cfg.handlerProcessingJobGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/assets", cfg.handlerVideoAssetsGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/verify", cfg.handlerVideoVerify)
+
+	mux.Handle("GET /metrics", promhttp.HandlerFor(cfg.metrics.registry, promhttp.HandlerOpts{}))
+
+	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("POST /admin/config/reload", cfg.requireAdmin(cfg.handlerConfigReload))
+	mux.HandleFunc("GET /admin/db/integrity", cfg.requireAdmin(cfg.handlerDBIntegrityCheck))
+	mux.HandleFunc("GET /admin/videos/poisoned", cfg.requireAdmin(cfg.handlerPoisonedVideosList))
+	mux.HandleFunc("GET /admin/videos/needs-attention", cfg.requireAdmin(cfg.handlerNeedsAttentionVideosList))
+	mux.HandleFunc("POST /admin/videos/{videoID}/retry", cfg.requireAdmin(cfg.handlerVideoRetryReset))
+	mux.HandleFunc("POST /admin/videos/{videoID}/reprocess", traced("POST /admin/videos/{videoID}/reprocess", cfg.requireAdmin(cfg.handlerVideoReprocess)))
+	mux.HandleFunc("POST /admin/videos/revalidate-media", cfg.requireAdmin(cfg.handlerRevalidateMedia))
+	mux.HandleFunc("GET /admin/flags", cfg.requireAdmin(cfg.handlerFeatureFlagsList))
+	mux.HandleFunc("PUT /admin/flags/{name}", cfg.requireAdmin(cfg.handlerFeatureFlagUpdate))
+	mux.HandleFunc("POST /admin/service-accounts", cfg.requireAdmin(cfg.handlerServiceAccountCreate))
+	mux.HandleFunc("GET /admin/service-accounts", cfg.requireAdmin(cfg.handlerServiceAccountsList))
+	mux.HandleFunc("DELETE /admin/service-accounts/{accountID}", cfg.requireAdmin(cfg.handlerServiceAccountRevoke))
+	mux.HandleFunc("PUT /admin/users/{userID}/role", cfg.requireAdmin(cfg.handlerUserRoleUpdate))
+}
+
+// serverHandler wraps mux in the middleware every request goes through.
+func (cfg *apiConfig) serverHandler(mux http.Handler) http.Handler {
+	return cfg.tunablesMiddleware(cfg.serviceAccountMiddleware(mux))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// loadAWSConfig builds the AWS config used for the S3 client. Operators can
+// pin a shared-config profile (S3_AWS_PROFILE) or explicit static keys
+// (S3_ACCESS_KEY_ID/S3_SECRET_ACCESS_KEY, optionally S3_SESSION_TOKEN);
+// with neither set the SDK's default credential chain is used.
+func loadAWSConfig(ctx context.Context, region string) (aws.Config, error) {
+	profile := os.Getenv("S3_AWS_PROFILE")
+	accessKeyID := os.Getenv("S3_ACCESS_KEY_ID")
+	secretAccessKey := os.Getenv("S3_SECRET_ACCESS_KEY")
+	sessionToken := os.Getenv("S3_SESSION_TOKEN")
+
+	hasStatic := accessKeyID != "" || secretAccessKey != "" || sessionToken != ""
+	if hasStatic && (accessKeyID == "" || secretAccessKey == "") {
+		return aws.Config{}, errors.New("S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set together")
+	}
+	if hasStatic && profile != "" {
+		return aws.Config{}, errors.New("S3_AWS_PROFILE can't be combined with static S3 credentials")
+	}
+
+	opts := []func(*config.LoadOptions) error{
+		config.WithRegion(region),
+	}
+	switch {
+	case profile != "":
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	case hasStatic:
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, sessionToken),
+		))
+	}
+
+	return config.LoadDefaultConfig(ctx, opts...)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// Output formats a video's processed file can be stored in.
+const (
+	// outputMP4 is a single progressive MP4
+	outputMP4 = "mp4"
+	// outputHLS and outputDASH are trees of segments under a manifest,
+	// which becomes the video URL
+	outputHLS  = "hls"
+	outputDASH = "dash"
+)
+
+// segmentManifests names the top manifest of each segmented format.
+var segmentManifests = map[string]string{
+	outputHLS:  hlsMasterPlaylist,
+	outputDASH: dashManifest,
+}
+
+// segmentContentTypes are the content types segment tree files are stored
+// with, by extension.
+var segmentContentTypes = map[string]string{
+	".m3u8": hlsPlaylistContentType,
+	".ts":   "video/mp2t",
+	".mpd":  dashManifestContentType,
+	".m4s":  "video/iso.segment",
+}
+
+var (
+	errUnknownOutputFormat      = errors.New("unknown output format")
+	errOutputFormatNotSupported = errors.New("audio records are always stored as a single file")
+	errSegmentsNeedCDN          = errors.New("segmented output can't be served with PRESIGN_VIDEO_URLS")
+)
+
+func validateOutputFormat(name string) error {
+	switch name {
+	case "", outputMP4, outputHLS, outputDASH:
+		return nil
+	}
+	return fmt.Errorf("%w %q, expected %s, %s or %s", errUnknownOutputFormat, name, outputMP4, outputHLS, outputDASH)
+}
+
+// resolveOutputFormat picks the video's output format, falling back to the
+// server's OUTPUT_FORMAT.
+func resolveOutputFormat(opts database.ProcessingOptions, serverDefault string) string {
+	if opts.OutputFormat != "" {
+		return opts.OutputFormat
+	}
+	return serverDefault
+}
+
+// selectOutputFormat validates an output format requested with an upload
+// and stores it on the video, like selectEncodingProfile. An empty name
+// leaves the video's current choice in place.
+func (cfg *apiConfig) selectOutputFormat(video *database.Video, name string) error {
+	if name == "" || name == video.ProcessingOptions.OutputFormat {
+		return nil
+	}
+	if video.MediaKind == database.MediaKindAudio && name != outputMP4 {
+		return errOutputFormatNotSupported
+	}
+	err := validateOutputFormat(name)
+	if err != nil {
+		return err
+	}
+	err = cfg.checkOutputFormatServable(name)
+	if err != nil {
+		return err
+	}
+	video.ProcessingOptions.OutputFormat = name
+	return cfg.db.UpdateVideoMetadata(*video)
+}
+
+// checkOutputFormatServable rejects segmented output with
+// PRESIGN_VIDEO_URLS, which presigns one object per URL and so can't cover
+// the segments a manifest points at.
+func (cfg *apiConfig) checkOutputFormatServable(name string) error {
+	if cfg.presignVideoURLs && name != "" && name != outputMP4 {
+		return errSegmentsNeedCDN
+	}
+	return nil
+}
+
+// storedOutputFormat tells the format of a stored video from its URL.
+func storedOutputFormat(videoURL string) string {
+	switch path.Ext(videoURL) {
+	case ".m3u8":
+		return outputHLS
+	case ".mpd":
+		return outputDASH
+	}
+	return outputMP4
+}
+
+// isSegmentedURL reports whether a video URL points at the manifest of a
+// segment tree rather than a single file.
+func isSegmentedURL(videoURL string) bool {
+	return storedOutputFormat(videoURL) != outputMP4
+}
+
+// segmentTreeDirKey returns the key of the directory a manifest's segment
+// tree is stored under, with a trailing slash.
+func segmentTreeDirKey(manifestKey string) string {
+	return path.Dir(manifestKey) + "/"
+}
+
+// segmentTreeManifestKey returns the key of the manifest whose segment tree
+// holds key, if it is in one. Trees are named "<name>-<format>-<hash>".
+func segmentTreeManifestKey(key string) (string, bool) {
+	for dir := path.Dir(key); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		for format, manifest := range segmentManifests {
+			if strings.Contains(path.Base(dir), "-"+format+"-") {
+				return path.Join(dir, manifest), true
+			}
+		}
+	}
+	return "", false
+}
+
+// segmentVariant is one resolution of a segmented video.
+type segmentVariant struct {
+	name string
+	// width and height are 0 when they aren't known up front
+	width, height int
+	// rung is the ladder rung the variant is encoded at. Without one the
+	// variant is the stream faststart would have made.
+	rung *renditionRung
+}
+
+// encodes reports whether packaging the variant re-encodes the video.
+func (v segmentVariant) encodes(job transcodeJob) bool {
+	return v.rung != nil || job.encodes()
+}
+
+// segmentVariants picks the streams to package. A video the ladder fits
+// gets a variant per rung, so players can switch with the bandwidth. One
+// with an encoding profile, padding or a picture smaller than every rung
+// gets a single variant.
+func segmentVariants(job transcodeJob, probe videoProbe) []segmentVariant {
+	rungs := renditionRungs(probe)
+	if job.profile != nil || job.padToLandscape || len(rungs) == 0 {
+		variant := segmentVariant{name: "source"}
+		if !job.padToLandscape {
+			variant.width, variant.height = probe.width, probe.height
+		}
+		return []segmentVariant{variant}
+	}
+
+	variants := make([]segmentVariant, 0, len(rungs))
+	for _, rung := range rungs {
+		width, height := rung.size(probe)
+		variants = append(variants, segmentVariant{
+			name:   rung.name,
+			width:  width,
+			height: height,
+			rung:   &rung,
+		})
+	}
+	return variants
+}
+
+// packageSegmented is faststart for segmented output. It writes the
+// format's segments and manifests to a work directory and stores the whole
+// tree next to job.key, the top manifest's key. It returns the size of the
+// tree. Segmented output is always packaged on this server.
+func (cfg *apiConfig) packageSegmented(ctx context.Context, job transcodeJob, probe videoProbe, format string) (int64, *processingError) {
+	segmentStep := job.plog.start(stageSegment, job.srcSize)
+
+	workDir, err := os.MkdirTemp(cfg.tempDir, tempFilePrefix+format+"-*")
+	if err != nil {
+		return 0, newProcessingError(stageSegment, err)
+	}
+	defer os.RemoveAll(workDir)
+
+	variants := segmentVariants(job, probe)
+	switch format {
+	case outputHLS:
+		err = cfg.segmentHLS(ctx, job, variants, workDir)
+	case outputDASH:
+		err = cfg.segmentDASH(ctx, job, probe, variants, workDir)
+	default:
+		err = fmt.Errorf("%w %q", errUnknownOutputFormat, format)
+	}
+	if err != nil {
+		return 0, newProcessingError(stageSegment, err)
+	}
+
+	manifest := segmentManifests[format]
+	files, total, err := segmentTreeFiles(workDir, manifest)
+	if err != nil {
+		return 0, newProcessingError(stageSegment, err)
+	}
+	names := make([]string, 0, len(variants))
+	for _, variant := range variants {
+		names = append(names, variant.name)
+	}
+	segmentStep.finish(total, fmt.Sprintf("packaged %s as %s", strings.Join(names, ", "), strings.ToUpper(format)))
+
+	// The segments are all that's needed from here on
+	removeSource(job)
+
+	storeStep := job.plog.start(stageStore, total)
+	err = cfg.publishSegmentTree(ctx, job, workDir, files, manifest)
+	if err != nil {
+		return 0, newProcessingError(stageStore, err)
+	}
+	storeStep.finish(total, fmt.Sprintf("stored %d %s files", len(files)+1, strings.ToUpper(format)))
+	return total, nil
+}
+
+// publishSegmentTree stores the tree packaged in workDir next to job.key.
+// If that fails, the partial tree is removed right away rather than left
+// for the retention sweep, unless its manifest was already stored: tree
+// names carry the content hash, so that tree is the one some video plays.
+func (cfg *apiConfig) publishSegmentTree(ctx context.Context, job transcodeJob, workDir string, files []string, manifest string) error {
+	_, err := cfg.storage.Stat(ctx, job.key)
+	live := !errors.Is(err, storage.ErrNotFound)
+	err = cfg.storeSegmentTree(ctx, workDir, segmentTreeDirKey(job.key), files, manifest)
+	if err != nil && !live {
+		// The request may be gone, but the tree still has to go
+		rmErr := cfg.removeSegmentTree(context.WithoutCancel(ctx), job.key)
+		if rmErr != nil {
+			log.Printf("Couldn't remove partial segment tree of video %s: %v", job.videoID, rmErr)
+		}
+	}
+	return err
+}
+
+// storeSegmentTree uploads a packaged tree from workDir under dir. The top
+// manifest is the commit point: it goes last, once every file it can point
+// at is checked to be stored whole, so it never points at anything
+// missing or cut short.
+func (cfg *apiConfig) storeSegmentTree(ctx context.Context, workDir, dir string, files []string, manifest string) error {
+	sizes := make([]int64, len(files))
+	for i, name := range files {
+		size, err := cfg.putSegmentFile(ctx, filepath.Join(workDir, filepath.FromSlash(name)), dir+name)
+		if err != nil {
+			return err
+		}
+		sizes[i] = size
+	}
+	for i, name := range files {
+		err := cfg.verifyStoredSize(ctx, dir+name, sizes[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	size, err := cfg.putSegmentFile(ctx, filepath.Join(workDir, manifest), dir+manifest)
+	if err != nil {
+		return err
+	}
+	return cfg.verifyStoredSize(ctx, dir+manifest, size)
+}
+
+// verifyStoredSize checks that the object at key exists with size bytes.
+func (cfg *apiConfig) verifyStoredSize(ctx context.Context, key string, size int64) error {
+	obj, err := cfg.storage.Stat(ctx, key)
+	if err != nil {
+		return fmt.Errorf("couldn't verify %s: %w", key, err)
+	}
+	if obj.Size != size {
+		return fmt.Errorf("%s was stored with %d bytes, expected %d", key, obj.Size, size)
+	}
+	return nil
+}
+
+// segmentTreeFiles lists the files under workDir other than the top
+// manifest as slash separated paths relative to it, segments ahead of the
+// playlists that point at them, and adds up the size of the whole tree.
+func segmentTreeFiles(workDir, manifest string) (files []string, total int64, err error) {
+	var playlists []string
+	err = filepath.WalkDir(workDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		rel, err := filepath.Rel(workDir, p)
+		if err != nil {
+			return err
+		}
+		switch filepath.Ext(rel) {
+		case ".m3u8", ".mpd":
+			if rel != manifest {
+				playlists = append(playlists, filepath.ToSlash(rel))
+			}
+		default:
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return append(files, playlists...), total, err
+}
+
+// putSegmentFile stores the file at filePath under key and returns its
+// size.
+func (cfg *apiConfig) putSegmentFile(ctx context.Context, filePath, key string) (int64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	contentType, ok := segmentContentTypes[path.Ext(key)]
+	if !ok {
+		contentType = "application/octet-stream"
+	}
+	return info.Size(), cfg.storage.Put(ctx, key, f, contentType)
+}
+
+// removeSegmentTree deletes every object under the manifest's directory.
+func (cfg *apiConfig) removeSegmentTree(ctx context.Context, manifestKey string) error {
+	objects, err := cfg.storage.List(ctx, segmentTreeDirKey(manifestKey))
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		err := cfg.storage.Delete(ctx, obj.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
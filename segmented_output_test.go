@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// truncatingStorage stores only the first half of objects whose key ends
+// with suffix, the way an upload cut off mid-stream can.
+type truncatingStorage struct {
+	storage.Storage
+	suffix string
+}
+
+func (s truncatingStorage) Put(ctx context.Context, key string, body io.Reader, contentType string) error {
+	if !strings.HasSuffix(key, s.suffix) {
+		return s.Storage.Put(ctx, key, body, contentType)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return s.Storage.Put(ctx, key, bytes.NewReader(data[:len(data)/2]), contentType)
+}
+
+// writeSegmentTree packages a small HLS tree in a work directory the way
+// segmentHLS lays one out, and lists it.
+func writeSegmentTree(t *testing.T) (workDir string, files []string) {
+	t.Helper()
+	workDir = t.TempDir()
+	for name, data := range map[string]string{
+		"720p/segment-000.ts": strings.Repeat("a", 188*4),
+		"720p/segment-001.ts": strings.Repeat("b", 188*4),
+		"720p/playlist.m3u8":  "#EXTM3U\nsegment-000.ts\nsegment-001.ts\n",
+		hlsMasterPlaylist:     "#EXTM3U\n720p/playlist.m3u8\n",
+		"480p/segment-000.ts": strings.Repeat("c", 188*2),
+		"480p/playlist.m3u8":  "#EXTM3U\nsegment-000.ts\n",
+	} {
+		p := filepath.Join(workDir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(p), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(p, []byte(data), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _, err := segmentTreeFiles(workDir, hlsMasterPlaylist)
+	if err != nil {
+		t.Fatalf("segmentTreeFiles: %v", err)
+	}
+	return workDir, files
+}
+
+func TestPublishSegmentTree(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		// truncate names the files the storage cuts short
+		truncate string
+		// live stores the manifest before publishing, as a tree some
+		// video already plays would have it
+		live bool
+		// wantErr and wantObjects are the outcome: how many of the tree's
+		// six objects are left stored
+		wantErr     bool
+		wantObjects int
+	}{
+		{name: "stored whole", wantObjects: 6},
+		{name: "segment cut short", truncate: "segment-001.ts", wantErr: true, wantObjects: 0},
+		{name: "manifest cut short", truncate: hlsMasterPlaylist, wantErr: true, wantObjects: 0},
+		{name: "live tree", truncate: "segment-001.ts", live: true, wantErr: true, wantObjects: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			store := cfg.storage
+			if tt.truncate != "" {
+				cfg.storage = truncatingStorage{Storage: store, suffix: tt.truncate}
+			}
+			workDir, files := writeSegmentTree(t)
+			job := transcodeJob{
+				videoID: uuid.New(),
+				key:     "landscape/video-hls-0123456789abcdef/" + hlsMasterPlaylist,
+			}
+			if tt.live {
+				_, err := (&apiConfig{storage: store}).putSegmentFile(ctx, filepath.Join(workDir, hlsMasterPlaylist), job.key)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := cfg.publishSegmentTree(ctx, job, workDir, files, hlsMasterPlaylist)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("publishSegmentTree error = %v, want error %v", err, tt.wantErr)
+			}
+			objects, err := store.List(ctx, segmentTreeDirKey(job.key))
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			if len(objects) != tt.wantObjects {
+				t.Errorf("%d objects stored under the tree, want %d: %v", len(objects), tt.wantObjects, objects)
+			}
+			if tt.truncate == "segment-001.ts" && !tt.live {
+				_, err := store.Stat(ctx, job.key)
+				if err == nil {
+					t.Error("manifest was stored though a segment under it was cut short")
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveStaleTempFiles(t *testing.T) {
+	cfg := newTestConfig(t)
+	old := time.Now().Add(-48 * time.Hour)
+	cutoff := time.Now().Add(-24 * time.Hour)
+
+	// write creates a file under the temp dir, last written at modTime
+	write := func(name string, modTime time.Time) string {
+		p := filepath.Join(cfg.tempDir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(p), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(p, []byte("x"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(p, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	// age sets a directory's own modification time
+	age := func(name string, modTime time.Time) {
+		err := os.Chtimes(filepath.Join(cfg.tempDir, name), modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	staleFile := write("tubely-upload-1.mp4", old)
+	freshFile := write("tubely-upload-2.mp4", time.Now())
+	write("tubely-hls-stale/720p/segment-000.ts", old)
+	age("tubely-hls-stale/720p", old)
+	age("tubely-hls-stale", old)
+	// A job still writing deep in its tree leaves the top directory's
+	// modification time alone
+	write("tubely-hls-busy/720p/segment-000.ts", time.Now())
+	age("tubely-hls-busy/720p", old)
+	age("tubely-hls-busy", old)
+	otherFile := write("not-ours.tmp", old)
+
+	cfg.removeStaleTempFiles(cutoff)
+
+	for p, want := range map[string]bool{
+		staleFile: false,
+		freshFile: true,
+		filepath.Join(cfg.tempDir, "tubely-hls-stale"): false,
+		filepath.Join(cfg.tempDir, "tubely-hls-busy"):  true,
+		otherFile: true,
+	} {
+		_, err := os.Stat(p)
+		if exists := err == nil; exists != want {
+			t.Errorf("%s exists = %v, want %v", filepath.Base(p), exists, want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// serviceAccountMiddleware answers requests made with a service account
+// token. Those may only list and read video metadata, across every user;
+// anything else gets 403. Requests with any other credentials, or none,
+// pass through to next untouched.
+func (cfg *apiConfig) serviceAccountMiddleware(next http.Handler) http.Handler {
+	serviceMux := http.NewServeMux()
+	serviceMux.HandleFunc("GET /api/videos", cfg.handlerServiceVideosList)
+	serviceMux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerServiceVideoGet)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		accountID, err := auth.ValidateServiceJWT(token, cfg.jwtKeys)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		account, err := cfg.db.GetServiceAccount(accountID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get service account", err)
+			return
+		}
+		if account.ID == uuid.Nil || account.RevokedAt != nil {
+			respondWithError(w, http.StatusUnauthorized, "Service account has been revoked", nil)
+			return
+		}
+
+		if _, pattern := serviceMux.Handler(r); pattern == "" {
+			respondWithError(w, http.StatusForbidden, "Service accounts can only read video metadata", nil)
+			return
+		}
+		serviceMux.ServeHTTP(w, r)
+	})
+}
+
+// serviceVideoView is what a service account sees of a video. Public
+// videos are shown whole. Of any other, only metadata is copied over: no
+// playback or asset URL, and no share slug, since that opens an unlisted
+// video to anyone. A field added to Video stays hidden until it is listed
+// here.
+func serviceVideoView(video database.Video) database.Video {
+	if video.Visibility == database.VisibilityPublic {
+		return video
+	}
+	return database.Video{
+		ID:                 video.ID,
+		CreatedAt:          video.CreatedAt,
+		UpdatedAt:          video.UpdatedAt,
+		SizeBytes:          video.SizeBytes,
+		LoudnessLUFS:       video.LoudnessLUFS,
+		ProcessingStatus:   video.ProcessingStatus,
+		LifecycleStage:     video.LifecycleStage,
+		ProcessingError:    video.ProcessingError,
+		ProcessingAttempts: video.ProcessingAttempts,
+		NextAttemptAt:      video.NextAttemptAt,
+		OriginalSizeBytes:  video.OriginalSizeBytes,
+		ProcessingOptions:  video.ProcessingOptions,
+		NeedsAttention:     video.NeedsAttention,
+		DurationSeconds:    video.DurationSeconds,
+		BitrateKbps:        video.BitrateKbps,
+		ThumbnailAuto:      video.ThumbnailAuto,
+		SourceHash:         video.SourceHash,
+		Version:            video.Version,
+		Width:              video.Width,
+		Height:             video.Height,
+		FrameRate:          video.FrameRate,
+		Codec:              video.Codec,
+		CreateVideoParams:  video.CreateVideoParams,
+	}
+}
+
+func (cfg *apiConfig) handlerServiceVideosList(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+
+	videos, err := cfg.db.GetAllVideosPage(limit, offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+	for i := range videos {
+		videos[i] = serviceVideoView(videos[i])
+	}
+	err = cfg.signVideos(r.Context(), videos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, videos)
+}
+
+func (cfg *apiConfig) handlerServiceVideoGet(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	cfg.respondWithSignedVideo(w, r, http.StatusOK, serviceVideoView(video))
+}
+
+// handlerServiceAccountCreate issues a service account and its token. The
+// token is only returned here; lose it and the account has to be revoked
+// and issued again.
+func (cfg *apiConfig) handlerServiceAccountCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name string `json:"name"`
+	}
+	type response struct {
+		database.ServiceAccount
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "Name is required", nil)
+		return
+	}
+
+	account, err := cfg.db.CreateServiceAccount(params.Name)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create service account", err)
+		return
+	}
+	token, err := auth.MakeServiceJWT(account.ID, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create service account token", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		ServiceAccount: account,
+		Token:          token,
+	})
+}
+
+func (cfg *apiConfig) handlerServiceAccountsList(w http.ResponseWriter, r *http.Request) {
+	accounts, err := cfg.db.GetServiceAccounts()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve service accounts", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, accounts)
+}
+
+func (cfg *apiConfig) handlerServiceAccountRevoke(w http.ResponseWriter, r *http.Request) {
+	accountID, err := uuid.Parse(r.PathValue("accountID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	revoked, err := cfg.db.RevokeServiceAccount(accountID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke service account", err)
+		return
+	}
+	if !revoked {
+		respondWithError(w, http.StatusNotFound, "Service account not found", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
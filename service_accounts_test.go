@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// newServiceToken creates a service account and returns its token.
+func newServiceToken(t *testing.T, cfg *apiConfig) string {
+	t.Helper()
+	account, err := cfg.db.CreateServiceAccount("indexer")
+	if err != nil {
+		t.Fatalf("CreateServiceAccount: %v", err)
+	}
+	token, err := auth.MakeServiceJWT(account.ID, cfg.jwtKeys)
+	if err != nil {
+		t.Fatalf("MakeServiceJWT: %v", err)
+	}
+	return token
+}
+
+// mutatingRoutes reads the routes that don't only read out of routes.go,
+// so a route added there is covered without touching the test.
+func mutatingRoutes(t *testing.T) []string {
+	t.Helper()
+	src, err := os.ReadFile("routes.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches := regexp.MustCompile(`HandleFunc\("((?:POST|PUT|PATCH|DELETE) [^"]+)"`).FindAllSubmatch(src, -1)
+	if len(matches) == 0 {
+		t.Fatal("found no mutating routes in routes.go")
+	}
+	routes := make([]string, 0, len(matches))
+	for _, m := range matches {
+		routes = append(routes, string(m[1]))
+	}
+	return routes
+}
+
+func TestServiceAccountCantMutate(t *testing.T) {
+	cfg := newTestConfig(t)
+	srv := newTestServer(t, cfg)
+	owner, _ := newTestUser(t, cfg)
+	video := newProcessedVideo(t, cfg, owner.ID, database.VisibilityPublic)
+	serviceToken := newServiceToken(t, cfg)
+
+	wildcard := regexp.MustCompile(`\{[^}]*\}`)
+	for _, route := range mutatingRoutes(t) {
+		t.Run(route, func(t *testing.T) {
+			method, pattern, _ := strings.Cut(route, " ")
+			path := wildcard.ReplaceAllStringFunc(pattern, func(w string) string {
+				switch w {
+				case "{$}":
+					return ""
+				case "{position}", "{n}":
+					return "0"
+				case "{name}":
+					return "some-flag"
+				}
+				return video.ID.String()
+			})
+			resp, body := doRequest(t, srv, method, path, serviceToken, "application/json", []byte(`{}`))
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, http.StatusForbidden, body)
+			}
+		})
+	}
+
+	got, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if got.ID == uuid.Nil || got.Title != video.Title || got.VideoURL == nil {
+		t.Errorf("video changed under a service account: %+v", got)
+	}
+}
+
+func TestServiceAccountHidesNonPublicMedia(t *testing.T) {
+	cfg := newTestConfig(t)
+	srv := newTestServer(t, cfg)
+	owner, _ := newTestUser(t, cfg)
+	serviceToken := newServiceToken(t, cfg)
+
+	// withEveryAsset gives a video a URL in every field that can hold one,
+	// and a share slug.
+	withEveryAsset := func(visibility string) database.Video {
+		video := newProcessedVideo(t, cfg, owner.ID, visibility)
+		makeReady(t, cfg, &video)
+		prefix := "landscape/" + video.ID.String()
+		video.ThumbnailWebPURL = storedURL(cfg, "thumbnails/"+video.ID.String()+".webp")
+		video.AnimatedPreviewURL = storedURL(cfg, prefix+"/preview.webp")
+		video.Renditions = database.Renditions{
+			{Name: "720p", Width: 1280, Height: 720, URL: *storedURL(cfg, prefix+"/720p.mp4"), SizeBytes: 512},
+		}
+		video.Storyboard = &database.Storyboard{
+			URL:       *storedURL(cfg, prefix+"/storyboard.vtt"),
+			SpriteURL: *storedURL(cfg, prefix+"/storyboard.jpg"),
+		}
+		err := cfg.db.UpdateVideo(video)
+		if err != nil {
+			t.Fatalf("UpdateVideo: %v", err)
+		}
+		err = cfg.db.SetAudioURL(video.ID, storedURL(cfg, prefix+"/audio.m4a"))
+		if err != nil {
+			t.Fatalf("SetAudioURL: %v", err)
+		}
+		video, err = cfg.db.GetVideo(video.ID)
+		if err != nil {
+			t.Fatalf("GetVideo: %v", err)
+		}
+		video, err = cfg.assignShareSlug(context.Background(), video)
+		if err != nil {
+			t.Fatalf("assignShareSlug: %v", err)
+		}
+		return video
+	}
+
+	public := withEveryAsset(database.VisibilityPublic)
+	for _, visibility := range []string{database.VisibilityUnlisted, database.VisibilityPrivate} {
+		t.Run(visibility, func(t *testing.T) {
+			video := withEveryAsset(visibility)
+			for _, path := range []string{"/api/videos/" + video.ID.String(), "/api/videos"} {
+				resp, body := doRequest(t, srv, http.MethodGet, path, serviceToken, "", nil)
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("GET %s status = %d: %s", path, resp.StatusCode, body)
+				}
+				if !strings.Contains(string(body), video.ID.String()) {
+					t.Fatalf("GET %s doesn't list the video: %s", path, body)
+				}
+				// The list also holds the public video, whose URLs are
+				// expected
+				for _, u := range storageURLs(t, cfg, body) {
+					if !strings.Contains(u, video.ID.String()) {
+						continue
+					}
+					t.Errorf("GET %s hands out %s", path, u)
+				}
+				if strings.Contains(string(body), *video.ShareSlug) {
+					t.Errorf("GET %s hands out the share slug", path)
+				}
+			}
+		})
+	}
+
+	resp, body := doRequest(t, srv, http.MethodGet, "/api/videos/"+public.ID.String(), serviceToken, "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	if len(storageURLs(t, cfg, body)) == 0 {
+		t.Errorf("public video shows no media URLs: %s", body)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// defaultShareSlugAlphabet leaves out characters that are easy to misread,
+// such as 0/o and 1/l, so slugs survive being read aloud or retyped.
+const defaultShareSlugAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+
+// shareSlugAttempts is how many slugs are tried before giving up on
+// collisions; running out means the alphabet or length is too small.
+const shareSlugAttempts = 5
+
+// Bounds on SHARE_SLUG_LENGTH.
+const (
+	minShareSlugLength = 4
+	maxShareSlugLength = 32
+)
+
+// validateShareSlugSettings checks a configured alphabet and length. Slugs
+// go in URL paths, so the alphabet is limited to unreserved characters.
+func validateShareSlugSettings(alphabet string, length int) error {
+	if length < minShareSlugLength || length > maxShareSlugLength {
+		return fmt.Errorf("SHARE_SLUG_LENGTH must be between %d and %d", minShareSlugLength, maxShareSlugLength)
+	}
+	if len(alphabet) < 2 {
+		return errors.New("SHARE_SLUG_ALPHABET needs at least 2 characters")
+	}
+	for i := 0; i < len(alphabet); i++ {
+		c := alphabet[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("SHARE_SLUG_ALPHABET may only use letters, digits, '-' and '_', not %q", c)
+		}
+		if strings.IndexByte(alphabet[i+1:], c) >= 0 {
+			return fmt.Errorf("SHARE_SLUG_ALPHABET repeats %q", c)
+		}
+	}
+	return nil
+}
+
+// newShareSlug draws length characters uniformly from alphabet.
+func newShareSlug(alphabet string, length int) (string, error) {
+	max := big.NewInt(int64(len(alphabet)))
+	slug := make([]byte, length)
+	for i := range slug {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		slug[i] = alphabet[n.Int64()]
+	}
+	return string(slug), nil
+}
+
+// assignShareSlug gives the video a share slug unless it already has one,
+// and returns the video with it.
+func (cfg *apiConfig) assignShareSlug(ctx context.Context, video database.Video) (database.Video, error) {
+	if video.ShareSlug != nil {
+		return video, nil
+	}
+
+	tun := cfg.tunables(ctx)
+	for range shareSlugAttempts {
+		slug, err := newShareSlug(tun.shareSlugAlphabet, tun.shareSlugLength)
+		if err != nil {
+			return database.Video{}, err
+		}
+		updated, err := cfg.db.SetShareSlug(video.ID, slug)
+		if errors.Is(err, database.ErrShareSlugTaken) {
+			continue
+		}
+		return updated, err
+	}
+	return database.Video{}, fmt.Errorf("%d share slugs in a row were taken; SHARE_SLUG_LENGTH may be too short", shareSlugAttempts)
+}
+
+// handlerVideoShareSlugCreate gives the video a short share slug for
+// cleaner links, or returns the one it already has. The UUID stays the
+// video's canonical ID.
+func (cfg *apiConfig) handlerVideoShareSlugCreate(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+	if video.ShareSlug != nil {
+		cfg.respondWithSignedVideo(w, r, http.StatusOK, video)
+		return
+	}
+
+	updated, err := cfg.assignShareSlug(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create share slug", err)
+		return
+	}
+	cfg.respondWithSignedVideo(w, r, http.StatusCreated, updated)
+}
+
+// handlerVideoGetBySlug resolves a share slug to its video, answering the
+// same way as GET /api/videos/{videoID}. Content-Location gives the
+// canonical URL. Browsers and link preview crawlers asking for HTML get a
+// page with Open Graph tags instead. The slug is what lets anyone see an
+// unlisted video; private ones still need their owner.
+func (cfg *apiConfig) handlerVideoGetBySlug(w http.ResponseWriter, r *http.Request) {
+	video, err := cfg.db.GetVideoByShareSlug(r.PathValue("slug"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ShareSlug == nil || video.Visibility == database.VisibilityPrivate && !cfg.canViewVideo(r, video) {
+		respondWithError(w, http.StatusNotFound, "No video has this share slug", nil)
+		return
+	}
+
+	if prefersHTML(r.Header.Get("Accept")) {
+		w.Header().Set("Vary", "Accept")
+		cfg.respondWithPreviewPage(w, r, video)
+		return
+	}
+
+	w.Header().Set("Content-Location", "/api/videos/"+video.ID.String())
+	cfg.respondWithVideo(w, r, video)
+}
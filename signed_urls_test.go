@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// storageURLs finds every URL in a response body that points at cfg's
+// storage: in JSON string values, and in HTML or XML with its entities
+// decoded.
+func storageURLs(t *testing.T, cfg *apiConfig, body []byte) []string {
+	t.Helper()
+	var texts []string
+	var doc any
+	if json.Unmarshal(body, &doc) == nil {
+		var walk func(v any)
+		walk = func(v any) {
+			switch v := v.(type) {
+			case string:
+				texts = append(texts, v)
+			case []any:
+				for _, e := range v {
+					walk(e)
+				}
+			case map[string]any:
+				for _, e := range v {
+					walk(e)
+				}
+			}
+		}
+		walk(doc)
+	} else {
+		texts = append(texts, string(body))
+	}
+
+	pattern := regexp.MustCompile(regexp.QuoteMeta(cfg.storage.URL("")) + `[^"'<>\s]*`)
+	var urls []string
+	for _, text := range texts {
+		urls = append(urls, pattern.FindAllString(html.UnescapeString(text), -1)...)
+	}
+	return urls
+}
+
+// makeReady moves a processed video to ready, as the pipeline would.
+func makeReady(t *testing.T, cfg *apiConfig, video *database.Video) {
+	t.Helper()
+	for _, stage := range []string{database.StageUploaded, database.StageProcessing, database.StageReady} {
+		err := cfg.db.TransitionVideo(video, stage, nil)
+		if err != nil {
+			t.Fatalf("TransitionVideo to %s: %v", stage, err)
+		}
+	}
+}
+
+func pngThumbnail(t *testing.T) ([]byte, string) {
+	t.Helper()
+	var img bytes.Buffer
+	err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 16, 9)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("thumbnail", "thumbnail.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(img.Bytes())
+	mw.Close()
+	return body.Bytes(), mw.FormDataContentType()
+}
+
+// TestResponsesSignURLs checks that every response handing out a video's
+// files signs them when the distribution only serves signed requests.
+func TestResponsesSignURLs(t *testing.T) {
+	cfg := newTestConfig(t)
+	useTestCDNSigner(t, cfg)
+	checkResponsesSigned(t, cfg, checkSigned)
+}
+
+// TestResponsesPresignURLs checks the same responses with
+// PRESIGN_VIDEO_URLS, where the bucket is private and every URL has to be
+// presigned. The fake S3 verifies the signatures.
+func TestResponsesPresignURLs(t *testing.T) {
+	cfg := newTestConfig(t)
+	useTestDevS3(t, cfg)
+	cfg.presignVideoURLs = true
+	checkResponsesSigned(t, cfg, func(t *testing.T, what, rawURL string) {
+		t.Helper()
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatalf("%s URL %q: %v", what, rawURL, err)
+		}
+		if u.Query().Get("X-Amz-Signature") == "" {
+			t.Errorf("%s URL isn't presigned: %s", what, rawURL)
+			return
+		}
+		resp, err := http.Get(rawURL)
+		if err != nil {
+			t.Fatalf("GET %s URL: %v", what, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusForbidden {
+			t.Errorf("%s URL was refused: %s", what, rawURL)
+		}
+	})
+}
+
+// checkResponsesSigned requests every endpoint that hands out a video's
+// files, with cfg serving them from its storage, and runs check on each
+// storage URL in the responses.
+func checkResponsesSigned(t *testing.T, cfg *apiConfig, check func(t *testing.T, what, rawURL string)) {
+	cfg.assets = cfg.storage
+	srv := newTestServer(t, cfg)
+	ctx := context.Background()
+
+	user, token := newTestUser(t, cfg)
+	_, adminToken := newTestAdmin(t, cfg)
+	account, err := cfg.db.CreateServiceAccount("indexer")
+	if err != nil {
+		t.Fatalf("CreateServiceAccount: %v", err)
+	}
+	serviceToken, err := auth.MakeServiceJWT(account.ID, cfg.jwtKeys)
+	if err != nil {
+		t.Fatalf("MakeServiceJWT: %v", err)
+	}
+
+	video := newProcessedVideo(t, cfg, user.ID, database.VisibilityPublic)
+	makeReady(t, cfg, &video)
+	video.AudioURL = storedURL(cfg, "landscape/"+video.ID.String()+"/audio.m4a")
+	err = cfg.db.SetAudioURL(video.ID, video.AudioURL)
+	if err != nil {
+		t.Fatalf("SetAudioURL: %v", err)
+	}
+	video, err = cfg.assignShareSlug(ctx, video)
+	if err != nil {
+		t.Fatalf("assignShareSlug: %v", err)
+	}
+	shareURL := cfg.publicBaseURL() + shareSlugPath + *video.ShareSlug
+	thumbnail, thumbnailContentType := pngThumbnail(t)
+
+	videoPath := "/api/videos/" + video.ID.String()
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		token       string
+		accept      string
+		contentType string
+		body        []byte
+	}{
+		{name: "video", method: "GET", path: videoPath, token: token},
+		{name: "video as JSON-LD", method: "GET", path: videoPath, token: token, accept: "application/ld+json"},
+		{name: "video list", method: "GET", path: "/api/videos", token: token},
+		{name: "patch", method: "PATCH", path: videoPath, token: token, contentType: "application/json", body: []byte(`{"title": "Renamed"}`)},
+		{name: "share slug", method: "POST", path: videoPath + "/share-slug", token: token},
+		{name: "share link", method: "GET", path: "/api/share/" + *video.ShareSlug},
+		{name: "share preview page", method: "GET", path: "/api/share/" + *video.ShareSlug, accept: "text/html"},
+		{name: "oEmbed", method: "GET", path: "/api/oembed?" + url.Values{"url": {shareURL}}.Encode()},
+		{name: "MRSS feed", method: "GET", path: "/api/users/" + user.ID.String() + "/feed"},
+		{name: "thumbnail candidates", method: "GET", path: videoPath + "/thumbnail-candidates", token: token},
+		{name: "thumbnail candidate select", method: "POST", path: videoPath + "/thumbnail-candidates/1/select", token: token},
+		{name: "thumbnail upload", method: "POST", path: "/api/thumbnail_upload/" + video.ID.String(), token: token, contentType: thumbnailContentType, body: thumbnail},
+		{name: "audio track", method: "POST", path: videoPath + "/audio", token: token},
+		{name: "assets", method: "GET", path: videoPath + "/assets", token: token},
+		{name: "admin video list", method: "GET", path: "/api/admin/videos", token: adminToken},
+		{name: "admin retry reset", method: "POST", path: "/admin/videos/" + video.ID.String() + "/retry", token: adminToken},
+		{name: "service account video", method: "GET", path: videoPath, token: serviceToken},
+		{name: "service account video list", method: "GET", path: "/api/videos", token: serviceToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode >= 300 {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+
+			urls := append(storageURLs(t, cfg, body), storageURLs(t, cfg, []byte(resp.Header.Get("Link")))...)
+			if len(urls) == 0 {
+				t.Fatalf("response has no storage URLs: %s", body)
+			}
+			for _, u := range urls {
+				check(t, tt.name, u)
+			}
+		})
+	}
+
+	t.Run("upload receipt", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+video.ID.String(), nil)
+		w := httptest.NewRecorder()
+		cfg.respondWithUploadedVideo(w, r, video, user.ID, true, newProcessingLog(ctx, video.ID))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+		urls := append(storageURLs(t, cfg, w.Body.Bytes()), storageURLs(t, cfg, []byte(w.Header().Get("Link")))...)
+		if len(urls) == 0 {
+			t.Fatalf("receipt has no storage URLs: %s", w.Body)
+		}
+		for _, u := range urls {
+			check(t, "receipt", u)
+		}
+	})
+
+	// The records keep their unsigned URLs
+	stored, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []*string{stored.VideoURL, stored.ThumbnailURL, stored.AudioURL} {
+		if strings.Contains(*u, "?") {
+			t.Errorf("stored URL is signed: %s", *u)
+		}
+	}
+}
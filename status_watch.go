@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+// statusRegistry tracks which pipeline step each video is in, and how far
+// through it when the step reports progress, and wakes anyone waiting on a
+// video when its stage, step or progress changes. Steps only live in memory;
+// the database records the stage.
+type statusRegistry struct {
+	mu       sync.Mutex
+	steps    map[uuid.UUID]string
+	progress map[uuid.UUID]int
+	watchers map[uuid.UUID]map[chan struct{}]struct{}
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newStatusRegistry() *statusRegistry {
+	return &statusRegistry{
+		steps:    make(map[uuid.UUID]string),
+		progress: make(map[uuid.UUID]int),
+		watchers: make(map[uuid.UUID]map[chan struct{}]struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// subscribe returns a channel that receives a value after each change to
+// the video. Changes that arrive while the previous one hasn't been read
+// are coalesced. Call cancel when done waiting.
+func (r *statusRegistry) subscribe(videoID uuid.UUID) (changes <-chan struct{}, cancel func()) {
+	ch := make(chan struct{}, 1)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.watchers[videoID] == nil {
+		r.watchers[videoID] = make(map[chan struct{}]struct{})
+	}
+	r.watchers[videoID][ch] = struct{}{}
+
+	return ch, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.watchers[videoID], ch)
+		if len(r.watchers[videoID]) == 0 {
+			delete(r.watchers, videoID)
+		}
+	}
+}
+
+// publish wakes everyone waiting on the video.
+func (r *statusRegistry) publish(videoID uuid.UUID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for ch := range r.watchers[videoID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// setStep records the pipeline step the video is in and publishes the
+// change. An empty step means the video isn't in the pipeline. The previous
+// step's progress is cleared.
+func (r *statusRegistry) setStep(videoID uuid.UUID, step string) {
+	r.mu.Lock()
+	delete(r.progress, videoID)
+	if step == "" {
+		delete(r.steps, videoID)
+	} else {
+		r.steps[videoID] = step
+	}
+	r.mu.Unlock()
+	r.publish(videoID)
+}
+
+func (r *statusRegistry) step(videoID uuid.UUID) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.steps[videoID]
+}
+
+// setProgress records how far through its current step the video is, as a
+// percentage, and publishes the change if it moved.
+func (r *statusRegistry) setProgress(videoID uuid.UUID, percent int) {
+	percent = min(max(percent, 0), 100)
+	r.mu.Lock()
+	previous, ok := r.progress[videoID]
+	r.progress[videoID] = percent
+	r.mu.Unlock()
+	if !ok || previous != percent {
+		r.publish(videoID)
+	}
+}
+
+// currentProgress returns the current step's progress, or nil if the step
+// doesn't report any.
+func (r *statusRegistry) currentProgress(videoID uuid.UUID) *int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	percent, ok := r.progress[videoID]
+	if !ok {
+		return nil
+	}
+	return &percent
+}
+
+// progressFile reports how much of a file has been read as the current
+// step's progress. It passes Seek and ReadAt through, so uploaders that
+// read a file in parallel parts still can. Rereads, such as a retried part,
+// count again, so progress can run ahead and is capped at 100. The file
+// isn't embedded, so io.Copy can't go around Read with the file's WriteTo.
+type progressFile struct {
+	f        *os.File
+	size     int64
+	read     atomic.Int64
+	videoID  uuid.UUID
+	statuses *statusRegistry
+}
+
+func newProgressFile(f *os.File, size int64, videoID uuid.UUID, statuses *statusRegistry) *progressFile {
+	return &progressFile{f: f, size: size, videoID: videoID, statuses: statuses}
+}
+
+func (p *progressFile) Read(b []byte) (int, error) {
+	n, err := p.f.Read(b)
+	p.add(n)
+	return n, err
+}
+
+func (p *progressFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := p.f.ReadAt(b, off)
+	p.add(n)
+	return n, err
+}
+
+func (p *progressFile) Seek(offset int64, whence int) (int64, error) {
+	return p.f.Seek(offset, whence)
+}
+
+func (p *progressFile) add(n int) {
+	if n <= 0 || p.size <= 0 {
+		return
+	}
+	read := p.read.Add(int64(n))
+	p.statuses.setProgress(p.videoID, int(read*100/p.size))
+}
+
+// close releases every waiter, for server shutdown. Waiters respond with
+// what they have instead of holding the shutdown up.
+func (r *statusRegistry) close() {
+	r.once.Do(func() {
+		close(r.closed)
+	})
+}
+
+// done is closed once the registry is shut down.
+func (r *statusRegistry) done() <-chan struct{} {
+	return r.closed
+}
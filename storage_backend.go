@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// Where videos and originals are kept, picked by STORAGE_BACKEND.
+const (
+	// backendS3 is an S3 bucket served through CloudFront, or DEV_MODE's
+	// fake of one
+	backendS3 = "s3"
+	// backendLocal writes them under MEDIA_ROOT and serves them from
+	// /media, for running without any cloud account
+	backendLocal = "local"
+	// backendGCS is a Google Cloud Storage bucket
+	backendGCS = "gcs"
+)
+
+const defaultMediaRoot = "./media"
+
+// parseStorageBackend validates a STORAGE_BACKEND value. Empty selects
+// backendS3.
+func parseStorageBackend(v string) (string, error) {
+	switch v {
+	case "":
+		return backendS3, nil
+	case backendS3, backendLocal, backendGCS:
+		return v, nil
+	}
+	return "", fmt.Errorf("unsupported STORAGE_BACKEND %q (want s3, local or gcs)", v)
+}
+
+// newLocalMediaStorage keeps videos under MEDIA_ROOT, which mediaHandler
+// serves.
+func newLocalMediaStorage(port string) (*storage.Local, string, error) {
+	root := os.Getenv("MEDIA_ROOT")
+	if root == "" {
+		root = defaultMediaRoot
+	}
+	store, err := storage.NewLocal(root, fmt.Sprintf("http://localhost:%s/media", port))
+	if err != nil {
+		return nil, "", fmt.Errorf("couldn't create media directory: %w", err)
+	}
+	return store, root, nil
+}
+
+// mediaHandler serves the files under root at /media. Directories answer
+// 404 rather than listing their files, so the keys of videos nobody was
+// given a URL for can't be found by browsing.
+func mediaHandler(root string) http.Handler {
+	return http.StripPrefix("/media", http.FileServer(filesOnly{http.Dir(root)}))
+}
+
+// filesOnly is an http.FileSystem that hides its directories.
+type filesOnly struct {
+	fs http.FileSystem
+}
+
+func (f filesOnly) Open(name string) (http.File, error) {
+	file, err := f.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, fs.ErrNotExist
+	}
+	return file, nil
+}
+
+// newGCSStorage connects to GCS_BUCKET. Objects are served from
+// GCS_PUBLIC_URL, which defaults to the bucket's storage.googleapis.com
+// URL and can point at a CDN in front of it instead.
+func newGCSStorage(ctx context.Context) (*storage.GCS, string, error) {
+	bucket := os.Getenv("GCS_BUCKET")
+	if bucket == "" {
+		return nil, "", fmt.Errorf("GCS_BUCKET environment variable is not set")
+	}
+	publicURL := os.Getenv("GCS_PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "https://storage.googleapis.com/" + bucket
+	}
+	store, err := storage.NewGCS(ctx, bucket, publicURL, storage.GCSOptions{
+		Endpoint: os.Getenv("GCS_ENDPOINT"),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("couldn't create GCS client: %w", err)
+	}
+	return store, bucket, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMediaHandlerHidesDirectories checks that /media serves stored files
+// but never lists a directory of them.
+func TestMediaHandlerHidesDirectories(t *testing.T) {
+	root := t.TempDir()
+	err := os.MkdirAll(filepath.Join(root, "landscape"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	video := []byte("not much of a video")
+	err = os.WriteFile(filepath.Join(root, "landscape", "private.mp4"), video, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := mediaHandler(root)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{path: "/media/landscape/private.mp4", status: http.StatusOK},
+		{path: "/media/", status: http.StatusNotFound},
+		{path: "/media/landscape/", status: http.StatusNotFound},
+		{path: "/media/landscape", status: http.StatusNotFound},
+		{path: "/media/missing.mp4", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusOK && w.Body.String() != string(video) {
+				t.Errorf("body = %q, want the file", w.Body)
+			}
+			if tt.status != http.StatusOK && strings.Contains(w.Body.String(), "private.mp4") {
+				t.Errorf("response lists the directory: %s", w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+
+	"github.com/google/uuid"
+)
+
+// shardPrefixLength is how many hex characters of the video ID's hash lead
+// a sharded key, which spreads keys over 256 prefixes.
+const shardPrefixLength = 2
+
+// shardPrefix is derived from the video ID alone, so every object of a
+// video lands under the same prefix. It uses SHA-256 regardless of
+// CONTENT_HASH so a setting change never moves where new keys go.
+func shardPrefix(videoID uuid.UUID) string {
+	sum := sha256.Sum256(videoID[:])
+	return hex.EncodeToString(sum[:])[:shardPrefixLength]
+}
+
+// videoObjectKey builds the bucket key for one of a video's objects. With
+// S3_KEY_SHARDING on, the key is led by the video's shard prefix, as in
+// "3f/landscape/<id>.mp4", to spread load across S3 partitions. Keys are
+// stored with the video, so toggling the setting only affects new objects.
+func (cfg *apiConfig) videoObjectKey(ctx context.Context, videoID uuid.UUID, name string) string {
+	if !cfg.tunables(ctx).s3KeySharding {
+		return name
+	}
+	return path.Join(shardPrefix(videoID), name)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	storyboardTileWidth = 160
+	storyboardColumns   = 10
+	// storyboardMaxTiles caps the sprite sheet's size. Longer videos get
+	// frames further apart than STORYBOARD_INTERVAL_SECONDS.
+	storyboardMaxTiles = 100
+)
+
+// storyboardLayout works out the frame interval and sprite sheet grid for a
+// video of the given duration.
+func storyboardLayout(probe videoProbe, intervalSeconds int) database.Storyboard {
+	interval := float64(intervalSeconds)
+	if probe.durationSeconds/interval > storyboardMaxTiles {
+		interval = math.Ceil(probe.durationSeconds / storyboardMaxTiles)
+	}
+	tiles := max(int(math.Ceil(probe.durationSeconds/interval)), 1)
+	columns := min(tiles, storyboardColumns)
+	return database.Storyboard{
+		IntervalSeconds: interval,
+		TileWidth:       storyboardTileWidth,
+		TileHeight:      max(int(math.Round(float64(storyboardTileWidth*probe.height)/float64(probe.width)/2))*2, 2),
+		Columns:         columns,
+		Rows:            (tiles + columns - 1) / columns,
+	}
+}
+
+// generateStoryboard tiles frames of the upload at srcPath into a sprite
+// sheet and writes a WebVTT file pointing each interval at its tile, then
+// stores both next to the processed file. srcHash is in their keys, like
+// renditions.
+func (cfg *apiConfig) generateStoryboard(ctx context.Context, video database.Video, srcPath, srcHash, keyDir string, probe videoProbe, intervalSeconds int) (*database.Storyboard, error) {
+	if probe.durationSeconds <= 0 || probe.width <= 0 || probe.height <= 0 {
+		return nil, errors.New("video duration or size is unknown")
+	}
+	storyboard := storyboardLayout(probe, intervalSeconds)
+
+	spriteFile, err := os.CreateTemp(cfg.tempDir, tempFilePrefix+"storyboard-*.jpg")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spriteFile.Name())
+	defer spriteFile.Close()
+
+	// Decoding is all this does, so it takes a single thread's share
+	weight, err := cfg.ffmpegThreads.acquire(ctx, 1, cfg.tunables(ctx).maxFFmpegThreads)
+	if err != nil {
+		return nil, err
+	}
+	filter := fmt.Sprintf("fps=1/%g,scale=%d:%d,tile=%dx%d",
+		storyboard.IntervalSeconds, storyboard.TileWidth, storyboard.TileHeight, storyboard.Columns, storyboard.Rows)
+	cmd := cfg.ffmpegCommand(ctx, "-y", "-i", srcPath, "-an", "-vf", filter, "-frames:v", "1", "-q:v", "5", "-f", "image2", spriteFile.Name())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	cfg.ffmpegThreads.release(weight)
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, lastLine(stderr.String()))
+	}
+
+	spriteKey := cfg.videoObjectKey(ctx, video.ID, videoFileName(video, keyDir, ".jpg", "storyboard-"+srcHash[:16]))
+	err = cfg.storage.Put(ctx, spriteKey, spriteFile, "image/jpeg")
+	if err != nil {
+		return nil, err
+	}
+	storyboard.SpriteURL = cfg.storage.URL(spriteKey)
+
+	vttKey := cfg.videoObjectKey(ctx, video.ID, videoFileName(video, keyDir, ".vtt", "storyboard-"+srcHash[:16]))
+	err = cfg.storage.Put(ctx, vttKey, strings.NewReader(storyboardVTT(storyboard, probe.durationSeconds)), "text/vtt")
+	if err != nil {
+		cfg.removeStoryboard(ctx, &storyboard)
+		return nil, err
+	}
+	storyboard.URL = cfg.storage.URL(vttKey)
+	return &storyboard, nil
+}
+
+// storyboardVTT writes a cue per tile, with a media fragment giving the
+// tile's place on the sprite sheet.
+func storyboardVTT(storyboard database.Storyboard, durationSeconds float64) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i := 0; i < storyboard.Columns*storyboard.Rows; i++ {
+		start := float64(i) * storyboard.IntervalSeconds
+		if start >= durationSeconds {
+			break
+		}
+		end := min(start+storyboard.IntervalSeconds, durationSeconds)
+		x := (i % storyboard.Columns) * storyboard.TileWidth
+		y := (i / storyboard.Columns) * storyboard.TileHeight
+		fmt.Fprintf(&b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(start), vttTimestamp(end), storyboard.SpriteURL, x, y, storyboard.TileWidth, storyboard.TileHeight)
+	}
+	return b.String()
+}
+
+// vttTimestamp formats seconds as WebVTT's hh:mm:ss.ttt.
+func vttTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// staleStoryboard returns previous unless current is the same storyboard.
+func staleStoryboard(previous, current *database.Storyboard) *database.Storyboard {
+	if previous == nil || (current != nil && current.URL == previous.URL) {
+		return nil
+	}
+	return previous
+}
+
+// removeStoryboard deletes a storyboard's files. Failures are logged, like
+// removeRenditions.
+func (cfg *apiConfig) removeStoryboard(ctx context.Context, storyboard *database.Storyboard) {
+	if storyboard == nil {
+		return
+	}
+	for _, u := range storyboard.URLs() {
+		if u == "" {
+			continue
+		}
+		key, err := cfg.bucketKeyFromURL(u)
+		if err != nil {
+			log.Printf("Couldn't remove storyboard file: %v", err)
+			continue
+		}
+		err = cfg.storage.Delete(ctx, key)
+		if err != nil {
+			log.Printf("Couldn't remove storyboard file %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// tempCopiesPerUpload is how many copies of an upload exist in temp storage
+// at peak: the multipart spool, the temp copy handed to ffprobe, and the
+// faststart output.
+const tempCopiesPerUpload = 3
+
+// errNoTempSpace is returned when a reservation doesn't fit.
+var errNoTempSpace = errors.New("not enough temp space")
+
+// tempSpace coordinates temp directory usage across concurrent uploads so
+// they are refused up front instead of failing with ENOSPC mid-copy.
+type tempSpace struct {
+	mu       sync.Mutex
+	capacity int64
+	reserved int64
+}
+
+// newTempSpace uses capacity when it is positive, and otherwise derives the
+// cap from the free space in dir at startup, keeping 10% in reserve.
+func newTempSpace(dir string, capacity int64) (*tempSpace, error) {
+	t := &tempSpace{}
+	err := t.setCapacity(dir, capacity)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// setCapacity changes the cap following the same rules as newTempSpace.
+// Existing reservations are kept even if they now exceed the cap.
+func (t *tempSpace) setCapacity(dir string, capacity int64) error {
+	if capacity <= 0 {
+		free, err := diskFreeBytes(dir)
+		if err != nil {
+			return fmt.Errorf("couldn't get free space in %s: %w", dir, err)
+		}
+		capacity = free / 10 * 9
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.capacity = capacity
+	return nil
+}
+
+// tryReserve claims n bytes, returning false without reserving anything if
+// that would exceed the cap. Every successful reservation must be released.
+func (t *tempSpace) tryReserve(n int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reserved+n > t.capacity {
+		return false
+	}
+	t.reserved += n
+	return true
+}
+
+// fits reports whether n bytes are within the cap, so tryReserve can
+// succeed once other reservations are released.
+func (t *tempSpace) fits(n int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return n <= t.capacity
+}
+
+// usage returns how many bytes are reserved and the cap.
+func (t *tempSpace) usage() (reserved, capacity int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reserved, t.capacity
+}
+
+func (t *tempSpace) release(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reserved -= n
+	if t.reserved < 0 {
+		t.reserved = 0
+	}
+}
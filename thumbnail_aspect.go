@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// THUMBNAIL_ASPECT_CHECK values: what happens when an uploaded thumbnail's
+// orientation doesn't match its video's.
+const (
+	thumbnailAspectOff    = "off"
+	thumbnailAspectWarn   = "warn"
+	thumbnailAspectReject = "reject"
+)
+
+// squareTolerance is how far from 1:1 an image may be and still count as
+// square, which fits either orientation.
+const squareTolerance = 0.1
+
+// aspectMismatch describes a thumbnail whose orientation doesn't match the
+// video it was uploaded for.
+type aspectMismatch struct {
+	VideoAspect     string `json:"video_aspect"`
+	ThumbnailAspect string `json:"thumbnail_aspect"`
+	ThumbnailWidth  int    `json:"thumbnail_width"`
+	ThumbnailHeight int    `json:"thumbnail_height"`
+}
+
+func (m *aspectMismatch) String() string {
+	return fmt.Sprintf("%s thumbnail (%dx%d) for a %s video", m.ThumbnailAspect, m.ThumbnailWidth, m.ThumbnailHeight, m.VideoAspect)
+}
+
+// storedAspect returns the aspect classification the pipeline filed the
+// video's processed file under ("landscape", "portrait" or "other"), or ""
+// when there is no processed video yet.
+func storedAspect(video database.Video) string {
+	if video.VideoURL == nil || video.MediaKind != database.MediaKindVideo {
+		return ""
+	}
+	for _, segment := range strings.Split(path.Dir(*video.VideoURL), "/") {
+		switch segment {
+		case "landscape", "portrait", "other":
+			return segment
+		}
+	}
+	return ""
+}
+
+// imageAspect classifies an image as landscape, portrait or square.
+func imageAspect(width, height int) string {
+	ratio := float64(width) / float64(height)
+	switch {
+	case ratio >= 1+squareTolerance:
+		return "landscape"
+	case ratio <= 1-squareTolerance:
+		return "portrait"
+	}
+	return "square"
+}
+
+// checkThumbnailAspect reads the image's dimensions from the start of src
+// and compares its orientation with the video's. It returns a reader that
+// still yields the whole image, and a mismatch when a landscape video got
+// a portrait thumbnail or the other way around. Square thumbnails and
+// videos classified as "other" always match. Images whose header can't be
+// read are left for the upload to deal with.
+func checkThumbnailAspect(video database.Video, src io.Reader) (io.Reader, *aspectMismatch) {
+	videoAspect := storedAspect(video)
+	if videoAspect != "landscape" && videoAspect != "portrait" {
+		return src, nil
+	}
+
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(src, &header))
+	rest := io.MultiReader(&header, src)
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		return rest, nil
+	}
+
+	thumbnailAspect := imageAspect(config.Width, config.Height)
+	if thumbnailAspect == "square" || thumbnailAspect == videoAspect {
+		return rest, nil
+	}
+	return rest, &aspectMismatch{
+		VideoAspect:     videoAspect,
+		ThumbnailAspect: thumbnailAspect,
+		ThumbnailWidth:  config.Width,
+		ThumbnailHeight: config.Height,
+	}
+}
+
+func respondWithAspectMismatch(w http.ResponseWriter, mismatch *aspectMismatch) {
+	type errorResponse struct {
+		Error          string          `json:"error"`
+		AspectMismatch *aspectMismatch `json:"aspect_mismatch"`
+	}
+	respondWithJSON(w, http.StatusUnprocessableEntity, errorResponse{
+		Error:          "Thumbnail orientation doesn't match the video: " + mismatch.String(),
+		AspectMismatch: mismatch,
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// thumbnailCandidatePositions are the points in the video, as fractions of
+// its duration, sampled for automatic thumbnails.
+var thumbnailCandidatePositions = []float64{0.1, 0.3, 0.5, 0.7, 0.9}
+
+// autoThumbnailPosition is where the single frame AUTO_THUMBNAIL uses is
+// taken, as a fraction of the duration. It's late enough to be past most
+// fades from black.
+const autoThumbnailPosition = 0.1
+
+// generateFrameThumbnail stores the frame at autoThumbnailPosition of the
+// upload at srcPath as a thumbnail and returns its URL. It's the cheap
+// alternative to generateThumbnailCandidates.
+func (cfg *apiConfig) generateFrameThumbnail(ctx context.Context, srcPath string) (string, error) {
+	duration, err := probeDuration(ctx, srcPath)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get video duration: %w", err)
+	}
+
+	frameFile, err := os.CreateTemp(cfg.tempDir, "tubely-frame-*.jpg")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(frameFile.Name())
+	defer frameFile.Close()
+
+	err = cfg.extractFrame(srcPath, duration*autoThumbnailPosition, frameFile.Name())
+	if err != nil {
+		return "", err
+	}
+	return cfg.saveThumbnail(ctx, frameFile, ".jpg")
+}
+
+// generateThumbnailCandidates extracts a frame at each candidate position,
+// stores every frame as a selectable alternative and returns the URL of the
+// best scoring one. srcHash is the content hash of the upload at srcPath.
+// With keepThumbnail the video's current thumbnail is left in place even if
+// it was one of the candidates being replaced.
+func (cfg *apiConfig) generateThumbnailCandidates(ctx context.Context, video database.Video, srcPath, srcHash string, keepThumbnail bool) (string, error) {
+	duration, err := probeDuration(ctx, srcPath)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get video duration: %w", err)
+	}
+
+	workDir, err := os.MkdirTemp(cfg.tempDir, "tubely-frames-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(workDir)
+
+	candidates := []database.ThumbnailCandidate{}
+	bestURL := ""
+	bestScore := -1.0
+	for i, position := range thumbnailCandidatePositions {
+		framePath := filepath.Join(workDir, fmt.Sprintf("frame-%d.jpg", i))
+		err := cfg.extractFrame(srcPath, duration*position, framePath)
+		if err != nil {
+			log.Printf("Couldn't extract thumbnail candidate %d for video %s: %v", i, video.ID, err)
+			continue
+		}
+
+		score, err := scoreFrame(framePath)
+		if err != nil {
+			log.Printf("Couldn't score thumbnail candidate %d for video %s: %v", i, video.ID, err)
+			continue
+		}
+
+		frame, err := os.Open(framePath)
+		if err != nil {
+			return "", err
+		}
+		url, err := cfg.saveThumbnail(ctx, frame, ".jpg")
+		frame.Close()
+		if err != nil {
+			return "", err
+		}
+
+		candidates = append(candidates, database.ThumbnailCandidate{
+			VideoID:    video.ID,
+			Position:   i,
+			URL:        url,
+			Score:      score,
+			SourceHash: srcHash,
+		})
+		if score > bestScore {
+			bestScore = score
+			bestURL = url
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no thumbnail candidates could be extracted")
+	}
+
+	removed, err := cfg.db.ReplaceThumbnailCandidates(video.ID, candidates)
+	if err != nil {
+		return "", err
+	}
+	for _, url := range removed {
+		if keepThumbnail && video.ThumbnailURL != nil && url == *video.ThumbnailURL {
+			continue
+		}
+		if err := cfg.removeThumbnail(ctx, url); err != nil {
+			log.Printf("Couldn't remove old thumbnail candidate %s: %v", url, err)
+		}
+	}
+	return bestURL, nil
+}
+
+// scoreFrame rates how good a frame is as a thumbnail. Sharpness is the
+// variance of the Laplacian of the luminance, which is low for blurry or
+// flat frames; it is weighted down for frames that are mostly black or
+// blown out.
+func scoreFrame(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, err
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 3 || height < 3 {
+		return 0, fmt.Errorf("frame too small to score: %dx%d", width, height)
+	}
+
+	luma := make([]float64, width*height)
+	var total float64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			l := (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+			luma[y*width+x] = l
+			total += l
+		}
+	}
+	brightness := total / float64(len(luma))
+
+	var sum, sumSq float64
+	n := 0
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			i := y*width + x
+			lap := luma[i-1] + luma[i+1] + luma[i-width] + luma[i+width] - 4*luma[i]
+			sum += lap
+			sumSq += lap * lap
+			n++
+		}
+	}
+	mean := sum / float64(n)
+	variance := sumSq/float64(n) - mean*mean
+
+	// 1 at mid-grey, falling towards 0.1 for black or white frames
+	exposure := math.Max(0.1, 1-math.Abs(brightness-128)/128)
+	return variance * exposure, nil
+}
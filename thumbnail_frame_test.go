@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// storeVideoFile puts data in storage under key and returns its URL.
+func storeVideoFile(t *testing.T, cfg *apiConfig, key string, data []byte) *string {
+	t.Helper()
+	err := cfg.storage.Put(context.Background(), key, bytes.NewReader(data), "video/mp4")
+	if err != nil {
+		t.Fatalf("Put %s: %v", key, err)
+	}
+	return storedURL(cfg, key)
+}
+
+func TestVideoThumbnailFromFrame(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, cfg *apiConfig)
+		// checkSource is run on what the frame was taken from
+		checkSource func(t *testing.T, src string)
+	}{
+		{
+			name:  "local storage",
+			setup: func(t *testing.T, cfg *apiConfig) {},
+			checkSource: func(t *testing.T, src string) {
+				if strings.Contains(src, "://") {
+					t.Errorf("frame source %s is a URL, want a downloaded file", src)
+				}
+				_, err := os.Stat(src)
+				if !os.IsNotExist(err) {
+					t.Errorf("downloaded frame source %s is left behind: %v", src, err)
+				}
+			},
+		},
+		{
+			name: "presigned bucket URLs",
+			setup: func(t *testing.T, cfg *apiConfig) {
+				useTestDevS3(t, cfg)
+				cfg.presignVideoURLs = true
+			},
+			checkSource: func(t *testing.T, src string) {
+				u, err := url.Parse(src)
+				if err != nil {
+					t.Fatalf("frame source %q: %v", src, err)
+				}
+				if u.Query().Get("X-Amz-Signature") == "" {
+					t.Errorf("frame source isn't presigned: %s", src)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			tt.setup(t, cfg)
+			frames := &frameSources{}
+			cfg.localTranscoder = fakeTranscoder{cfg: cfg, frames: frames}
+			srv := newTestServer(t, cfg)
+			user, token := newTestUser(t, cfg)
+
+			video := newTestVideo(t, cfg, user.ID)
+			video.VideoURL = storeVideoFile(t, cfg, "landscape/"+video.ID.String()+".mp4", fakeMP4())
+			video.SizeBytes = int64(len(fakeMP4()))
+			err := cfg.db.UpdateVideo(video)
+			if err != nil {
+				t.Fatalf("UpdateVideo: %v", err)
+			}
+
+			path := "/api/videos/" + video.ID.String() + "/thumbnail"
+			resp, body := doRequest(t, srv, http.MethodPost, path, token, "application/json", []byte(`{"timestamp": "00:00:01.5"}`))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+			srcs := frames.list()
+			if len(srcs) != 1 {
+				t.Fatalf("took frames from %v, want one source", srcs)
+			}
+			tt.checkSource(t, srcs[0])
+			if reserved := reservedTempBytes(cfg); reserved != 0 {
+				t.Errorf("%d bytes of temp space still reserved", reserved)
+			}
+
+			// fakeTranscoder reports 10 second videos
+			resp, body = doRequest(t, srv, http.MethodPost, path, token, "application/json", []byte(`{"timestamp": "12"}`))
+			if resp.StatusCode != http.StatusUnprocessableEntity {
+				t.Errorf("past the end status = %d, want %d: %s", resp.StatusCode, http.StatusUnprocessableEntity, body)
+			}
+		})
+	}
+}
+
+func TestVideoThumbnailFromSegmentedVideo(t *testing.T) {
+	cfg := newTestConfig(t)
+	useTestDevS3(t, cfg)
+	cfg.presignVideoURLs = true
+	frames := &frameSources{}
+	cfg.localTranscoder = fakeTranscoder{cfg: cfg, frames: frames}
+	srv := newTestServer(t, cfg)
+	user, token := newTestUser(t, cfg)
+
+	newSegmented := func(withOriginal bool) database.Video {
+		video := newTestVideo(t, cfg, user.ID)
+		prefix := "landscape/" + video.ID.String()
+		video.VideoURL = storeVideoFile(t, cfg, prefix+"/hls/master.m3u8", []byte("#EXTM3U\n"))
+		if withOriginal {
+			key := "originals/" + video.ID.String() + ".mp4"
+			storeVideoFile(t, cfg, key, fakeMP4())
+			video.OriginalKey = &key
+			video.OriginalSizeBytes = int64(len(fakeMP4()))
+		}
+		err := cfg.db.UpdateVideo(video)
+		if err != nil {
+			t.Fatalf("UpdateVideo: %v", err)
+		}
+		return video
+	}
+	request := func(video database.Video) (*http.Response, []byte) {
+		return doRequest(t, srv, http.MethodPost, "/api/videos/"+video.ID.String()+"/thumbnail", token, "application/json", []byte(`{"timestamp": "1"}`))
+	}
+
+	video := newSegmented(true)
+	resp, body := request(video)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	srcs := frames.list()
+	if len(srcs) != 1 || !strings.Contains(srcs[0], *video.OriginalKey) {
+		t.Errorf("took frames from %v, want the original %s", srcs, *video.OriginalKey)
+	}
+
+	resp, body = request(newSegmented(false))
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("without an original status = %d, want %d: %s", resp.StatusCode, http.StatusConflict, body)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// Where thumbnails are kept, picked by THUMBNAIL_STORAGE.
+const (
+	// thumbnailsLocal writes them under ASSETS_ROOT and serves them from
+	// /assets, which suits development
+	thumbnailsLocal = "local"
+	// thumbnailsS3 puts them in the video storage under thumbnailS3Prefix,
+	// so they live wherever STORAGE_BACKEND keeps videos
+	thumbnailsS3 = "s3"
+)
+
+const thumbnailS3Prefix = "thumbnails/"
+
+// parseThumbnailStorage validates a THUMBNAIL_STORAGE value. Empty selects
+// thumbnailsLocal.
+func parseThumbnailStorage(v string) (string, error) {
+	switch v {
+	case "":
+		return thumbnailsLocal, nil
+	case thumbnailsLocal, thumbnailsS3:
+		return v, nil
+	}
+	return "", fmt.Errorf("unsupported THUMBNAIL_STORAGE %q (want local or s3)", v)
+}
+
+// saveThumbnail stores the image under a random name in the assets storage
+// and returns the URL it is served from. Thumbnails are small and their
+// uploads capped, so the image is read into memory first: S3 then gets it
+// in a single PutObject of known length, and nothing is spooled to disk.
+// With GENERATE_WEBP_THUMBNAILS on, a WebP copy is stored next to it under
+// the same name; see webpVariantKey.
+func (cfg *apiConfig) saveThumbnail(ctx context.Context, src io.Reader, ext string) (string, error) {
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(src)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read thumbnail: %w", err)
+	}
+
+	assetKey, err := cfg.putImageAsset(ctx, buf.Bytes(), ext)
+	if err != nil {
+		return "", fmt.Errorf("couldn't write thumbnail file: %w", err)
+	}
+
+	// The WebP copy is only an optimization, so browsers fall back to the
+	// original when it couldn't be made
+	if cfg.generateWebPThumbnails && ext != ".webp" {
+		webp, err := cfg.encodeWebP(ctx, buf.Bytes())
+		if err == nil {
+			err = cfg.assets.Put(ctx, webpVariantKey(assetKey), bytes.NewReader(webp), "image/webp")
+		}
+		if err != nil {
+			log.Printf("Couldn't store WebP variant of thumbnail %s: %v", assetKey, err)
+		}
+	}
+
+	return cfg.assets.URL(assetKey), nil
+}
+
+// putImageAsset stores an image under a random name with the thumbnail key
+// prefix and returns its key.
+func (cfg *apiConfig) putImageAsset(ctx context.Context, img []byte, ext string) (string, error) {
+	// Use crypto/rand.Read to fill a 32 byte slice with random bytes
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", fmt.Errorf("couldn't generate random bytes for filename: %w", err)
+	}
+	// Convert to random base64 string
+	randomName := base64.RawURLEncoding.EncodeToString(key)
+
+	assetKey := fmt.Sprintf("%s%s%s", cfg.thumbnailKeyPrefix, randomName, ext)
+
+	err = cfg.assets.Put(ctx, assetKey, bytes.NewReader(img), mime.TypeByExtension(ext))
+	if err != nil {
+		return "", err
+	}
+	return assetKey, nil
+}
+
+// webpVariantKey is where the WebP copy of the thumbnail at key is stored.
+func webpVariantKey(key string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + ".webp"
+}
+
+// encodeWebP converts an image to WebP with ffmpeg, in memory.
+func (cfg *apiConfig) encodeWebP(ctx context.Context, img []byte) ([]byte, error) {
+	cmd := cfg.ffmpegCommand(ctx, "-f", "image2pipe", "-i", "pipe:0", "-frames:v", "1", "-c:v", "libwebp", "-quality", "80", "-f", "webp", "pipe:1")
+	cmd.Stdin = bytes.NewReader(img)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg WebP encoding failed: %w: %s", err, lastLine(stderr.String()))
+	}
+	return out.Bytes(), nil
+}
+
+// useThumbnail points the video at a thumbnail made by saveThumbnail, along
+// with its WebP copy when one was stored.
+func (cfg *apiConfig) useThumbnail(ctx context.Context, video *database.Video, thumbnailURL string) {
+	video.ThumbnailURL = &thumbnailURL
+	video.ThumbnailWebPURL = nil
+	if !cfg.generateWebPThumbnails {
+		return
+	}
+	key, ok := cfg.assets.KeyFromURL(thumbnailURL)
+	if !ok {
+		return
+	}
+	webpKey := webpVariantKey(key)
+	if webpKey == key {
+		return
+	}
+	_, err := cfg.assets.Stat(ctx, webpKey)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Couldn't look up WebP variant of thumbnail %s: %v", key, err)
+		}
+		return
+	}
+	webpURL := cfg.assets.URL(webpKey)
+	video.ThumbnailWebPURL = &webpURL
+}
+
+// removeThumbnail deletes the asset behind a thumbnail URL produced by
+// saveThumbnail. URLs that don't point at the assets storage are ignored.
+func (cfg *apiConfig) removeThumbnail(ctx context.Context, thumbnailURL string) error {
+	key, ok := cfg.assets.KeyFromURL(thumbnailURL)
+	if !ok {
+		return nil
+	}
+	if webpKey := webpVariantKey(key); webpKey != key {
+		err := cfg.assets.Delete(ctx, webpKey)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	return cfg.assets.Delete(ctx, key)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// transcoder runs the media steps of the pipeline. ffmpegTranscoder runs
+// them on this server; remoteTranscoder hands the heavy ones to a
+// transcoding service. Both report failures as processing errors with the
+// same codes, so callers can't tell which one ran.
+type transcoder interface {
+	// probeVideo reads the video's dimensions and duration, and classifies
+	// its aspect ratio as "16:9" or "9:16", or otherwise gives its reduced
+	// ratio, such as "4:3".
+	probeVideo(ctx context.Context, srcPath string) (videoProbe, error)
+	probeAudio(ctx context.Context, srcPath string) (audioInfo, error)
+	// faststart produces the playable file for job and stores it under
+	// job.key, or finds the same bytes already stored under another key,
+	// and returns where the file is. It records the faststart and store
+	// steps in job.plog, and removes job.srcPath as soon as it no longer
+	// needs it.
+	faststart(ctx context.Context, job transcodeJob) (storedFile, *processingError)
+	// extractFrame writes the frame at seconds into src, a path or URL, to
+	// outPath as a JPEG.
+	extractFrame(ctx context.Context, src string, seconds float64, outPath string) error
+}
+
+// storedFile is where faststart left a processed file.
+type storedFile struct {
+	key  string
+	size int64
+}
+
+// transcodeJob describes the file faststart should produce.
+type transcodeJob struct {
+	videoID uuid.UUID
+	userID  uuid.UUID
+	srcPath string
+	srcSize int64
+	// audio is set for audio records
+	audio *audioInfo
+	// profile re-encodes the video with its settings; without one the
+	// streams are copied
+	profile     *encodingProfile
+	profileName string
+	// padToLandscape pads a portrait video to 16:9 over a blurred copy of
+	// itself
+	padToLandscape bool
+	// fragmented writes a fragmented MP4 instead of a faststart one
+	fragmented bool
+	// threads is how many threads an encode runs with, sized to the video
+	// by FFMPEG_THREAD_TIERS; 0 leaves it to ffmpeg
+	threads     int
+	key         string
+	contentType string
+	plog        *processingLog
+}
+
+// videoEncodeArgs are the ffmpeg input and codec arguments for the job's
+// video.
+func (job transcodeJob) videoEncodeArgs() []string {
+	var args []string
+	if job.padToLandscape {
+		args = padToLandscapeArgs(job.srcPath, job.profile)
+	} else {
+		args = videoEncodeArgs(job.srcPath, job.profile)
+	}
+	// Copying streams barely uses a thread, so only encodes are sized
+	if job.threads > 0 && job.encodes() {
+		args = append(args, "-threads", strconv.Itoa(job.threads))
+	}
+	return args
+}
+
+// encodes reports whether the job re-encodes the video rather than copying
+// its streams.
+func (job transcodeJob) encodes() bool {
+	return job.audio == nil && (job.profile != nil || job.padToLandscape)
+}
+
+// runFaststart writes the faststart file for job and returns its path.
+// With VERIFY_FASTSTART on, MP4 output whose moov atom didn't end up at the
+// front is made again, and fails the job if it still isn't.
+func (t ffmpegTranscoder) runFaststart(ctx context.Context, job transcodeJob) (string, error) {
+	verify := t.cfg.tunables(ctx).verifyFaststart && (job.audio == nil || !job.audio.mp3)
+	var err error
+	for attempt := 1; attempt <= faststartAttempts; attempt++ {
+		var processedFilePath string
+		if job.audio != nil {
+			processedFilePath, err = t.cfg.processAudioForFastStart(job.srcPath, *job.audio)
+		} else {
+			processedFilePath, err = t.cfg.processVideoForFastStart(job.srcPath, job.videoEncodeArgs())
+		}
+		if err != nil || !verify {
+			return processedFilePath, err
+		}
+		err = checkFaststart(processedFilePath)
+		if err == nil {
+			return processedFilePath, nil
+		}
+		os.Remove(processedFilePath)
+		log.Printf("Faststart check failed for video %s (attempt %d of %d): %v", job.videoID, attempt, faststartAttempts, err)
+	}
+	return "", err
+}
+
+// transcoderFor picks where a video's transcode runs. Only encodes with a
+// profile listed in REMOTE_TRANSCODE_PROFILES leave the box; copies and
+// audio remuxes are cheap and always run here.
+func (cfg *apiConfig) transcoderFor(ctx context.Context, profileName string) transcoder {
+	if cfg.remoteTranscoder != nil && profileName != "" && slices.Contains(cfg.tunables(ctx).remoteTranscodeProfiles, profileName) {
+		return cfg.remoteTranscoder
+	}
+	return cfg.localTranscoder
+}
+
+// ffmpegTranscoder runs ffprobe and ffmpeg on this server.
+type ffmpegTranscoder struct {
+	cfg *apiConfig
+}
+
+// Probes wait for a slot under MAX_CONCURRENT_PROBES.
+func (t ffmpegTranscoder) probeVideo(ctx context.Context, srcPath string) (videoProbe, error) {
+	err := t.cfg.probes.acquire(ctx, t.cfg.tunables(ctx).maxConcurrentProbes)
+	if err != nil {
+		return videoProbe{}, err
+	}
+	defer t.cfg.probes.release()
+	return probeVideoFile(ctx, srcPath)
+}
+
+func (t ffmpegTranscoder) probeAudio(ctx context.Context, srcPath string) (audioInfo, error) {
+	err := t.cfg.probes.acquire(ctx, t.cfg.tunables(ctx).maxConcurrentProbes)
+	if err != nil {
+		return audioInfo{}, err
+	}
+	defer t.cfg.probes.release()
+	return probeAudio(ctx, srcPath)
+}
+
+func (t ffmpegTranscoder) extractFrame(ctx context.Context, src string, seconds float64, outPath string) error {
+	return t.cfg.extractFrame(src, seconds, outPath)
+}
+
+// faststart pipes outputs that are finished in one pass straight from
+// ffmpeg into storage. A faststart MP4 has its start rewritten once the
+// rest is written, so it goes through a temp file.
+func (t ffmpegTranscoder) faststart(ctx context.Context, job transcodeJob) (storedFile, *processingError) {
+	faststartStep := job.plog.start(stageFaststart, job.srcSize)
+
+	// Wait for room in MAX_FFMPEG_THREADS. Copies and remuxes count as one
+	// thread; the budget is given back as soon as ffmpeg is done.
+	weight := 1
+	if job.encodes() {
+		weight = job.threads
+	}
+	weight, err := t.cfg.ffmpegThreads.acquire(ctx, weight, t.cfg.tunables(ctx).maxFFmpegThreads)
+	if err != nil {
+		return storedFile{}, newProcessingError(stageFaststart, err)
+	}
+	released := false
+	releaseThreads := func() {
+		if !released {
+			released = true
+			t.cfg.ffmpegThreads.release(weight)
+		}
+	}
+	defer releaseThreads()
+	faststartMessage := "moved playback metadata to the start of the file"
+	if job.audio != nil && job.audio.mp3 {
+		faststartMessage = "remuxed audio"
+	} else if job.profile != nil {
+		faststartMessage = fmt.Sprintf("encoded with the %s profile", job.profileName)
+	}
+
+	var streamArgs []string
+	switch {
+	case job.audio != nil && job.audio.mp3:
+		streamArgs = append(audioEncodeArgs(job.srcPath), "-f", "mp3")
+	case job.audio == nil && job.fragmented:
+		streamArgs = append(job.videoEncodeArgs(), fragmentedMP4Args...)
+	}
+
+	if streamArgs != nil {
+		storeStep := job.plog.start(stageStore, 0)
+		n, perr := t.cfg.streamFFmpegToStorage(ctx, streamArgs, job.key, job.contentType)
+		releaseThreads()
+		if perr != nil {
+			return storedFile{}, perr
+		}
+		faststartStep.finish(n, faststartMessage)
+		storeStep.finish(n, "stored processed video as it was written")
+		removeSource(job)
+		return storedFile{key: job.key, size: n}, nil
+	}
+
+	processedFilePath, err := t.runFaststart(ctx, job)
+	releaseThreads()
+	if err != nil {
+		return storedFile{}, newProcessingError(stageFaststart, err)
+	}
+	defer os.Remove(processedFilePath) // Clean up processed file after uploading
+
+	// Open the processed file for reading
+	processedFile, err := os.Open(processedFilePath)
+	if err != nil {
+		return storedFile{}, newProcessingError(stageFaststart, err)
+	}
+	defer processedFile.Close()
+
+	processedInfo, err := processedFile.Stat()
+	if err != nil {
+		return storedFile{}, newProcessingError(stageFaststart, err)
+	}
+	faststartStep.finish(processedInfo.Size(), faststartMessage)
+
+	// Nothing reads the source after faststart (a kept original is already
+	// in the bucket), so free its disk space now instead of holding it
+	// until the upload returns
+	removeSource(job)
+
+	// The same bytes already in storage are pointed at rather than stored
+	// again. The dedup check on the upload's hash is what saves the work;
+	// this one also catches uploads that only differ in what processing
+	// drops, such as metadata.
+	storeStep := job.plog.start(stageStore, processedInfo.Size())
+	contentHash, err := t.cfg.contentHash.Sum(processedFile)
+	if err != nil {
+		return storedFile{}, newProcessingError(stageStore, err)
+	}
+	existing, err := t.cfg.findStoredObject(job, contentHash)
+	if err != nil {
+		log.Printf("Couldn't look for a stored copy of the processed file of video %s: %v", job.videoID, err)
+	}
+	if existing != nil {
+		storeStep.finish(0, "reused an identical processed file that was already stored")
+		return storedFile{key: existing.Key, size: existing.SizeBytes}, nil
+	}
+
+	_, err = processedFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return storedFile{}, newProcessingError(stageStore, err)
+	}
+	body := newProgressFile(processedFile, processedInfo.Size(), job.videoID, t.cfg.statuses)
+	err = t.cfg.storage.Put(ctx, job.key, body, job.contentType)
+	if err != nil {
+		return storedFile{}, newProcessingError(stageStore, err)
+	}
+	storeStep.finish(processedInfo.Size(), "stored processed video")
+	t.cfg.recordStoredObject(job, contentHash, processedInfo.Size())
+	return storedFile{key: job.key, size: processedInfo.Size()}, nil
+}
+
+func removeSource(job transcodeJob) {
+	err := os.Remove(job.srcPath)
+	if err != nil {
+		log.Printf("Couldn't remove source file for video %s: %v", job.videoID, err)
+	}
+}
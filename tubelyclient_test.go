@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/pkg/tubelyclient"
+)
+
+// TestTubelyClient runs the Go client against the real handlers, so the
+// client's types and the server's responses can't drift apart.
+func TestTubelyClient(t *testing.T) {
+	cfg := newTestConfig(t)
+	srv := newTestServer(t, cfg)
+	user, _ := newTestUser(t, cfg)
+	ctx := context.Background()
+
+	c := tubelyclient.New(srv.URL)
+	login, err := c.Login(ctx, user.Email, testUserPassword)
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if login.Token == "" || login.RefreshToken == "" {
+		t.Fatalf("Login = %+v, want both tokens", login)
+	}
+
+	video, err := c.CreateVideo(ctx, "Boots", "A video of boots")
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	if video.UserID != user.ID || video.Title != "Boots" || video.MediaKind != tubelyclient.MediaKindVideo ||
+		video.Visibility != tubelyclient.VisibilityPublic || video.ProcessingStatus != tubelyclient.StatusAwaitingUpload {
+		t.Errorf("CreateVideo = %+v", video)
+	}
+
+	got, err := c.GetVideo(ctx, video.ID)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if got.ID != video.ID || got.Description != "A video of boots" {
+		t.Errorf("GetVideo = %+v", got)
+	}
+
+	got, err = c.SetVisibility(ctx, video.ID, tubelyclient.VisibilityUnlisted)
+	if err != nil {
+		t.Fatalf("SetVisibility: %v", err)
+	}
+	if got.Visibility != tubelyclient.VisibilityUnlisted || got.ShareSlug == nil {
+		t.Errorf("SetVisibility = %+v, want unlisted with a share slug", got)
+	}
+
+	job, err := c.QueueVideo(ctx, video.ID, bytes.NewReader(fakeMP4()), tubelyclient.UploadOptions{})
+	if err != nil {
+		t.Fatalf("QueueVideo: %v", err)
+	}
+	if job.VideoID != video.ID || job.Status != tubelyclient.JobStatusQueued || job.SourceSize != int64(len(fakeMP4())) {
+		t.Errorf("QueueVideo = %+v", job)
+	}
+	gotJob, err := c.GetJob(ctx, job.ID)
+	if err != nil {
+		t.Fatalf("GetJob: %v", err)
+	}
+	if gotJob.ID != job.ID || gotJob.Status != tubelyclient.JobStatusQueued {
+		t.Errorf("GetJob = %+v", gotJob)
+	}
+
+	for range 4 {
+		_, err = c.CreateVideo(ctx, "More boots", "")
+		if err != nil {
+			t.Fatalf("CreateVideo: %v", err)
+		}
+	}
+	n := 0
+	for _, err := range c.ListVideos(ctx, 2) {
+		if err != nil {
+			t.Fatalf("ListVideos: %v", err)
+		}
+		n++
+	}
+	if n != 5 {
+		t.Errorf("ListVideos listed %d videos, want 5", n)
+	}
+
+	refreshed, err := c.Refresh(ctx, login.RefreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if refreshed.RefreshToken == login.RefreshToken {
+		t.Error("Refresh didn't rotate the refresh token")
+	}
+	err = c.Revoke(ctx, refreshed.RefreshToken)
+	if err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	_, err = c.Refresh(ctx, refreshed.RefreshToken)
+	var apiErr *tubelyclient.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Refresh with a revoked token = %v, want a 401 *APIError", err)
+	}
+}
+
+// TestTubelyClientUploadVideo checks that UploadVideo returns the receipt
+// the finished processing job reports.
+func TestTubelyClientUploadVideo(t *testing.T) {
+	cfg := newTestConfig(t)
+	useFakeTranscoder(cfg)
+	cfg.startProcessingWorkers(1)
+	t.Cleanup(func() { cfg.jobs.shutdown(context.Background()) })
+	srv := newTestServer(t, cfg)
+	user, token := newTestUser(t, cfg)
+	video := newTestVideo(t, cfg, user.ID)
+	ctx := context.Background()
+
+	c := tubelyclient.New(srv.URL, tubelyclient.WithToken(token))
+	got, err := c.UploadVideo(ctx, video.ID, bytes.NewReader(fakeMP4()), tubelyclient.UploadOptions{})
+	if err != nil {
+		t.Fatalf("UploadVideo: %v", err)
+	}
+	if got.ID != video.ID || got.VideoURL == nil || got.ProcessingStatus != tubelyclient.StatusReady {
+		t.Errorf("UploadVideo = %+v, want the ready video", got)
+	}
+	if got.Assets == nil || got.Assets.Video == nil || got.Assets.Video.URL != *got.VideoURL {
+		t.Errorf("UploadVideo assets = %+v, want the receipt with the video file", got.Assets)
+	}
+}
+
+// TestTubelyClientErrors checks that the client decodes the error
+// responses the handlers actually send.
+func TestTubelyClientErrors(t *testing.T) {
+	cfg := newTestConfig(t)
+	srv := newTestServer(t, cfg)
+	user, token := newTestUser(t, cfg)
+	ctx := context.Background()
+	c := tubelyclient.New(srv.URL, tubelyclient.WithToken(token))
+
+	t.Run("wrong password", func(t *testing.T) {
+		_, err := tubelyclient.New(srv.URL).Login(ctx, user.Email, "wrong")
+		var apiErr *tubelyclient.APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Message != "Incorrect email or password" {
+			t.Errorf("got %v, want the server's 401", err)
+		}
+	})
+
+	t.Run("rejected upload", func(t *testing.T) {
+		video := newTestVideo(t, cfg, user.ID)
+		_, err := c.QueueVideo(ctx, video.ID, bytes.NewReader(bytes.Repeat([]byte("not a video "), 100)), tubelyclient.UploadOptions{})
+		var apiErr *tubelyclient.APIError
+		if !errors.As(err, &apiErr) || apiErr.Processing == nil {
+			t.Fatalf("got %v, want an *APIError with a processing error", err)
+		}
+		if apiErr.Processing.Code != errCodeUnsupportedMedia || apiErr.Processing.Retryable {
+			t.Errorf("processing error = %+v, want a final %s", apiErr.Processing, errCodeUnsupportedMedia)
+		}
+	})
+
+	t.Run("upload slot taken", func(t *testing.T) {
+		video := newTestVideo(t, cfg, user.ID)
+		limit := cfg.tunables(ctx).maxUploadsPerUser
+		if limit <= 0 {
+			t.Skip("MAX_UPLOADS_PER_USER is off")
+		}
+		for range limit {
+			cfg.uploads.tryAcquire(user.ID, limit)
+		}
+		defer func() {
+			for range limit {
+				cfg.uploads.release(user.ID)
+			}
+		}()
+
+		_, err := tubelyclient.New(srv.URL, tubelyclient.WithToken(token), tubelyclient.WithMaxRetries(0)).
+			QueueVideo(ctx, video.ID, bytes.NewReader(fakeMP4()), tubelyclient.UploadOptions{})
+		var apiErr *tubelyclient.APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests || apiErr.RetryAfter <= 0 {
+			t.Errorf("got %v, want a 429 *APIError with RetryAfter", err)
+		}
+	})
+
+	t.Run("deleted video", func(t *testing.T) {
+		video := newTestVideo(t, cfg, user.ID)
+		err := c.DeleteVideo(ctx, video.ID)
+		if err != nil {
+			t.Fatalf("DeleteVideo: %v", err)
+		}
+		stored, err := cfg.db.GetVideo(video.ID)
+		if err != nil || stored.ID != (database.Video{}).ID {
+			t.Fatalf("video still stored after DeleteVideo: %+v, %v", stored, err)
+		}
+		_, err = c.GetVideo(ctx, video.ID)
+		var apiErr *tubelyclient.APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+			t.Errorf("GetVideo after delete = %v, want a 404 *APIError", err)
+		}
+	})
+}
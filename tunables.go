@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// tunables are the settings that can change without a restart. A snapshot
+// is never modified after it is published; a reload swaps in a new one.
+type tunables struct {
+	userQuotaBytes           int64
+	maxVideosPerUser         int
+	verifyFaststart          bool
+	measureLoudness          bool
+	warmCDN                  bool
+	cdnInvalidation          bool
+	processingLogRetention   int
+	tempSpaceCapBytes        int64
+	diskHeadroomFactor       float64
+	autoThumbnail            bool
+	autoThumbnailCandidates  bool
+	keepOriginal             bool
+	generateRenditions       bool
+	generateStoryboard       bool
+	storyboardInterval       int
+	generateAnimatedPreview  bool
+	animatedPreviewFormat    string
+	outputFormat             string
+	maxUploadsPerUser        int
+	assetsMaxAge             int64
+	assetsSMaxAge            int64
+	maxProcessingAttempts    int
+	multipartMaxHeaderBytes  int64
+	uploadRejectedWebhookURL string
+	s3KeySharding            bool
+	otherAspectSubdirs       bool
+	refreshAutoThumbnails    bool
+	fragmentedMP4            bool
+	remoteTranscodeProfiles  []string
+	maxConcurrentProbes      int
+	maxFFmpegThreads         int
+	ffmpegThreadTiers        []threadTier
+	shareSlugAlphabet        string
+	shareSlugLength          int
+	thumbnailAspectCheck     string
+	allowedVideoCodecs       []string
+	maxVideoDurationSeconds  int64
+	maxVideoBitrateKbps      int64
+	// failedUploadRetentionHours is how long failed uploads keep their
+	// leftovers; 0 keeps them forever
+	failedUploadRetentionHours int64
+	failedUploadDeleteRecord   bool
+	repeatDeleteResponse       string
+	deletedVideoRetention      time.Duration
+	directUploadURLTTL         time.Duration
+	signedURLTTL               time.Duration
+	accessTokenTTL             time.Duration
+	refreshTokenTTL            time.Duration
+	tusUploadExpiry            time.Duration
+	uploadSessionExpiry        time.Duration
+}
+
+// restartRequiredEnv lists settings that identify the server's data or
+// secrets. They are read once at startup; a reload only warns when they
+// change.
+var restartRequiredEnv = []string{
+	"DB_PATH",
+	"JWT_SECRET",
+	"JWT_KEYS",
+	"JWT_KEY_ID",
+	"PLATFORM",
+	"FILEPATH_ROOT",
+	"ASSETS_ROOT",
+	"STORAGE_BACKEND",
+	"MEDIA_ROOT",
+	"GCS_BUCKET",
+	"GCS_PUBLIC_URL",
+	"GCS_ENDPOINT",
+	"S3_BUCKET",
+	"S3_REGION",
+	"S3_CF_DISTRO",
+	"CLOUDFRONT_DISTRIBUTION_ID",
+	"CLOUDFRONT_KEY_PAIR_ID",
+	"CLOUDFRONT_PRIVATE_KEY_PATH",
+	"PRESIGN_VIDEO_URLS",
+	"S3_AWS_PROFILE",
+	"S3_ACCESS_KEY_ID",
+	"S3_SECRET_ACCESS_KEY",
+	"S3_SESSION_TOKEN",
+	"S3_PART_ATTEMPTS",
+	"PROCESSING_WORKERS",
+	"PORT",
+	"GRPC_PORT",
+	"TEMP_DIR",
+	"ADMIN_API_KEY",
+	"WEBHOOK_SECRET",
+	"CONTENT_HASH",
+	"DEDUP_SCOPE",
+	"STRICT_MIME",
+	"MAX_VIDEO_UPLOAD_BYTES",
+	"MAX_THUMBNAIL_UPLOAD_BYTES",
+	"THUMBNAIL_STORAGE",
+	"GENERATE_WEBP_THUMBNAILS",
+	"FFMPEG_GLOBAL_ARGS",
+	"PAD_PORTRAIT_TO_LANDSCAPE",
+	"DEV_MODE",
+	"DEV_S3_ROOT",
+	"UPLOAD_RESPONSE_HEADERS",
+	"TRANSCODER_URL",
+	"TRANSCODER_API_KEY",
+}
+
+func loadTunables() (*tunables, error) {
+	var t tunables
+	var err error
+	if t.userQuotaBytes, err = envInt64("USER_QUOTA_BYTES", 0); err != nil {
+		return nil, err
+	}
+	maxVideos, err := envInt64("MAX_VIDEOS_PER_USER", 0)
+	if err != nil {
+		return nil, err
+	}
+	t.maxVideosPerUser = int(maxVideos)
+	if t.measureLoudness, err = envBool("MEASURE_LOUDNESS", false); err != nil {
+		return nil, err
+	}
+	if t.verifyFaststart, err = envBool("VERIFY_FASTSTART", true); err != nil {
+		return nil, err
+	}
+	if t.warmCDN, err = envBool("WARM_CDN", false); err != nil {
+		return nil, err
+	}
+	if t.cdnInvalidation, err = envBool("CDN_INVALIDATION", true); err != nil {
+		return nil, err
+	}
+	retention, err := envInt64("PROCESSING_LOG_RETENTION", 5)
+	if err != nil {
+		return nil, err
+	}
+	t.processingLogRetention = int(retention)
+	if t.tempSpaceCapBytes, err = envInt64("TEMP_SPACE_CAP_BYTES", 0); err != nil {
+		return nil, err
+	}
+	if t.diskHeadroomFactor, err = envFloat("DISK_HEADROOM_FACTOR", tempCopiesPerUpload); err != nil {
+		return nil, err
+	}
+	if t.autoThumbnail, err = envBool("AUTO_THUMBNAIL", true); err != nil {
+		return nil, err
+	}
+	if t.autoThumbnailCandidates, err = envBool("AUTO_THUMBNAIL_CANDIDATES", false); err != nil {
+		return nil, err
+	}
+	if t.keepOriginal, err = envBool("KEEP_ORIGINAL", false); err != nil {
+		return nil, err
+	}
+	if t.generateRenditions, err = envBool("GENERATE_RENDITIONS", false); err != nil {
+		return nil, err
+	}
+	if t.generateStoryboard, err = envBool("GENERATE_STORYBOARD", false); err != nil {
+		return nil, err
+	}
+	storyboardInterval, err := envInt64("STORYBOARD_INTERVAL_SECONDS", 10)
+	if err != nil {
+		return nil, err
+	}
+	if storyboardInterval == 0 {
+		return nil, fmt.Errorf("STORYBOARD_INTERVAL_SECONDS must be at least 1")
+	}
+	t.storyboardInterval = int(storyboardInterval)
+	if t.generateAnimatedPreview, err = envBool("GENERATE_ANIMATED_PREVIEW", false); err != nil {
+		return nil, err
+	}
+	t.animatedPreviewFormat = os.Getenv("ANIMATED_PREVIEW_FORMAT")
+	if t.animatedPreviewFormat == "" {
+		t.animatedPreviewFormat = previewWebP
+	}
+	if t.animatedPreviewFormat != previewWebP && t.animatedPreviewFormat != previewGIF {
+		return nil, fmt.Errorf("ANIMATED_PREVIEW_FORMAT must be %s or %s", previewWebP, previewGIF)
+	}
+	t.outputFormat = os.Getenv("OUTPUT_FORMAT")
+	if t.outputFormat == "" {
+		t.outputFormat = outputMP4
+	}
+	if err := validateOutputFormat(t.outputFormat); err != nil {
+		return nil, fmt.Errorf("OUTPUT_FORMAT: %w", err)
+	}
+	maxUploads, err := envInt64("MAX_CONCURRENT_UPLOADS_PER_USER", 3)
+	if err != nil {
+		return nil, err
+	}
+	t.maxUploadsPerUser = int(maxUploads)
+	if t.assetsMaxAge, err = envInt64("ASSETS_MAX_AGE", 0); err != nil {
+		return nil, err
+	}
+	if t.assetsSMaxAge, err = envInt64("ASSETS_S_MAXAGE", 0); err != nil {
+		return nil, err
+	}
+	maxAttempts, err := envInt64("MAX_PROCESSING_ATTEMPTS", 5)
+	if err != nil {
+		return nil, err
+	}
+	t.maxProcessingAttempts = int(maxAttempts)
+	if t.multipartMaxHeaderBytes, err = envInt64("MULTIPART_MAX_HEADER_BYTES", 8<<10); err != nil {
+		return nil, err
+	}
+	t.uploadRejectedWebhookURL = os.Getenv("UPLOAD_REJECTED_WEBHOOK_URL")
+	if t.s3KeySharding, err = envBool("S3_KEY_SHARDING", false); err != nil {
+		return nil, err
+	}
+	if t.otherAspectSubdirs, err = envBool("OTHER_ASPECT_SUBDIRS", false); err != nil {
+		return nil, err
+	}
+	if t.refreshAutoThumbnails, err = envBool("REFRESH_AUTO_THUMBNAILS", true); err != nil {
+		return nil, err
+	}
+	if t.fragmentedMP4, err = envBool("FRAGMENTED_MP4", false); err != nil {
+		return nil, err
+	}
+	t.remoteTranscodeProfiles = envList("REMOTE_TRANSCODE_PROFILES")
+	for _, name := range t.remoteTranscodeProfiles {
+		if err := validateEncodingProfile(name); err != nil {
+			return nil, fmt.Errorf("REMOTE_TRANSCODE_PROFILES: %w", err)
+		}
+	}
+	if len(t.remoteTranscodeProfiles) > 0 && os.Getenv("TRANSCODER_URL") == "" {
+		return nil, errors.New("REMOTE_TRANSCODE_PROFILES requires TRANSCODER_URL")
+	}
+	maxProbes, err := envInt64("MAX_CONCURRENT_PROBES", 8)
+	if err != nil {
+		return nil, err
+	}
+	t.maxConcurrentProbes = int(maxProbes)
+	maxThreads, err := envInt64("MAX_FFMPEG_THREADS", 0)
+	if err != nil {
+		return nil, err
+	}
+	t.maxFFmpegThreads = int(maxThreads)
+	if t.ffmpegThreadTiers, err = parseThreadTiers(envList("FFMPEG_THREAD_TIERS")); err != nil {
+		return nil, err
+	}
+	t.shareSlugAlphabet = os.Getenv("SHARE_SLUG_ALPHABET")
+	if t.shareSlugAlphabet == "" {
+		t.shareSlugAlphabet = defaultShareSlugAlphabet
+	}
+	slugLength, err := envInt64("SHARE_SLUG_LENGTH", 8)
+	if err != nil {
+		return nil, err
+	}
+	t.shareSlugLength = int(slugLength)
+	if err := validateShareSlugSettings(t.shareSlugAlphabet, t.shareSlugLength); err != nil {
+		return nil, err
+	}
+	t.thumbnailAspectCheck = os.Getenv("THUMBNAIL_ASPECT_CHECK")
+	switch t.thumbnailAspectCheck {
+	case "":
+		t.thumbnailAspectCheck = thumbnailAspectOff
+	case thumbnailAspectOff, thumbnailAspectWarn, thumbnailAspectReject:
+	default:
+		return nil, fmt.Errorf("THUMBNAIL_ASPECT_CHECK must be off, warn or reject, not %q", t.thumbnailAspectCheck)
+	}
+	t.allowedVideoCodecs = envList("ALLOWED_VIDEO_CODECS")
+	if len(t.allowedVideoCodecs) == 0 {
+		t.allowedVideoCodecs = defaultVideoCodecs
+	}
+	if t.maxVideoDurationSeconds, err = envInt64("MAX_VIDEO_DURATION_SECONDS", 4*60*60); err != nil {
+		return nil, err
+	}
+	if t.maxVideoBitrateKbps, err = envInt64("MAX_VIDEO_BITRATE_KBPS", 100_000); err != nil {
+		return nil, err
+	}
+	if t.failedUploadRetentionHours, err = envInt64("FAILED_UPLOAD_RETENTION_HOURS", 0); err != nil {
+		return nil, err
+	}
+	if t.failedUploadDeleteRecord, err = envBool("FAILED_UPLOAD_DELETE_RECORD", false); err != nil {
+		return nil, err
+	}
+	t.repeatDeleteResponse = os.Getenv("REPEAT_DELETE_RESPONSE")
+	switch t.repeatDeleteResponse {
+	case "":
+		t.repeatDeleteResponse = repeatDeleteNotFound
+	case repeatDeleteNotFound, repeatDeletePriorState:
+	default:
+		return nil, fmt.Errorf("REPEAT_DELETE_RESPONSE must be not_found or prior_state, not %q", t.repeatDeleteResponse)
+	}
+	retentionHours, err := envInt64("DELETED_VIDEO_RETENTION_HOURS", 24)
+	if err != nil {
+		return nil, err
+	}
+	t.deletedVideoRetention = time.Duration(retentionHours) * time.Hour
+	uploadURLMinutes, err := envInt64("DIRECT_UPLOAD_URL_TTL_MINUTES", 15)
+	if err != nil {
+		return nil, err
+	}
+	if uploadURLMinutes <= 0 {
+		return nil, fmt.Errorf("DIRECT_UPLOAD_URL_TTL_MINUTES must be positive, not %d", uploadURLMinutes)
+	}
+	t.directUploadURLTTL = time.Duration(uploadURLMinutes) * time.Minute
+	signedURLMinutes, err := envInt64("SIGNED_URL_TTL_MINUTES", 60)
+	if err != nil {
+		return nil, err
+	}
+	if signedURLMinutes <= 0 {
+		return nil, fmt.Errorf("SIGNED_URL_TTL_MINUTES must be positive, not %d", signedURLMinutes)
+	}
+	t.signedURLTTL = time.Duration(signedURLMinutes) * time.Minute
+	accessTokenMinutes, err := envInt64("ACCESS_TOKEN_TTL_MINUTES", 15)
+	if err != nil {
+		return nil, err
+	}
+	if accessTokenMinutes <= 0 {
+		return nil, fmt.Errorf("ACCESS_TOKEN_TTL_MINUTES must be positive, not %d", accessTokenMinutes)
+	}
+	t.accessTokenTTL = time.Duration(accessTokenMinutes) * time.Minute
+	refreshTokenDays, err := envInt64("REFRESH_TOKEN_TTL_DAYS", 60)
+	if err != nil {
+		return nil, err
+	}
+	if refreshTokenDays <= 0 {
+		return nil, fmt.Errorf("REFRESH_TOKEN_TTL_DAYS must be positive, not %d", refreshTokenDays)
+	}
+	t.refreshTokenTTL = time.Duration(refreshTokenDays) * 24 * time.Hour
+	tusExpiryHours, err := envInt64("TUS_UPLOAD_EXPIRY_HOURS", 24)
+	if err != nil {
+		return nil, err
+	}
+	if tusExpiryHours <= 0 {
+		return nil, fmt.Errorf("TUS_UPLOAD_EXPIRY_HOURS must be positive, not %d", tusExpiryHours)
+	}
+	t.tusUploadExpiry = time.Duration(tusExpiryHours) * time.Hour
+	sessionExpiryHours, err := envInt64("UPLOAD_SESSION_EXPIRY_HOURS", 24)
+	if err != nil {
+		return nil, err
+	}
+	if sessionExpiryHours <= 0 {
+		return nil, fmt.Errorf("UPLOAD_SESSION_EXPIRY_HOURS must be positive, not %d", sessionExpiryHours)
+	}
+	t.uploadSessionExpiry = time.Duration(sessionExpiryHours) * time.Hour
+	return &t, nil
+}
+
+// snapshotRestartRequiredEnv records the startup values of settings that
+// need a restart, so a reload can tell whether any of them changed.
+func snapshotRestartRequiredEnv() map[string]string {
+	snapshot := make(map[string]string, len(restartRequiredEnv))
+	for _, key := range restartRequiredEnv {
+		snapshot[key] = os.Getenv(key)
+	}
+	return snapshot
+}
+
+type tunablesContextKey struct{}
+
+// tunables returns the snapshot attached to ctx, or the current one when the
+// context has none. Read it once per request and keep using the same value,
+// so a reload part way through an upload doesn't mix old and new settings.
+func (cfg *apiConfig) tunables(ctx context.Context) *tunables {
+	if t, ok := ctx.Value(tunablesContextKey{}).(*tunables); ok {
+		return t
+	}
+	return cfg.currentTunables.Load()
+}
+
+// withTunables pins the current snapshot to ctx for the rest of a request.
+func (cfg *apiConfig) withTunables(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tunablesContextKey{}, cfg.currentTunables.Load())
+}
+
+func (cfg *apiConfig) tunablesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(cfg.withTunables(r.Context())))
+	})
+}
+
+// reloadConfig re-reads .env and the environment and publishes a new
+// tunables snapshot. Invalid values leave the current snapshot in place. It
+// returns the restart-only settings that changed, which are not applied.
+func (cfg *apiConfig) reloadConfig() ([]string, error) {
+	err := godotenv.Overload(".env")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	t, err := loadTunables()
+	if err != nil {
+		return nil, err
+	}
+	if t.tempSpaceCapBytes != cfg.currentTunables.Load().tempSpaceCapBytes {
+		err = cfg.tempSpace.setCapacity(cfg.tempDir, t.tempSpaceCapBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg.currentTunables.Store(t)
+
+	var changed []string
+	for _, key := range restartRequiredEnv {
+		if os.Getenv(key) != cfg.startupEnv[key] {
+			changed = append(changed, key)
+		}
+	}
+	if len(changed) > 0 {
+		log.Printf("Warning: %v changed but only take effect after a restart", changed)
+	}
+	return changed, nil
+}
+
+// reloadOnSIGHUP reloads the config every time the process gets SIGHUP.
+func (cfg *apiConfig) reloadOnSIGHUP() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		_, err := cfg.reloadConfig()
+		if err != nil {
+			log.Printf("Couldn't reload config: %v", err)
+			continue
+		}
+		log.Println("Reloaded config")
+	}
+}
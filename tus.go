@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// tusVersion is the tus protocol version the upload endpoint speaks.
+const tusVersion = "1.0.0"
+
+// tusExtensions are the tus extensions supported on top of the core
+// protocol.
+const tusExtensions = "creation,termination,expiration"
+
+// tusUpload is a resumable upload being assembled in a temp file. It is
+// kept in memory, so uploads in progress don't survive a restart.
+type tusUpload struct {
+	// mu is held by the request appending to the upload; a second one
+	// fails rather than waits
+	mu sync.Mutex
+
+	id      string
+	userID  uuid.UUID
+	videoID uuid.UUID
+	length  int64
+	offset  int64
+	version string
+	path    string
+	// hash covers the bytes received so far
+	hash      hash.Hash
+	tempBytes int64
+	expiresAt time.Time
+}
+
+// tusRegistry holds the uploads in progress.
+type tusRegistry struct {
+	mu      sync.Mutex
+	uploads map[string]*tusUpload
+}
+
+func newTusRegistry() *tusRegistry {
+	return &tusRegistry{uploads: map[string]*tusUpload{}}
+}
+
+func (t *tusRegistry) add(u *tusUpload) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.uploads[u.id] = u
+}
+
+// get returns the caller's unexpired upload, or nil.
+func (t *tusRegistry) get(id string, userID uuid.UUID) *tusUpload {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.uploads[id]
+	if u == nil || u.userID != userID || time.Now().After(u.expiresAt) {
+		return nil
+	}
+	return u
+}
+
+// remove takes the upload out of the registry, reporting whether it was
+// still there, so only one caller cleans it up.
+func (t *tusRegistry) remove(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.uploads[id]
+	delete(t.uploads, id)
+	return ok
+}
+
+// expired takes the uploads past their expiry out of the registry and
+// returns them.
+func (t *tusRegistry) expired(now time.Time) []*tusUpload {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var expired []*tusUpload
+	for id, u := range t.uploads {
+		if now.After(u.expiresAt) {
+			expired = append(expired, u)
+			delete(t.uploads, id)
+		}
+	}
+	return expired
+}
+
+// discardTusUpload frees what an upload that was taken out of the registry
+// holds.
+func (cfg *apiConfig) discardTusUpload(u *tusUpload) {
+	err := os.Remove(u.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Couldn't remove tus upload file %s: %v", u.path, err)
+	}
+	cfg.tempSpace.release(u.tempBytes)
+}
+
+// tusHandler checks the Tus-Resumable header every tus request but OPTIONS
+// carries and adds it to the response.
+func tusHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			respondWithError(w, http.StatusPreconditionFailed, "Unsupported tus version", fmt.Errorf("Tus-Resumable %q", r.Header.Get("Tus-Resumable")))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// authenticateTus returns the user a tus request is made by.
+func (cfg *apiConfig) authenticateTus(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.Nil, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated
+// pairs of a key and a base64 encoded value, where the value may be left
+// out.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %q isn't base64 encoded: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func (cfg *apiConfig) handlerTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(cfg.maxVideoUploadBytes, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerTusCreate starts a resumable upload of a video's file. The
+// Upload-Metadata header names the video as video_id and the file's type
+// as filetype, the key tus clients such as Uppy use; encoding_profile,
+// output_format and version work like the regular upload's query
+// parameters and form field. Temp space for the whole file is reserved
+// until the upload is finished or expires.
+func (cfg *apiConfig) handlerTusCreate(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateTus(w, r)
+	if !ok {
+		return
+	}
+	for _, u := range cfg.tusUploads.expired(time.Now()) {
+		cfg.discardTusUpload(u)
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		respondWithError(w, http.StatusBadRequest, "Upload-Length must be a non-negative integer", err)
+		return
+	}
+	if length > cfg.maxVideoUploadBytes {
+		respondWithUploadTooLarge(w, "Video exceeds the upload size limit", cfg.maxVideoUploadBytes, fmt.Errorf("upload length %d", length))
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Metadata", err)
+		return
+	}
+
+	videoID, err := uuid.Parse(metadata["video_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Upload-Metadata needs the video_id", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video metadata", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You don't have access to this video", nil)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(metadata["filetype"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Upload-Metadata needs the filetype", err)
+		return
+	}
+	if !acceptsMediaType(video.MediaKind, mediaType) {
+		cfg.notifyUploadRejected(r.Context(), video, rejectUnsupportedMediaType, fmt.Sprintf("Unsupported media type %s", mediaType))
+		respondWithError(w, http.StatusBadRequest, "Unsupported media type", fmt.Errorf("unsupported media type: %s", mediaType))
+		return
+	}
+	_, err = nextVideoVersion(video, metadata["version"])
+	if errors.Is(err, errVersionNotIncreasing) {
+		respondWithError(w, http.StatusConflict, "Version must be greater than the video's current version", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid version", err)
+		return
+	}
+
+	err = cfg.selectEncodingProfile(&video, metadata["encoding_profile"])
+	if errors.Is(err, errUnknownEncodingProfile) || errors.Is(err, errEncodingProfileNotSupported) {
+		respondWithError(w, http.StatusBadRequest, "Invalid encoding profile", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save encoding profile", err)
+		return
+	}
+	err = cfg.selectOutputFormat(&video, metadata["output_format"])
+	if errors.Is(err, errUnknownOutputFormat) || errors.Is(err, errOutputFormatNotSupported) || errors.Is(err, errSegmentsNeedCDN) {
+		respondWithError(w, http.StatusBadRequest, "Invalid output format", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save output format", err)
+		return
+	}
+
+	// Don't start receiving a file that won't be processed
+	perr := checkProcessingAllowed(video)
+	if perr != nil {
+		respondWithProcessingError(w, perr)
+		return
+	}
+	limit, err := cfg.checkVideoLimit(r.Context(), userID, videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check video limit", err)
+		return
+	}
+	if limit.reached() {
+		cfg.notifyUploadRejected(r.Context(), video, rejectVideoLimitReached, "Video limit reached")
+		respondWithVideoLimit(w, limit)
+		return
+	}
+	remainingQuota, err := cfg.remainingQuota(r.Context(), userID, videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check storage quota", err)
+		return
+	}
+	if remainingQuota >= 0 && length > remainingQuota {
+		cfg.notifyUploadRejected(r.Context(), video, rejectQuotaExceeded, "Upload exceeds remaining storage quota")
+		respondWithQuotaExceeded(w, fmt.Errorf("upload length %d exceeds remaining quota %d for user %s", length, remainingQuota, userID))
+		return
+	}
+
+	// The assembled file is the first of the upload's temp copies
+	tempBytes := max(length, 1) * tempCopiesPerUpload
+	if !cfg.tempSpace.tryReserve(tempBytes) {
+		w.Header().Set("Retry-After", "30")
+		respondWithError(w, http.StatusServiceUnavailable, "Server is busy processing other uploads, try again shortly", fmt.Errorf("couldn't reserve %d bytes of temp space", tempBytes))
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	_, err = rand.Read(idBytes)
+	if err != nil {
+		cfg.tempSpace.release(tempBytes)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate upload ID", err)
+		return
+	}
+	file, err := os.CreateTemp(cfg.tempDir, "tubely-tus-*.mp4")
+	if err != nil {
+		cfg.tempSpace.release(tempBytes)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
+		return
+	}
+	file.Close()
+
+	upload := &tusUpload{
+		id:        hex.EncodeToString(idBytes),
+		userID:    userID,
+		videoID:   videoID,
+		length:    length,
+		version:   metadata["version"],
+		path:      file.Name(),
+		hash:      cfg.contentHash.New(),
+		tempBytes: tempBytes,
+		expiresAt: time.Now().Add(cfg.tunables(r.Context()).tusUploadExpiry),
+	}
+	cfg.tusUploads.add(upload)
+
+	w.Header().Set("Location", "/api/tus/"+upload.id)
+	w.Header().Set("Upload-Expires", upload.expiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handlerTusHead reports how much of the upload the server has, so the
+// client knows where to resume.
+func (cfg *apiConfig) handlerTusHead(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateTus(w, r)
+	if !ok {
+		return
+	}
+	upload := cfg.tusUploads.get(r.PathValue("uploadID"), userID)
+	if upload == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !upload.mu.TryLock() {
+		// A PATCH is still appending; its offset isn't final yet
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	offset := upload.offset
+	upload.mu.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.length, 10))
+	w.Header().Set("Upload-Expires", upload.expiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlerTusPatch appends the body to the upload at Upload-Offset. Bytes
+// received before a dropped connection are kept, so the client can resume
+// from them. The PATCH that completes the file runs the processing
+// pipeline before answering, and answers with the processing error if it
+// fails; the upload is over either way.
+func (cfg *apiConfig) handlerTusPatch(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateTus(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+	upload := cfg.tusUploads.get(r.PathValue("uploadID"), userID)
+	if upload == nil {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return
+	}
+	if !upload.mu.TryLock() {
+		respondWithError(w, http.StatusConflict, "Upload is already being appended to", nil)
+		return
+	}
+	defer upload.mu.Unlock()
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match the upload", fmt.Errorf("got offset %q, upload is at %d", r.Header.Get("Upload-Offset"), upload.offset))
+		return
+	}
+
+	err = cfg.appendTusUpload(upload, r.Body)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	w.Header().Set("Upload-Expires", upload.expiresAt.UTC().Format(http.TimeFormat))
+	if errors.Is(err, errTusBodyTooLong) {
+		respondWithUploadTooLarge(w, "Body goes past Upload-Length", upload.length, err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't receive upload", err)
+		return
+	}
+	if upload.offset < upload.length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(upload.videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video metadata", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		if cfg.tusUploads.remove(upload.id) {
+			cfg.discardTusUpload(upload)
+		}
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	// The upload is kept, so an empty PATCH at the final offset retries
+	if !cfg.uploads.tryAcquire(userID, cfg.tunables(r.Context()).maxUploadsPerUser) {
+		w.Header().Set("Retry-After", "30")
+		respondWithError(w, http.StatusTooManyRequests, "Too many uploads in progress, wait for one to finish", fmt.Errorf("user %s is at the concurrent upload limit", userID))
+		return
+	}
+	defer cfg.uploads.release(userID)
+
+	if !cfg.tusUploads.remove(upload.id) {
+		// Terminated while the last bytes were arriving
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return
+	}
+	defer cfg.discardTusUpload(upload)
+
+	err = cfg.processTusUpload(r.Context(), &video, upload)
+	if err != nil {
+		cfg.respondToIngestError(w, r, video, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var errTusBodyTooLong = errors.New("body is longer than the rest of the upload")
+
+// appendTusUpload writes body to the end of the upload, counting only what
+// made it to the file.
+func (cfg *apiConfig) appendTusUpload(upload *tusUpload, body io.Reader) error {
+	file, err := os.OpenFile(upload.path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	body = io.LimitReader(body, upload.length-upload.offset+1)
+	buf := make([]byte, 32<<10)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if upload.offset+int64(n) > upload.length {
+				return errTusBodyTooLong
+			}
+			written, err := file.WriteAt(buf[:n], upload.offset)
+			upload.hash.Write(buf[:written])
+			upload.offset += int64(written)
+			if err != nil {
+				return err
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// processTusUpload runs the assembled file through the pipeline, with the
+// checks a regular upload gets once its file has arrived.
+func (cfg *apiConfig) processTusUpload(ctx context.Context, video *database.Video, upload *tusUpload) error {
+	if perr := checkProcessingAllowed(*video); perr != nil {
+		return perr
+	}
+	if upload.length == 0 {
+		return errEmptyUpload
+	}
+	// The version was checked when the upload was created, but the video
+	// may have moved past it since
+	version, err := nextVideoVersion(*video, upload.version)
+	if err != nil {
+		return newProcessingError(stageReceive, err)
+	}
+	video.Version = version
+
+	plog := newProcessingLog(ctx, video.ID)
+	defer cfg.saveProcessingLog(ctx, plog)
+	defer cfg.followSteps(video.ID, plog)()
+	plog.start(stageReceive, 0).finish(upload.length, "assembled resumable upload")
+
+	return cfg.processReceivedVideo(ctx, video, upload.path, upload.length, hex.EncodeToString(upload.hash.Sum(nil)), plog)
+}
+
+// handlerTusDelete terminates an upload and frees what it holds.
+func (cfg *apiConfig) handlerTusDelete(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticateTus(w, r)
+	if !ok {
+		return
+	}
+	upload := cfg.tusUploads.get(r.PathValue("uploadID"), userID)
+	if upload == nil || !cfg.tusUploads.remove(upload.id) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// A PATCH in progress finishes writing before the file goes
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	cfg.discardTusUpload(upload)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// userUploadLimiter counts in-flight uploads per user so one user can't tie
+// up all of the processing capacity.
+type userUploadLimiter struct {
+	mu       sync.Mutex
+	inFlight map[uuid.UUID]int
+}
+
+func newUserUploadLimiter() *userUploadLimiter {
+	return &userUploadLimiter{
+		inFlight: make(map[uuid.UUID]int),
+	}
+}
+
+// tryAcquire claims an upload slot for the user, returning false if they
+// already have limit uploads in flight. A limit of 0 means no limit. Every
+// successful acquire must be released.
+func (l *userUploadLimiter) tryAcquire(userID uuid.UUID, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit > 0 && l.inFlight[userID] >= limit {
+		return false
+	}
+	l.inFlight[userID]++
+	return true
+}
+
+func (l *userUploadLimiter) release(userID uuid.UUID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight[userID]--
+	if l.inFlight[userID] <= 0 {
+		delete(l.inFlight, userID)
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// fakeMP4 is enough of an MP4 to get past content sniffing.
+func fakeMP4() []byte {
+	data := make([]byte, 1024)
+	copy(data, "\x00\x00\x00\x18ftypisom")
+	return data
+}
+
+// multipartVideo encodes data as the video part of an upload form.
+func multipartVideo(t *testing.T, contentType string, data []byte) ([]byte, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="video"; filename="video.mp4"`)
+	header.Set("Content-Type", contentType)
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+	return buf.Bytes(), mw.FormDataContentType()
+}
+
+// scriptedBody reads prefix, then returns whatever atEnd does instead of
+// io.EOF, standing in for a client that stalls, drops or breaks part way
+// through an upload.
+type scriptedBody struct {
+	prefix io.Reader
+	atEnd  func() error
+}
+
+func (b *scriptedBody) Read(p []byte) (int, error) {
+	n, err := b.prefix.Read(p)
+	if n > 0 || err != io.EOF || b.atEnd == nil {
+		return n, err
+	}
+	return 0, b.atEnd()
+}
+
+func reservedTempBytes(cfg *apiConfig) int64 {
+	cfg.tempSpace.mu.Lock()
+	defer cfg.tempSpace.mu.Unlock()
+	return cfg.tempSpace.reserved
+}
+
+func uploadsInFlight(cfg *apiConfig, userID uuid.UUID) int {
+	cfg.uploads.mu.Lock()
+	defer cfg.uploads.mu.Unlock()
+	return cfg.uploads.inFlight[userID]
+}
+
+func checkHeld(t *testing.T, cfg *apiConfig, userID uuid.UUID) {
+	t.Helper()
+	if reservedTempBytes(cfg) == 0 {
+		t.Error("no temp space reserved while the upload was being received")
+	}
+	if uploadsInFlight(cfg, userID) != 1 {
+		t.Errorf("%d upload slots held while the upload was being received, want 1", uploadsInFlight(cfg, userID))
+	}
+}
+
+func checkReleased(t *testing.T, cfg *apiConfig, userID uuid.UUID) {
+	t.Helper()
+	if n := reservedTempBytes(cfg); n != 0 {
+		t.Errorf("%d bytes of temp space still reserved", n)
+	}
+	if n := uploadsInFlight(cfg, userID); n != 0 {
+		t.Errorf("%d upload slots still held", n)
+	}
+}
+
+func newUploadRequest(ctx context.Context, videoID uuid.UUID, token, contentType string, body io.Reader, size int64) *http.Request {
+	r := httptest.NewRequestWithContext(ctx, http.MethodPost, "/api/video_upload/"+videoID.String(), body)
+	r.SetPathValue("videoID", videoID.String())
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Content-Type", contentType)
+	r.ContentLength = size
+	return r
+}
+
+// TestUploadVideoReleases checks that an upload gives back its upload slot
+// and temp space reservation however the handler exits.
+func TestUploadVideoReleases(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		user, token := newTestUser(t, cfg)
+		video := newTestVideo(t, cfg, user.ID)
+
+		body, contentType := multipartVideo(t, "video/mp4", fakeMP4())
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, newUploadRequest(context.Background(), video.ID, token, contentType, bytes.NewReader(body), int64(len(body))))
+
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+		}
+		checkReleased(t, cfg, user.ID)
+	})
+
+	t.Run("rejected content", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		user, token := newTestUser(t, cfg)
+		video := newTestVideo(t, cfg, user.ID)
+
+		body, contentType := multipartVideo(t, "video/mp4", bytes.Repeat([]byte("not a video "), 100))
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, newUploadRequest(context.Background(), video.ID, token, contentType, bytes.NewReader(body), int64(len(body))))
+
+		if w.Code < 400 {
+			t.Fatalf("status = %d, want an error", w.Code)
+		}
+		checkReleased(t, cfg, user.ID)
+	})
+
+	t.Run("truncated body", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		user, token := newTestUser(t, cfg)
+		video := newTestVideo(t, cfg, user.ID)
+
+		body, contentType := multipartVideo(t, "video/mp4", fakeMP4())
+		src := &scriptedBody{
+			prefix: bytes.NewReader(body[:len(body)/2]),
+			atEnd: func() error {
+				checkHeld(t, cfg, user.ID)
+				return io.ErrUnexpectedEOF
+			},
+		}
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, newUploadRequest(context.Background(), video.ID, token, contentType, src, int64(len(body))))
+
+		if w.Code < 400 {
+			t.Fatalf("status = %d, want an error", w.Code)
+		}
+		checkReleased(t, cfg, user.ID)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		user, token := newTestUser(t, cfg)
+		video := newTestVideo(t, cfg, user.ID)
+
+		body, contentType := multipartVideo(t, "video/mp4", fakeMP4())
+		src := &scriptedBody{
+			prefix: bytes.NewReader(body[:len(body)/2]),
+			atEnd: func() error {
+				checkHeld(t, cfg, user.ID)
+				panic("body reader panicked")
+			},
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("handler didn't panic")
+				}
+			}()
+			cfg.handlerUploadVideo(httptest.NewRecorder(), newUploadRequest(context.Background(), video.ID, token, contentType, src, int64(len(body))))
+		}()
+		checkReleased(t, cfg, user.ID)
+	})
+
+	t.Run("context canceled", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		user, token := newTestUser(t, cfg)
+		video := newTestVideo(t, cfg, user.ID)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stalled := make(chan struct{})
+		body, contentType := multipartVideo(t, "video/mp4", fakeMP4())
+		src := &scriptedBody{
+			prefix: bytes.NewReader(body[:len(body)/2]),
+			atEnd: func() error {
+				close(stalled)
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			cfg.handlerUploadVideo(httptest.NewRecorder(), newUploadRequest(ctx, video.ID, token, contentType, src, int64(len(body))))
+		}()
+
+		select {
+		case <-stalled:
+		case <-done:
+			t.Fatal("handler returned before reading the body")
+		}
+		checkHeld(t, cfg, user.ID)
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler didn't return after its context was canceled")
+		}
+		checkReleased(t, cfg, user.ID)
+	})
+}
+
+// panickingTranscoder stands in for a transcoder with a bug.
+type panickingTranscoder struct{}
+
+func (panickingTranscoder) probeVideo(context.Context, string) (videoProbe, error) {
+	panic("probe panicked")
+}
+
+func (panickingTranscoder) probeAudio(context.Context, string) (audioInfo, error) {
+	panic("probe panicked")
+}
+
+func (panickingTranscoder) faststart(context.Context, transcodeJob) (storedFile, *processingError) {
+	panic("faststart panicked")
+}
+
+func (panickingTranscoder) extractFrame(context.Context, string, float64, string) error {
+	panic("frame extraction panicked")
+}
+
+// newClaimedJob queues a job for a fresh video the way enqueueVideo does,
+// and claims it the way a worker does.
+func newClaimedJob(t *testing.T, cfg *apiConfig) (database.Video, database.ProcessingJob) {
+	t.Helper()
+	user, _ := newTestUser(t, cfg)
+	video := newTestVideo(t, cfg, user.ID)
+	perr := cfg.claimVideo(&video)
+	if perr != nil {
+		t.Fatalf("claimVideo: %v", perr)
+	}
+
+	data := fakeMP4()
+	jobID := uuid.New()
+	err := os.WriteFile(cfg.jobSourcePath(jobID), data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.db.CreateProcessingJob(database.ProcessingJob{
+		ID:         jobID,
+		VideoID:    video.ID,
+		UserID:     user.ID,
+		SourceSize: int64(len(data)),
+		SourceHash: "hash",
+	})
+	if err != nil {
+		t.Fatalf("CreateProcessingJob: %v", err)
+	}
+	job, ok, err := cfg.db.ClaimNextProcessingJob()
+	if err != nil || !ok {
+		t.Fatalf("ClaimNextProcessingJob = %v, %v", ok, err)
+	}
+	return video, job
+}
+
+func getJob(t *testing.T, cfg *apiConfig, id uuid.UUID) database.ProcessingJob {
+	t.Helper()
+	job, ok, err := cfg.db.GetProcessingJob(id)
+	if err != nil || !ok {
+		t.Fatalf("GetProcessingJob = %v, %v", ok, err)
+	}
+	return job
+}
+
+// TestRunProcessingJobReleases checks that a worker gives back the temp
+// space it reserved for a job however the job ends.
+func TestRunProcessingJobReleases(t *testing.T) {
+	t.Run("error", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		video, job := newClaimedJob(t, cfg)
+		err := cfg.db.DeleteVideo(video.ID)
+		if err != nil {
+			t.Fatalf("DeleteVideo: %v", err)
+		}
+
+		cfg.runProcessingJob(job)
+
+		job = getJob(t, cfg, job.ID)
+		if job.Status != database.JobStatusFailed || job.Error == nil || job.Error.Code != errCodeVideoDeleted {
+			t.Errorf("job is %s with error %+v, want failed with %s", job.Status, job.Error, errCodeVideoDeleted)
+		}
+		if n := reservedTempBytes(cfg); n != 0 {
+			t.Errorf("%d bytes of temp space still reserved", n)
+		}
+		if _, err := os.Stat(cfg.jobSourcePath(job.ID)); !os.IsNotExist(err) {
+			t.Errorf("job file wasn't removed: %v", err)
+		}
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		cfg.localTranscoder = panickingTranscoder{}
+		video, job := newClaimedJob(t, cfg)
+
+		cfg.runProcessingJob(job)
+
+		job = getJob(t, cfg, job.ID)
+		if job.Status != database.JobStatusFailed || job.Error == nil || job.Error.Code != errCodeInternal {
+			t.Errorf("job is %s with error %+v, want failed with %s", job.Status, job.Error, errCodeInternal)
+		}
+		video, err := cfg.db.GetVideo(video.ID)
+		if err != nil {
+			t.Fatalf("GetVideo: %v", err)
+		}
+		if video.LifecycleStage != database.StageFailed {
+			t.Errorf("video is %s, want %s", video.LifecycleStage, database.StageFailed)
+		}
+		if n := reservedTempBytes(cfg); n != 0 {
+			t.Errorf("%d bytes of temp space still reserved", n)
+		}
+		if _, err := os.Stat(cfg.jobSourcePath(job.ID)); !os.IsNotExist(err) {
+			t.Errorf("job file wasn't removed: %v", err)
+		}
+	})
+
+	t.Run("shutdown while waiting for temp space", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		_, job := newClaimedJob(t, cfg)
+		held := cfg.tempSpace.capacity
+		if !cfg.tempSpace.tryReserve(held) {
+			t.Fatal("couldn't fill temp space")
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			cfg.runProcessingJob(job)
+		}()
+		err := cfg.jobs.shutdown(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("worker didn't stop waiting at shutdown")
+		}
+
+		job = getJob(t, cfg, job.ID)
+		if job.Status != database.JobStatusQueued {
+			t.Errorf("job is %s, want %s", job.Status, database.JobStatusQueued)
+		}
+		if n := reservedTempBytes(cfg); n != held {
+			t.Errorf("%d bytes of temp space reserved, want only the %d held before", n, held)
+		}
+		if _, err := os.Stat(cfg.jobSourcePath(job.ID)); err != nil {
+			t.Errorf("requeued job lost its file: %v", err)
+		}
+	})
+
+	t.Run("bigger than the temp space cap", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		video, job := newClaimedJob(t, cfg)
+		// As a reload of TEMP_SPACE_CAP_BYTES would after the upload
+		err := cfg.tempSpace.setCapacity(cfg.tempDir, job.SourceSize*tempCopiesPerUpload-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			cfg.runProcessingJob(job)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("worker is still waiting for temp space that can't be reserved")
+		}
+
+		job = getJob(t, cfg, job.ID)
+		if job.Status != database.JobStatusFailed || job.Error == nil || job.Error.Code != errCodeNoTempSpace {
+			t.Errorf("job is %s with error %+v, want failed with %s", job.Status, job.Error, errCodeNoTempSpace)
+		}
+		video, err = cfg.db.GetVideo(video.ID)
+		if err != nil {
+			t.Fatalf("GetVideo: %v", err)
+		}
+		if video.LifecycleStage != database.StageFailed {
+			t.Errorf("video is %s, want %s", video.LifecycleStage, database.StageFailed)
+		}
+		if n := reservedTempBytes(cfg); n != 0 {
+			t.Errorf("%d bytes of temp space still reserved", n)
+		}
+		if _, err := os.Stat(cfg.jobSourcePath(job.ID)); !os.IsNotExist(err) {
+			t.Errorf("job file wasn't removed: %v", err)
+		}
+	})
+}
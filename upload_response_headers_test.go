@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// doRequest sends an authenticated request to srv and returns the response
+// with its body read.
+func doRequest(t *testing.T, srv *httptest.Server, method, path, token, contentType string, body []byte) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, respBody
+}
+
+// sessionUpload sends data through an upload session in two chunks and
+// completes it.
+func sessionUpload(t *testing.T, srv *httptest.Server, token string, videoID uuid.UUID, data []byte) (*http.Response, []byte) {
+	t.Helper()
+	params, err := json.Marshal(map[string]any{"video_id": videoID, "content_type": "video/mp4", "size": len(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, body := doRequest(t, srv, http.MethodPost, "/api/uploads", token, "application/json", params)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create upload session status = %d: %s", resp.StatusCode, body)
+	}
+	var session uploadSessionResponse
+	err = json.Unmarshal(body, &session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionPath := "/api/uploads/" + session.ID.String()
+	half := len(data) / 2
+	for n, chunk := range [][]byte{data[:half], data[half:]} {
+		resp, body := doRequest(t, srv, http.MethodPut, fmt.Sprintf("%s/chunks/%d", sessionPath, n), token, "application/octet-stream", chunk)
+		if resp.StatusCode >= 300 {
+			t.Fatalf("PUT chunk %d status = %d: %s", n, resp.StatusCode, body)
+		}
+	}
+	return doRequest(t, srv, http.MethodPost, sessionPath+"/complete", token, "", nil)
+}
+
+// TestUploadResponseHeaders checks the headers of a successful response
+// from each kind of upload: Location at the video, Link at the file that
+// was stored, and the UPLOAD_RESPONSE_HEADERS extras.
+func TestUploadResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		upload func(t *testing.T, srv *httptest.Server, token string, video database.Video) (*http.Response, []byte)
+		status int
+		rel    string
+		// assetURL picks the Link target out of the response
+		assetURL func(video database.Video) *string
+	}{
+		{
+			name: "direct upload",
+			upload: func(t *testing.T, srv *httptest.Server, token string, video database.Video) (*http.Response, []byte) {
+				key := stageDirectUpload(t, srv, token, video.ID, fakeMP4())
+				params, err := json.Marshal(map[string]string{"key": key})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return doRequest(t, srv, http.MethodPost, "/api/videos/"+video.ID.String()+"/upload-complete", token, "application/json", params)
+			},
+			status:   http.StatusCreated,
+			rel:      "enclosure",
+			assetURL: func(video database.Video) *string { return video.VideoURL },
+		},
+		{
+			name: "upload session",
+			upload: func(t *testing.T, srv *httptest.Server, token string, video database.Video) (*http.Response, []byte) {
+				return sessionUpload(t, srv, token, video.ID, fakeMP4())
+			},
+			status:   http.StatusCreated,
+			rel:      "enclosure",
+			assetURL: func(video database.Video) *string { return video.VideoURL },
+		},
+		{
+			name: "thumbnail upload",
+			upload: func(t *testing.T, srv *httptest.Server, token string, video database.Video) (*http.Response, []byte) {
+				body, contentType := pngThumbnail(t)
+				return doRequest(t, srv, http.MethodPost, "/api/thumbnail_upload/"+video.ID.String(), token, contentType, body)
+			},
+			status:   http.StatusOK,
+			rel:      "preview",
+			assetURL: func(video database.Video) *string { return video.ThumbnailURL },
+		},
+		{
+			name: "thumbnail upload to the video resource",
+			upload: func(t *testing.T, srv *httptest.Server, token string, video database.Video) (*http.Response, []byte) {
+				body, contentType := pngThumbnail(t)
+				return doRequest(t, srv, http.MethodPost, "/api/videos/"+video.ID.String()+"/thumbnail", token, contentType, body)
+			},
+			status:   http.StatusOK,
+			rel:      "preview",
+			assetURL: func(video database.Video) *string { return video.ThumbnailURL },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			useTestDevS3(t, cfg)
+			useFakeTranscoder(cfg)
+			cfg.uploadResponseHeaders = http.Header{
+				"Cache-Control":   {"no-store"},
+				"X-Upload-Region": {"test"},
+			}
+			srv := newTestServer(t, cfg)
+			user, token := newTestUser(t, cfg)
+			video := newTestVideo(t, cfg, user.ID)
+
+			resp, body := tt.upload(t, srv, token, video)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			var got database.Video
+			err := json.Unmarshal(body, &got)
+			if err != nil {
+				t.Fatalf("response %s: %v", body, err)
+			}
+
+			if want := "/api/videos/" + video.ID.String(); resp.Header.Get("Location") != want {
+				t.Errorf("Location = %q, want %q", resp.Header.Get("Location"), want)
+			}
+			assetURL := tt.assetURL(got)
+			if assetURL == nil {
+				t.Fatalf("response has no URL for the uploaded file: %s", body)
+			}
+			if want := fmt.Sprintf("<%s>; rel=%q", *assetURL, tt.rel); resp.Header.Get("Link") != want {
+				t.Errorf("Link = %q, want %q", resp.Header.Get("Link"), want)
+			}
+			for name, values := range cfg.uploadResponseHeaders {
+				if resp.Header.Get(name) != values[0] {
+					t.Errorf("%s = %q, want %q", name, resp.Header.Get(name), values[0])
+				}
+			}
+		})
+	}
+}
+
+// TestUploadErrorHeaders checks that a failed upload gets none of the
+// success headers.
+func TestUploadErrorHeaders(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.uploadResponseHeaders = http.Header{"X-Upload-Region": {"test"}}
+	srv := newTestServer(t, cfg)
+	user, token := newTestUser(t, cfg)
+	video := newTestVideo(t, cfg, user.ID)
+
+	resp, body := doRequest(t, srv, http.MethodPost, "/api/thumbnail_upload/"+video.ID.String(), token, "text/plain", []byte("not a form"))
+	if resp.StatusCode < 400 {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	for _, name := range []string{"Location", "Link", "X-Upload-Region"} {
+		if resp.Header.Get(name) != "" {
+			t.Errorf("error response has %s: %s", name, resp.Header.Get(name))
+		}
+	}
+}
+
+// TestQueuedUploadResponseHeaders checks the headers of a multipart upload,
+// which is answered before the file is processed: Location points at the
+// processing job and Link at the video it will update.
+func TestQueuedUploadResponseHeaders(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.uploadResponseHeaders = http.Header{"X-Upload-Region": {"test"}}
+	srv := newTestServer(t, cfg)
+	user, token := newTestUser(t, cfg)
+	video := newTestVideo(t, cfg, user.ID)
+
+	body, contentType := multipartVideo(t, "video/mp4", fakeMP4())
+	resp, respBody := doRequest(t, srv, http.MethodPost, "/api/video_upload/"+video.ID.String(), token, contentType, body)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusAccepted, respBody)
+	}
+	var job database.ProcessingJob
+	err := json.Unmarshal(respBody, &job)
+	if err != nil {
+		t.Fatalf("response %s: %v", respBody, err)
+	}
+
+	if want := "/api/jobs/" + job.ID.String(); resp.Header.Get("Location") != want {
+		t.Errorf("Location = %q, want %q", resp.Header.Get("Location"), want)
+	}
+	if want := fmt.Sprintf(`</api/videos/%s>; rel="related"`, video.ID); resp.Header.Get("Link") != want {
+		t.Errorf("Link = %q, want %q", resp.Header.Get("Link"), want)
+	}
+	if resp.Header.Get("X-Upload-Region") != "test" {
+		t.Errorf("X-Upload-Region = %q, want test", resp.Header.Get("X-Upload-Region"))
+	}
+}
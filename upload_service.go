@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// defaultMaxVideoUploadBytes is MAX_VIDEO_UPLOAD_BYTES when it isn't set.
+const defaultMaxVideoUploadBytes = 1 << 30 // 1 GB
+
+var errEmptyUpload = errors.New("empty video upload")
+
+// respondWithUploadTooLarge answers an upload over its size limit with a
+// 413 that gives the limit, so clients can say how big a file may be.
+func respondWithUploadTooLarge(w http.ResponseWriter, msg string, limitBytes int64, err error) {
+	if err != nil {
+		log.Println(err)
+	}
+	type errorResponse struct {
+		Error      string `json:"error"`
+		LimitBytes int64  `json:"limit_bytes"`
+	}
+	respondWithJSON(w, http.StatusRequestEntityTooLarge, errorResponse{
+		Error:      msg,
+		LimitBytes: limitBytes,
+	})
+}
+
+// ingestVideo stages an incoming video in a temp file and runs the
+// processing pipeline over it. It is shared by the HTTP and gRPC upload
+// paths, which handle authentication, quotas and temp space reservation
+// themselves. Errors from src are returned as is; pipeline failures are
+// returned as a *processingError.
+func (cfg *apiConfig) ingestVideo(ctx context.Context, video *database.Video, src io.Reader, plog *processingLog) error {
+	defer cfg.followSteps(video.ID, plog)()
+
+	srcPath, size, srcHash, err := cfg.receiveVideo(src, plog)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(srcPath) // Clean up temp file after processing
+
+	return cfg.processReceivedVideo(ctx, video, srcPath, size, srcHash, plog)
+}
+
+// receiveVideo stages src in a temp file, recording the receive step, and
+// returns the file's path, size and content hash. The caller removes the
+// file. Errors from src are returned as is.
+func (cfg *apiConfig) receiveVideo(src io.Reader, plog *processingLog) (string, int64, string, error) {
+	receiveStep := plog.start(stageReceive, 0)
+
+	tempFile, err := os.CreateTemp(cfg.tempDir, "tubely-upload-*.mp4")
+	if err != nil {
+		return "", 0, "", fmt.Errorf("couldn't create temp file: %w", err)
+	}
+	defer tempFile.Close()
+
+	// Hash the upload on the way in; derived assets record the hash of the
+	// content they were made from
+	hash := cfg.contentHash.New()
+	written, err := io.Copy(io.MultiWriter(tempFile, hash), src)
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return "", 0, "", err
+	}
+
+	// Close now so the pipeline can remove the file as soon as it is done
+	// with it; an open descriptor would keep the space allocated
+	err = tempFile.Close()
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return "", 0, "", fmt.Errorf("couldn't write temp file: %w", err)
+	}
+
+	// An empty file would otherwise surface as an opaque ffprobe failure
+	if written == 0 {
+		os.Remove(tempFile.Name())
+		return "", 0, "", errEmptyUpload
+	}
+
+	receiveStep.finish(written, "received upload")
+	return tempFile.Name(), written, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// followSteps lets status long-polls follow the upload through the
+// pipeline. Call the returned function once processing is over.
+func (cfg *apiConfig) followSteps(videoID uuid.UUID, plog *processingLog) func() {
+	plog.onStep = func(step string) {
+		cfg.statuses.setStep(videoID, step)
+	}
+	return func() {
+		cfg.statuses.setStep(videoID, "")
+	}
+}
+
+// processReceivedVideo runs the pipeline over a video fully received into
+// srcPath, which the pipeline may remove when it is done with it. Content
+// the record doesn't accept is turned away before the video is claimed.
+// Failures are returned as a *processingError.
+func (cfg *apiConfig) processReceivedVideo(ctx context.Context, video *database.Video, srcPath string, size int64, srcHash string, plog *processingLog) error {
+	perr := checkReceivedContent(*video, srcPath)
+	if perr != nil {
+		return perr
+	}
+
+	perr = cfg.processVideo(ctx, video, srcPath, size, srcHash, plog)
+	if perr != nil {
+		return perr
+	}
+
+	cfg.warmCDNCache(ctx, video.VideoURL, video.ThumbnailURL)
+	return nil
+}
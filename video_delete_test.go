@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// TestDeleteDuringUpload deletes videos while their uploads are processed
+// and their metadata is read, and checks that nothing brings a deleted
+// video back or leaves its files in storage. Run it with -race.
+func TestDeleteDuringUpload(t *testing.T) {
+	cfg := newTestConfig(t)
+	useTestDevS3(t, cfg)
+	useFakeTranscoder(cfg)
+	srv := newTestServer(t, cfg)
+	user, token := newTestUser(t, cfg)
+
+	const n = 8
+	var wg sync.WaitGroup
+	for range n {
+		video := newTestVideo(t, cfg, user.ID)
+		key := stageDirectUpload(t, srv, token, video.ID, fakeMP4())
+		videoPath := "/api/videos/" + video.ID.String()
+		params, err := json.Marshal(map[string]string{"key": key})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			// The upload may win or find the video gone; either is fine
+			doRequest(t, srv, http.MethodPost, videoPath+"/upload-complete", token, "application/json", params)
+		}()
+		go func() {
+			defer wg.Done()
+			resp, body := doRequest(t, srv, http.MethodDelete, videoPath, token, "", nil)
+			if resp.StatusCode != http.StatusNoContent {
+				t.Errorf("DELETE status = %d: %s", resp.StatusCode, body)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 5 {
+				doRequest(t, srv, http.MethodGet, videoPath, token, "", nil)
+			}
+		}()
+	}
+	wg.Wait()
+
+	videos, err := cfg.db.GetVideosPage(user.ID, 2*n, 0)
+	if err != nil {
+		t.Fatalf("GetVideosPage: %v", err)
+	}
+	for _, video := range videos {
+		t.Errorf("deleted video %s is back, %s", video.ID, video.LifecycleStage)
+	}
+	objects, err := cfg.storage.List(context.Background(), "")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	for _, object := range objects {
+		t.Errorf("file of a deleted video left in storage: %s", object.Key)
+	}
+}
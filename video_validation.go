@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// defaultVideoCodecs is ALLOWED_VIDEO_CODECS when it isn't set: the codecs
+// an MP4 can carry that browsers play.
+var defaultVideoCodecs = []string{"h264", "hevc", "av1", "vp9"}
+
+var (
+	errUnsupportedVideoCodec = errors.New("unsupported video codec")
+	errVideoTooLong          = errors.New("video is too long")
+	errVideoBitrate          = errors.New("video bitrate out of range")
+)
+
+// videoRejection is a probed video that doesn't meet the upload
+// requirements. Its message says what's wrong in terms the uploader can act
+// on, and is shown to clients as it is.
+type videoRejection struct {
+	reason  error
+	message string
+}
+
+func (e *videoRejection) Error() string {
+	return e.message
+}
+
+func (e *videoRejection) Unwrap() error {
+	return e.reason
+}
+
+// validateVideo checks a probed video against the upload requirements: a
+// supported codec, MAX_VIDEO_DURATION_SECONDS and MAX_VIDEO_BITRATE_KBPS.
+// Limits of 0 aren't enforced, and neither are values ffprobe couldn't
+// tell. Failures are returned as a *videoRejection.
+func validateVideo(probe videoProbe, t *tunables) error {
+	if !slices.Contains(t.allowedVideoCodecs, probe.codec) {
+		return &videoRejection{
+			reason:  errUnsupportedVideoCodec,
+			message: fmt.Sprintf("Video codec %q isn't supported. Re-export it as one of: %s.", probe.codec, strings.Join(t.allowedVideoCodecs, ", ")),
+		}
+	}
+	if t.maxVideoDurationSeconds > 0 && probe.durationSeconds > float64(t.maxVideoDurationSeconds) {
+		return &videoRejection{
+			reason:  errVideoTooLong,
+			message: fmt.Sprintf("The video is %.0f seconds long; the limit is %d seconds.", probe.durationSeconds, t.maxVideoDurationSeconds),
+		}
+	}
+	if t.maxVideoBitrateKbps > 0 && probe.bitrateKbps > t.maxVideoBitrateKbps {
+		return &videoRejection{
+			reason:  errVideoBitrate,
+			message: fmt.Sprintf("The video's bitrate of %d kbps is over the limit of %d kbps.", probe.bitrateKbps, t.maxVideoBitrateKbps),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+var (
+	errInvalidVersion       = errors.New("version must be a positive integer")
+	errVersionNotIncreasing = errors.New("version must be greater than the current one")
+)
+
+// nextVideoVersion decides which version an upload is stored as. A version
+// the client asks for must be above the video's current one, so every
+// version gets its own immutable URL and CDNs never serve stale content for
+// it. Without one, a video that already has versioned files moves on to the
+// next version, while the rest keep their single unversioned key.
+func nextVideoVersion(video database.Video, requested string) (int, error) {
+	if requested == "" {
+		if video.Version > 0 {
+			return video.Version + 1, nil
+		}
+		return 0, nil
+	}
+
+	version, err := strconv.Atoi(requested)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("%w: %q", errInvalidVersion, requested)
+	}
+	if version <= video.Version {
+		return 0, fmt.Errorf("%w: got %d, video %s is at %d", errVersionNotIncreasing, version, video.ID, video.Version)
+	}
+	return version, nil
+}
+
+// videoFileName is the name of a video's processed file under its aspect
+// directory: "<aspect>/<videoID>/v<n><ext>" for versioned videos and
+// "<aspect>/<videoID><ext>" otherwise. A non-empty suffix is appended to the
+// base name to keep it apart from a file other videos share.
+func videoFileName(video database.Video, aspect, ext, suffix string) string {
+	if suffix != "" {
+		suffix = "-" + suffix
+	}
+	if video.Version > 0 {
+		return fmt.Sprintf("%s/%s/v%d%s%s", aspect, video.ID, video.Version, suffix, ext)
+	}
+	return fmt.Sprintf("%s/%s%s%s", aspect, video.ID, suffix, ext)
+}
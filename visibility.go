@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+var (
+	errUnknownVisibility      = errors.New("unknown visibility")
+	errPrivateNeedsSignedURLs = errors.New("private videos need CLOUDFRONT_KEY_PAIR_ID or PRESIGN_VIDEO_URLS, so their URLs expire")
+	errPrivateNeedsBucket     = errors.New("private videos need STORAGE_BACKEND=s3: files under /media can be fetched by anyone")
+)
+
+func validateVisibility(visibility string) error {
+	switch visibility {
+	case database.VisibilityPublic, database.VisibilityUnlisted, database.VisibilityPrivate:
+		return nil
+	}
+	return fmt.Errorf("%w %q, expected %s, %s or %s", errUnknownVisibility, visibility,
+		database.VisibilityPublic, database.VisibilityUnlisted, database.VisibilityPrivate)
+}
+
+// checkVisibilityServable rejects private videos when URLs aren't signed:
+// a private video's URLs must stop working, or anyone the owner's player
+// handed them to could keep streaming it. Files this server serves itself
+// from /media have no signed URLs at all.
+func (cfg *apiConfig) checkVisibilityServable(visibility string) error {
+	if visibility != database.VisibilityPrivate {
+		return nil
+	}
+	if cfg.mediaServedUnsigned {
+		return errPrivateNeedsBucket
+	}
+	if cfg.cdnURLSigner == nil && !cfg.presignVideoURLs {
+		return errPrivateNeedsSignedURLs
+	}
+	return nil
+}
+
+// canViewVideo reports whether the request may see the video by its ID.
+// Public videos are open to anyone. Others need the access token of their
+// owner or an admin; unlisted videos are shared through their share slug
+// instead.
+func (cfg *apiConfig) canViewVideo(r *http.Request, video database.Video) bool {
+	if video.Visibility == database.VisibilityPublic {
+		return true
+	}
+	user, err := cfg.authenticateUser(r)
+	if err != nil {
+		return false
+	}
+	return user.ID == video.UserID || user.HasRole(database.RoleAdmin)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// TestVisibilityChangeDuringUpload changes a video's visibility after an
+// upload has loaded it, and checks the upload saving its options doesn't
+// put the old visibility back.
+func TestVisibilityChangeDuringUpload(t *testing.T) {
+	cfg := newTestConfig(t)
+	srv := newTestServer(t, cfg)
+	user, token := newTestUser(t, cfg)
+	loaded := newTestVideo(t, cfg, user.ID)
+
+	resp, body := doRequest(t, srv, http.MethodPatch, "/api/videos/"+loaded.ID.String(), token, "application/json", []byte(`{"visibility": "unlisted"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PATCH status = %d: %s", resp.StatusCode, body)
+	}
+
+	err := cfg.selectEncodingProfile(&loaded, "small-file")
+	if err != nil {
+		t.Fatalf("selectEncodingProfile: %v", err)
+	}
+	err = cfg.selectOutputFormat(&loaded, outputMP4)
+	if err != nil {
+		t.Fatalf("selectOutputFormat: %v", err)
+	}
+
+	video, err := cfg.db.GetVideo(loaded.ID)
+	if err != nil {
+		t.Fatalf("GetVideo: %v", err)
+	}
+	if video.Visibility != database.VisibilityUnlisted {
+		t.Errorf("visibility = %s, want %s", video.Visibility, database.VisibilityUnlisted)
+	}
+	if video.ProcessingOptions.EncodingProfile != "small-file" || video.ProcessingOptions.OutputFormat != outputMP4 {
+		t.Errorf("processing options = %+v, want the upload's", video.ProcessingOptions)
+	}
+}
+
+// TestPrivateVisibilityNeedsSignedURLs checks that a video can only be made
+// private when every URL handed out for it expires.
+func TestPrivateVisibilityNeedsSignedURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, cfg *apiConfig)
+		allowed bool
+	}{
+		{name: "unsigned URLs"},
+		{name: "signed CloudFront URLs", setup: useTestCDNSigner, allowed: true},
+		{
+			name: "presigned URLs",
+			setup: func(t *testing.T, cfg *apiConfig) {
+				useTestDevS3(t, cfg)
+				cfg.presignVideoURLs = true
+			},
+			allowed: true,
+		},
+		{
+			name: "signed URLs with files also served from /media",
+			setup: func(t *testing.T, cfg *apiConfig) {
+				useTestCDNSigner(t, cfg)
+				cfg.mediaServedUnsigned = true
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			if tt.setup != nil {
+				tt.setup(t, cfg)
+			}
+			srv := newTestServer(t, cfg)
+			user, token := newTestUser(t, cfg)
+			video := newTestVideo(t, cfg, user.ID)
+
+			patchStatus, createStatus := http.StatusBadRequest, http.StatusBadRequest
+			if tt.allowed {
+				patchStatus, createStatus = http.StatusOK, http.StatusCreated
+			}
+			resp, body := doRequest(t, srv, http.MethodPatch, "/api/videos/"+video.ID.String(), token, "application/json", []byte(`{"visibility": "private"}`))
+			if resp.StatusCode != patchStatus {
+				t.Errorf("PATCH status = %d, want %d: %s", resp.StatusCode, patchStatus, body)
+			}
+			resp, body = doRequest(t, srv, http.MethodPost, "/api/videos", token, "application/json", []byte(`{"title": "Secret", "visibility": "private"}`))
+			if resp.StatusCode != createStatus {
+				t.Errorf("create status = %d, want %d: %s", resp.StatusCode, createStatus, body)
+			}
+		})
+	}
+}
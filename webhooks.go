@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/httpclient"
+	"github.com/google/uuid"
+)
+
+// Webhook endpoints are configured by the operator rather than by users, so
+// internal addresses are allowed.
+var webhookClient = httpclient.New(httpclient.Policy{
+	Timeout:         10 * time.Second,
+	MaxRedirects:    0,
+	AllowPrivateIPs: true,
+	MaxBodyBytes:    64 << 10,
+	Retry: httpclient.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+	},
+})
+
+const eventUploadRejected = "upload.rejected"
+
+// Reasons reported in upload.rejected events, alongside the pipeline's
+// errCodeUnreadableMedia, errCodeTranscodeFailed and errCodeInvalidMedia.
+const (
+	rejectUnsupportedMediaType = "unsupported_media_type"
+	rejectMalformedUpload      = "malformed_upload"
+	rejectTooLarge             = "too_large"
+	rejectQuotaExceeded        = "quota_exceeded"
+	rejectVideoLimitReached    = "video_limit_reached"
+	rejectEmptyFile            = "empty_file"
+)
+
+type webhookEvent struct {
+	ID         uuid.UUID `json:"id"`
+	Type       string    `json:"type"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Data       any       `json:"data"`
+}
+
+type uploadRejectedData struct {
+	VideoID uuid.UUID `json:"video_id"`
+	UserID  uuid.UUID `json:"user_id"`
+	Reason  string    `json:"reason"`
+	Message string    `json:"message"`
+}
+
+// notifyUploadRejected tells the configured webhook that an upload failed
+// validation, so integrations learn why even if the client never saw the
+// error response. It returns immediately; delivery happens in the
+// background and failures are only logged.
+func (cfg *apiConfig) notifyUploadRejected(ctx context.Context, video database.Video, reason, message string) {
+	target := cfg.tunables(ctx).uploadRejectedWebhookURL
+	if target == "" {
+		return
+	}
+
+	event := webhookEvent{
+		ID:         uuid.New(),
+		Type:       eventUploadRejected,
+		OccurredAt: time.Now().UTC(),
+		Data: uploadRejectedData{
+			VideoID: video.ID,
+			UserID:  video.UserID,
+			Reason:  reason,
+			Message: message,
+		},
+	}
+	go func() {
+		err := cfg.deliverWebhook(target, event)
+		if err != nil {
+			log.Printf("Couldn't deliver %s webhook for video %s: %v", event.Type, video.ID, err)
+		}
+	}()
+}
+
+// deliverWebhook POSTs the event as JSON. When WEBHOOK_SECRET is set the
+// body is signed: X-Tubely-Signature is "sha256=" followed by the hex
+// HMAC-SHA256 of "<X-Tubely-Timestamp>.<body>", so receivers can reject
+// forged and replayed deliveries.
+func (cfg *apiConfig) deliverWebhook(target string, event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(event.OccurredAt.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tubely-Event", event.Type)
+	req.Header.Set("X-Tubely-Timestamp", timestamp)
+	// Lets the client retry the POST, and receivers drop duplicates
+	req.Header.Set("Idempotency-Key", event.ID.String())
+	if cfg.webhookSecret != "" {
+		req.Header.Set("X-Tubely-Signature", "sha256="+signWebhook(cfg.webhookSecret, timestamp, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
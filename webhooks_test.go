@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+const testWebhookSecret = "test-webhook-secret"
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+// useTestWebhook points UPLOAD_REJECTED_WEBHOOK_URL at a test receiver and
+// returns the deliveries it gets.
+func useTestWebhook(t *testing.T, cfg *apiConfig) <-chan receivedWebhook {
+	t.Helper()
+	received := make(chan receivedWebhook, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- receivedWebhook{header: r.Header.Clone(), body: body}
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg.webhookSecret = testWebhookSecret
+	tun := *cfg.currentTunables.Load()
+	tun.uploadRejectedWebhookURL = srv.URL
+	cfg.currentTunables.Store(&tun)
+	return received
+}
+
+// checkRejectedWebhook waits for one delivery and checks it reports reason
+// for video, signed with testWebhookSecret.
+func checkRejectedWebhook(t *testing.T, received <-chan receivedWebhook, video database.Video, reason string) {
+	t.Helper()
+	var got receivedWebhook
+	select {
+	case got = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s webhook was delivered", reason)
+	}
+
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(got.header.Get("X-Tubely-Timestamp") + "."))
+	mac.Write(got.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); got.header.Get("X-Tubely-Signature") != want {
+		t.Errorf("X-Tubely-Signature = %q, want %q", got.header.Get("X-Tubely-Signature"), want)
+	}
+
+	var event struct {
+		ID   uuid.UUID          `json:"id"`
+		Type string             `json:"type"`
+		Data uploadRejectedData `json:"data"`
+	}
+	err := json.Unmarshal(got.body, &event)
+	if err != nil {
+		t.Fatalf("webhook body %s: %v", got.body, err)
+	}
+	if event.Type != eventUploadRejected || got.header.Get("X-Tubely-Event") != eventUploadRejected {
+		t.Errorf("event type = %q, header %q, want %s", event.Type, got.header.Get("X-Tubely-Event"), eventUploadRejected)
+	}
+	if got.header.Get("Idempotency-Key") != event.ID.String() {
+		t.Errorf("Idempotency-Key = %q, want the event ID %s", got.header.Get("Idempotency-Key"), event.ID)
+	}
+	if event.Data.VideoID != video.ID || event.Data.UserID != video.UserID || event.Data.Reason != reason || event.Data.Message == "" {
+		t.Errorf("event data = %+v, want video %s of user %s rejected for %s", event.Data, video.ID, video.UserID, reason)
+	}
+}
+
+// checkNoWebhook fails if anything is delivered shortly after a request
+// that shouldn't notify.
+func checkNoWebhook(t *testing.T, received <-chan receivedWebhook) {
+	t.Helper()
+	select {
+	case got := <-received:
+		t.Errorf("unexpected webhook: %s", got.body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// stageDirectUpload asks for a presigned upload URL and PUTs data to the
+// fake S3 with it, as a client of the direct upload flow would.
+func stageDirectUpload(t *testing.T, srv *httptest.Server, token string, videoID uuid.UUID, data []byte) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/videos/"+videoID.String()+"/upload-url", strings.NewReader(`{"content_type": "video/mp4"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("upload-url status = %d: %s", resp.StatusCode, body)
+	}
+	var upload directUploadURLResponse
+	err = json.NewDecoder(resp.Body).Decode(&upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put, err := http.NewRequest(upload.Method, upload.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range upload.Headers {
+		put.Header.Set(name, value)
+	}
+	putResp, err := http.DefaultClient.Do(put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putResp.Body.Close()
+	if putResp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT to the upload URL status = %d", putResp.StatusCode)
+	}
+	return upload.Key
+}
+
+func completeDirectUpload(t *testing.T, srv *httptest.Server, token string, videoID uuid.UUID, key string) int {
+	t.Helper()
+	body, err := json.Marshal(map[string]string{"key": key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/videos/"+videoID.String()+"/upload-complete", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// TestDirectUploadRejectedWebhook stages files in the DEV_MODE fake S3 and
+// checks that each rejection at upload-complete notifies the webhook and
+// removes the staged file.
+func TestDirectUploadRejectedWebhook(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		setup  func(cfg *apiConfig)
+		status int
+		reason string
+	}{
+		{
+			name:   "too large",
+			data:   fakeMP4(),
+			setup:  func(cfg *apiConfig) { cfg.maxVideoUploadBytes = 512 },
+			status: http.StatusRequestEntityTooLarge,
+			reason: rejectTooLarge,
+		},
+		{
+			name: "over quota",
+			data: fakeMP4(),
+			setup: func(cfg *apiConfig) {
+				tun := *cfg.currentTunables.Load()
+				tun.userQuotaBytes = 512
+				cfg.currentTunables.Store(&tun)
+			},
+			status: http.StatusForbidden,
+			reason: rejectQuotaExceeded,
+		},
+		{
+			name:   "not a video",
+			data:   bytes.Repeat([]byte("not a video "), 100),
+			status: http.StatusUnsupportedMediaType,
+			reason: errCodeUnsupportedMedia,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			useTestDevS3(t, cfg)
+			received := useTestWebhook(t, cfg)
+			if tt.setup != nil {
+				tt.setup(cfg)
+			}
+			srv := newTestServer(t, cfg)
+			user, token := newTestUser(t, cfg)
+			video := newTestVideo(t, cfg, user.ID)
+
+			key := stageDirectUpload(t, srv, token, video.ID, tt.data)
+			status := completeDirectUpload(t, srv, token, video.ID, key)
+			if status != tt.status {
+				t.Errorf("upload-complete status = %d, want %d", status, tt.status)
+			}
+			checkRejectedWebhook(t, received, video, tt.reason)
+
+			_, err := cfg.storage.Stat(context.Background(), key)
+			if !errors.Is(err, storage.ErrNotFound) {
+				t.Errorf("staged file after rejection: %v, want it removed", err)
+			}
+		})
+	}
+
+	t.Run("nothing staged", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		useTestDevS3(t, cfg)
+		received := useTestWebhook(t, cfg)
+		srv := newTestServer(t, cfg)
+		user, token := newTestUser(t, cfg)
+		video := newTestVideo(t, cfg, user.ID)
+
+		// Not the file's fault, so there is nothing to report
+		status := completeDirectUpload(t, srv, token, video.ID, directUploadDir(video.ID)+"missing")
+		if status != http.StatusConflict {
+			t.Errorf("upload-complete status = %d, want %d", status, http.StatusConflict)
+		}
+		checkNoWebhook(t, received)
+	})
+}
+
+// TestUploadRejectedWebhook checks the multipart upload's rejections.
+func TestUploadRejectedWebhook(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   func(t *testing.T) ([]byte, string)
+		status int
+		reason string
+	}{
+		{
+			name: "not multipart",
+			body: func(t *testing.T) ([]byte, string) {
+				return fakeMP4(), "video/mp4"
+			},
+			status: http.StatusBadRequest,
+			reason: rejectMalformedUpload,
+		},
+		{
+			name: "unsupported media type",
+			body: func(t *testing.T) ([]byte, string) {
+				return multipartVideo(t, "text/plain", fakeMP4())
+			},
+			status: http.StatusBadRequest,
+			reason: rejectUnsupportedMediaType,
+		},
+		{
+			name: "empty file",
+			body: func(t *testing.T) ([]byte, string) {
+				return multipartVideo(t, "video/mp4", nil)
+			},
+			status: http.StatusUnprocessableEntity,
+			reason: rejectEmptyFile,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			useTestDevS3(t, cfg)
+			received := useTestWebhook(t, cfg)
+			user, token := newTestUser(t, cfg)
+			video := newTestVideo(t, cfg, user.ID)
+
+			body, contentType := tt.body(t)
+			w := httptest.NewRecorder()
+			cfg.handlerUploadVideo(w, newUploadRequest(context.Background(), video.ID, token, contentType, bytes.NewReader(body), int64(len(body))))
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			checkRejectedWebhook(t, received, video, tt.reason)
+		})
+	}
+
+	t.Run("accepted upload", func(t *testing.T) {
+		cfg := newTestConfig(t)
+		useTestDevS3(t, cfg)
+		received := useTestWebhook(t, cfg)
+		user, token := newTestUser(t, cfg)
+		video := newTestVideo(t, cfg, user.ID)
+
+		body, contentType := multipartVideo(t, "video/mp4", fakeMP4())
+		w := httptest.NewRecorder()
+		cfg.handlerUploadVideo(w, newUploadRequest(context.Background(), video.ID, token, contentType, bytes.NewReader(body), int64(len(body))))
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+		}
+		checkNoWebhook(t, received)
+	})
+}